@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// defaultProbeTimeout is how long each of ssh.addresses gets to answer when
+// ssh.connect_timeout isn't set.
+const defaultProbeTimeout = 3 * time.Second
+
+// pickAddress points ssh.host at the first of ssh.addresses that answers, so
+// the same config works at home, over Tailscale and away. It probes again
+// for every run, as the daemon's machine may have moved networks since.
+func pickAddress(cfg *config.Config) error {
+	if len(cfg.SSH.Addresses) == 0 {
+		return nil
+	}
+	timeout := defaultProbeTimeout
+	if d, err := time.ParseDuration(cfg.SSH.ConnectTimeout); err == nil {
+		timeout = d
+	}
+	addr, err := ssh.PickAddress(cfg.SSH.Addresses, cfg.SSH.Port, timeout)
+	if err != nil {
+		return withExitCode(exitNetwork, err)
+	}
+	if addr != cfg.SSH.Host {
+		printAt(rsync.Verbose, "Using %s for %s\n", addr, cfg.SSH.HostKeyAlias)
+		logger.Info("ssh address", "address", addr, "host", cfg.SSH.HostKeyAlias)
+	}
+	cfg.SSH.Host = addr
+	return nil
+}
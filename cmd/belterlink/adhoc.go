@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+const adhocUsage = `usage:
+  belterlink adhoc -local <path> -remote [user@]host:<path> <push|pull> [flags]
+
+flags: -port <n>, -key <file>, -exclude <pattern> (repeatable), -dry-run, -delete, -checksum`
+
+// adhocFlags are the flags of "adhoc" besides the sync flags it shares.
+type adhocFlags struct {
+	local, remote, key string
+	port               int
+	excludes           stringList
+}
+
+// register adds the flags to fs, the shared ones bound to opts.
+func (f *adhocFlags) register(fs *flag.FlagSet, opts *RunOptions) {
+	fs.StringVar(&f.local, "local", "", "local path")
+	fs.StringVar(&f.remote, "remote", "", "remote as [user@]host:path")
+	fs.IntVar(&f.port, "port", 22, "ssh port")
+	fs.StringVar(&f.key, "key", "", "ssh private key")
+	fs.Var(&f.excludes, "exclude", "exclude pattern (repeatable)")
+	fs.BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "show what would change without writing")
+	fs.BoolVar(&opts.Delete, "delete", opts.Delete, "delete files on the destination that don't exist at the source")
+	fs.BoolVar(&opts.Checksum, "checksum", opts.Checksum, "use checksums to detect changes")
+}
+
+// runAdhocCommand implements "belterlink adhoc": a one-off sync of two paths
+// with the same safeguards as a configured category (built-in excludes,
+// --update, remote path checks), without touching the config.
+func runAdhocCommand(g *globals, args []string) error {
+	opts := g.sync.options()
+	flags := newFlagSet("adhoc")
+	g.register(flags)
+	var f adhocFlags
+	f.register(flags, &opts)
+
+	// flags may come before and after the direction
+	positional, err := parseInterleaved(flags, args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if f.local == "" || f.remote == "" || len(positional) != 1 {
+		return withExitCode(exitUsage, errors.New(adhocUsage))
+	}
+	opts.Verbosity = verbosity // as -q, -v or -vv after the command left it
+	opts.Direction = parseDirection(positional[0])
+	if opts.Direction != "push" && opts.Direction != "pull" {
+		return exitErrorf(exitUsage, "direction must be 'push' or 'pull'\n%s", adhocUsage)
+	}
+
+	s, remotePath, err := parseRemoteSpec(f.remote)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	s.Port, s.Key = f.port, f.key
+	cat := config.Category{Local: f.local, Remote: remotePath, Exclude: f.excludes}
+	if cat.Local, err = config.ExpandPath(cat.Local); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if s.Key, err = config.ExpandPath(s.Key); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if cat.Remote, err = config.ExpandRemotePath(cat.Remote); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	cfg := &config.Config{SSH: s, Categories: map[string]config.Category{"adhoc": cat}}
+	ctx, stop := interruptContext()
+	defer stop()
+	_, err = syncCategory(ctx, cfg, "adhoc", opts, max(g.sync.retries.n, 0))
+	return err
+}
+
+// parseRemoteSpec splits "[user@]host:path"; the user defaults to $USER.
+func parseRemoteSpec(spec string) (config.SSH, string, error) {
+	target, remotePath, ok := strings.Cut(spec, ":")
+	if !ok || target == "" || remotePath == "" {
+		return config.SSH{}, "", fmt.Errorf("invalid remote %q (want [user@]host:path)", spec)
+	}
+	user, host, hasUser := strings.Cut(target, "@")
+	if !hasUser {
+		host = target
+		var err error
+		if user, err = config.ExpandEnv("$USER"); err != nil {
+			return config.SSH{}, "", fmt.Errorf("remote %q has no user and $USER is not set", spec)
+		}
+	}
+	if _, err := strconv.Atoi(host); err == nil || host == "" {
+		return config.SSH{}, "", fmt.Errorf("invalid host in remote %q", spec)
+	}
+	return config.SSH{User: user, Host: host}, remotePath, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestParseRemoteSpec(t *testing.T) {
+	s, p, err := parseRemoteSpec("alice@nas.local:/srv/vault")
+	if err != nil || s.User != "alice" || s.Host != "nas.local" || p != "/srv/vault" {
+		t.Fatalf("parseRemoteSpec = %+v %q %v", s, p, err)
+	}
+	t.Setenv("USER", "bob")
+	s, p, err = parseRemoteSpec("mac:~/Vault")
+	if err != nil || s.User != "bob" || s.Host != "mac" || p != "~/Vault" {
+		t.Fatalf("parseRemoteSpec without user = %+v %q %v", s, p, err)
+	}
+	for _, bad := range []string{"/just/a/path", "host:", "@:/x"} {
+		if _, _, err := parseRemoteSpec(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
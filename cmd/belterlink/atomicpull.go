@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// stagedPull is an atomic_pull in progress: the staging copy rsync pulls
+// into, and what it and the live tree held when it was made.
+type stagedPull struct {
+	live, dir string
+	liveFiles map[string]fs.FileInfo
+	dirFiles  map[string]fs.FileInfo
+}
+
+// prepareStaging sets up atomic_pull: a hidden directory next to live with
+// the same tree, hard-linked, for rsync to pull into. rsync replaces the
+// files it transfers instead of writing into them, so the live files stay
+// as they are until swapIn; unshare copies the ones whose metadata it would
+// change in place. Whatever a crashed run left behind is removed first.
+func prepareStaging(live string) (*stagedPull, error) {
+	if resolved, err := filepath.EvalSymlinks(live); err == nil {
+		live = resolved
+	}
+	s := &stagedPull{live: live, dir: siblingPath(live, "staging")}
+	if err := os.RemoveAll(s.dir); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(siblingPath(live, "old")); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(live); errors.Is(err, fs.ErrNotExist) {
+		return s, os.MkdirAll(s.dir, 0o755)
+	}
+	if err := linkTree(live, s.dir); err != nil {
+		os.RemoveAll(s.dir)
+		if errors.Is(err, syscall.EXDEV) {
+			return nil, fmt.Errorf("atomic_pull: %s is a mountpoint; the staging copy next to it must be on the same filesystem", live)
+		}
+		return nil, fmt.Errorf("atomic_pull: prepare %s: %w", s.dir, err)
+	}
+	var err error
+	if s.liveFiles, err = treeFiles(live); err != nil {
+		os.RemoveAll(s.dir)
+		return nil, fmt.Errorf("atomic_pull: %w", err)
+	}
+	if s.dirFiles, err = treeFiles(s.dir); err != nil {
+		os.RemoveAll(s.dir)
+		return nil, fmt.Errorf("atomic_pull: %w", err)
+	}
+	return s, nil
+}
+
+// unshare replaces the hard links rsync would update in place, changing
+// only their permissions, owner or times, with copies: through a link the
+// change would reach the live file before the swap, or without one.
+// itemized is the output of a dry run of the pull.
+func (s *stagedPull) unshare(itemized string) error {
+	for _, rel := range rsync.ParseInPlace(itemized) {
+		p := filepath.Join(s.dir, filepath.FromSlash(rel))
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue // new on this side after all
+		}
+		tmp := p + ".belterlink-copy"
+		if err := copyFile(p, tmp, info); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("atomic_pull: copy %s: %w", rel, err)
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return fmt.Errorf("atomic_pull: %w", err)
+		}
+		if s.dirFiles[rel], err = os.Lstat(p); err != nil {
+			return fmt.Errorf("atomic_pull: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst with src's permissions and times.
+func copyFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// treeFiles lists the files and symlinks under root, by slash-separated
+// path relative to it.
+func treeFiles(root string) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return files, err
+}
+
+// linkEntry recreates the file or symlink src at dst.
+func linkEntry(src, dst string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return os.Link(src, dst)
+	}
+	link, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(link, dst)
+}
+
+// unchanged reports whether a and b are the same file, not modified in
+// between.
+func unchanged(a, b fs.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.Mode() == b.Mode() && a.ModTime().Equal(b.ModTime())
+}
+
+func siblingPath(dir, suffix string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".belterlink-"+suffix)
+}
+
+// linkTree recreates src at dst with hard links to its files, keeping
+// directory permissions and times.
+func linkTree(src, dst string) error {
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, dirTimes{target, info.ModTime()})
+			return os.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return os.Link(p, target)
+		}
+		return nil // sockets, fifos: not synced anyway
+	})
+	if err != nil {
+		return err
+	}
+	// innermost first, as creating entries touches the parent's mtime
+	for _, d := range slices.Backward(dirs) {
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapIn replaces the live tree with the staging copy once the pull
+// succeeded: two renames, so the live tree is never half-updated. Files
+// saved, added or deleted locally while rsync ran are carried over into the
+// copy first, unless the pull changed them too: then the live tree is kept
+// and the pull refused.
+func (s *stagedPull) swapIn() error {
+	old := siblingPath(s.live, "old")
+	if err := os.Rename(s.live, old); errors.Is(err, fs.ErrNotExist) {
+		if len(s.liveFiles) > 0 {
+			return exitErrorf(exitRefused, "atomic_pull: %s was removed during the pull; the pulled copy was dropped", s.live)
+		}
+	} else if err != nil {
+		return fmt.Errorf("atomic_pull: %w", err)
+	} else if err := s.carryOver(old); err != nil {
+		os.Rename(old, s.live) // put the live tree back
+		return err
+	}
+	if err := os.Rename(s.dir, s.live); err != nil {
+		os.Rename(old, s.live) // put the previous tree back
+		return fmt.Errorf("atomic_pull: %w", err)
+	}
+	return os.RemoveAll(old)
+}
+
+// carryOver brings the local changes made in old since the staging copy was
+// made into it.
+func (s *stagedPull) carryOver(old string) error {
+	now, err := treeFiles(old)
+	if err != nil {
+		return fmt.Errorf("atomic_pull: %w", err)
+	}
+	var changed []string
+	for rel, info := range now {
+		if !unchanged(info, s.liveFiles[rel]) {
+			changed = append(changed, rel)
+		}
+	}
+	for rel := range s.liveFiles {
+		if now[rel] == nil {
+			changed = append(changed, rel)
+		}
+	}
+	slices.Sort(changed)
+	var conflicts []string
+	for _, rel := range changed {
+		staged, _ := os.Lstat(filepath.Join(s.dir, filepath.FromSlash(rel)))
+		if !unchanged(staged, s.dirFiles[rel]) {
+			conflicts = append(conflicts, rel)
+		}
+	}
+	if len(conflicts) > 0 {
+		for _, rel := range conflicts {
+			fmt.Fprintf(os.Stderr, "  changed locally and by the pull: %s\n", rel)
+		}
+		return exitErrorf(exitRefused, "atomic_pull: %d file(s) changed both locally and on the remote while pulling; kept the local tree, pull again", len(conflicts))
+	}
+	for _, rel := range changed {
+		dst := filepath.Join(s.dir, filepath.FromSlash(rel))
+		if now[rel] == nil {
+			if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("atomic_pull: %w", err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("atomic_pull: %w", err)
+		}
+		if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("atomic_pull: %w", err)
+		}
+		// linked rather than moved, so old stays whole until the swap
+		if err := linkEntry(filepath.Join(old, filepath.FromSlash(rel)), dst, now[rel]); err != nil {
+			return fmt.Errorf("atomic_pull: %w", err)
+		}
+		logger.Info("atomic_pull: kept a local change made during the pull", "path", rel)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStagingAndSwapIn(t *testing.T) {
+	live := filepath.Join(t.TempDir(), "Notes")
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, f := range []string{"note.md", "Daily/today.md"} {
+		p := filepath.Join(live, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(live, "Daily"), t0, t0); err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := prepareStaging(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := staged.dir
+	if info, err := os.Stat(filepath.Join(staging, "Daily")); err != nil || !info.ModTime().Equal(t0) {
+		t.Fatalf("staged directory = %v, %v; want its mtime kept", info, err)
+	}
+	a, _ := os.Stat(filepath.Join(live, "note.md"))
+	b, _ := os.Stat(filepath.Join(staging, "note.md"))
+	if !os.SameFile(a, b) {
+		t.Fatal("staged file is not a hard link to the live one")
+	}
+
+	// what rsync does: replace a file by renaming a new one over it
+	tmp := filepath.Join(staging, ".note.md.tmp")
+	if err := os.WriteFile(tmp, []byte("pulled"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(staging, "note.md")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(live, "note.md")); string(b) != "note.md" {
+		t.Fatalf("live file changed before the swap: %q", b)
+	}
+
+	if err := staged.swapIn(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(live, "note.md")); string(b) != "pulled" {
+		t.Fatalf("live file after the swap = %q", b)
+	}
+	for _, p := range []string{staging, siblingPath(live, "old")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s left behind", p)
+		}
+	}
+}
+
+func TestStagingForMissingLiveDir(t *testing.T) {
+	live := filepath.Join(t.TempDir(), "Fresh")
+	staged, err := prepareStaging(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.swapIn(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(live); err != nil || !info.IsDir() {
+		t.Fatalf("first pull left no directory: %v", err)
+	}
+}
+
+// stageNotes makes a live tree with the given files and stages it.
+func stageNotes(t *testing.T, files ...string) (string, *stagedPull) {
+	t.Helper()
+	live := filepath.Join(t.TempDir(), "Notes")
+	for _, f := range files {
+		p := filepath.Join(live, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staged, err := prepareStaging(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return live, staged
+}
+
+func TestStagingUnsharesInPlaceUpdates(t *testing.T) {
+	live, staged := stageNotes(t, "chmod.md", "same.md")
+	if err := staged.unshare(".f...p..... chmod.md\n"); err != nil {
+		t.Fatal(err)
+	}
+	// what rsync does for .f...p: chmod the file it has
+	if err := os.Chmod(filepath.Join(staged.dir, "chmod.md"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(live, "chmod.md")); info.Mode().Perm() != 0o644 {
+		t.Fatalf("live file's mode changed to %v before the swap", info.Mode().Perm())
+	}
+	a, _ := os.Stat(filepath.Join(live, "same.md"))
+	b, _ := os.Stat(filepath.Join(staged.dir, "same.md"))
+	if !os.SameFile(a, b) {
+		t.Error("a file rsync leaves alone was copied")
+	}
+	if err := staged.swapIn(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(live, "chmod.md")); info.Mode().Perm() != 0o600 {
+		t.Errorf("mode after the swap = %v, want the pulled 0600", info.Mode().Perm())
+	}
+}
+
+func TestSwapInKeepsLocalChanges(t *testing.T) {
+	live, staged := stageNotes(t, "edited.md", "deleted.md", "pulled.md")
+	// saved in the editor while rsync ran: a new file renamed over the old
+	tmp := filepath.Join(live, ".edited.md.swp")
+	os.WriteFile(tmp, []byte("typed during the pull"), 0o644)
+	if err := os.Rename(tmp, filepath.Join(live, "edited.md")); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(live, "Daily"), 0o755)
+	os.WriteFile(filepath.Join(live, "Daily", "new.md"), []byte("new"), 0o644)
+	os.Remove(filepath.Join(live, "deleted.md"))
+	// and the pull replaced another file
+	os.WriteFile(filepath.Join(staged.dir, ".pulled.md.tmp"), []byte("from the remote"), 0o644)
+	os.Rename(filepath.Join(staged.dir, ".pulled.md.tmp"), filepath.Join(staged.dir, "pulled.md"))
+
+	if err := staged.swapIn(); err != nil {
+		t.Fatal(err)
+	}
+	for f, want := range map[string]string{"edited.md": "typed during the pull", "Daily/new.md": "new", "pulled.md": "from the remote"} {
+		if b, err := os.ReadFile(filepath.Join(live, filepath.FromSlash(f))); string(b) != want {
+			t.Errorf("%s after the swap = %q, %v; want %q", f, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(live, "deleted.md")); !os.IsNotExist(err) {
+		t.Errorf("a file deleted during the pull came back: %v", err)
+	}
+}
+
+func TestSwapInRefusesConflicts(t *testing.T) {
+	live, staged := stageNotes(t, "note.md")
+	os.WriteFile(filepath.Join(live, "note.md"), []byte("local edit"), 0o644)
+	os.Chtimes(filepath.Join(live, "note.md"), time.Now(), time.Now().Add(time.Minute))
+	os.WriteFile(filepath.Join(staged.dir, ".note.md.tmp"), []byte("remote edit"), 0o644)
+	os.Rename(filepath.Join(staged.dir, ".note.md.tmp"), filepath.Join(staged.dir, "note.md"))
+
+	err := staged.swapIn()
+	if errorExitCode(err) != exitRefused || !strings.Contains(err.Error(), "1 file(s) changed") {
+		t.Fatalf("swapIn with a conflict = %v, want it refused", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(live, "note.md")); string(b) != "local edit" {
+		t.Errorf("live file after a refused swap = %q, want the local edit", b)
+	}
+	if _, err := os.Stat(siblingPath(live, "old")); !os.IsNotExist(err) {
+		t.Errorf("the live tree was left at %s", siblingPath(live, "old"))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// auditEntry is one line of the audit log: a file deleted or overwritten,
+// with what it was like before.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RunID     string    `json:"run_id"`
+	Category  string    `json:"category"`
+	Direction string    `json:"direction"`
+	Action    string    `json:"action"` // delete or overwrite
+	Side      string    `json:"side"`   // local or remote: where the file was
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime,omitzero"`
+	RunFailed bool      `json:"run_failed,omitempty"` // the run failed; the change may not have happened
+}
+
+// newRunID is a short random ID for one run of one category.
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func auditEnabled(cfg *config.Config) bool {
+	return cfg.Audit.Enable
+}
+
+// auditPath is audit.path, by default audit.log in the state dir.
+func auditPath(cfg *config.Config) string {
+	if cfg.Audit.Path != "" {
+		return cfg.Audit.Path
+	}
+	return filepath.Join(config.StateDir(cfg), "audit.log")
+}
+
+// appendAudit adds entries to the audit log. The file is only ever
+// appended to, one JSON object per line.
+func appendAudit(cfg *config.Config, entries []auditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	path := auditPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// previewAudit finds what the run is about to delete or overwrite, with a
+// dry run, and records size and mtime of those files on the receiving side
+// while they still exist.
+func previewAudit(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions, rsArgs []string) ([]auditEntry, error) {
+	var out bytes.Buffer
+	preview := rsyncCommand(ctx, cfg, opts.Options, rsync.InsertBeforePaths(rsArgs, "--dry-run", "--itemize-changes")...)
+	preview.Stdout = &out
+	preview.Stderr = os.Stderr
+	if err := preview.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return nil, exitErrorf(rsyncExitCode(code), "audit preview failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	changes := rsync.ParseChanges(out.String())
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	side := "local"
+	var remote map[string]rsync.Entry
+	if opts.Direction == "push" {
+		side = "remote"
+		var files []string
+		for _, c := range changes {
+			files = append(files, strings.TrimSuffix(c.Path, "/"))
+		}
+		var err error
+		if remote, err = listRemoteFiles(ctx, cfg, cat, files); err != nil {
+			return nil, err
+		}
+	}
+	var entries []auditEntry
+	for _, c := range changes {
+		e := auditEntry{RunID: opts.RunID, Category: name, Direction: opts.Direction, Action: c.Kind, Side: side, Path: c.Path}
+		if opts.Direction == "push" {
+			if r, ok := remote[c.Path]; ok {
+				e.Size, e.ModTime = r.Size, r.ModTime
+			}
+		} else if info, err := os.Lstat(filepath.Join(cat.Local, filepath.FromSlash(c.Path))); err == nil && !info.IsDir() {
+			e.Size, e.ModTime = info.Size(), info.ModTime().UTC()
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// warnAuditPreview reports a failed previewAudit. The run goes ahead, just
+// without audit entries.
+func warnAuditPreview(name string, err error) {
+	fmt.Fprintf(os.Stderr, "warning: %s: %v; this run isn't audited\n", name, err)
+	logger.Warn("audit preview failed", "category", name, "error", err)
+}
+
+// recordAudit stamps the previewed changes with the time the run ended and
+// appends them; problems with the audit log are warnings.
+func recordAudit(cfg *config.Config, entries []auditEntry, runErr error) {
+	now := time.Now().UTC()
+	for i := range entries {
+		entries[i].Time = now
+		entries[i].RunFailed = runErr != nil
+	}
+	if err := appendAudit(cfg, entries); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: audit log:", err)
+		logger.Warn("audit log not written", "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestRecordAuditAppends(t *testing.T) {
+	cfg := &config.Config{Audit: config.Audit{Path: filepath.Join(t.TempDir(), "audit", "audit.log")}}
+	mtime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	recordAudit(cfg, []auditEntry{{RunID: "a1", Category: "Notes", Direction: "push", Action: "delete", Side: "remote", Path: "old.md", Size: 12, ModTime: mtime}}, nil)
+	recordAudit(cfg, []auditEntry{{RunID: "b2", Category: "Notes", Direction: "pull", Action: "overwrite", Side: "local", Path: "ideas.md"}}, errors.New("rsync failed"))
+	recordAudit(cfg, nil, nil)
+
+	f, err := os.Open(cfg.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []auditEntry
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatalf("audit log has %d entries, want 2", len(got))
+	}
+	if got[0].Path != "old.md" || got[0].Size != 12 || !got[0].ModTime.Equal(mtime) || got[0].RunFailed || got[0].Time.IsZero() {
+		t.Errorf("first entry = %+v", got[0])
+	}
+	if got[1].RunID != "b2" || !got[1].RunFailed {
+		t.Errorf("second entry = %+v, want run_failed", got[1])
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	a, b := newRunID(), newRunID()
+	if len(a) != 8 || a == b {
+		t.Errorf("newRunID = %q, %q", a, b)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/plugin"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// syncViaBackend transfers a category with its backend plugin instead of
+// rsync. The local safety checks and git commits still apply; deletion limits
+// and verification are up to the plugin.
+func syncViaBackend(cfg *config.Config, name string, cat config.Category, opts RunOptions) (*rsync.Stats, error) {
+	if opts.Direction == "push" && !opts.Force {
+		if err := checkLocalSource(cat.Local); err != nil {
+			return nil, withExitCode(exitRefused, fmt.Errorf("%w; re-run with -force if this is intended", err))
+		}
+	}
+	if cat.Git && opts.Direction == "push" && !opts.DryRun {
+		if err := gitCommit(cat.Local, "belterlink pre-push"); err != nil {
+			return nil, fmt.Errorf("git safety commit: %w", err)
+		}
+	}
+
+	req := plugin.BackendRequest{
+		Protocol:  plugin.ProtocolVersion,
+		Category:  name,
+		Direction: opts.Direction,
+		Local:     cat.Local,
+		Remote:    cat.Remote,
+		Exclude:   config.CategoryExcludes(cat),
+		Paths:     opts.Paths,
+		DryRun:    opts.DryRun,
+		Delete:    rsync.ResolveDelete(cfg, opts.Options),
+		Checksum:  config.GetBool(opts.Checksum, cfg.Defaults.Checksum, false),
+		Options:   cat.BackendOptions,
+	}
+	printAt(rsync.Normal, "Running: %s %s %s\n", ssh.Quote(plugin.Executable(plugin.KindBackend, cat.Backend)), opts.Direction, ssh.Quote(cat.Remote))
+	logger.Debug("running backend plugin", "backend", cat.Backend, "request", req)
+
+	options, err := resolveSecrets(cfg, cat.BackendOptions)
+	if err != nil {
+		return nil, err
+	}
+	req.Options = options
+	var resp plugin.BackendResponse
+	if err := plugin.Call(plugin.KindBackend, cat.Backend, req, &resp); err != nil {
+		return nil, err
+	}
+	stats := &rsync.Stats{
+		FilesTransferred: resp.FilesTransferred,
+		FilesDeleted:     resp.FilesDeleted,
+		BytesTransferred: resp.BytesTransferred,
+	}
+	if cat.Git && opts.Direction == "pull" && !opts.DryRun {
+		if err := gitCommit(cat.Local, "belterlink post-pull"); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: git commit after pull:", err)
+			logger.Warn("git commit after pull failed", "error", err)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+	"golang.org/x/text/unicode/norm"
+)
+
+// windowsFilesystems are the filesystems that refuse Windows' reserved
+// device names.
+var windowsFilesystems = []string{"vfat", "msdos", "exfat", "fat", "fat32", "ntfs", "ntfs3", "smbfs", "cifs", "smb3"}
+
+// destination describes the filesystem a run writes to, as far as known.
+type destination struct {
+	where           string // e.g. "mymac.local" or "this machine"
+	root            string // the category's path there
+	os              string // as uname -s or GOOS name it
+	fsType          string
+	caseInsensitive bool
+}
+
+// caseCollisions is the case_collisions mode of cat, warn unless set.
+func caseCollisions(cfg *config.Config, cat config.Category) string {
+	if cat.Encrypted {
+		return "ignore" // rsync only sees encrypted names
+	}
+	return cmp.Or(cat.CaseCollisions, cfg.Defaults.CaseCollisions, "warn")
+}
+
+// checkDestinationNames implements case_collisions: fail. Before a push or
+// pull it lists the source and looks for names that would be one file at
+// the destination, like Readme.md and README.md on APFS, where rsync would
+// write both into the same file and leave whichever came last. On a Windows
+// filesystem it also looks for names that can't be created there: reserved
+// ones like CON or aux.txt, and ones with characters like : or ?. A dry run
+// also checks every name and path against the destination's length limits,
+// so that a transfer to an external drive doesn't fail halfway. Problems
+// refuse the run, unless -force.
+func checkDestinationNames(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions, live string) error {
+	if caseCollisions(cfg, cat) != "fail" {
+		return nil
+	}
+	dest, srcCI := namesDestination(ctx, cfg, cat, opts.Direction, live)
+	limits := limitsFor(dest.fsType, dest.os)
+	if !(dest.caseInsensitive && !srcCI) && !limits.windows && !opts.DryRun {
+		return nil
+	}
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	var names []string
+	if opts.Direction == "push" {
+		files, err := listLocal(live, m)
+		if err != nil {
+			return err
+		}
+		names = slices.Collect(maps.Keys(files))
+	} else if names, err = listRemoteNames(ctx, cfg, cat.Remote, m); err != nil {
+		return withExitCode(exitNetwork, err)
+	}
+	if !reportNameProblems(dest, nameProblems(dest, srcCI, names)) || opts.Force {
+		return nil
+	}
+	return exitErrorf(exitRefused, "rename them, or set case_collisions: warn; re-run with -force to transfer anyway")
+}
+
+// warnDestinationNames implements case_collisions: warn. It makes no
+// listing of its own: once rsync ran, it checks the names rsync -v listed
+// (so only the files the run sent, and none with -q) like
+// checkDestinationNames does, and prints the problems. After a dry run,
+// that's before anything was written.
+func warnDestinationNames(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions, live, output string) {
+	if caseCollisions(cfg, cat) != "warn" {
+		return
+	}
+	names := rsync.ParseTransferred(output)
+	if len(names) == 0 {
+		return
+	}
+	dest, srcCI := namesDestination(ctx, cfg, cat, opts.Direction, live)
+	reportNameProblems(dest, nameProblems(dest, srcCI, names))
+}
+
+// nameProblems lists what's wrong with names at dest: collisions where the
+// destination ignores case and the source doesn't, reserved names on a
+// Windows filesystem, and names or paths it refuses.
+func nameProblems(dest destination, srcCI bool, names []string) []string {
+	limits := limitsFor(dest.fsType, dest.os)
+	var problems []string
+	if dest.caseInsensitive && !srcCI {
+		for _, group := range findCaseCollisions(names) {
+			problems = append(problems, strings.Join(group, " and ")+" are one file there")
+		}
+	}
+	if limits.windows {
+		for _, name := range reservedNames(names) {
+			problems = append(problems, name+" is a reserved name there")
+		}
+	}
+	for _, p := range invalidNames(names, dest.root, limits) {
+		problems = append(problems, p.String())
+	}
+	return problems
+}
+
+// reportNameProblems prints and logs problems, if any, and reports whether
+// there were.
+func reportNameProblems(dest destination, problems []string) bool {
+	if len(problems) == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%d name(s) that won't work on %s (%s):\n", len(problems), dest.where, cmp.Or(dest.fsType, "unknown filesystem"))
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "  "+p)
+		logger.Warn("name problem", "problem", p, "destination", dest.where, "fs_type", dest.fsType)
+	}
+	return true
+}
+
+// namesDestination finds out what it can about the filesystem the run
+// writes to, and whether the source's ignores case too (then it can't hold
+// colliding names).
+func namesDestination(ctx context.Context, cfg *config.Config, cat config.Category, direction, live string) (dest destination, srcCI bool) {
+	var remote probedTarget
+	dest = destination{where: ssh.KnownHostsName(cfg.SSH), root: cat.Remote}
+	if p, err := remoteInfo(ctx, cfg, false); err == nil {
+		remote, dest.os = p.Targets[cat.Remote], p.OS
+	}
+	remoteCI := remote.CaseInsensitive != nil && *remote.CaseInsensitive
+	localCI := localCaseInsensitive(cfg, live)
+	if direction == "push" {
+		dest.fsType, dest.caseInsensitive = remote.FSType, remoteCI
+		return dest, localCI != nil && *localCI
+	}
+	dest = destination{where: "this machine", root: live, os: runtime.GOOS, fsType: localFSType(live)}
+	dest.caseInsensitive = localCI != nil && *localCI
+	return dest, remoteCI
+}
+
+// localFSType is the type of the filesystem dir is on, from df and mount;
+// "" if unknown.
+func localFSType(dir string) string {
+	df, err := exec.Command("df", "-P", dir).Output()
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(df)), "\n")
+	f := strings.Fields(lines[len(lines)-1])
+	if len(f) < 6 {
+		return ""
+	}
+	mounts, err := exec.Command("mount").Output()
+	if err != nil {
+		return ""
+	}
+	return parseMounts(strings.Split(string(mounts), "\n"))[strings.Join(f[5:], " ")]
+}
+
+// findCaseCollisions groups the paths that differ only in case (or in
+// Unicode normalization, which APFS ignores too) and returns the groups
+// with more than one spelling. Inside a colliding directory only the
+// directory itself is reported.
+func findCaseCollisions(paths []string) [][]string {
+	groups := map[string][]string{}
+	for _, p := range paths {
+		key := strings.ToLower(norm.NFD.String(p))
+		if !slices.Contains(groups[key], p) {
+			groups[key] = append(groups[key], p)
+		}
+	}
+	var out [][]string
+	colliding := map[string]bool{}
+	for _, key := range slices.Sorted(maps.Keys(groups)) {
+		if len(groups[key]) < 2 {
+			continue
+		}
+		colliding[key] = true
+		if inCollidingDir(key, colliding) {
+			continue
+		}
+		out = append(out, slices.Sorted(slices.Values(groups[key])))
+	}
+	return out
+}
+
+// reservedNames returns the paths whose last element is a device name
+// Windows reserves, with or without an extension: CON, PRN, AUX, NUL,
+// COM1-9 and LPT1-9, in any case.
+func reservedNames(paths []string) []string {
+	var out []string
+	for _, p := range paths {
+		stem, _, _ := strings.Cut(path.Base(p), ".")
+		stem = strings.ToUpper(strings.TrimRight(stem, " "))
+		switch {
+		case slices.Contains([]string{"CON", "PRN", "AUX", "NUL"}, stem),
+			len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) && stem[3] >= '1' && stem[3] <= '9':
+			out = append(out, p)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindCaseCollisions(t *testing.T) {
+	paths := []string{
+		"Readme.md", "README.md", "notes.md",
+		"Projects", "projects", "Projects/a.md", "projects/a.md",
+		"Café.md", "café.md",
+	}
+	want := [][]string{
+		{"Café.md", "café.md"},
+		{"Projects", "projects"},
+		{"README.md", "Readme.md"},
+	}
+	if got := findCaseCollisions(paths); !reflect.DeepEqual(got, want) {
+		t.Errorf("findCaseCollisions = %q, want %q", got, want)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	paths := []string{"con", "Notes/aux.txt", "Notes/auxiliary.md", "LPT1.log", "COM0", "com10", "nul.tar.gz", "CONSOLE.md"}
+	want := []string{"LPT1.log", "Notes/aux.txt", "con", "nul.tar.gz"}
+	if got := reservedNames(paths); !reflect.DeepEqual(got, want) {
+		t.Errorf("reservedNames = %q, want %q", got, want)
+	}
+}
+
+func TestNameProblems(t *testing.T) {
+	// the names a pull's rsync -v listed
+	names := []string{"Readme.md", "README.md", "aux.md", "a:b.md"}
+	apfs := destination{where: "this machine", root: "/Users/me/Notes", os: "darwin", fsType: "apfs", caseInsensitive: true}
+	if got := nameProblems(apfs, false, names); len(got) != 1 || got[0] != "README.md and Readme.md are one file there" {
+		t.Errorf("nameProblems on APFS = %q, want the collision", got)
+	}
+	if got := nameProblems(apfs, true, names); len(got) != 0 {
+		t.Errorf("nameProblems from a case-insensitive source = %q, want none", got)
+	}
+	exfat := destination{where: "this machine", root: "/media/me/USB", os: "linux", fsType: "exfat", caseInsensitive: true}
+	if got := nameProblems(exfat, true, names); len(got) != 2 {
+		t.Errorf("nameProblems on exFAT = %q, want aux.md and a:b.md", got)
+	}
+}
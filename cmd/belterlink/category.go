@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+const categoryUsage = `usage:
+  belterlink category add <Name> -local <path> -remote <path> [-exclude <pattern>]... [key=value]...
+  belterlink category set <Name> [-local <path>] [-remote <path>] [-exclude <pattern>]... [key=value]...
+  belterlink category rm <Name>
+
+-exclude replaces the category's exclude list; key=value sets any other category option
+(e.g. compress=auto resume=true). Comments and ordering in the config file are preserved.`
+
+// categoryFlags are the flags of "category add" and "category set".
+type categoryFlags struct {
+	local, remote string
+	excludes      stringList
+}
+
+func (f *categoryFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.local, "local", "", "local path")
+	fs.StringVar(&f.remote, "remote", "", "remote path")
+	fs.Var(&f.excludes, "exclude", "exclude pattern (repeatable)")
+}
+
+// runCategoryCommand implements "belterlink category ...", editing the config
+// file in place.
+func runCategoryCommand(g *globals, args []string) error {
+	if helpFirst("category", args) {
+		return flag.ErrHelp
+	}
+	if len(args) < 2 {
+		return withExitCode(exitUsage, errors.New(categoryUsage))
+	}
+	action, name := args[0], args[1]
+
+	flags := newFlagSet("category " + action)
+	g.register(flags)
+	var f categoryFlags
+	f.register(flags)
+	if err := flags.Parse(args[2:]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	if config.IsEncrypted(g.cfgPath) {
+		return exitErrorf(exitConfig, "%s is encrypted; decrypt it with age, edit it and encrypt it again", g.cfgPath)
+	}
+	if f := config.Format(g.cfgPath); f != "yaml" {
+		return exitErrorf(exitConfig, "%s is %s; belterlink category only edits YAML configs, edit it by hand", g.cfgPath, strings.ToUpper(f))
+	}
+	doc, err := readConfigNode(g.cfgPath)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	cats := categoriesNode(doc)
+
+	switch action {
+	case "add":
+		if f.local == "" || f.remote == "" {
+			return exitErrorf(exitUsage, "category add requires -local and -remote\n%s", categoryUsage)
+		}
+		if mappingValue(cats, name) != nil {
+			return exitErrorf(exitConfig, "category %q already exists in %s", name, g.cfgPath)
+		}
+		cat := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		cats.Content = append(cats.Content, scalarNode(name), cat)
+		if err := applyCategoryEdits(cat, f.local, f.remote, f.excludes, flags.Args()); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	case "set":
+		cat := mappingValue(cats, name)
+		if cat == nil {
+			return exitErrorf(exitConfig, "category %q not found in %s (defined in an included file?)", name, g.cfgPath)
+		}
+		if err := applyCategoryEdits(cat, f.local, f.remote, f.excludes, flags.Args()); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	case "rm", "remove":
+		if !removeMappingKey(cats, name) {
+			return exitErrorf(exitConfig, "category %q not found in %s (defined in an included file?)", name, g.cfgPath)
+		}
+	default:
+		return exitErrorf(exitUsage, "unknown category action %q\n%s", action, categoryUsage)
+	}
+
+	if err := writeConfigNode(g.cfgPath, doc); err != nil {
+		return err
+	}
+	fmt.Printf("category %s: %s updated\n", action, g.cfgPath)
+	return nil
+}
+
+func applyCategoryEdits(cat *yaml.Node, local, remote string, excludes []string, assignments []string) error {
+	if local != "" {
+		setMappingValue(cat, "local", scalarNode(local))
+	}
+	if remote != "" {
+		setMappingValue(cat, "remote", scalarNode(remote))
+	}
+	if len(excludes) > 0 {
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range excludes {
+			seq.Content = append(seq.Content, scalarNode(e))
+		}
+		setMappingValue(cat, "exclude", seq)
+	}
+	for _, a := range assignments {
+		key, value, ok := strings.Cut(a, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("expected key=value, got %q", a)
+		}
+		var v yaml.Node
+		if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if len(v.Content) == 0 {
+			setMappingValue(cat, key, scalarNode(""))
+			continue
+		}
+		setMappingValue(cat, key, v.Content[0])
+	}
+	// make sure the result still decodes as a category
+	var c config.Category
+	if err := cat.Decode(&c); err != nil {
+		return fmt.Errorf("invalid category: %w", err)
+	}
+	return nil
+}
+
+// readConfigNode parses the config file keeping comments; a missing file
+// yields an empty document so "category add" can bootstrap a config.
+func readConfigNode(path string) (*yaml.Node, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		b = nil
+	} else if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a mapping", path)
+	}
+	return &doc, nil
+}
+
+func writeConfigNode(path string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// categoriesNode returns the categories mapping, creating it if needed.
+func categoriesNode(doc *yaml.Node) *yaml.Node {
+	root := doc.Content[0]
+	if cats := mappingValue(root, "categories"); cats != nil {
+		if cats.Kind != yaml.MappingNode {
+			// e.g. "categories:" with no value
+			*cats = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		return cats
+	}
+	cats := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	root.Content = append(root.Content, scalarNode("categories"), cats)
+	return cats
+}
+
+func scalarNode(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(m *yaml.Node, key string, v *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			// keep the comment that was attached to the old value
+			if v.LineComment == "" {
+				v.LineComment = m.Content[i+1].LineComment
+			}
+			m.Content[i+1] = v
+			return
+		}
+	}
+	m.Content = append(m.Content, scalarNode(key), v)
+}
+
+func removeMappingKey(m *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
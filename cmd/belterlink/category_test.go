@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+const categoryTestConfig = `# my belterlink config
+ssh:
+  user: u
+  host: h
+
+categories:
+  # the piano vault
+  Piano:
+    local: /l/Piano # keep me
+    remote: /r/Piano
+`
+
+func writeCategoryTestConfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(categoryTestConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCategoryAddSetRemove(t *testing.T) {
+	path := writeCategoryTestConfig(t)
+
+	err := runCategoryCommand(&globals{cfgPath: path}, []string{"add", "Notes", "-local", "/l/Notes", "-remote", "/r/Notes", "-exclude", "*.tmp", "compress=auto"})
+	if err != nil {
+		t.Fatalf("category add: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("config.Load after add: %v", err)
+	}
+	notes := cfg.Categories["Notes"]
+	if notes.Local != "/l/Notes" || notes.Remote != "/r/Notes" || notes.Compress != "auto" || len(notes.Exclude) != 1 {
+		t.Fatalf("unexpected category after add: %+v", notes)
+	}
+
+	if err := runCategoryCommand(&globals{cfgPath: path}, []string{"set", "Piano", "-remote", "/r/Piano2", "resume=true"}); err != nil {
+		t.Fatalf("category set: %v", err)
+	}
+	if err := runCategoryCommand(&globals{cfgPath: path}, []string{"rm", "Notes"}); err != nil {
+		t.Fatalf("category rm: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{"# my belterlink config", "# the piano vault", "# keep me", "remote: /r/Piano2", "resume: true"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("config lost %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Notes") {
+		t.Fatalf("Notes should have been removed:\n%s", out)
+	}
+	if strings.Index(out, "ssh:") > strings.Index(out, "categories:") {
+		t.Fatalf("ordering not preserved:\n%s", out)
+	}
+}
+
+func TestCategoryCommandErrors(t *testing.T) {
+	path := writeCategoryTestConfig(t)
+	tests := [][]string{
+		{"add", "Piano", "-local", "/a", "-remote", "/b"}, // exists
+		{"add", "New", "-local", "/a"},                    // missing -remote
+		{"rm", "Missing"},
+		{"set", "Piano", "novalue"},
+		{"rename", "Piano"},
+	}
+	for _, args := range tests {
+		if err := runCategoryCommand(&globals{cfgPath: path}, args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
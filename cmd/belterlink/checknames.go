@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+	"golang.org/x/text/unicode/norm"
+)
+
+// nameCollision is a set of paths that differ only in Unicode normalization,
+// e.g. "café" typed on Linux (precomposed é, NFC) and on a Mac (e followed by
+// a combining accent, NFD). rsync treats them as different files.
+type nameCollision struct {
+	Variants []nameVariant
+}
+
+type nameVariant struct {
+	Path  string
+	Sides []string // local, remote or both
+}
+
+// runCheckNamesCommand implements "belterlink check-names <Category>...": it
+// lists the local and remote names that would collide once normalized.
+func runCheckNamesCommand(g *globals, patterns []string) error {
+	flags := newFlagSet("check-names")
+	g.register(flags)
+	if err := flags.Parse(patterns); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	patterns = flags.Args()
+	if len(patterns) == 0 {
+		return exitErrorf(exitUsage, "usage: belterlink check-names <CategoryName>...")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	if cfg.SSH.User == "" || cfg.SSH.Host == "" {
+		return exitErrorf(exitConfig, "ssh.user and ssh.host are required in config")
+	}
+	names, err := config.SelectCategories(cfg, patterns)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var errs []error
+	for _, name := range names {
+		collisions, err := checkCategoryNames(ctx, cfg, cfg.Categories[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if len(collisions) == 0 {
+			fmt.Printf("%s: no colliding names\n", name)
+			continue
+		}
+		fmt.Printf("%s: %d name collision(s)\n", name, len(collisions))
+		for _, c := range collisions {
+			fmt.Printf("  %s\n", c.Variants[0].Path)
+			for _, v := range c.Variants {
+				fmt.Printf("    %-14s %-11s %+q\n", strings.Join(v.Sides, "+"), normalForm(v.Path), v.Path)
+			}
+		}
+		errs = append(errs, exitErrorf(exitDiffers, "%s: names differ only in Unicode normalization", name))
+	}
+	return errors.Join(errs...)
+}
+
+func checkCategoryNames(ctx context.Context, cfg *config.Config, cat config.Category) ([]nameCollision, error) {
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	local, err := listLocal(cat.Local, m)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := listRemoteNames(ctx, cfg, cat.Remote, m)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+	return findNameCollisions(slices.Collect(maps.Keys(local)), remote), nil
+}
+
+// listRemoteNames lists the paths below root on the remote with find, minus
+// the excluded ones.
+func listRemoteNames(ctx context.Context, cfg *config.Config, root string, m *rsync.Matcher) ([]string, error) {
+	q := ssh.Quote(root)
+	// directories, an empty record, then everything else
+	out, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("find %s -mindepth 1 -type d -print0; printf '\\0'; find %s -mindepth 1 ! -type d -print0", q, q))
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimRight(root, "/") + "/"
+	var paths []string
+	isDir := true
+	for _, p := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		if p == "" {
+			isDir = false
+			continue
+		}
+		rel := strings.TrimPrefix(p, prefix)
+		if !excludedWithParents(m, rel, isDir) {
+			paths = append(paths, rel)
+		}
+	}
+	return paths, nil
+}
+
+// excludedWithParents reports whether rel or one of its parent directories is
+// excluded, which a walk would have skipped.
+func excludedWithParents(m *rsync.Matcher, rel string, isDir bool) bool {
+	if m.Match(rel, isDir) {
+		return true
+	}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if m.Match(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// findNameCollisions groups the paths of both sides by their decomposed form
+// and returns the groups with more than one spelling. Inside a colliding
+// directory only the directory itself is reported.
+func findNameCollisions(local, remote []string) []nameCollision {
+	groups := map[string]map[string][]string{} // decomposed -> spelling -> sides
+	add := func(paths []string, side string) {
+		for _, p := range paths {
+			key := norm.NFD.String(p)
+			if groups[key] == nil {
+				groups[key] = map[string][]string{}
+			}
+			if !slices.Contains(groups[key][p], side) {
+				groups[key][p] = append(groups[key][p], side)
+			}
+		}
+	}
+	add(local, "local")
+	add(remote, "remote")
+
+	var collisions []nameCollision
+	colliding := map[string]bool{}
+	for _, key := range slices.Sorted(maps.Keys(groups)) {
+		spellings := groups[key]
+		if len(spellings) < 2 {
+			continue
+		}
+		colliding[key] = true
+		if inCollidingDir(key, colliding) {
+			continue
+		}
+		var c nameCollision
+		for _, p := range slices.Sorted(maps.Keys(spellings)) {
+			c.Variants = append(c.Variants, nameVariant{Path: p, Sides: spellings[p]})
+		}
+		collisions = append(collisions, c)
+	}
+	return collisions
+}
+
+func inCollidingDir(key string, colliding map[string]bool) bool {
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if colliding[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalForm describes how a name is spelled: with precomposed characters
+// (NFC, as Linux and Windows usually write it), fully decomposed (NFD, as
+// macOS HFS+ stored it and many Mac apps still write it), or a mix of both.
+func normalForm(s string) string {
+	switch {
+	case norm.NFC.IsNormalString(s):
+		return "NFC"
+	case norm.NFD.IsNormalString(s):
+		return "NFD"
+	}
+	return "mixed"
+}
+
+// iconvCharsets picks rsync's --iconv value for normalize_unicode: the Mac
+// side reads and writes names as utf-8-mac (NFD), the other side as plain
+// utf-8. Nothing is converted when neither or both sides are Macs.
+func iconvCharsets(localOS, remoteOS string) string {
+	localMac, remoteMac := strings.EqualFold(localOS, "darwin"), strings.EqualFold(remoteOS, "darwin")
+	switch {
+	case localMac && !remoteMac:
+		return "utf-8-mac,utf-8"
+	case remoteMac && !localMac:
+		return "utf-8,utf-8-mac"
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalForm(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"R\u00e9sum\u00e9.md", "NFC"},
+		{"Re\u0301sume\u0301.md", "NFD"},
+		{"R\u00e9sume\u0301.md", "mixed"}, // half of it decomposed
+		{"\u1112\u1161\u11ab\uae00", "mixed"},
+		{"plain.md", "NFC"},
+	} {
+		if got := normalForm(tt.in); got != tt.want {
+			t.Errorf("normalForm(%+q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFindNameCollisions(t *testing.T) {
+	local := []string{"R\u00e9sum\u00e9.md", "Caf\u00e9", "Caf\u00e9/menu.md", "same.md"}
+	remote := []string{"Re\u0301sume\u0301.md", "Cafe\u0301", "Cafe\u0301/menu.md", "same.md", "R\u00e9sum\u00e9.md"}
+	got := findNameCollisions(local, remote)
+	if len(got) != 2 {
+		t.Fatalf("collisions = %+v, want the Cafe directory and Resume.md only", got)
+	}
+	cafe := got[0]
+	if cafe.Variants[0].Path != "Cafe\u0301" || !slices.Equal(cafe.Variants[1].Sides, []string{"local"}) {
+		t.Fatalf("first collision = %+v", cafe)
+	}
+	resume := got[1]
+	if len(resume.Variants) != 2 || !slices.Equal(resume.Variants[1].Sides, []string{"local", "remote"}) {
+		t.Fatalf("second collision = %+v", resume)
+	}
+	if normalForm(resume.Variants[0].Path) != "NFD" || normalForm(resume.Variants[1].Path) != "NFC" {
+		t.Fatalf("forms = %s, %s", normalForm(resume.Variants[0].Path), normalForm(resume.Variants[1].Path))
+	}
+}
+
+func TestIconvCharsets(t *testing.T) {
+	for _, tt := range []struct{ local, remote, want string }{
+		{"darwin", "Linux", "utf-8-mac,utf-8"},
+		{"linux", "Darwin", "utf-8,utf-8-mac"},
+		{"darwin", "Darwin", ""},
+		{"linux", "Linux", ""},
+	} {
+		if got := iconvCharsets(tt.local, tt.remote); got != tt.want {
+			t.Errorf("iconvCharsets(%s, %s) = %q, want %q", tt.local, tt.remote, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// syncUsage is the synopsis of the main form, which is also the sync
+// command.
+const syncUsage = "<CategoryName>... [push|pull|sync|backup]"
+
+// command is a subcommand, belterlink [flags] <name> [args]. The table of
+// commands both dispatches them and documents them: the help's USAGE
+// section, the man page and the shell completions, with each command's
+// flags, are generated from it.
+type command struct {
+	name    string
+	usage   []string // synopses, after "belterlink [flags] "
+	summary string
+	run     func(g *globals, args []string) error
+	// flags adds the command's own flags to fs, as its run does; nil if it
+	// only takes the global ones
+	flags func(fs *flag.FlagSet)
+}
+
+// globals are the flags every command takes, before or after its name,
+// and the sync flags as given before it.
+type globals struct {
+	cfgPath  string
+	logLevel string
+	sync     syncFlags
+}
+
+// register adds the global flags to fs, with their current values as
+// defaults; -q, -v and -vv set the verbosity as they're parsed.
+func (g *globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.cfgPath, "config", g.cfgPath, "path to the config `file`: YAML, TOML or JSON by extension; $BELTERLINK_CONFIG if set")
+	fs.Var(verbosityFlag(rsync.Quiet), "q", "quiet: print only errors and warnings (e.g. for cron)")
+	fs.Var(verbosityFlag(rsync.Quiet), "quiet", "same as -q")
+	fs.Var(verbosityFlag(rsync.Quiet), "no-verbose", "deprecated: same as -q")
+	fs.Var(verbosityFlag(rsync.Verbose), "v", "more detail: rsync --stats and belterlink's own steps")
+	fs.Var(verbosityFlag(rsync.VeryVerbose), "vv", "even more detail: rsync -vv and its filter and deletion debugging")
+	fs.StringVar(&g.logLevel, "log-level", g.logLevel, "log file `level`: debug, info, warn or error (default from config, else info)")
+}
+
+// verbosityFlag is -q, -v or -vv: giving it sets verbosity to its level.
+type verbosityFlag rsync.Verbosity
+
+func (f verbosityFlag) IsBoolFlag() bool { return true }
+func (f verbosityFlag) String() string   { return "false" }
+func (f verbosityFlag) Set(v string) error {
+	if on, err := strconv.ParseBool(v); err != nil || !on {
+		return err
+	}
+	level := rsync.Verbosity(f)
+	switch {
+	case level == rsync.Quiet && verbosity > rsync.Normal, level > rsync.Normal && verbosity == rsync.Quiet:
+		return errors.New("-q can't be combined with -v or -vv")
+	case level == rsync.Quiet:
+		verbosity = level
+	default:
+		verbosity = max(verbosity, level)
+	}
+	return nil
+}
+
+// commandTable lists the commands in the order the help shows them. It's a
+// function rather than a variable because gen, which is in it, reads it.
+func commandTable() []command {
+	return []command{
+		{
+			name:    "sync",
+			usage:   []string{"sync [sync flags] " + syncUsage},
+			summary: "push, pull, sync or back up categories; the same as leaving out the command",
+			run:     runSyncCommand,
+			flags:   func(fs *flag.FlagSet) { new(syncFlags).register(fs) },
+		},
+		{
+			name: "category",
+			usage: []string{
+				"category add <Name> -local <path> -remote <path> [-exclude <pattern>]... [key=value]...",
+				"category set <Name> [-local <path>] [-remote <path>] [-exclude <pattern>]... [key=value]...",
+				"category rm <Name>",
+			},
+			summary: "add, change or remove a category in the config file, keeping its comments",
+			run:     runCategoryCommand,
+			flags:   func(fs *flag.FlagSet) { new(categoryFlags).register(fs) },
+		},
+		{
+			name:    "config",
+			usage:   []string{"config dump [-format yaml|json]"},
+			summary: "print the merged config with the defaults filled in",
+			run:     runConfigCommand,
+			flags:   func(fs *flag.FlagSet) { new(configFlags).register(fs) },
+		},
+		{
+			name:    "discover",
+			usage:   []string{"discover [-timeout 3s]"},
+			summary: "list the SSH hosts on the local network",
+			run:     runDiscoverCommand,
+			flags:   func(fs *flag.FlagSet) { new(discoverFlags).register(fs) },
+		},
+		{
+			name:    "verify",
+			usage:   []string{"verify <CategoryName>..."},
+			summary: "compare both sides by checksum without transferring anything",
+			run:     runVerifyCommand,
+		},
+		{
+			name:    "check-names",
+			usage:   []string{"check-names <CategoryName>..."},
+			summary: "find names that differ only in Unicode normalization (NFC vs NFD)",
+			run:     runCheckNamesCommand,
+		},
+		{
+			name:    "manifest",
+			usage:   []string{"manifest [diff] <CategoryName>..."},
+			summary: "write a SHA-256 manifest of the local tree, or report changes and bitrot since the last one",
+			run:     runManifestCommand,
+		},
+		{
+			name:    "test-excludes",
+			usage:   []string{"test-excludes <CategoryName> [path...]"},
+			summary: "show whether paths are synced and which pattern skips them",
+			run:     runTestExcludesCommand,
+		},
+		{
+			name:    "explain",
+			usage:   []string{"explain [-delete] [-checksum] [-dry-run] <CategoryName> [push|pull]"},
+			summary: "print the rsync and ssh commands a push or pull would run, and where their settings come from, without running them",
+			run:     runExplainCommand,
+			flags:   func(fs *flag.FlagSet) { new(syncFlags).registerExplain(fs) },
+		},
+		{
+			name:    "adhoc",
+			usage:   []string{"adhoc -local <path> -remote [user@]host:<path> [-port <n>] [-key <file>] [-exclude <pattern>]... <push|pull>"},
+			summary: "sync two paths once, with a category's safeguards but no config",
+			run:     runAdhocCommand,
+			flags:   func(fs *flag.FlagSet) { new(adhocFlags).register(fs, &RunOptions{}) },
+		},
+		{
+			name:    "hostkey",
+			usage:   []string{"hostkey accept|remove [-yes] [host]"},
+			summary: "show the host's fingerprints and add them to known_hosts, or remove them",
+			run:     runHostKeyCommand,
+			flags:   func(fs *flag.FlagSet) { new(hostKeyFlags).register(fs) },
+		},
+		{
+			name:    "probe",
+			usage:   []string{"probe [-refresh] [-json] [host]"},
+			summary: "look at the remote's OS, rsync and filesystems (cached)",
+			run:     runProbeCommand,
+			flags:   func(fs *flag.FlagSet) { new(probeFlags).register(fs) },
+		},
+		{
+			name:    "last",
+			usage:   []string{"last [-json] <CategoryName>..."},
+			summary: "when categories last synced and how it went; fails if the last run failed",
+			run:     runLastCommand,
+			flags:   func(fs *flag.FlagSet) { new(lastFlags).register(fs) },
+		},
+		{
+			name:    "undo",
+			usage:   []string{"undo [-yes] [-dry-run] <CategoryName>"},
+			summary: "put back what the last run of a category replaced or deleted",
+			run:     runUndoCommand,
+			flags:   func(fs *flag.FlagSet) { new(undoFlags).register(fs) },
+		},
+		{
+			name: "backups",
+			usage: []string{
+				"backups <CategoryName>...",
+				"backups prune [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-dry-run] <CategoryName>...",
+			},
+			summary: "list the snapshots made by the backup direction, or remove those a retention policy doesn't keep",
+			run:     runBackupsCommand,
+			flags:   func(fs *flag.FlagSet) { new(pruneFlags).register(fs) },
+		},
+		{
+			name:    "restore",
+			usage:   []string{"restore [-at <time>] [-path <rel>]... [-to <dir> | -in-place [-yes]] [-dry-run] <CategoryName>"},
+			summary: "copy a snapshot, or some paths of it, back to this machine",
+			run:     runRestoreCommand,
+			flags:   func(fs *flag.FlagSet) { new(restoreFlags).register(fs) },
+		},
+		{
+			name: "state",
+			usage: []string{
+				"state export [-o <file>] [<CategoryName>...]",
+				"state import [-force] <file> [<CategoryName>...]",
+			},
+			summary: "carry the sync history of categories to another machine",
+			run:     runStateCommand,
+			flags:   func(fs *flag.FlagSet) { new(stateFlags).register(fs, "") },
+		},
+		{
+			name:    "daemon",
+			usage:   []string{"daemon"},
+			summary: "run daemon.jobs on schedule, with a control API on a Unix socket",
+			run:     runDaemonCommand,
+		},
+		{
+			name:    "pause",
+			usage:   []string{"pause [<CategoryName>...]"},
+			summary: "hold back the daemon's scheduled runs (of some categories, or all)",
+			run: func(g *globals, args []string) error {
+				return runPauseCommand(g, args, true)
+			},
+		},
+		{
+			name:    "resume",
+			usage:   []string{"resume [<CategoryName>...]"},
+			summary: "restart the daemon's scheduled runs",
+			run: func(g *globals, args []string) error {
+				return runPauseCommand(g, args, false)
+			},
+		},
+		{
+			name:    "queue",
+			usage:   []string{"queue [clear [<CategoryName>...]]"},
+			summary: "show the daemon's current and waiting runs, or drop the waiting ones",
+			run:     runQueueCommand,
+		},
+		{
+			name:    "push-agent",
+			usage:   []string{"push-agent [-binary <file>] [-dest <path>] [[user@]host]"},
+			summary: "install belterlink, built for the remote's OS and architecture, on the remote",
+			run:     runPushAgentCommand,
+			flags:   func(fs *flag.FlagSet) { new(pushAgentFlags).register(fs) },
+		},
+		{
+			name:    "agent",
+			usage:   []string{"agent"},
+			summary: "the remote side of transport: agent; started over ssh",
+			run: func(_ *globals, args []string) error {
+				return runAgentCommand(args)
+			},
+		},
+		{
+			name:    "help",
+			usage:   []string{"help [<command>]"},
+			summary: "show the help, or a command's usage and flags",
+			run:     runHelpCommand,
+		},
+		{
+			name: "gen",
+			usage: []string{
+				"gen man",
+				"gen completion bash|zsh|fish",
+				"gen categories",
+			},
+			summary: "print the man page or a shell completion script, for packaging; categories lists the category and group names for the scripts",
+			run:     runGenCommand,
+		},
+	}
+}
+
+// findCommand returns the command called name.
+func findCommand(name string) (command, bool) {
+	for _, c := range commandTable() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// printCommandHelp writes the usage and summary of the command called name.
+func printCommandHelp(w io.Writer, name string) {
+	c, ok := findCommand(name)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, "usage:")
+	for _, u := range c.usage {
+		fmt.Fprintf(w, "  belterlink [flags] %s\n", u)
+	}
+	fmt.Fprintf(w, "\n%s%s.\n", strings.ToUpper(c.summary[:1]), c.summary[1:])
+}
+
+// newFlagSet returns the flag set of the command called name (its first
+// word, e.g. "state" for "state export"). Its -h prints the command's help
+// and then its flags.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		printCommandHelp(fs.Output(), strings.Fields(name)[0])
+		n := 0
+		fs.VisitAll(func(*flag.Flag) { n++ })
+		if n > 0 {
+			fmt.Fprintln(fs.Output(), "\nflags:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// helpFirst handles "belterlink <command> -h" for the commands that read an
+// action before their flags, printing the command's help.
+func helpFirst(name string, args []string) bool {
+	if len(args) == 0 || args[0] != "-h" && args[0] != "-help" && args[0] != "--help" {
+		return false
+	}
+	printCommandHelp(os.Stderr, name)
+	return true
+}
+
+// runHelpCommand implements "belterlink help [command]".
+func runHelpCommand(g *globals, args []string) error {
+	if len(args) == 0 {
+		printHelp()
+		return nil
+	}
+	c, ok := findCommand(args[0])
+	if len(args) > 1 || !ok || c.name == "help" {
+		return exitErrorf(exitUsage, "usage: belterlink help [<command>]; the commands are listed by belterlink help")
+	}
+	// every command answers -h with its help
+	if err := c.run(g, []string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return nil
+}
+
+// parseInterleaved parses args with fs, letting flags come before, between
+// and after the positional arguments, which it returns. "--" ends the flags.
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		if len(args) > fs.NArg() && args[len(args)-fs.NArg()-1] == "--" {
+			return append(positional, fs.Args()...), nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// printFlags writes the flags of fs for the help, one per line, leaving
+// out deprecated ones.
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		if strings.HasPrefix(usage, "deprecated:") {
+			return
+		}
+		spec := "-" + f.Name
+		if name != "" {
+			spec += " <" + name + ">"
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", spec, usage)
+	})
+}
+
+// printUsage writes the synopses of the main form and every command.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "  belterlink [flags] %s\n", syncUsage)
+	for _, c := range commandTable() {
+		for _, u := range c.usage {
+			fmt.Fprintf(w, "  belterlink [flags] %s\n", u)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestCommandTable(t *testing.T) {
+	seen := map[string]bool{}
+	for _, c := range commandTable() {
+		if seen[c.name] || c.run == nil || len(c.usage) == 0 || c.summary == "" {
+			t.Errorf("command %q: duplicate or incomplete", c.name)
+		}
+		seen[c.name] = true
+		for _, u := range c.usage {
+			if !strings.HasPrefix(u, c.name) {
+				t.Errorf("usage %q doesn't start with %q", u, c.name)
+			}
+		}
+	}
+	if _, ok := findCommand("push"); ok {
+		t.Error("findCommand(push): a direction isn't a command")
+	}
+}
+
+func TestParseInterleaved(t *testing.T) {
+	for _, c := range []struct {
+		args      []string
+		wantPos   []string
+		wantDry   bool
+		wantPaths []string
+	}{
+		{[]string{"-dry-run", "Notes", "push"}, []string{"Notes", "push"}, true, nil},
+		{[]string{"Notes", "push", "-dry-run"}, []string{"Notes", "push"}, true, nil},
+		{[]string{"Notes", "-path", "a.md", "Piano", "pull", "-path", "b.md"}, []string{"Notes", "Piano", "pull"}, false, []string{"a.md", "b.md"}},
+		{[]string{"Notes", "--", "-odd", "push"}, []string{"Notes", "-odd", "push"}, false, nil},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		dry := fs.Bool("dry-run", false, "")
+		var paths stringList
+		fs.Var(&paths, "path", "")
+		pos, err := parseInterleaved(fs, c.args)
+		if err != nil || !slices.Equal(pos, c.wantPos) || *dry != c.wantDry || !slices.Equal(paths, c.wantPaths) {
+			t.Errorf("parseInterleaved(%q) = %q, dry-run %v, paths %q, %v", c.args, pos, *dry, paths, err)
+		}
+	}
+}
+
+func TestSyncFlagsRegister(t *testing.T) {
+	// flags given before the sync command stay set unless given again
+	s := syncFlags{dryRun: true}
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	s.register(fs)
+	if err := fs.Parse([]string{"-delete", "-retries", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.dryRun || !s.delete || s.retries != (optionalInt{2, true}) {
+		t.Fatalf("syncFlags = %+v", s)
+	}
+	if opts := s.options(); !opts.DryRun || !opts.Delete || opts.Direction != "" {
+		t.Fatalf("options = %+v", opts)
+	}
+}
+
+func TestGlobalsAfterCommand(t *testing.T) {
+	t.Cleanup(func() { verbosity = rsync.Normal })
+	g := &globals{cfgPath: "default.yaml"}
+	fs := newFlagSet("probe")
+	g.register(fs)
+	if err := fs.Parse([]string{"-config", "other.yaml", "-vv", "-v", "-log-level", "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	if g.cfgPath != "other.yaml" || g.logLevel != "debug" || verbosity != rsync.VeryVerbose {
+		t.Fatalf("globals = %+v, verbosity %v", g, verbosity)
+	}
+	fs = newFlagSet("probe")
+	fs.SetOutput(io.Discard)
+	g.register(fs)
+	if err := fs.Parse([]string{"-q"}); err == nil || !strings.Contains(err.Error(), "-q can't be combined") {
+		t.Fatalf("-q after -vv = %v", err)
+	}
+}
+
+func TestRetriesDefault(t *testing.T) {
+	var s syncFlags
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	s.register(fs)
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	fs.PrintDefaults()
+	if strings.Contains(out.String(), "default -1") || !strings.Contains(out.String(), "-retries n") {
+		t.Errorf("-retries help:\n%s", out.String())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+const configUsage = "usage: belterlink config dump [-format yaml|json] [-show-secrets]"
+
+// configFlags are the flags of "config dump".
+type configFlags struct {
+	format      string
+	showSecrets bool
+}
+
+func (f *configFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.format, "format", "yaml", "output format: yaml or json")
+	fs.BoolVar(&f.showSecrets, "show-secrets", false, "print passphrases, passwords, backend options and secret-looking vars instead of "+config.RedactedValue)
+}
+
+// runConfigCommand implements "belterlink config dump": the configuration as
+// belterlink uses it, after includes, drop-ins, config.local.yaml,
+// environment overrides, templates and path expansion, with each category's
+// unset options filled in from defaults. Secrets are redacted unless
+// -show-secrets is given.
+func runConfigCommand(g *globals, args []string) error {
+	if helpFirst("config", args) {
+		return flag.ErrHelp
+	}
+	if len(args) == 0 || args[0] != "dump" {
+		return withExitCode(exitUsage, errors.New(configUsage))
+	}
+	flags := newFlagSet("config dump")
+	g.register(flags)
+	var f configFlags
+	f.register(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 0 || f.format != "yaml" && f.format != "json" {
+		return withExitCode(exitUsage, errors.New(configUsage))
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	cfg = resolveDefaults(cfg)
+	if !f.showSecrets {
+		cfg = config.Redacted(cfg)
+	}
+	out, err := dumpConfig(cfg, f.format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// resolveDefaults returns a copy of cfg whose categories have the defaults
+// they inherit filled in: every option a category leaves unset that
+// defaults sets under the same key. defaults.rsync_args goes before a
+// category's own rather than replacing them, so it stays in defaults.
+func resolveDefaults(cfg *config.Config) *config.Config {
+	out := *cfg
+	out.Categories = make(map[string]config.Category, len(cfg.Categories))
+	defaults := reflect.ValueOf(cfg.Defaults)
+	byKey := map[string]reflect.Value{}
+	for i := range defaults.NumField() {
+		key := yamlKey(defaults.Type().Field(i))
+		if key != "rsync_args" {
+			byKey[key] = defaults.Field(i)
+		}
+	}
+	for name, cat := range cfg.Categories {
+		v := reflect.ValueOf(&cat).Elem()
+		for i := range v.NumField() {
+			def, ok := byKey[yamlKey(v.Type().Field(i))]
+			if ok && v.Field(i).IsZero() && !def.IsZero() {
+				v.Field(i).Set(def)
+			}
+		}
+		out.Categories[name] = cat
+	}
+	return &out
+}
+
+// yamlKey is the key a struct field has in the config file.
+func yamlKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return key
+}
+
+// dumpConfig renders cfg as YAML, or as JSON with the same keys.
+func dumpConfig(cfg *config.Config, format string) ([]byte, error) {
+	b, err := yaml.Marshal(cfg)
+	if err != nil || format == "yaml" {
+		return b, err
+	}
+	var tree any
+	if err := yaml.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+	b, err = json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("config as JSON: %w", err)
+	}
+	return append(b, '\n'), nil
+}
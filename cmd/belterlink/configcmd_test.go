@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestResolveDefaults(t *testing.T) {
+	yes, no := true, false
+	cfg := &config.Config{
+		Defaults: config.Defaults{Resume: &yes, Compress: "auto", Chmod: "D755,F644", RsyncArgs: []string{"--iconv=utf-8-mac,utf-8"}},
+		Categories: map[string]config.Category{
+			"Notes": {Local: "/l", Remote: "/r", Resume: &no, RsyncArgs: []string{"--fuzzy"}},
+			"Piano": {Local: "/p", Remote: "/q", Compress: "true"},
+		},
+	}
+	got := resolveDefaults(cfg)
+	notes, piano := got.Categories["Notes"], got.Categories["Piano"]
+	if *notes.Resume || notes.Compress != "auto" || notes.Chmod != "D755,F644" || !slices.Equal(notes.RsyncArgs, []string{"--fuzzy"}) {
+		t.Errorf("Notes = %+v", notes)
+	}
+	if !*piano.Resume || piano.Compress != "true" || piano.RsyncArgs != nil {
+		t.Errorf("Piano = %+v", piano)
+	}
+	if cfg.Categories["Piano"].Resume != nil {
+		t.Error("resolveDefaults changed the config it was given")
+	}
+
+	b, err := dumpConfig(got, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree struct {
+		Categories map[string]map[string]any `json:"categories"`
+	}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if tree.Categories["Piano"]["resume"] != true || tree.Categories["Piano"]["local"] != "/p" {
+		t.Errorf("JSON keys should match the YAML config's:\n%s", b)
+	}
+}
+
+func TestDumpConfigRedacted(t *testing.T) {
+	cfg := &config.Config{
+		SSH:    config.SSH{KeyPassphrase: "hunter2"},
+		Notify: config.Notify{Email: &config.Email{Host: "smtp", Password: "secret:smtp"}},
+		Vars:   map[string]any{"vault": "~/Notes", "s3": map[string]any{"api_key": "AKIA123"}, "DB_PASSWORD": "pw"},
+		Categories: map[string]config.Category{
+			"Photos": {Local: "/l", Backend: "s3", BackendOptions: map[string]string{"bucket": "photos"}},
+		},
+	}
+	b, err := dumpConfig(config.Redacted(cfg), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "AKIA123", "pw\n", "photos"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("dump shows %q:\n%s", secret, b)
+		}
+	}
+	for _, kept := range []string{"secret:smtp", "~/Notes", "password: secret:smtp"} {
+		if !strings.Contains(string(b), kept) {
+			t.Errorf("dump lacks %q:\n%s", kept, b)
+		}
+	}
+	if cfg.SSH.KeyPassphrase != "hunter2" || cfg.Categories["Photos"].BackendOptions["bucket"] != "photos" || cfg.Vars["DB_PASSWORD"] != "pw" {
+		t.Error("Redacted changed the config it was given")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// syncedFile is a file as it was on both sides after the last sync, or a
+// tombstone for one a sync deleted.
+type syncedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Deleted time.Time `json:"deleted,omitzero"` // when a sync propagated its deletion
+}
+
+// tombstoneTTL is how long deleted files are remembered.
+const tombstoneTTL = 30 * 24 * time.Hour
+
+// changedSince reports whether a file of the given size and mtime differs
+// from f. Times are compared in whole seconds, as rsync lists them.
+func (f syncedFile) changedSince(size int64, mtime time.Time) bool {
+	return f.Size != size || !f.ModTime.Truncate(time.Second).Equal(mtime.Truncate(time.Second))
+}
+
+func syncedStatePath(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "synced", category+".json")
+}
+
+// saveSyncedState records the local files after a sync, when both sides
+// agree, so the next sync can tell which side changed a file. The previous
+// state's tombstones and the new ones are kept, unless the file is back or
+// the tombstone expired.
+func saveSyncedState(cfg *config.Config, name string, cat config.Category, tombstones map[string]syncedFile) error {
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return err
+	}
+	files, err := listLocal(cat.Local, m)
+	if err != nil {
+		return err
+	}
+	state := map[string]syncedFile{}
+	old, _ := loadSyncedState(cfg, name)
+	for _, t := range []map[string]syncedFile{old, tombstones} {
+		for rel, f := range t {
+			if !f.Deleted.IsZero() && time.Since(f.Deleted) < tombstoneTTL {
+				state[rel] = f
+			}
+		}
+	}
+	for rel, f := range files {
+		if !f.Dir {
+			state[rel] = syncedFile{Size: f.Size, ModTime: f.ModTime}
+		}
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(syncedStatePath(cfg, name), append(b, '\n'))
+}
+
+func loadSyncedState(cfg *config.Config, name string) (map[string]syncedFile, error) {
+	b, err := os.ReadFile(syncedStatePath(cfg, name))
+	if err != nil {
+		return nil, err
+	}
+	var state map[string]syncedFile
+	return state, json.Unmarshal(b, &state)
+}
+
+// conflictPolicy is the category's conflict setting; newer-wins, rsync's
+// --update, unless set.
+func conflictPolicy(cat config.Category) string {
+	if cat.Conflict == "" {
+		return "newer-wins"
+	}
+	return cat.Conflict
+}
+
+// resolveConflicts runs before the passes of a sync. A file both sides
+// changed since the last sync is a conflict, and the category's conflict
+// policy decides it up front, so that the pull and push that follow just
+// carry out the decision:
+//   - local-wins touches the local copy, which --update then pushes;
+//   - remote-wins fetches the remote copy over the local one;
+//   - keep-both renames the local copy with a host and time suffix, so the
+//     push sends it as a new file, and fetches the remote one;
+//   - abort stops the sync.
+//
+// Nothing is decided before the first sync with a policy recorded a state.
+func resolveConflicts(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions) error {
+	policy := conflictPolicy(cat)
+	if policy == "newer-wins" {
+		return nil
+	}
+	state, err := loadSyncedState(cfg, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read sync state: %w", err)
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	conflicts, err := findConflicts(ctx, cfg, cat, state)
+	if err != nil || len(conflicts) == 0 {
+		return err
+	}
+
+	if policy == "abort" {
+		for _, rel := range conflicts {
+			fmt.Fprintln(os.Stderr, "  conflict:", rel)
+		}
+		return exitErrorf(exitRefused, "%d file(s) changed on both sides since the last sync; resolve them or pick another conflict policy", len(conflicts))
+	}
+	if opts.DryRun {
+		for _, rel := range conflicts {
+			printAt(rsync.Normal, "Would resolve conflict (%s): %s\n", policy, rel)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	var fetch []string
+	for _, rel := range conflicts {
+		local := filepath.Join(cat.Local, filepath.FromSlash(rel))
+		switch policy {
+		case "local-wins":
+			if err := os.Chtimes(local, now, now); err != nil {
+				return err
+			}
+			printAt(rsync.Normal, "Conflict, keeping local: %s\n", rel)
+		case "remote-wins":
+			fetch = append(fetch, rel)
+			printAt(rsync.Normal, "Conflict, keeping remote: %s\n", rel)
+		case "keep-both":
+			renamed := conflictName(rel, peerName(cfg), now)
+			if err := os.Rename(local, filepath.Join(cat.Local, filepath.FromSlash(renamed))); err != nil {
+				return err
+			}
+			fetch = append(fetch, rel)
+			printAt(rsync.Normal, "Conflict, keeping both: %s (local copy: %s)\n", rel, renamed)
+		}
+		logger.Info("conflict resolved", "category", name, "path", rel, "policy", policy)
+	}
+	if len(fetch) > 0 {
+		if err := fetchRemoteFiles(ctx, cfg, cat, fetch, cat.Local); err != nil {
+			return fmt.Errorf("fetch remote copies: %w", err)
+		}
+	}
+	return nil
+}
+
+// findConflicts lists the files that differ between the sides and changed
+// on both since state was recorded. A file both sides created is a conflict
+// too. Notes left to merge: markdown are not.
+func findConflicts(ctx context.Context, cfg *config.Config, cat config.Category, state map[string]syncedFile) ([]string, error) {
+	pull := rsync.Options{Direction: "pull", NoDelete: true, Verbosity: rsync.Quiet, LowPriority: rsync.LowPriority(cfg, cat)}
+	rsArgs, err := rsync.BuildArgs(cfg, cat, pull)
+	if err != nil {
+		return nil, err
+	}
+	rsArgs = slices.DeleteFunc(adaptRsyncArgs(ctx, cfg, rsArgs), func(a string) bool { return a == "--update" })
+	diffs, err := itemizedDryRun(ctx, cfg, pull, rsArgs, false)
+	if err != nil {
+		return nil, fmt.Errorf("find changed files: %w", err)
+	}
+
+	// files that changed locally; the others only changed on the remote
+	var candidates []string
+	for _, d := range diffs {
+		if d.Kind != "differs" && d.Kind != "metadata" {
+			continue
+		}
+		if cat.Merge == "markdown" && strings.HasSuffix(strings.ToLower(d.Path), ".md") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(cat.Local, filepath.FromSlash(d.Path)))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if was, ok := state[d.Path]; ok && was.Deleted.IsZero() && !was.changedSince(info.Size(), info.ModTime()) {
+			continue
+		}
+		candidates = append(candidates, d.Path)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	remote, err := listRemoteFiles(ctx, cfg, cat, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("list remote files: %w", err)
+	}
+
+	var conflicts []string
+	for _, rel := range candidates {
+		was, ok := state[rel]
+		r, listed := remote[rel]
+		if !ok || !was.Deleted.IsZero() || !listed || was.changedSince(r.Size, r.ModTime) {
+			conflicts = append(conflicts, rel)
+		}
+	}
+	return conflicts, nil
+}
+
+// listRemoteFiles describes the given category-relative remote files with
+// rsync --list-only; nil lists the whole remote tree.
+func listRemoteFiles(ctx context.Context, cfg *config.Config, cat config.Category, files []string) (map[string]rsync.Entry, error) {
+	args := []string{"--list-only", "--protect-args", "-e", rsync.Shell(cfg.SSH)}
+	if files == nil {
+		args = append(args, "-r")
+	} else {
+		args = append(args, "--files-from=-")
+	}
+	if cfg.Rsync.RemotePath != "" {
+		args = append(args, "--rsync-path="+cfg.Rsync.RemotePath)
+	}
+	var out bytes.Buffer
+	cmd := rsync.Command(ctx, cfg, append(args, rsync.RemoteSpec(cfg.SSH, cat))...)
+	if files != nil {
+		cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return nil, exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	entries := map[string]rsync.Entry{}
+	for _, e := range rsync.ParseListing(out.String()) {
+		if !e.Dir {
+			entries[e.Path] = e
+		}
+	}
+	return entries, nil
+}
+
+// conflictName is where keep-both moves the local copy of rel: the host and
+// time go before the extension, so the file still opens in the same app.
+func conflictName(rel, host string, t time.Time) string {
+	dir, base := path.Split(rel)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = "" // a dotfile such as .env
+	}
+	return dir + fmt.Sprintf("%s.conflict-%s-%s%s", strings.TrimSuffix(base, ext), host, t.Format("20060102-150405"), ext)
+}
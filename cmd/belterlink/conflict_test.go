@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestConflictName(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	tests := map[string]string{
+		"scores/Nocturne.pdf": "scores/Nocturne.conflict-laptop-20240501-103000.pdf",
+		"todo":                "todo.conflict-laptop-20240501-103000",
+		".env":                ".env.conflict-laptop-20240501-103000",
+		"a.tar.gz":            "a.tar.conflict-laptop-20240501-103000.gz",
+	}
+	for rel, want := range tests {
+		if got := conflictName(rel, "laptop", at); got != want {
+			t.Errorf("conflictName(%q) = %q, want %q", rel, got, want)
+		}
+	}
+}
+
+func TestSyncedFileChangedSince(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	f := syncedFile{Size: 10, ModTime: t0.Add(400 * time.Millisecond)}
+	if f.changedSince(10, t0) {
+		t.Fatal("sub-second difference counted as a change")
+	}
+	if !f.changedSince(11, t0) || !f.changedSince(10, t0.Add(time.Second)) {
+		t.Fatal("size or time change missed")
+	}
+}
+
+func TestSyncedStateRoundTrip(t *testing.T) {
+	local := t.TempDir()
+	for _, f := range []string{"a.md", "sub/b.pdf"} {
+		p := filepath.Join(local, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{StateDir: t.TempDir()}
+	cat := config.Category{Local: local, Conflict: "keep-both"}
+	if err := saveSyncedState(cfg, "Notes", cat, nil); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadSyncedState(cfg, "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 2 || state["a.md"].Size != 4 || state["sub/b.pdf"].Size != 9 {
+		t.Fatalf("state = %+v", state)
+	}
+}
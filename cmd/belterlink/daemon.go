@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// historySize is how many finished runs the daemon remembers for /history.
+const historySize = 100
+
+// daemon runs the configured jobs on their intervals and serves the control
+// API. Runs are serialized: a scheduled or requested run waits for the
+// current one to finish.
+type daemon struct {
+	ctx context.Context // cancelled when the daemon stops
+	cfg *config.Config
+	// run syncs one category; replaced in tests
+	run func(name, direction string) (RunSummary, error)
+	// metered reports a metered connection, for not_on; replaced in tests
+	metered func() bool
+	// network describes the network addresses, to notice it come up;
+	// replaced in tests
+	network func() string
+
+	runMu sync.Mutex // held for the duration of a run
+
+	mu           sync.Mutex
+	paused       bool
+	pausedCats   map[string]bool // categories held back by "belterlink pause <Category>"
+	running      string          // "<category> <direction>" while a run is in progress
+	queue        []queuedRun     // runs waiting for the current one
+	nextQueuedID int
+	history      []RunSummary
+	jobs         []jobState
+	offline      map[string]offlineRun // "<category> <direction>" -> run waiting for the remote
+	lastNetwork  *string               // as of the last scheduler tick
+}
+
+type queuedRun struct {
+	ID        int       `json:"id"`
+	Category  string    `json:"category"`
+	Direction string    `json:"direction"`
+	Scheduled bool      `json:"scheduled"`
+	Since     time.Time `json:"since"`
+}
+
+type jobState struct {
+	config.Job
+	Interval time.Duration `json:"-"`
+	NextRun  time.Time     `json:"next_run"`
+	LastRun  time.Time     `json:"last_run,omitzero"`
+}
+
+type daemonStatus struct {
+	Paused           bool         `json:"paused"`
+	PausedCategories []string     `json:"paused_categories,omitempty"`
+	Running          string       `json:"running,omitempty"`
+	Queue            []queuedRun  `json:"queue,omitempty"`
+	Offline          []offlineRun `json:"offline,omitempty"`
+	Jobs             []jobState   `json:"jobs"`
+}
+
+func runDaemonCommand(g *globals, args []string) error {
+	flags := newFlagSet("daemon")
+	g.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	if len(args) > 0 {
+		return exitErrorf(exitUsage, "usage: belterlink daemon")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	logFile, err := setupLogging(cfg.Log, g.logLevel)
+	if err != nil {
+		return exitErrorf(exitConfig, "logging: %v", err)
+	}
+	defer logFile.Close()
+
+	maxRetries := 0
+	if cfg.Defaults.Retries != nil {
+		maxRetries = *cfg.Defaults.Retries
+	}
+	ctx, stopRuns := interruptContext()
+	defer stopRuns()
+	d := newDaemon(ctx, cfg, func(name, direction string) (RunSummary, error) {
+		if direction == "scrub" {
+			return scrubCategory(ctx, cfg, name)
+		}
+		opts := RunOptions{Options: rsync.Options{Direction: direction}, NonInteractive: true}
+		return runCategory(ctx, cfg, name, opts, maxRetries)
+	})
+
+	sock := daemonSocket(cfg)
+	if err := os.MkdirAll(filepath.Dir(sock), 0o700); err != nil {
+		return err
+	}
+	if err := removeStaleSocket(sock); err != nil {
+		return err
+	}
+	ln, err := listenPrivate(sock)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", sock, err)
+	}
+	defer os.Remove(sock)
+
+	srv := &http.Server{Handler: d.handler()}
+	go srv.Serve(ln)
+	stop := make(chan struct{})
+	go d.schedule(stop)
+
+	fmt.Printf("belterlink daemon: %d job(s), control socket %s\n", len(d.jobs), sock)
+	logger.Info("daemon started", "jobs", len(d.jobs), "socket", sock)
+
+	<-ctx.Done()
+	close(stop)
+	srv.Close()
+	// let the run in progress stop rsync and record itself as aborted;
+	// queued runs never start
+	d.runMu.Lock()
+	logger.Info("daemon stopped")
+	return nil
+}
+
+func newDaemon(ctx context.Context, cfg *config.Config, run func(name, direction string) (RunSummary, error)) *daemon {
+	d := &daemon{ctx: ctx, cfg: cfg, run: run, metered: meteredConnection, network: networkState, pausedCats: map[string]bool{}, offline: map[string]offlineRun{}}
+	now := time.Now()
+	for _, job := range cfg.Daemon.Jobs {
+		every, _ := time.ParseDuration(job.Every) // validated by config.Load
+		d.jobs = append(d.jobs, jobState{Job: job, Interval: every, NextRun: now.Add(every)})
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Categories)) {
+		if every := config.ScrubInterval(cfg.Categories[name]); every > 0 {
+			d.jobs = append(d.jobs, scrubJob(cfg, name, every, now))
+		}
+	}
+	return d
+}
+
+// scrubJob schedules the scrubs of a category from the last one, so that
+// restarting the daemon doesn't put them off. A category never scrubbed is
+// first scrubbed one interval after startup, like any other job, rather than
+// reading both trees in full while the daemon starts.
+func scrubJob(cfg *config.Config, name string, every time.Duration, now time.Time) jobState {
+	j := jobState{Job: config.Job{Category: name, Direction: "scrub", Every: cfg.Categories[name].Scrub}, Interval: every, NextRun: now.Add(every)}
+	if last, err := readScrub(cfg, name); err == nil && !last.Started.IsZero() {
+		j.LastRun = last.Started
+		j.NextRun = now
+		if next := last.Started.Add(every); next.After(now) {
+			j.NextRun = next
+		}
+	}
+	return j
+}
+
+// daemonSocket is the control socket path, ~/.belterlink/daemon.sock unless
+// daemon.socket is set.
+func daemonSocket(cfg *config.Config) string {
+	if cfg.Daemon.Socket != "" {
+		return cfg.Daemon.Socket
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "belterlink-daemon.sock")
+	}
+	return filepath.Join(home, ".belterlink", "daemon.sock")
+}
+
+// listenPrivate listens on the Unix socket sock, which only the user can
+// connect to from the moment it exists: the umask is 077 while it's created,
+// rather than the socket being chmodded after others could already connect.
+// The jobs don't run yet, so no other file is created meanwhile.
+func listenPrivate(sock string) (net.Listener, error) {
+	old := syscall.Umask(0o077)
+	ln, err := net.Listen("unix", sock)
+	syscall.Umask(old)
+	return ln, err
+}
+
+// removeStaleSocket deletes a socket left behind by a daemon that died, but
+// refuses to start a second daemon next to a live one.
+func removeStaleSocket(sock string) error {
+	if _, err := os.Stat(sock); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", sock)
+	}
+	return os.Remove(sock)
+}
+
+// schedule starts due jobs, and retries the runs that found the remote
+// unreachable, once a second until stop is closed. Jobs that come due while
+// paused are skipped, not queued.
+func (d *daemon) schedule(stop <-chan struct{}) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			for _, i := range d.dueJobs(now) {
+				job := d.jobs[i].Job
+				d.runJob(job.Category, job.Direction, true)
+			}
+			for _, r := range d.dueRetries(now) {
+				d.runJob(r.Category, r.Direction, true)
+			}
+		}
+	}
+}
+
+// dueJobs returns the jobs whose time has come and moves their next run on.
+func (d *daemon) dueJobs(now time.Time) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var due []int
+	for i := range d.jobs {
+		j := &d.jobs[i]
+		if now.Before(j.NextRun) {
+			continue
+		}
+		j.NextRun = now.Add(j.Interval)
+		if d.paused {
+			continue
+		}
+		j.LastRun = now
+		due = append(due, i)
+	}
+	return due
+}
+
+// runJob queues every category selected by pattern and syncs them one after
+// the other. Scheduled runs skip the categories that are paused or whose
+// sync_window or not_on holds them back; requested ones don't. Runs removed
+// from the queue meanwhile are dropped, and so is the rest of the job once
+// the daemon stops.
+func (d *daemon) runJob(pattern, direction string, scheduled bool) error {
+	names, err := config.SelectCategories(d.cfg, []string{pattern})
+	if err != nil {
+		logger.Warn("daemon job skipped", "category", pattern, "error", err)
+		return err
+	}
+	ids := make([]int, len(names))
+	for i, name := range names {
+		ids[i] = d.enqueue(name, direction, scheduled)
+	}
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+	for i, name := range names {
+		if d.ctx.Err() != nil {
+			break // stopping: the rest of the job never starts
+		}
+		if !d.dequeue(ids[i]) {
+			continue
+		}
+		if scheduled {
+			if reason := d.holdReason(name, time.Now()); reason != "" {
+				logger.Info("daemon run held back", "category", name, "direction", direction, "reason", reason)
+				continue
+			}
+		}
+		d.setRunning(name + " " + direction)
+		sum, err := d.run(name, direction)
+		d.record(sum)
+		d.noteOutcome(name, direction, err, time.Now())
+	}
+	d.setRunning("")
+	return nil
+}
+
+func (d *daemon) enqueue(name, direction string, scheduled bool) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextQueuedID++
+	d.queue = append(d.queue, queuedRun{ID: d.nextQueuedID, Category: name, Direction: direction, Scheduled: scheduled, Since: time.Now()})
+	return d.nextQueuedID
+}
+
+// dequeue takes a run off the queue when it starts; false means it was
+// cleared while waiting.
+func (d *daemon) dequeue(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.IndexFunc(d.queue, func(q queuedRun) bool { return q.ID == id })
+	if i < 0 {
+		return false
+	}
+	d.queue = slices.Delete(d.queue, i, i+1)
+	return true
+}
+
+// clearQueue drops the waiting runs, all of them or those of the given
+// categories, and returns how many it dropped. Runs waiting for the remote
+// to become reachable again count as waiting.
+func (d *daemon) clearQueue(names []string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.queue) + len(d.offline)
+	d.queue = slices.DeleteFunc(d.queue, func(q queuedRun) bool {
+		return names == nil || slices.Contains(names, q.Category)
+	})
+	maps.DeleteFunc(d.offline, func(_ string, r offlineRun) bool {
+		return names == nil || slices.Contains(names, r.Category)
+	})
+	return n - len(d.queue) - len(d.offline)
+}
+
+// holdReason tells why the scheduler must not sync the category at now, or
+// returns "" if it may.
+func (d *daemon) holdReason(name string, now time.Time) string {
+	d.mu.Lock()
+	paused := d.pausedCats[name]
+	d.mu.Unlock()
+	if paused {
+		return "paused"
+	}
+	cat := d.cfg.Categories[name]
+	if cat.SyncWindow != "" {
+		w, _ := config.ParseWindow(cat.SyncWindow) // validated by config.Load
+		if !w.Contains(now) {
+			return "outside sync_window " + cat.SyncWindow
+		}
+	}
+	if slices.Contains(cat.NotOn, "metered") && d.metered() {
+		return "on a metered connection"
+	}
+	return ""
+}
+
+func (d *daemon) setRunning(what string) {
+	d.mu.Lock()
+	d.running = what
+	d.mu.Unlock()
+}
+
+func (d *daemon) record(sum RunSummary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.history = append(d.history, sum)
+	if len(d.history) > historySize {
+		d.history = slices.Delete(d.history, 0, len(d.history)-historySize)
+	}
+}
+
+// handler serves the control API:
+//
+//	GET    /status                               scheduler state, queue and jobs
+//	GET    /history                              the last runs, newest last
+//	POST   /sync?category=<name>&direction=push  start a run (push, pull, sync or backup)
+//	POST   /pause, POST /resume                  stop or restart scheduled runs
+//	POST   /pause?category=<name>                ... of some categories only
+//	DELETE /queue[?category=<name>]              drop runs waiting to start
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		h := slices.Clone(d.history)
+		d.mu.Unlock()
+		if h == nil {
+			h = []RunSummary{}
+		}
+		writeJSON(w, http.StatusOK, h)
+	})
+	mux.HandleFunc("POST /sync", func(w http.ResponseWriter, r *http.Request) {
+		category, direction := r.FormValue("category"), r.FormValue("direction")
+		if !slices.Contains([]string{"push", "pull", "sync", "backup"}, direction) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "direction must be push, pull, sync or backup"})
+			return
+		}
+		if _, err := config.SelectCategories(d.cfg, []string{category}); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		go d.runJob(category, direction, false)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+	})
+	for _, route := range []struct {
+		path   string
+		paused bool
+	}{{"POST /pause", true}, {"POST /resume", false}} {
+		mux.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
+			names, ok := d.selectCategories(w, r)
+			if !ok {
+				return
+			}
+			if names == nil {
+				d.setPaused(route.paused)
+			} else {
+				d.setCategoriesPaused(names, route.paused)
+			}
+			writeJSON(w, http.StatusOK, d.status())
+		})
+	}
+	mux.HandleFunc("DELETE /queue", func(w http.ResponseWriter, r *http.Request) {
+		names, ok := d.selectCategories(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": d.clearQueue(names)})
+	})
+	return mux
+}
+
+// selectCategories resolves the request's category parameter; nil means
+// there was none. It answers the request itself when the name is unknown.
+func (d *daemon) selectCategories(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	pattern := r.FormValue("category")
+	if pattern == "" {
+		return nil, true
+	}
+	names, err := config.SelectCategories(d.cfg, []string{pattern})
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	return names, true
+}
+
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return daemonStatus{
+		Paused:           d.paused,
+		PausedCategories: slices.Sorted(maps.Keys(d.pausedCats)),
+		Running:          d.running,
+		Queue:            slices.Clone(d.queue),
+		Offline:          slices.SortedFunc(maps.Values(d.offline), func(a, b offlineRun) int { return a.Since.Compare(b.Since) }),
+		Jobs:             slices.Clone(d.jobs),
+	}
+}
+
+// setPaused stops or restarts all scheduled runs. Resuming also resumes the
+// categories paused one by one.
+func (d *daemon) setPaused(paused bool) {
+	d.mu.Lock()
+	d.paused = paused
+	if !paused {
+		clear(d.pausedCats)
+	}
+	d.mu.Unlock()
+	logger.Info("daemon scheduler", "paused", paused)
+}
+
+func (d *daemon) setCategoriesPaused(names []string, paused bool) {
+	d.mu.Lock()
+	for _, name := range names {
+		if paused {
+			d.pausedCats[name] = true
+		} else {
+			delete(d.pausedCats, name)
+		}
+	}
+	d.mu.Unlock()
+	logger.Info("daemon categories", "categories", names, "paused", paused)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func testDaemon(ran chan<- string) *daemon {
+	cfg := &config.Config{
+		Categories: map[string]config.Category{"Notes": {}, "Piano": {}},
+		Groups:     map[string][]string{"vault": {"Notes", "Piano"}},
+		Daemon:     config.Daemon{Jobs: []config.Job{{Category: "Notes", Direction: "push", Every: "15m"}}},
+	}
+	return newDaemon(context.Background(), cfg, func(name, direction string) (RunSummary, error) {
+		ran <- name + " " + direction
+		return RunSummary{Category: name, Direction: direction, Status: "success"}, nil
+	})
+}
+
+func TestDaemonAPI(t *testing.T) {
+	ran := make(chan string, 4)
+	d := testDaemon(ran)
+	h := d.handler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	if rec := do("POST", "/sync?category=vault&direction=pull"); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /sync = %d %s", rec.Code, rec.Body)
+	}
+	for _, want := range []string{"Notes pull", "Piano pull"} {
+		select {
+		case got := <-ran:
+			if got != want {
+				t.Fatalf("ran %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s never ran", want)
+		}
+	}
+	if rec := do("POST", "/sync?category=Nope&direction=push"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown category = %d", rec.Code)
+	}
+	if rec := do("POST", "/sync?category=Notes&direction=sideways"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad direction = %d", rec.Code)
+	}
+
+	do("POST", "/pause")
+	var st daemonStatus
+	if err := json.Unmarshal(do("GET", "/status").Body.Bytes(), &st); err != nil || !st.Paused || len(st.Jobs) != 1 {
+		t.Fatalf("status = %+v (%v)", st, err)
+	}
+	do("POST", "/resume")
+
+	// the history is recorded after each run returns
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var hist []RunSummary
+		json.Unmarshal(do("GET", "/history").Body.Bytes(), &hist)
+		if len(hist) == 2 && hist[1].Category == "Piano" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history = %+v", hist)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonDueJobs(t *testing.T) {
+	d := testDaemon(make(chan string, 1))
+	next := d.jobs[0].NextRun
+	if due := d.dueJobs(next.Add(-time.Second)); len(due) != 0 {
+		t.Fatalf("job due early: %v", due)
+	}
+	if due := d.dueJobs(next); len(due) != 1 || !d.jobs[0].NextRun.Equal(next.Add(15*time.Minute)) {
+		t.Fatalf("due = %v, next run %v", due, d.jobs[0].NextRun)
+	}
+	d.setPaused(true)
+	if due := d.dueJobs(next.Add(15 * time.Minute)); len(due) != 0 {
+		t.Fatalf("job ran while paused: %v", due)
+	}
+	if !d.jobs[0].NextRun.Equal(next.Add(30 * time.Minute)) {
+		t.Fatalf("paused job not rescheduled: %v", d.jobs[0].NextRun)
+	}
+}
+
+func TestDaemonHoldReason(t *testing.T) {
+	d := testDaemon(make(chan string, 1))
+	metered := false
+	d.metered = func() bool { return metered }
+	d.cfg.Categories["Notes"] = config.Category{SyncWindow: "22:00-07:00", NotOn: []string{"metered"}}
+	night := time.Date(2024, 5, 1, 23, 30, 0, 0, time.Local)
+	if r := d.holdReason("Notes", night); r != "" {
+		t.Fatalf("held back at night: %s", r)
+	}
+	if r := d.holdReason("Notes", night.Add(12*time.Hour)); r == "" {
+		t.Fatal("ran outside the window")
+	}
+	metered = true
+	if r := d.holdReason("Notes", night); r == "" {
+		t.Fatal("ran on a metered connection")
+	}
+}
+
+func TestDaemonPauseCategoryAndQueue(t *testing.T) {
+	ran := make(chan string, 4)
+	d := testDaemon(ran)
+	h := d.handler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	var st daemonStatus
+	json.Unmarshal(do("POST", "/pause?category=Notes").Body.Bytes(), &st)
+	if st.Paused || len(st.PausedCategories) != 1 || st.PausedCategories[0] != "Notes" {
+		t.Fatalf("status after pausing Notes = %+v", st)
+	}
+	if r := d.holdReason("Notes", time.Now()); r != "paused" {
+		t.Fatalf("hold reason = %q, want paused", r)
+	}
+	d.runJob("vault", "push", true)
+	if got := <-ran; got != "Piano push" || len(ran) != 0 {
+		t.Fatalf("scheduled run of a paused category: %q", got)
+	}
+	if rec := do("POST", "/resume?category=Nope"); rec.Code != http.StatusNotFound {
+		t.Fatalf("resume of an unknown category = %d", rec.Code)
+	}
+	do("POST", "/resume")
+	if r := d.holdReason("Notes", time.Now()); r != "" {
+		t.Fatalf("still held back after resume: %s", r)
+	}
+
+	// runs wait behind the current one and can be dropped meanwhile
+	d.runMu.Lock()
+	done := make(chan struct{})
+	go func() { d.runJob("vault", "pull", false); close(done) }()
+	for len(d.status().Queue) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	var cleared map[string]int
+	json.Unmarshal(do("DELETE", "/queue?category=Piano").Body.Bytes(), &cleared)
+	if cleared["cleared"] != 1 {
+		t.Fatalf("cleared = %v", cleared)
+	}
+	d.runMu.Unlock()
+	<-done
+	if got := <-ran; got != "Notes pull" || len(ran) != 0 {
+		t.Fatalf("ran %q after clearing Piano", got)
+	}
+}
+
+func TestDaemonStopDropsRestOfJob(t *testing.T) {
+	ran := make(chan string, 4)
+	d := testDaemon(ran)
+	ctx, stop := context.WithCancel(context.Background())
+	d.ctx = ctx
+	d.run = func(name, direction string) (RunSummary, error) {
+		ran <- name + " " + direction
+		stop() // as on SIGTERM during the run
+		return RunSummary{Category: name, Direction: direction, Status: "aborted"}, ctx.Err()
+	}
+	d.runJob("vault", "push", true)
+	if got := <-ran; got != "Notes push" || len(ran) != 0 {
+		t.Fatalf("ran %q and %d more after the daemon stopped", got, len(ran))
+	}
+}
+
+func TestDaemonOfflineRetry(t *testing.T) {
+	ran := make(chan string, 8)
+	d := testDaemon(ran)
+	online := false
+	network := "192.168.1.20/24"
+	d.network = func() string { return network }
+	d.run = func(name, direction string) (RunSummary, error) {
+		ran <- name + " " + direction
+		if !online {
+			return RunSummary{}, exitErrorf(exitNetwork, "ssh: connect to host mymac.local: No route to host")
+		}
+		return RunSummary{Category: name, Direction: direction, Status: "success"}, nil
+	}
+
+	start := time.Now()
+	d.dueRetries(start)
+	d.runJob("Notes", "push", true)
+	<-ran
+	st := d.status()
+	if len(st.Offline) != 1 || st.Offline[0].Attempts != 1 || !st.Offline[0].NextTry.After(start) {
+		t.Fatalf("offline after a failed run = %+v", st.Offline)
+	}
+	if due := d.dueRetries(start.Add(time.Second)); len(due) != 0 {
+		t.Fatalf("retried before the backoff: %+v", due)
+	}
+	if due := d.dueRetries(start.Add(firstBackoff + time.Second)); len(due) != 1 {
+		t.Fatalf("not retried after the backoff: %+v", due)
+	}
+	d.runJob("Notes", "push", true)
+	<-ran
+	if r := d.status().Offline[0]; r.Attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", r.Attempts)
+	}
+
+	// a new network address makes the run due at once
+	network = "10.0.0.5/24"
+	online = true
+	due := d.dueRetries(start.Add(firstBackoff + 2*time.Second))
+	if len(due) != 1 {
+		t.Fatalf("not retried when the network changed: %+v", due)
+	}
+	d.runJob(due[0].Category, due[0].Direction, true)
+	if got := <-ran; got != "Notes push" {
+		t.Fatalf("ran %q", got)
+	}
+	if st := d.status(); len(st.Offline) != 0 {
+		t.Fatalf("offline after a successful run = %+v", st.Offline)
+	}
+
+	// other failures and run timeouts aren't retried
+	online = false
+	d.noteOutcome("Piano", "pull", withExitCode(exitNetwork, runTimeoutError{time.Hour}), time.Now())
+	d.noteOutcome("Piano", "push", exitErrorf(exitRefused, "max_delete"), time.Now())
+	if st := d.status(); len(st.Offline) != 0 {
+		t.Fatalf("offline = %+v", st.Offline)
+	}
+}
+
+func TestDaemonBackoff(t *testing.T) {
+	d := testDaemon(nil)
+	d.cfg.Daemon.MaxBackoff = "5m"
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 5: 5 * time.Minute, 40: 5 * time.Minute} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestScrubJob(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir(), Categories: map[string]config.Category{"Notes": {Scrub: "weekly"}}}
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	if j := scrubJob(cfg, "Notes", 7*24*time.Hour, now); !j.NextRun.Equal(now.Add(7*24*time.Hour)) || j.Direction != "scrub" {
+		t.Fatalf("never scrubbed: %+v, want a scrub a week after startup", j)
+	}
+	last := scrubResult{RunSummary: RunSummary{Category: "Notes", Direction: "scrub", Started: now.Add(-48 * time.Hour)}}
+	b, _ := json.Marshal(last)
+	if err := writeFileAtomic(scrubPath(cfg, "Notes"), b); err != nil {
+		t.Fatal(err)
+	}
+	if j := scrubJob(cfg, "Notes", 7*24*time.Hour, now); !j.NextRun.Equal(now.Add(5 * 24 * time.Hour)) {
+		t.Fatalf("next scrub %v, want a week after the last one", j.NextRun)
+	}
+	if j := scrubJob(cfg, "Notes", 24*time.Hour, now); !j.NextRun.Equal(now) {
+		t.Fatalf("overdue scrub %v, want now", j.NextRun)
+	}
+}
+
+func TestListenPrivate(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "daemon.sock")
+	ln, err := listenPrivate(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	st, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := st.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("socket created with mode %v, want no access for group and others", perm)
+	}
+}
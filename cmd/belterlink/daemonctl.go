@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// runPauseCommand implements "belterlink pause [Category...]" and
+// "belterlink resume [Category...]": without categories the whole scheduler
+// is paused or resumed.
+func runPauseCommand(g *globals, args []string, pause bool) error {
+	name := "resume"
+	if pause {
+		name = "pause"
+	}
+	flags := newFlagSet(name)
+	g.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	path := "/resume"
+	if pause {
+		path = "/pause"
+	}
+	var st daemonStatus
+	if len(args) == 0 {
+		if err := daemonRequest(cfg, "POST", path, nil, &st); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range args {
+		if err := daemonRequest(cfg, "POST", path, url.Values{"category": {pattern}}, &st); err != nil {
+			return err
+		}
+	}
+	printDaemonState(st)
+	return nil
+}
+
+// runQueueCommand implements "belterlink queue", which shows the run in
+// progress and the ones waiting, and "belterlink queue clear [Category...]".
+func runQueueCommand(g *globals, args []string) error {
+	flags := newFlagSet("queue")
+	g.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	if len(args) > 0 && args[0] == "clear" {
+		patterns := args[1:]
+		if len(patterns) == 0 {
+			patterns = []string{""}
+		}
+		total := 0
+		for _, pattern := range patterns {
+			var resp map[string]int
+			var q url.Values
+			if pattern != "" {
+				q = url.Values{"category": {pattern}}
+			}
+			if err := daemonRequest(cfg, "DELETE", "/queue", q, &resp); err != nil {
+				return err
+			}
+			total += resp["cleared"]
+		}
+		fmt.Printf("Dropped %d queued run(s)\n", total)
+		return nil
+	}
+	if len(args) > 0 {
+		return exitErrorf(exitUsage, "usage: belterlink queue [clear [CategoryName...]]")
+	}
+	var st daemonStatus
+	if err := daemonRequest(cfg, "GET", "/status", nil, &st); err != nil {
+		return err
+	}
+	printDaemonState(st)
+	return nil
+}
+
+func printDaemonState(st daemonStatus) {
+	switch {
+	case st.Paused:
+		fmt.Println("Scheduler: paused")
+	case len(st.PausedCategories) > 0:
+		fmt.Println("Scheduler: running; paused:", strings.Join(st.PausedCategories, ", "))
+	default:
+		fmt.Println("Scheduler: running")
+	}
+	if st.Running != "" {
+		fmt.Println("Now syncing:", st.Running)
+	}
+	for _, r := range st.Offline {
+		fmt.Printf("Remote unreachable: %s %s, offline %s, %d attempt(s), next try in %s\n", r.Category, r.Direction,
+			time.Since(r.Since).Round(time.Second), r.Attempts, max(time.Until(r.NextTry), 0).Round(time.Second))
+	}
+	if len(st.Queue) == 0 {
+		fmt.Println("Queue: empty")
+		return
+	}
+	fmt.Println("Queue:")
+	for _, q := range st.Queue {
+		origin := "requested"
+		if q.Scheduled {
+			origin = "scheduled"
+		}
+		fmt.Printf("  %-20s %-5s %s, waiting %s\n", q.Category, q.Direction, origin, time.Since(q.Since).Round(time.Second))
+	}
+}
+
+// daemonRequest calls the control API of the running daemon and decodes its
+// JSON answer into out.
+func daemonRequest(cfg *config.Config, method, path string, query url.Values, out any) error {
+	sock := daemonSocket(cfg)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}},
+	}
+	u := url.URL{Scheme: "http", Host: "belterlink", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return exitErrorf(exitFailure, "no daemon listening on %s (start it with belterlink daemon): %v", sock, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e map[string]string
+		json.NewDecoder(resp.Body).Decode(&e)
+		code := exitFailure
+		if resp.StatusCode == http.StatusNotFound {
+			code = exitConfig
+		}
+		return exitErrorf(code, "daemon: %s", e["error"])
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+const (
+	// diffMaxSize is the largest file -diff compares; bigger ones are listed
+	// without their changes.
+	diffMaxSize = 256 << 10
+	// diffContext is the number of unchanged lines around each change.
+	diffContext = 3
+)
+
+// printDryRunDiff implements -dry-run -diff: for every text file the run
+// would create, change or delete, a unified diff from the receiving side's
+// version to the sending side's. Remote versions are fetched into a
+// temporary directory.
+func printDryRunDiff(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions, rsArgs []string) error {
+	diffs, err := itemizedDryRun(ctx, cfg, opts.Options, rsArgs, false)
+	if err != nil {
+		return err
+	}
+	var files, onRemote []string
+	for _, d := range diffs {
+		if d.Kind == "metadata" || strings.HasSuffix(d.Path, "/") {
+			continue
+		}
+		files = append(files, d.Path)
+		if d.Kind != "local-only" {
+			onRemote = append(onRemote, d.Path)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	tmp, err := os.MkdirTemp("", "belterlink-diff-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	remote := map[string]rsync.Entry{}
+	if len(onRemote) > 0 {
+		if remote, err = listRemoteFiles(ctx, cfg, cat, onRemote); err != nil {
+			return err
+		}
+		var fetch []string
+		for rel, e := range remote {
+			if e.Size <= diffMaxSize {
+				fetch = append(fetch, rel)
+			}
+		}
+		if len(fetch) > 0 {
+			if err := fetchRemoteFiles(ctx, cfg, cat, fetch, tmp); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, rel := range files {
+		local, err := readDiffSide(filepath.Join(cat.Local, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		var rem diffSide
+		if e, ok := remote[rel]; ok && e.Size > diffMaxSize {
+			rem = diffSide{exists: true, tooLarge: true}
+		} else if ok {
+			if rem, err = readDiffSide(filepath.Join(tmp, filepath.FromSlash(rel))); err != nil {
+				return err
+			}
+		}
+		oldSide, newSide := rem, local
+		oldName, newName := "remote/"+rel, "local/"+rel
+		if opts.Direction == "pull" {
+			oldSide, newSide = local, rem
+			oldName, newName = newName, oldName
+		}
+		fmt.Print(formatDiff(oldName, newName, oldSide, newSide))
+	}
+	return nil
+}
+
+// diffSide is one side's version of a file for -diff.
+type diffSide struct {
+	exists   bool
+	tooLarge bool
+	binary   bool
+	text     string
+}
+
+// readDiffSide reads p; a missing file is a side that doesn't exist.
+func readDiffSide(p string) (diffSide, error) {
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return diffSide{}, nil
+	} else if err != nil {
+		return diffSide{}, err
+	}
+	s := diffSide{exists: true}
+	if !info.Mode().IsRegular() {
+		s.binary = true
+		return s, nil
+	}
+	if info.Size() > diffMaxSize {
+		s.tooLarge = true
+		return s, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return diffSide{}, err
+	}
+	s.binary = isBinary(b)
+	s.text = string(b)
+	return s, nil
+}
+
+// isBinary guesses the way diff does: a NUL byte, or bytes that aren't
+// UTF-8.
+func isBinary(b []byte) bool {
+	return bytes.IndexByte(b, 0) >= 0 || !utf8.Valid(b)
+}
+
+// formatDiff is the unified diff from old to new, or a one-line note when
+// either side can't be shown.
+func formatDiff(oldName, newName string, old, cur diffSide) string {
+	switch {
+	case old.tooLarge || cur.tooLarge:
+		return fmt.Sprintf("Files %s and %s differ (larger than %dK, not compared)\n", oldName, newName, diffMaxSize>>10)
+	case old.binary || cur.binary:
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName)
+	}
+	if !old.exists {
+		oldName = "/dev/null"
+	}
+	if !cur.exists {
+		newName = "/dev/null"
+	}
+	hunks := unifiedDiff(splitLines(old.text), splitLines(cur.text))
+	if hunks == "" {
+		return ""
+	}
+	return "--- " + oldName + "\n+++ " + newName + "\n" + hunks
+}
+
+// unifiedDiff returns the hunks turning a into b, with diffContext lines of
+// context.
+func unifiedDiff(a, b []string) string {
+	// the common prefix and suffix are cheap to find and keep the
+	// quadratic LCS small for the usual edit in a long note
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	match := lcsMatch(a[pre:len(a)-suf], b[pre:len(b)-suf])
+
+	type op struct {
+		kind byte // ' ', '-' or '+'
+		ai   int  // line in a (' ', '-')
+		bi   int  // line in b (' ', '+')
+	}
+	var ops []op
+	for i := range pre {
+		ops = append(ops, op{' ', i, i})
+	}
+	j := pre
+	for i, m := range match {
+		if m < 0 {
+			ops = append(ops, op{'-', pre + i, j})
+			continue
+		}
+		for ; j < pre+m; j++ {
+			ops = append(ops, op{'+', pre + i, j})
+		}
+		ops = append(ops, op{' ', pre + i, j})
+		j++
+	}
+	for ; j < len(b)-suf; j++ {
+		ops = append(ops, op{'+', len(a) - suf, j})
+	}
+	for k := range suf {
+		ops = append(ops, op{' ', len(a) - suf + k, len(b) - suf + k})
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// extend the hunk while the next change is close enough for the
+		// contexts to touch
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		from, to := max(0, start-diffContext), min(len(ops), end+diffContext)
+		aStart, bStart, aLen, bLen := -1, -1, 0, 0
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+			if aStart < 0 {
+				aStart, bStart = o.ai, o.bi
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, o := range ops[from:to] {
+			var line string
+			if o.kind == '+' {
+				line = b[o.bi]
+			} else {
+				line = a[o.ai]
+			}
+			out.WriteByte(o.kind)
+			out.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// hunkRange formats a hunk's start line and length the way diff -u does;
+// an empty range names the line before it.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
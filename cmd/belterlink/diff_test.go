@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "# Ideas\n\none\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	cur := "# Ideas\n\none\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven"
+	want := `@@ -1,7 +1,7 @@
+ # Ideas
+ 
+ one
+-two
++2
+ three
+ four
+ five
+@@ -10,3 +10,4 @@
+ eight
+ nine
+ ten
++eleven
+\ No newline at end of file
+`
+	if got := unifiedDiff(splitLines(old), splitLines(cur)); got != want {
+		t.Fatalf("unifiedDiff =\n%s\nwant\n%s", got, want)
+	}
+	if got := unifiedDiff(splitLines(old), splitLines(old)); got != "" {
+		t.Fatalf("diff of equal texts = %q", got)
+	}
+}
+
+func TestFormatDiff(t *testing.T) {
+	created := formatDiff("remote/new.md", "local/new.md", diffSide{}, diffSide{exists: true, text: "hello\n"})
+	if want := "--- /dev/null\n+++ local/new.md\n@@ -0,0 +1 @@\n+hello\n"; created != want {
+		t.Fatalf("new file diff = %q, want %q", created, want)
+	}
+	binary := formatDiff("remote/a.png", "local/a.png", diffSide{exists: true, binary: true}, diffSide{exists: true, text: "x"})
+	if !strings.HasPrefix(binary, "Binary files") {
+		t.Fatalf("binary diff = %q", binary)
+	}
+	if !isBinary([]byte("PNG\x00\x01")) || isBinary([]byte("Grüße\n")) {
+		t.Fatal("isBinary misclassifies")
+	}
+}
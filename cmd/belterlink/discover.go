@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/mdns"
+)
+
+const discoverUsage = "usage: belterlink discover [-timeout 3s]"
+
+// discoverFlags are the flags of "discover".
+type discoverFlags struct {
+	timeout time.Duration
+}
+
+func (f *discoverFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&f.timeout, "timeout", 3*time.Second, "how long to listen for answers")
+}
+
+// runDiscoverCommand implements "belterlink discover": the SSH servers that
+// announce themselves on the local network (Macs with Remote Login on), for
+// users who don't know their Mac's host name or whose address keeps
+// changing. The config is optional; if it loads, its ssh.host is marked.
+func runDiscoverCommand(g *globals, args []string) error {
+	flags := newFlagSet("discover")
+	g.register(flags)
+	var f discoverFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 0 || f.timeout <= 0 {
+		return withExitCode(exitUsage, errors.New(discoverUsage))
+	}
+	var configured string
+	if cfg, err := config.Load(g.cfgPath); err == nil {
+		configured = cfg.SSH.Host
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	fmt.Printf("Looking for SSH hosts on the local network (%s)...\n", f.timeout)
+	found, err := mdns.Browse(ctx, mdns.SSH)
+	if err != nil {
+		return exitErrorf(exitNetwork, "discover: %v", err)
+	}
+	printDiscovered(os.Stdout, found, configured)
+	return nil
+}
+
+// printDiscovered lists the hosts found, marking the configured one, and
+// shows how to use one.
+func printDiscovered(w io.Writer, found []mdns.Service, configured string) {
+	if len(found) == 0 {
+		fmt.Fprintln(w, "No SSH hosts answered. On the Mac, turn on Remote Login (System Settings > General > Sharing),")
+		fmt.Fprintln(w, "and check both machines are on the same network; some guest and office Wi-Fi blocks multicast.")
+		return
+	}
+	fmt.Fprintf(w, "Found %d SSH host(s):\n", len(found))
+	for _, s := range found {
+		host := s.Host
+		if host == "" {
+			host = "?"
+		}
+		var addrs []string
+		for _, ip := range s.Addrs {
+			addrs = append(addrs, ip.String())
+		}
+		line := fmt.Sprintf("  %-24s %-32s %s", host, strings.Join(addrs, ", "), s.Instance)
+		if s.Port != 0 && s.Port != 22 {
+			line += fmt.Sprintf(" (port %d)", s.Port)
+		}
+		if configured != "" && (strings.EqualFold(configured, host) || slices.Contains(addrs, configured)) {
+			line += "  <- ssh.host"
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	for _, s := range found {
+		if s.Host == "" {
+			continue
+		}
+		fmt.Fprintln(w, "\nPut one under ssh in config.yaml; the .local name keeps working when the address changes:")
+		fmt.Fprintf(w, "  ssh:\n    host: %s\n", s.Host)
+		if s.Port != 0 && s.Port != 22 {
+			fmt.Fprintf(w, "    port: %d\n", s.Port)
+		}
+		return
+	}
+}
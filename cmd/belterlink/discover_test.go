@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/mdns"
+)
+
+func TestPrintDiscovered(t *testing.T) {
+	found := []mdns.Service{
+		{Instance: "Anna's MacBook Pro", Host: "annas-mbp.local", Port: 22, Addrs: []net.IP{net.IPv4(192, 168, 1, 50)}},
+		{Instance: "nas", Host: "nas.local", Port: 2222, Addrs: []net.IP{net.IPv4(192, 168, 1, 10)}},
+	}
+	var out bytes.Buffer
+	printDiscovered(&out, found, "192.168.1.50")
+	got := out.String()
+	for _, want := range []string{
+		"Found 2 SSH host(s)",
+		"annas-mbp.local          192.168.1.50                     Anna's MacBook Pro  <- ssh.host\n",
+		"nas.local                192.168.1.10                     nas (port 2222)\n",
+		"    host: annas-mbp.local\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, got)
+		}
+	}
+
+	out.Reset()
+	printDiscovered(&out, nil, "")
+	if !strings.Contains(out.String(), "Remote Login") {
+		t.Errorf("no hint when nothing answered:\n%s", out.String())
+	}
+}
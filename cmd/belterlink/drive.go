@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// mountEntry is a line of mount's output: a device and where it's mounted.
+type mountEntry struct {
+	device, dir string
+}
+
+// driveMountpoint finds where the drive named by a category's drive setting
+// is mounted right now. On Linux udev links the device under /dev/disk by
+// UUID and label; on macOS diskutil reports them for each mounted volume.
+func driveMountpoint(spec string) (string, error) {
+	kind, value, err := config.ParseDrive(spec)
+	if err != nil {
+		return "", withExitCode(exitConfig, err)
+	}
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return "", exitErrorf(exitRefused, "list mounted filesystems: %v", err)
+	}
+	mounts := parseMountEntries(strings.Split(string(out), "\n"))
+	if runtime.GOOS == "darwin" {
+		if dir, ok := volumeMountpoint(kind, value, mounts); ok {
+			return dir, nil
+		}
+		return "", exitErrorf(exitRefused, "drive %s is not plugged in (no mounted volume has that %s)", spec, strings.ToLower(kind))
+	}
+	dev, ok := udevDevice("/dev/disk", kind, value)
+	if !ok {
+		return "", exitErrorf(exitRefused, "drive %s is not plugged in", spec)
+	}
+	if dir, ok := deviceMountpoint(dev, mounts); ok {
+		return dir, nil
+	}
+	return "", exitErrorf(exitRefused, "drive %s is plugged in as %s but not mounted; mount it (udisksctl mount -b %s) and try again", spec, dev, dev)
+}
+
+// parseMountEntries reads mount's output, in the "dev on /dir type t (...)"
+// form of Linux and the "dev on /dir (t, ...)" form of macOS.
+func parseMountEntries(lines []string) []mountEntry {
+	var mounts []mountEntry
+	for _, line := range lines {
+		dev, rest, ok := strings.Cut(line, " on ")
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(rest, " type "); i >= 0 {
+			rest = rest[:i]
+		} else if i := strings.LastIndex(rest, " ("); i >= 0 {
+			rest = rest[:i]
+		}
+		mounts = append(mounts, mountEntry{device: dev, dir: rest})
+	}
+	return mounts
+}
+
+// udevDevice resolves a UUID or label through udev's links in
+// devDir/by-uuid and devDir/by-label. UUIDs are compared ignoring case, as
+// FAT's are upper case there; labels have spaces and slashes escaped as \xNN.
+func udevDevice(devDir, kind, value string) (string, bool) {
+	dir := filepath.Join(devDir, "by-"+strings.ToLower(kind))
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		name := unescapeUdev(e.Name())
+		if name == value || kind == "UUID" && strings.EqualFold(name, value) {
+			dev, err := filepath.EvalSymlinks(filepath.Join(dir, e.Name()))
+			return dev, err == nil
+		}
+	}
+	return "", false
+}
+
+func unescapeUdev(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], `\x`) && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// deviceMountpoint is the first directory dev is mounted on, comparing
+// devices after symlinks (/dev/mapper names, /dev/disk links).
+func deviceMountpoint(dev string, mounts []mountEntry) (string, bool) {
+	for _, m := range mounts {
+		if d, err := filepath.EvalSymlinks(m.device); err == nil && d == dev {
+			return m.dir, true
+		}
+	}
+	return "", false
+}
+
+// volumeMountpoint asks diskutil about each volume mounted under /Volumes
+// for the one with the given UUID or name.
+func volumeMountpoint(kind, value string, mounts []mountEntry) (string, bool) {
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.dir, "/Volumes/") {
+			continue
+		}
+		out, err := exec.Command("diskutil", "info", m.dir).Output()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			key, val, _ := strings.Cut(line, ":")
+			key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+			switch {
+			case kind == "LABEL" && key == "Volume Name" && val == value,
+				kind == "UUID" && (key == "Volume UUID" || key == "Disk / Partition UUID") && strings.EqualFold(val, value):
+				return m.dir, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMountEntries(t *testing.T) {
+	got := parseMountEntries([]string{
+		"/dev/sdb1 on /media/me/Backup A type vfat (rw,nosuid,nodev)",
+		"/dev/disk4s1 on /Volumes/BACKUP (msdos, local, nodev, nosuid, noowners)",
+		"",
+	})
+	want := []mountEntry{{"/dev/sdb1", "/media/me/Backup A"}, {"/dev/disk4s1", "/Volumes/BACKUP"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseMountEntries = %v, want %v", got, want)
+	}
+}
+
+func TestUdevDevice(t *testing.T) {
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "sdb1")
+	if err := os.WriteFile(dev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"by-uuid/1234-ABCD", `by-label/Backup\x20A`} {
+		p := filepath.Join(dir, link)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../sdb1", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, _ := filepath.EvalSymlinks(dev)
+	for _, tc := range []struct{ kind, value string }{{"UUID", "1234-abcd"}, {"LABEL", "Backup A"}} {
+		if got, ok := udevDevice(dir, tc.kind, tc.value); !ok || got != want {
+			t.Errorf("udevDevice(%s=%s) = %q, %v; want %q", tc.kind, tc.value, got, ok, want)
+		}
+	}
+	if _, ok := udevDevice(dir, "LABEL", "Backup B"); ok {
+		t.Error("found a drive that isn't plugged in")
+	}
+
+	mounts := []mountEntry{{"/dev/sda1", "/"}, {dev, "/media/me/Backup A"}}
+	if got, ok := deviceMountpoint(want, mounts); !ok || got != "/media/me/Backup A" {
+		t.Errorf("deviceMountpoint = %q, %v", got, ok)
+	}
+	if _, ok := deviceMountpoint(want, mounts[:1]); ok {
+		t.Error("found a mountpoint for a drive that isn't mounted")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/agent"
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/crypt"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// encryptedMirror is where an encrypted category keeps the ciphertext of its
+// local tree. rsync transfers between the mirror and the remote, so the
+// remote never sees a plaintext name or byte.
+func encryptedMirror(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "encrypted", category)
+}
+
+// loadEncryptionKey reads the category's key file, or takes the passphrase
+// from the secret encryption_key names.
+func loadEncryptionKey(cfg *config.Config, cat config.Category) (*crypt.Key, error) {
+	if _, ok := config.SecretRef(cat.EncryptionKey); !ok {
+		return crypt.LoadKey(cat.EncryptionKey)
+	}
+	passphrase, err := resolveSecret(cfg, cat.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.PassphraseKey(passphrase)
+}
+
+// sealTree brings mirror in line with the plain tree: files changed since
+// they were last encrypted are encrypted again, with the plaintext's mtime so
+// rsync's quick check keeps working, and anything no longer in plain is
+// removed.
+func sealTree(key *crypt.Key, plain, mirror string, excludes *rsync.Matcher) error {
+	files, err := listLocal(plain, excludes)
+	if err != nil {
+		return err
+	}
+	want := map[string]bool{}
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		f := files[rel]
+		enc, err := key.EncryptPath(rel)
+		if err != nil {
+			return err
+		}
+		want[enc] = true
+		dst := filepath.Join(mirror, filepath.FromSlash(enc))
+		if f.Dir {
+			if err := os.MkdirAll(dst, 0o700); err != nil {
+				return err
+			}
+			continue
+		}
+		if sameFile(dst, crypt.EncryptedSize(f.Size), f.ModTime) {
+			continue
+		}
+		if err := transformFile(filepath.Join(plain, filepath.FromSlash(rel)), dst, 0o600, f.ModTime, key.Encrypt); err != nil {
+			return fmt.Errorf("encrypt %s: %w", rel, err)
+		}
+	}
+	if err := os.MkdirAll(mirror, 0o700); err != nil {
+		return err
+	}
+	enc, err := listLocal(mirror, noExcludes())
+	if err != nil {
+		return err
+	}
+	return removeUnlisted(mirror, enc, want)
+}
+
+// openTree decrypts the files in mirror that differ from the plain tree into
+// it. With del, files in plain that aren't in the mirror are deleted, except
+// for excluded ones.
+func openTree(key *crypt.Key, mirror, plain string, excludes *rsync.Matcher, del bool) error {
+	enc, err := listLocal(mirror, noExcludes())
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	for _, erel := range slices.Sorted(maps.Keys(enc)) {
+		f := enc[erel]
+		rel, err := key.DecryptPath(erel)
+		if err != nil {
+			return fmt.Errorf("%s: %w (was it encrypted with another key?)", mirror, err)
+		}
+		if excludedWithParents(excludes, rel, f.Dir) {
+			continue
+		}
+		kept[rel] = true
+		dst := filepath.Join(plain, filepath.FromSlash(rel))
+		if f.Dir {
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if sameFile(dst, crypt.DecryptedSize(f.Size), f.ModTime) {
+			continue
+		}
+		perm := os.FileMode(0o644)
+		if info, err := os.Stat(dst); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := transformFile(filepath.Join(mirror, filepath.FromSlash(erel)), dst, perm, f.ModTime, key.Decrypt); err != nil {
+			return fmt.Errorf("decrypt %s: %w", rel, err)
+		}
+	}
+	if !del {
+		return nil
+	}
+	local, err := listLocal(plain, excludes)
+	if err != nil {
+		return err
+	}
+	return removeUnlisted(plain, local, kept)
+}
+
+func noExcludes() *rsync.Matcher {
+	m, _ := rsync.NewMatcher(nil)
+	return m
+}
+
+// sameFile reports whether p has the given size and mtime, to the second as
+// rsync compares them.
+func sameFile(p string, size int64, mtime time.Time) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size && info.ModTime().Unix() == mtime.Unix()
+}
+
+// transformFile writes fn's output for src to dst through a temporary file,
+// so an interrupted run leaves the old dst in place.
+func transformFile(src, dst string, perm os.FileMode, mtime time.Time, fn func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".belterlink-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := fn(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// removeUnlisted deletes the entries of root's listing that keep doesn't
+// have, deepest first.
+func removeUnlisted(root string, listing map[string]agent.File, keep map[string]bool) error {
+	for _, rel := range slices.Backward(slices.Sorted(maps.Keys(listing))) {
+		if keep[rel] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/crypt"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestSealAndOpenTree(t *testing.T) {
+	key, err := crypt.NewKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := rsync.CategoryMatcher(config.Category{Exclude: []string{"*.tmp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	plain, mirror, other := filepath.Join(dir, "plain"), filepath.Join(dir, "mirror"), filepath.Join(dir, "other")
+	mtime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	write := func(root, rel, content string) {
+		p := filepath.Join(root, rel)
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, []byte(content), 0o644)
+		os.Chtimes(p, mtime, mtime)
+	}
+	write(plain, "Projects/ideas.md", "# Ideas")
+	write(plain, "todo.md", "- [ ] sync")
+	write(plain, "scratch.tmp", "excluded")
+
+	if err := sealTree(key, plain, mirror, matcher); err != nil {
+		t.Fatalf("sealTree error: %v", err)
+	}
+	var names []string
+	filepath.WalkDir(mirror, func(p string, d os.DirEntry, err error) error {
+		names = append(names, d.Name())
+		return nil
+	})
+	if len(names) != 4 { // mirror, Projects, ideas.md, todo.md
+		t.Errorf("mirror has %v, want 3 entries", names[1:])
+	}
+	for _, n := range names[1:] {
+		if strings.Contains(n, "ideas") || strings.Contains(n, "todo") || strings.Contains(n, "scratch") {
+			t.Errorf("mirror has a plaintext name: %q", n)
+		}
+	}
+
+	// another machine: a local file the mirror doesn't have goes with del,
+	// excluded ones stay
+	write(other, "stale.md", "old")
+	write(other, "keep.tmp", "excluded")
+	if err := openTree(key, mirror, other, matcher, true); err != nil {
+		t.Fatalf("openTree error: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(other, "Projects/ideas.md")); err != nil || string(b) != "# Ideas" {
+		t.Errorf("decrypted ideas.md = %q, %v", b, err)
+	}
+	if info, err := os.Stat(filepath.Join(other, "todo.md")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("todo.md: %v, %v; want mtime %v", info, err, mtime)
+	}
+	if _, err := os.Stat(filepath.Join(other, "stale.md")); !os.IsNotExist(err) {
+		t.Errorf("stale.md wasn't deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(other, "keep.tmp")); err != nil {
+		t.Errorf("excluded keep.tmp was deleted: %v", err)
+	}
+
+	// deleting a local file removes its ciphertext on the next seal
+	os.Remove(filepath.Join(plain, "todo.md"))
+	if err := sealTree(key, plain, mirror, matcher); err != nil {
+		t.Fatalf("sealTree error: %v", err)
+	}
+	enc, _ := key.EncryptPath("todo.md")
+	if _, err := os.Stat(filepath.Join(mirror, enc)); !os.IsNotExist(err) {
+		t.Errorf("ciphertext of a deleted file is still there: %v", err)
+	}
+
+	wrong, _ := crypt.NewKey(bytes.Repeat([]byte{8}, 32))
+	if err := openTree(wrong, mirror, other, matcher, false); err == nil {
+		t.Errorf("openTree with the wrong key succeeded")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+const explainUsage = "usage: belterlink explain [-delete] [-checksum] [-dry-run] <CategoryName> [push|pull]"
+
+// explainSetting is one resolved setting of a run and where its value came
+// from: the command line, the category, defaults or belterlink itself.
+type explainSetting struct {
+	name, value, source string
+}
+
+// registerExplain adds the sync flags explain takes to fs, with their
+// current values as defaults.
+func (s *syncFlags) registerExplain(fs *flag.FlagSet) {
+	fs.BoolVar(&s.delete, "delete", s.delete, "explain a run with -delete")
+	fs.BoolVar(&s.checksum, "checksum", s.checksum, "explain a run with -checksum")
+	fs.BoolVar(&s.dryRun, "dry-run", s.dryRun, "explain a dry run")
+}
+
+// runExplainCommand implements "belterlink explain": it prints the rsync
+// command a push or pull of a category would run, shell-quoted so it can be
+// pasted, the ssh command rsync connects with, and the settings behind them.
+// Nothing is transferred; the remote is only contacted for its probe, as a
+// run would.
+func runExplainCommand(g *globals, args []string) error {
+	flags := newFlagSet("explain")
+	g.register(flags)
+	s := g.sync
+	s.registerExplain(flags)
+	args, err := parseInterleaved(flags, args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return withExitCode(exitUsage, errors.New(explainUsage))
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	name, err := config.ResolveCategory(cfg.Categories, args[0])
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	cat := cfg.Categories[name]
+	given := ""
+	if len(args) == 2 {
+		if given = parseDirection(args[1]); given == "" {
+			return withExitCode(exitUsage, errors.New(explainUsage))
+		}
+	}
+	opts := RunOptions{Options: rsync.Options{
+		Direction: cmp.Or(given, cat.DefaultDirection),
+		DryRun:    s.dryRun,
+		Delete:    s.delete,
+		Checksum:  s.checksum,
+		Verbosity: verbosity,
+	}}
+	if opts.Direction == "" {
+		return exitErrorf(exitUsage, "%s has no default_direction; say push or pull", name)
+	}
+	ctx := context.Background()
+	run, err := planRun(ctx, cfg, name, opts)
+	if err != nil {
+		return err
+	}
+	local, remote := rsyncVersions(ctx, cfg)
+	if !remote.Known() {
+		run.notes = append(run.notes, "the remote's rsync version is unknown (see belterlink probe), so no option was left out for it")
+	}
+
+	w := os.Stdout
+	fmt.Fprintf(w, "%s %s, rsync %s (local) / %s (remote)\n\n", name, opts.Direction, local, remote)
+	fmt.Fprintf(w, "rsync command:\n  %s\n\n", run.command())
+	fmt.Fprintf(w, "ssh command:\n  %s\n\n", shellCommand(append(ssh.Args(cfg.SSH), ssh.Target(cfg.SSH))))
+	fmt.Fprintln(w, "settings:")
+	writeSettings(w, explainSettings(cfg, run.cat, run.opts, s, given))
+	if len(run.notes) > 0 {
+		fmt.Fprintln(w, "\nnotes:")
+		for _, n := range run.notes {
+			fmt.Fprintf(w, "  %s\n", n)
+		}
+	}
+	return nil
+}
+
+// plannedRun is the rsync a push or pull of a category would start.
+type plannedRun struct {
+	cat    config.Category // as rsync sees it
+	opts   RunOptions      // as resolved by resolveRsyncOptions
+	binary string
+	args   []string
+	files  []string // with -path: the list rsync reads on stdin
+	notes  []string // where the run does more than the command says
+}
+
+// planRun works out the rsync command of a push or pull of the category
+// called name, as syncCategory would run it, without preparing anything for
+// it. Only the remote's probe is run, if it isn't cached; with
+// cachedProbeOnly nothing reaches the remote.
+func planRun(ctx context.Context, cfg *config.Config, name string, opts RunOptions) (plannedRun, error) {
+	cat := cfg.Categories[name]
+	switch {
+	case opts.Direction != "push" && opts.Direction != "pull":
+		return plannedRun{}, exitErrorf(exitUsage, "%s %s: only the rsync of a push or pull can be shown without running anything", name, opts.Direction)
+	case cat.Backend != "":
+		return plannedRun{}, exitErrorf(exitUsage, "category %q uses the %s backend, which doesn't run rsync", name, cat.Backend)
+	case cat.Transport == "agent":
+		return plannedRun{}, exitErrorf(exitUsage, "category %q uses transport: agent, which doesn't run rsync", name)
+	case cat.FromHost != "":
+		return plannedRun{}, exitErrorf(exitUsage, "category %q has from_host; its rsync runs through a copy on this machine or on from_host", name)
+	case config.IsDaemonURL(cat.Remote), cat.Mount != "", cat.Drive != "":
+		return plannedRun{}, exitErrorf(exitUsage, "category %q has an rsync:// remote, mount or drive; only runs over ssh can be shown", name)
+	}
+	if !cachedProbeOnly {
+		if err := pickAddress(cfg); err != nil {
+			return plannedRun{}, err
+		}
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return plannedRun{}, err
+	}
+	run := plannedRun{binary: rsync.Binary(cfg)}
+	if len(opts.Paths) > 0 {
+		for _, p := range opts.Paths {
+			rel, _, err := categoryRelPath(cat.Local, p)
+			if err != nil {
+				return plannedRun{}, withExitCode(exitUsage, err)
+			}
+			run.files = append(run.files, rel)
+		}
+		opts.FilesFrom = "-"
+	}
+	if cat.Encrypted {
+		if opts.FilesFrom != "" {
+			return plannedRun{}, exitErrorf(exitUsage, "category %q is encrypted; -path and -files-from can't select files in its encrypted mirror", name)
+		}
+		cat.Local = encryptedMirror(cfg, name)
+		cat.Exclude, cat.OnlyExtensions = nil, nil
+		run.notes = append(run.notes, "encrypted: rsync transfers the encrypted mirror, which belterlink builds from the local tree and its excludes first")
+	}
+	if len(cat.Transforms) > 0 {
+		switch opts.Direction {
+		case "push":
+			cat.Local = transformStaging(cfg, name)
+			run.notes = append(run.notes, "transforms: rsync pushes a copy of the local tree in which belterlink first runs the transforms")
+		case "pull":
+			cat.Exclude = append(slices.Clone(cat.Exclude), transformedPatterns(cat)...)
+			run.notes = append(run.notes, "transforms: the pull leaves the files they rewrite alone")
+		}
+	}
+	if cat.AtomicPull && opts.Direction == "pull" && !opts.DryRun {
+		live := cat.Local
+		if resolved, err := filepath.EvalSymlinks(live); err == nil {
+			live = resolved
+		}
+		cat.Local = siblingPath(live, "staging")
+		run.notes = append(run.notes, "atomic_pull: rsync pulls into a hard-linked staging copy that is swapped in once the pull succeeded")
+	}
+	if rsync.Backup(cfg, cat) && !opts.DryRun {
+		opts.RunID = newRunID()
+		run.notes = append(run.notes, "backup: "+opts.RunID+" stands for the run's ID; each run gets a new one")
+	}
+	if err := resolveRsyncOptions(ctx, cfg, cat, &opts); err != nil {
+		return plannedRun{}, err
+	}
+	args, err := categoryRsyncArgs(ctx, cfg, cat, opts)
+	if err != nil {
+		return plannedRun{}, err
+	}
+	if opts.LowPriority {
+		run.notes = append(run.notes, "low_priority: rsync runs under nice -n 19 and ionice -c 3 (taskpolicy -b on macOS)")
+	}
+	run.cat, run.opts, run.args = cat, opts, args
+	return run, nil
+}
+
+// command is the run as a line for a POSIX shell, with the -path list piped
+// in.
+func (r plannedRun) command() string {
+	line := shellCommand(append([]string{r.binary}, r.args...))
+	if len(r.files) > 0 {
+		line = `printf '%s\n' ` + shellCommand(r.files) + " | " + line
+	}
+	return line
+}
+
+// explainSettings lists the settings that shape the rsync command of a run of
+// cat with opts, as resolved by resolveRsyncOptions. given is the direction
+// from the command line, if any.
+func explainSettings(cfg *config.Config, cat config.Category, opts RunOptions, s syncFlags, given string) []explainSetting {
+	d := cfg.Defaults
+	profile := config.RemoteProfile(cfg)
+	direction := explainSetting{"direction", opts.Direction, "command line"}
+	if given == "" {
+		direction.source = "category (default_direction)"
+	}
+	compress := stringSetting("compress", cat.Compress, d.Compress, "false")
+	switch {
+	case opts.CompressChoice != "":
+		compress.value += " → " + opts.CompressChoice
+	case opts.Compress:
+		compress.value += " → on"
+	default:
+		compress.value += " → off"
+	}
+	wholeFile := stringSetting("whole_file", cat.WholeFile, d.WholeFile, "rsync's choice")
+	if opts.WholeFile != nil {
+		wholeFile.value += " → " + strconv.FormatBool(*opts.WholeFile)
+	}
+	tempDir := stringSetting("temp_dir", cat.TempDir, d.TempDir, "-")
+	if opts.TempDir != "" {
+		tempDir.value = opts.TempDir
+	}
+	symlinks := stringSetting("symlinks", cat.Symlinks, "", "preserve")
+	if cat.Symlinks == "" && profile.Symlinks != "" {
+		symlinks = explainSetting{"symlinks", profile.Symlinks, "ssh.profile"}
+	}
+	modifyWindow := explainSetting{"modify_window", strconv.Itoa(rsync.ModifyWindow(cfg, cat)), "built-in"}
+	switch {
+	case cat.ModifyWindow != nil:
+		modifyWindow.source = "category"
+	case d.ModifyWindow != nil:
+		modifyWindow.source = "defaults"
+	case profile.ModifyWindow > 0:
+		modifyWindow.source = "ssh.profile"
+	}
+	del := boolSetting("delete", s.delete, nil, d.Delete, false)
+	if rsync.AppendOnly(cat) {
+		del = explainSetting{"delete", "false", "mode: archive-append"}
+	}
+	inplace := explainSetting{"inplace", "false", "built-in"}
+	if cat.Inplace {
+		inplace.value, inplace.source = "true", "category"
+	}
+	out := []explainSetting{
+		direction,
+		boolSetting("dry_run", s.dryRun, nil, nil, false),
+		stringSetting("mode", cat.Mode, "", "-"),
+		del,
+		boolSetting("checksum", s.checksum, nil, d.Checksum, false),
+		compress,
+		wholeFile,
+		boolSetting("resume", false, cat.Resume, d.Resume, false),
+		boolSetting("backup", false, cat.Backup, d.Backup, false),
+		boolSetting("detect_renames", false, cat.DetectRenames, d.DetectRenames, false),
+		boolSetting("preserve_xattrs", false, cat.PreserveXattrs, d.PreserveXattrs, false),
+		boolSetting("normalize_unicode", false, cat.NormalizeUnicode, d.NormalizeUnicode, false),
+		boolSetting("numeric_ids", false, cat.NumericIDs, d.NumericIDs, false),
+		boolSetting("perms", false, cat.Perms, d.Perms, !profile.NoOwnership),
+		boolSetting("owner", false, cat.Owner, d.Owner, !profile.NoOwnership),
+		boolSetting("sparse", false, cat.Sparse, d.Sparse, false),
+		modifyWindow,
+		symlinks,
+		stringSetting("chmod", cat.Chmod, d.Chmod, "-"),
+		stringSetting("chown", cat.Chown, d.Chown, "-"),
+		tempDir,
+		inplace,
+		stringSetting("run_timeout", cat.RunTimeout, d.RunTimeout, "-"),
+		boolSetting("low_priority", s.bg, cat.LowPriority, d.LowPriority, false),
+		stringSetting("rsync.path", cfg.Rsync.Path, "", "rsync"),
+		stringSetting("rsync.remote_path", cfg.Rsync.RemotePath, "", "rsync"),
+	}
+	if len(d.RsyncArgs) > 0 {
+		out = append(out, explainSetting{"rsync_args", shellCommand(d.RsyncArgs), "defaults"})
+	}
+	if len(cat.RsyncArgs) > 0 {
+		out = append(out, explainSetting{"rsync_args", shellCommand(cat.RsyncArgs), "category"})
+	}
+	if cfg.SSH.Profile != "" {
+		out = append(out, explainSetting{"ssh.profile", cfg.SSH.Profile, "config"})
+	}
+	if opts.Iconv != "" {
+		out = append(out, explainSetting{"iconv", opts.Iconv, "normalize_unicode and the systems at both ends"})
+	}
+	if opts.BackupDir != "" {
+		out = append(out, explainSetting{"backup_dir", path.Clean(opts.BackupDir), "backup"})
+	}
+	return out
+}
+
+// boolSetting resolves a boolean setting the way config.GetBool does: a flag
+// given on the command line, else the category's value, else defaults', else
+// fallback.
+func boolSetting(name string, cli bool, catValue, defValue *bool, fallback bool) explainSetting {
+	switch {
+	case cli:
+		return explainSetting{name, "true", "command line"}
+	case catValue != nil:
+		return explainSetting{name, strconv.FormatBool(*catValue), "category"}
+	case defValue != nil:
+		return explainSetting{name, strconv.FormatBool(*defValue), "defaults"}
+	}
+	return explainSetting{name, strconv.FormatBool(fallback), "built-in"}
+}
+
+// stringSetting resolves a setting the category can override defaults for.
+func stringSetting(name, catValue, defValue, fallback string) explainSetting {
+	switch {
+	case catValue != "":
+		return explainSetting{name, catValue, "category"}
+	case defValue != "":
+		return explainSetting{name, defValue, "defaults"}
+	}
+	return explainSetting{name, fallback, "built-in"}
+}
+
+// writeSettings writes settings as aligned columns.
+func writeSettings(w io.Writer, settings []explainSetting) {
+	nameWidth, valueWidth := 0, 0
+	for _, s := range settings {
+		nameWidth, valueWidth = max(nameWidth, len(s.name)), max(valueWidth, len([]rune(s.value)))
+	}
+	for _, s := range settings {
+		fmt.Fprintf(w, "  %-*s  %-*s  %s\n", nameWidth, s.name, valueWidth, s.value, s.source)
+	}
+}
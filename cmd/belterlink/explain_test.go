@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestPlannedRunCommand(t *testing.T) {
+	run := plannedRun{binary: "rsync", args: []string{"-aH", "--files-from=-", "/Users/me/My Notes/", "me@nas:/data/Notes/"}, files: []string{"Projects/big idea.md"}}
+	want := `printf '%s\n' 'Projects/big idea.md' | rsync -aH --files-from=- '/Users/me/My Notes/' me@nas:/data/Notes/`
+	if got := run.command(); got != want {
+		t.Fatalf("command = %s, want %s", got, want)
+	}
+}
+
+func TestExplainSettings(t *testing.T) {
+	yes, no := true, false
+	cfg := &config.Config{Defaults: config.Defaults{Delete: &yes, Resume: &yes, Compress: "auto"}}
+	cat := config.Category{Resume: &no, Symlinks: "safe", DefaultDirection: "push"}
+	opts := RunOptions{Options: rsync.Options{Direction: "push"}}
+	settings := map[string]explainSetting{}
+	for _, s := range explainSettings(cfg, cat, opts, syncFlags{checksum: true}, "") {
+		settings[s.name] = s
+	}
+	for _, want := range []explainSetting{
+		{"direction", "push", "category (default_direction)"},
+		{"delete", "true", "defaults"},
+		{"checksum", "true", "command line"},
+		{"resume", "false", "category"},
+		{"compress", "auto → off", "defaults"},
+		{"perms", "true", "built-in"},
+		{"symlinks", "safe", "category"},
+	} {
+		if got := settings[want.name]; got != want {
+			t.Errorf("%s = %+v, want %+v", want.name, got, want)
+		}
+	}
+}
+
+func TestPlanRunCachedProbeOnly(t *testing.T) {
+	cachedProbeOnly = true
+	t.Cleanup(func() { cachedProbeOnly = false })
+	cfg := &config.Config{
+		StateDir: t.TempDir(),
+		SSH:      config.SSH{User: "me", Host: "nas", Addresses: []string{"127.0.0.1"}, Port: 1, ConnectTimeout: "1s"},
+		Categories: map[string]config.Category{
+			"Notes": {Local: t.TempDir(), Remote: "/data/Notes"},
+		},
+	}
+	run, err := planRun(context.Background(), cfg, "Notes", RunOptions{Options: rsync.Options{Direction: "push"}})
+	if err != nil {
+		t.Fatalf("planRun without a reachable address or a cached probe: %v", err)
+	}
+	if cfg.SSH.Host != "nas" {
+		t.Errorf("ssh.host = %q, want it left as configured", cfg.SSH.Host)
+	}
+	if cmd := run.command(); !strings.Contains(cmd, "me@nas:/data/Notes") {
+		t.Errorf("command = %s", cmd)
+	}
+}
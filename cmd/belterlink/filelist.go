@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readFileList reads one path per line from name ("-" is stdin), skipping
+// blank lines.
+func readFileList(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var paths []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimRight(sc.Text(), "\r"); strings.TrimSpace(line) != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, sc.Err()
+}
+
+// writeFileList writes paths, made relative to the category root local, to
+// a temporary file for rsync --files-from. The caller removes the file.
+func writeFileList(local string, paths []string) (string, error) {
+	var b strings.Builder
+	for _, p := range paths {
+		rel, _, err := categoryRelPath(local, p)
+		if err != nil {
+			return "", err
+		}
+		if rel == "." {
+			return "", fmt.Errorf("%s is the category root itself; drop the path to sync everything", p)
+		}
+		b.WriteString(rel + "\n")
+	}
+	f, err := os.CreateTemp("", "belterlink-files-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
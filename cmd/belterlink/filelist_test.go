@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWriteFileList(t *testing.T) {
+	list, err := writeFileList("/vault", []string{"Projects/ideas.md", "/vault/Daily/", "./Inbox/../Inbox/a.md"})
+	if err != nil {
+		t.Fatalf("writeFileList: %v", err)
+	}
+	defer os.Remove(list)
+	b, err := os.ReadFile(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Projects/ideas.md\nDaily\nInbox/a.md\n"; string(b) != want {
+		t.Fatalf("file list = %q, want %q", b, want)
+	}
+	for _, bad := range []string{"../elsewhere.md", "/etc/passwd", "."} {
+		if _, err := writeFileList("/vault", []string{bad}); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(name, []byte("Daily/a.md\r\n\n  \nwith space.md\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFileList(name)
+	if err != nil {
+		t.Fatalf("readFileList: %v", err)
+	}
+	if want := []string{"Daily/a.md", "with space.md"}; !slices.Equal(got, want) {
+		t.Fatalf("readFileList = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// nameLimits are the file names a destination filesystem accepts.
+type nameLimits struct {
+	maxName int  // per path element: bytes, or UTF-16 units on Windows filesystems
+	maxPath int  // bytes, of the whole destination path
+	windows bool // no <>:"\|?* or control characters, no trailing dot or space
+}
+
+// limitsFor returns the limits of a filesystem type on an OS (as uname -s
+// or GOOS name it): 255 per name everywhere, 1024 bytes per path on macOS
+// and 4096 elsewhere.
+func limitsFor(fsType, osName string) nameLimits {
+	l := nameLimits{maxName: 255, maxPath: 4096}
+	if strings.EqualFold(osName, "darwin") {
+		l.maxPath = 1024
+	}
+	l.windows = slices.Contains(windowsFilesystems, strings.ToLower(fsType))
+	return l
+}
+
+// nameProblem is a path the destination won't accept, with a name that it
+// would, if one can be suggested.
+type nameProblem struct {
+	Path, Reason, Suggestion string
+}
+
+func (p nameProblem) String() string {
+	if p.Suggestion == "" {
+		return fmt.Sprintf("%s: %s", p.Path, p.Reason)
+	}
+	return fmt.Sprintf("%s: %s; rename to %s", p.Path, p.Reason, p.Suggestion)
+}
+
+// invalidNames checks the last element of each path, and the whole path
+// below root, against l. Listings include the directories, so each
+// element gets checked once.
+func invalidNames(paths []string, root string, l nameLimits) []nameProblem {
+	var out []nameProblem
+	for _, p := range paths {
+		dir, name := path.Split(p)
+		var reasons []string
+		if l.windows {
+			if bad := badWindowsChars(name); bad != "" {
+				reasons = append(reasons, fmt.Sprintf("%s not allowed", bad))
+			}
+			if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+				reasons = append(reasons, "ends in a dot or space")
+			}
+		}
+		if n := nameLength(name, l); n > l.maxName {
+			reasons = append(reasons, fmt.Sprintf("name is %d long, more than %d", n, l.maxName))
+		}
+		if len(reasons) > 0 {
+			out = append(out, nameProblem{Path: p, Reason: strings.Join(reasons, ", "), Suggestion: dir + suggestName(name, l)})
+			continue
+		}
+		if n := len(strings.TrimRight(root, "/")) + 1 + len(p); n > l.maxPath {
+			out = append(out, nameProblem{Path: p, Reason: fmt.Sprintf("path is %d bytes there, more than %d; shorten a directory name", n, l.maxPath)})
+		}
+	}
+	slices.SortFunc(out, func(a, b nameProblem) int { return strings.Compare(a.Path, b.Path) })
+	return out
+}
+
+// badWindowsChars lists the characters of name that Windows filesystems
+// refuse, quoted, e.g. `":", "?"`.
+func badWindowsChars(name string) string {
+	var bad []string
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+			if q := fmt.Sprintf("%q", string(r)); !slices.Contains(bad, q) {
+				bad = append(bad, q)
+			}
+		}
+	}
+	return strings.Join(bad, ", ")
+}
+
+func nameLength(name string, l nameLimits) int {
+	if l.windows {
+		return len(utf16.Encode([]rune(name)))
+	}
+	return len(name)
+}
+
+// suggestName makes name acceptable under l: refused characters become
+// underscores, trailing dots and spaces go, and a name that is too long is
+// cut short before its extension.
+func suggestName(name string, l nameLimits) string {
+	if l.windows {
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, name)
+		name = strings.TrimRight(name, ". ")
+		if name == "" {
+			name = "_"
+		}
+	}
+	ext := path.Ext(name)
+	if len(ext) > 16 || ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	for nameLength(stem+ext, l) > l.maxName {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return stem + ext
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInvalidNames(t *testing.T) {
+	long := strings.Repeat("x", 300) + ".md"
+	paths := []string{"Notes", "Notes/bad:name?.md", "draft. ", "fine.md", long}
+	want := []nameProblem{
+		{Path: "Notes/bad:name?.md", Reason: `":", "?" not allowed`, Suggestion: "Notes/bad_name_.md"},
+		{Path: "draft. ", Reason: "ends in a dot or space", Suggestion: "draft"},
+		{Path: long, Reason: "name is 303 long, more than 255", Suggestion: strings.Repeat("x", 252) + ".md"},
+	}
+	if got := invalidNames(paths, "/Volumes/USB", limitsFor("exfat", "Darwin")); !reflect.DeepEqual(got, want) {
+		t.Errorf("invalidNames = %+v, want %+v", got, want)
+	}
+	// the same names are fine on ext4, apart from the long one
+	if got := invalidNames(paths[:4], "/home/anna", limitsFor("ext4", "Linux")); len(got) != 0 {
+		t.Errorf("invalidNames on ext4 = %+v, want none", got)
+	}
+}
+
+func TestInvalidNamesPathLength(t *testing.T) {
+	dir := strings.Repeat("d", 200)
+	p := strings.Join([]string{dir, dir, dir, dir, dir, "a.md"}, "/")
+	got := invalidNames([]string{p}, "/Users/anna/Notes", limitsFor("apfs", "Darwin"))
+	if len(got) != 1 || got[0].Suggestion != "" || !strings.Contains(got[0].Reason, "more than 1024") {
+		t.Errorf("invalidNames = %+v, want the path reported as too long", got)
+	}
+	if got := invalidNames([]string{p}, "/home/anna/Notes", limitsFor("ext4", "Linux")); len(got) != 0 {
+		t.Errorf("invalidNames on Linux = %+v, want none", got)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+const genUsage = "usage: belterlink gen man | gen completion bash|zsh|fish | gen categories"
+
+// runGenCommand implements "belterlink gen": the man page and the shell
+// completions, generated from the command table and the top-level flags so
+// packages can install docs that match the binary. "gen categories" prints
+// the config's category and group names, for the completion scripts.
+func runGenCommand(g *globals, args []string) error {
+	if helpFirst("gen", args) {
+		return flag.ErrHelp
+	}
+	switch {
+	case len(args) == 1 && args[0] == "man":
+		return writeMan(os.Stdout, commandTable(), flag.CommandLine)
+	case len(args) == 2 && args[0] == "completion":
+		switch args[1] {
+		case "bash":
+			return writeBashCompletion(os.Stdout, commandTable(), flag.CommandLine)
+		case "zsh":
+			return writeZshCompletion(os.Stdout, commandTable(), flag.CommandLine)
+		case "fish":
+			return writeFishCompletion(os.Stdout, commandTable(), flag.CommandLine)
+		}
+		return exitErrorf(exitUsage, "gen completion: unknown shell %q (bash, zsh or fish)", args[1])
+	case len(args) == 1 && args[0] == "categories":
+		cfg, err := config.Load(g.cfgPath)
+		if err != nil {
+			return exitErrorf(exitConfig, "load config: %v", err)
+		}
+		names := slices.Concat(slices.Collect(maps.Keys(cfg.Categories)), slices.Collect(maps.Keys(cfg.Groups)))
+		slices.Sort(names)
+		for _, n := range slices.Compact(names) {
+			fmt.Println(n)
+		}
+		return nil
+	}
+	return withExitCode(exitUsage, errors.New(genUsage))
+}
+
+// commandFlags returns a flag set with c's own flags, or nil if it has none.
+func commandFlags(c command) *flag.FlagSet {
+	if c.flags == nil {
+		return nil
+	}
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.flags(fs)
+	return fs
+}
+
+// flagNames returns the flags of fs, those that take a value and those that
+// don't.
+func flagNames(fs *flag.FlagSet) (valued, bools []string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			bools = append(bools, f.Name)
+		} else {
+			valued = append(valued, f.Name)
+		}
+	})
+	return valued, bools
+}
+
+// roff escapes s for a man page: backslashes, hyphens (which would otherwise
+// be typeset as hyphens, not minus signs) and a leading dot or quote.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+func writeMan(w io.Writer, cmds []command, fs *flag.FlagSet) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH BELTERLINK 1 \"\" \"belterlink %s\" \"User Commands\"\n", roff(version))
+	b.WriteString(".SH NAME\nbelterlink \\- simple, config\\-driven rsync wrapper (one\\-way by choice)\n")
+	b.WriteString(".SH SYNOPSIS\n")
+	fmt.Fprintf(&b, ".B belterlink\n[flags] %s\n", roff(syncUsage))
+	for _, c := range cmds {
+		for _, u := range c.usage {
+			fmt.Fprintf(&b, ".br\n.B belterlink\n[flags] %s\n", roff(u))
+		}
+	}
+	b.WriteString(".SH DESCRIPTION\n" +
+		"belterlink syncs the directories named as categories in its config file with a remote " +
+		"host over ssh, one way at a time, using rsync. " +
+		"\\fBpush\\fR copies local to remote, \\fBpull\\fR remote to local, \\fBsync\\fR pulls and then pushes, " +
+		"and \\fBbackup\\fR makes a dated snapshot on the remote.\n")
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range cmds {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", roff(c.name), roff(c.summary))
+		if cf := commandFlags(c); cf != nil {
+			b.WriteString(".RS\n")
+			manFlags(&b, cf)
+			b.WriteString(".RE\n")
+		}
+	}
+	b.WriteString(".SH OPTIONS\n")
+	b.WriteString("These work before or after a command's name; the sync flags before the categories or after the sync command.\n")
+	manFlags(&b, fs)
+	b.WriteString(".SH EXIT STATUS\n")
+	for _, e := range []struct {
+		code int
+		what string
+	}{
+		{0, "success"},
+		{exitFailure, "a failure not covered below"},
+		{exitUsage, "bad flags or arguments"},
+		{exitConfig, "the config is missing or invalid, or names an unknown category"},
+		{exitNetwork, "ssh connection, socket or timeout problems"},
+		{exitPartial, "partial transfer"},
+		{exitVanished, "source files vanished during the transfer"},
+		{exitRefused, "a safety check refused to run"},
+		{exitDiffers, "verification found differences between the two sides"},
+		{exitAborted, "interrupted by SIGINT or SIGTERM"},
+	} {
+		fmt.Fprintf(&b, ".TP\n.B %d\n%s\n", e.code, roff(e.what))
+	}
+	b.WriteString(".SH ENVIRONMENT\n.TP\n.B BELTERLINK_CONFIG\nthe config file when \\fB\\-config\\fR isn't given\n")
+	b.WriteString(".SH FILES\n.TP\n.I ~/.belterlink/config.yaml\nthe default config file; config.toml or config.json if there is no config.yaml\n")
+	b.WriteString(".SH SEE ALSO\n.BR rsync (1),\n.BR ssh (1)\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// manFlags writes the flags of fs as a man page's tagged paragraphs.
+func manFlags(b *strings.Builder, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		if name != "" {
+			fmt.Fprintf(b, ".TP\n.BI %s \" %s\"\n", roff("-"+f.Name), roff(name))
+		} else {
+			fmt.Fprintf(b, ".TP\n.B %s\n", roff("-"+f.Name))
+		}
+		b.WriteString(roff(usage) + "\n")
+	})
+}
+
+func writeBashCompletion(w io.Writer, cmds []command, fs *flag.FlagSet) error {
+	valued, bools := flagNames(fs)
+	globalNames := dashed(append(valued, bools...))
+	var names, cases []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+		cf := commandFlags(c)
+		if cf == nil {
+			continue
+		}
+		v, b := flagNames(cf)
+		for _, n := range v {
+			if !slices.Contains(valued, n) {
+				valued = append(valued, n)
+			}
+		}
+		cases = append(cases, fmt.Sprintf("%s) flags+=\" %s\" ;;", c.name, dashed(append(v, b...))))
+	}
+	_, err := fmt.Fprintf(w, `# bash completion for belterlink; generated by "belterlink gen completion bash"
+_belterlink() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local valued=" %[1]s " commands=" %[3]s "
+	if [[ $valued == *" ${prev#-} "* && $prev == -* ]]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+	fi
+	local i w first= n=0
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		w=${COMP_WORDS[i]}
+		if [[ $w == -* ]]; then
+			[[ $valued == *" ${w#-} "* ]] && ((i++))
+			continue
+		fi
+		[[ -z $first ]] && first=$w
+		((n++))
+	done
+	if [[ $cur == -* ]]; then
+		local flags="%[2]s"
+		if [[ $commands == *" $first "* ]]; then
+			case $first in
+			%[5]s
+			esac
+		fi
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+		return
+	fi
+	local categories
+	categories=$(belterlink gen categories 2>/dev/null)
+	if ((n == 0)); then
+		COMPREPLY=($(compgen -W "$commands $categories" -- "$cur"))
+	elif [[ $commands == *" $first "* ]]; then
+		COMPREPLY=($(compgen -W "$categories" -- "$cur") $(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "$categories %[4]s" -- "$cur"))
+	fi
+}
+complete -F _belterlink belterlink
+`, strings.Join(valued, " "), globalNames, strings.Join(names, " "), strings.Join(directions, " "), strings.Join(cases, "\n\t\t\t"))
+	return err
+}
+
+func writeZshCompletion(w io.Writer, cmds []command, fs *flag.FlagSet) error {
+	valued, _ := flagNames(fs)
+	var commands []string
+	for _, c := range cmds {
+		commands = append(commands, zshQuote(c.name+":"+c.summary))
+	}
+	var flags []string
+	fs.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		spec := "-" + f.Name + "[" + strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(usage) + "]"
+		if slices.Contains(valued, f.Name) {
+			spec += ":value:_files"
+		}
+		flags = append(flags, zshQuote(spec))
+	})
+	_, err := fmt.Fprintf(w, `#compdef belterlink
+# zsh completion for belterlink; generated by "belterlink gen completion zsh"
+_belterlink() {
+	local -a commands categories
+	commands=(
+		%[1]s
+	)
+	categories=(${(f)"$(belterlink gen categories 2>/dev/null)"})
+	_arguments -s \
+		%[2]s \
+		'*::arg:->args'
+	case $state in
+	args)
+		if (( CURRENT == 1 )); then
+			_describe command commands
+			compadd -a categories
+		elif (( ${commands[(I)${words[1]}:*]} )); then
+			compadd -a categories
+			_files
+		else
+			compadd -a categories
+			compadd %[3]s
+		fi
+		;;
+	esac
+}
+_belterlink "$@"
+`, strings.Join(commands, "\n\t\t"), strings.Join(flags, " \\\n\t\t"), strings.Join(directions, " "))
+	return err
+}
+
+func writeFishCompletion(w io.Writer, cmds []command, fs *flag.FlagSet) error {
+	valued, _ := flagNames(fs)
+	var b strings.Builder
+	b.WriteString("# fish completion for belterlink; generated by \"belterlink gen completion fish\"\n")
+	b.WriteString("complete -c belterlink -f\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		line := "complete -c belterlink -o " + f.Name
+		if slices.Contains(valued, f.Name) {
+			line += " -r -F"
+		}
+		b.WriteString(line + " -d " + fishQuote(usage) + "\n")
+	})
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+		fmt.Fprintf(&b, "complete -c belterlink -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+		if cf := commandFlags(c); cf != nil {
+			v, _ := flagNames(cf)
+			cf.VisitAll(func(f *flag.Flag) {
+				_, usage := flag.UnquoteUsage(f)
+				line := "complete -c belterlink -n '__fish_seen_subcommand_from " + c.name + "' -o " + f.Name
+				if slices.Contains(v, f.Name) {
+					line += " -r -F"
+				}
+				b.WriteString(line + " -d " + fishQuote(usage) + "\n")
+			})
+		}
+	}
+	b.WriteString("complete -c belterlink -a '(belterlink gen categories 2>/dev/null)'\n")
+	fmt.Fprintf(&b, "complete -c belterlink -n 'not __fish_use_subcommand; and not __fish_seen_subcommand_from %s' -a %s\n",
+		strings.Join(names, " "), fishQuote(strings.Join(directions, " ")))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dashed prefixes each flag name with a dash and joins them.
+func dashed(names []string) string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = "-" + n
+	}
+	return strings.Join(out, " ")
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestWriteMan(t *testing.T) {
+	fs := flag.NewFlagSet("belterlink", flag.ContinueOnError)
+	fs.String("config", "", "path to the config `file`")
+	fs.Bool("dry-run", false, "show what would change")
+	var b strings.Builder
+	if err := writeMan(&b, commandTable(), fs); err != nil {
+		t.Fatal(err)
+	}
+	man := b.String()
+	for _, want := range []string{
+		".TH BELTERLINK 1",
+		".BI \\-config \" file\"\npath to the config file\n",
+		".B \\-dry\\-run\nshow what would change\n",
+		".B push\\-agent\n",
+		"[flags] restore [\\-at <time>]",
+		".B probe\nlook at the remote's OS, rsync and filesystems (cached)\n.RS\n.TP\n.B \\-json\n",
+	} {
+		if !strings.Contains(man, want) {
+			t.Errorf("man page lacks %q", want)
+		}
+	}
+	if got := roff(`.hidden \n`); got != `\&.hidden \en` {
+		t.Errorf("roff = %q", got)
+	}
+}
+
+func TestWriteBashCompletion(t *testing.T) {
+	fs := flag.NewFlagSet("belterlink", flag.ContinueOnError)
+	fs.String("config", "", "path to the config `file`")
+	fs.Bool("dry-run", false, "show what would change")
+	var b strings.Builder
+	if err := writeBashCompletion(&b, commandTable(), fs); err != nil {
+		t.Fatal(err)
+	}
+	script := b.String()
+	for _, want := range []string{
+		`local flags="-config -dry-run"`,
+		`probe) flags+=" -json -refresh" ;;`,
+		`restore) flags+=" -at -path -to -dry-run -in-place -yes" ;;`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("bash completion lacks %q", want)
+		}
+	}
+	// a command's valued flags take the next word too
+	if !strings.Contains(script, ` keep-monthly keep-weekly at to o binary dest `) {
+		t.Errorf("valued flags:\n%s", script)
+	}
+}
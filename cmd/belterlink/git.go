@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// gitCommit records the current state of dir in its git repository (created
+// on first use), so every sync has a local version to go back to. Nothing is
+// committed when the tree is clean.
+func gitCommit(dir, message string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if _, err := git(dir, "init", "--quiet"); err != nil {
+			return err
+		}
+		printAt(rsync.Normal, "Initialized git repository in %s\n", dir)
+	}
+	if _, err := git(dir, "add", "-A"); err != nil {
+		return err
+	}
+	if _, err := git(dir, "diff", "--cached", "--quiet"); err == nil {
+		return nil // nothing staged
+	}
+	var env []string
+	if out, _ := git(dir, "config", "user.email"); strings.TrimSpace(out) == "" {
+		// don't fail on machines where git was never configured
+		env = []string{
+			"GIT_AUTHOR_NAME=belterlink", "GIT_AUTHOR_EMAIL=belterlink@localhost",
+			"GIT_COMMITTER_NAME=belterlink", "GIT_COMMITTER_EMAIL=belterlink@localhost",
+		}
+	}
+	if _, err := gitEnv(dir, env, "commit", "--quiet", "--no-verify", "-m", message); err != nil {
+		return err
+	}
+	logger.Info("git commit", "dir", dir, "message", message)
+	return nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	return gitEnv(dir, nil, args...)
+}
+
+func gitEnv(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "note.md"), []byte("hello\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitCommit(dir, "belterlink pre-push"); err != nil {
+		t.Fatalf("gitCommit: %v", err)
+	}
+	// a clean tree must not produce an empty commit
+	if err := gitCommit(dir, "belterlink post-pull"); err != nil {
+		t.Fatalf("gitCommit on clean tree: %v", err)
+	}
+	out, err := git(dir, "log", "--format=%s")
+	if err != nil {
+		t.Fatalf("git log: %v", err)
+	}
+	if got := strings.TrimSpace(out); got != "belterlink pre-push" {
+		t.Fatalf("git log = %q, want a single pre-push commit", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// knownHostsFile is ssh.known_hosts, or the user's own known_hosts.
+func knownHostsFile(s config.SSH) string {
+	if s.KnownHosts != "" {
+		return s.KnownHosts
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// hostKnown reports whether known_hosts has a key for the host.
+func hostKnown(s config.SSH) (bool, error) {
+	file := knownHostsFile(s)
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	out, err := exec.Command("ssh-keygen", "-F", ssh.KnownHostsName(s), "-f", file).Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		return false, nil // not found
+	} else if err != nil {
+		return false, fmt.Errorf("ssh-keygen -F: %w", err)
+	}
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
+
+// scanHostKeys asks the host for its keys, in known_hosts format, and
+// returns them with their fingerprints.
+func scanHostKeys(s config.SSH) (keys []byte, fingerprints []string, err error) {
+	port := s.Port
+	if port == 0 {
+		port = 22
+	}
+	cmd := exec.Command("ssh-keyscan", "-T", "10", "-p", fmt.Sprint(port), s.Host)
+	keys, err = cmd.Output()
+	if err != nil || len(bytes.TrimSpace(keys)) == 0 {
+		return nil, nil, fmt.Errorf("ssh-keyscan %s: no host keys received (is the host up?)", ssh.KnownHostsName(s))
+	}
+	if s.HostKeyAlias != "" {
+		keys = renameKeys(keys, s.HostKeyAlias)
+	}
+	fp := exec.Command("ssh-keygen", "-l", "-f", "-")
+	fp.Stdin = bytes.NewReader(keys)
+	out, err := fp.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ssh-keygen -l: %w", err)
+	}
+	return keys, strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+// renameKeys puts name in place of the host in ssh-keyscan output, for
+// host_key_alias: ssh looks the keys up under it whichever address it used.
+func renameKeys(keys []byte, name string) []byte {
+	var out []byte
+	for _, line := range strings.SplitAfter(string(keys), "\n") {
+		if _, rest, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+			line = name + " " + rest
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+// acceptHostKey shows the host's fingerprints and, once confirmed (or with
+// yes), appends its keys to known_hosts.
+func acceptHostKey(s config.SSH, yes bool) error {
+	keys, fingerprints, err := scanHostKeys(s)
+	if err != nil {
+		return withExitCode(exitNetwork, err)
+	}
+	fmt.Fprintf(os.Stderr, "Host keys of %s (compare them with ssh-keygen -l -f /etc/ssh/ssh_host_*_key.pub on the host):\n", ssh.KnownHostsName(s))
+	for _, f := range fingerprints {
+		fmt.Fprintln(os.Stderr, "  "+f)
+	}
+	if !yes {
+		if !isTerminal(os.Stdin) {
+			return exitErrorf(exitRefused, "no terminal to confirm the host key of %s on; re-run with -yes to trust it", s.Host)
+		}
+		if !askYesNo("Trust these keys?") {
+			return exitErrorf(exitRefused, "host key of %s not trusted", s.Host)
+		}
+	}
+	file := knownHostsFile(s)
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(keys); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Added the host keys of %s to %s\n", ssh.KnownHostsName(s), file)
+	return nil
+}
+
+// ensureHostKey implements host_key_check: tofu. The first connection to a
+// host asks to confirm its fingerprints and remembers them; from then on ssh
+// only accepts those keys. Without a terminal an unknown host is refused.
+func ensureHostKey(cfg *config.Config, opts RunOptions) error {
+	if cfg.SSH.HostKeyCheck != "tofu" {
+		return nil
+	}
+	known, err := hostKnown(cfg.SSH)
+	if err != nil || known {
+		return err
+	}
+	if opts.NonInteractive || !isTerminal(os.Stdin) {
+		return exitErrorf(exitRefused, "the host key of %s isn't known yet; check and trust it with: belterlink hostkey accept", cfg.SSH.Host)
+	}
+	return acceptHostKey(cfg.SSH, false)
+}
+
+// hostKeyFlags are the flags of "hostkey accept" and "hostkey remove".
+type hostKeyFlags struct {
+	yes bool
+}
+
+func (f *hostKeyFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.yes, "yes", false, "trust the keys without asking")
+}
+
+// runHostKeyCommand implements "belterlink hostkey accept|remove [host]",
+// which manage the host's entry in known_hosts. The host defaults to
+// ssh.host; the configured port is used for it.
+func runHostKeyCommand(g *globals, args []string) error {
+	if helpFirst("hostkey", args) {
+		return flag.ErrHelp
+	}
+	if len(args) == 0 || (args[0] != "accept" && args[0] != "remove") {
+		return exitErrorf(exitUsage, "usage: belterlink hostkey accept|remove [-yes] [host]")
+	}
+	flags := newFlagSet("hostkey " + args[0])
+	g.register(flags)
+	var f hostKeyFlags
+	f.register(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	if flags.NArg() > 1 {
+		return exitErrorf(exitUsage, "usage: belterlink hostkey accept|remove [-yes] [host]")
+	}
+	if flags.NArg() == 0 && args[0] == "accept" {
+		if err := pickAddress(cfg); err != nil {
+			return err
+		}
+	}
+	s := cfg.SSH
+	if h := flags.Arg(0); h != "" && h != s.Host && h != s.HostKeyAlias {
+		s.Host, s.Port, s.HostKeyAlias = h, 22, ""
+	}
+	if s.Host == "" {
+		return exitErrorf(exitUsage, "no host given and ssh.host isn't set")
+	}
+
+	if args[0] == "remove" {
+		out, err := exec.Command("ssh-keygen", "-R", ssh.KnownHostsName(s), "-f", knownHostsFile(s)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ssh-keygen -R: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		fmt.Printf("Removed the host keys of %s from %s\n", ssh.KnownHostsName(s), knownHostsFile(s))
+		return nil
+	}
+	if known, err := hostKnown(s); err != nil {
+		return err
+	} else if known {
+		fmt.Printf("%s is already in %s; to replace a changed key, run belterlink hostkey remove first\n", ssh.KnownHostsName(s), knownHostsFile(s))
+		return nil
+	}
+	return acceptHostKey(s, f.yes)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestHostKnown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	s := config.SSH{Host: "nas.local", Port: 2222, KnownHosts: file}
+	if known, err := hostKnown(s); err != nil || known {
+		t.Fatalf("hostKnown without a file = %v, %v", known, err)
+	}
+	key := "[nas.local]:2222 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHOc8yGtVDXcdMYZPTi/4MWkMz4HV+U1PbNDe7IGBEWm\n"
+	if err := os.WriteFile(file, []byte(key), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if known, err := hostKnown(s); err != nil || !known {
+		t.Errorf("hostKnown = %v, %v; want known", known, err)
+	}
+	s.Port = 22
+	if known, err := hostKnown(s); err != nil || known {
+		t.Errorf("hostKnown on another port = %v, %v; want unknown", known, err)
+	}
+}
+
+func TestEnsureHostKeyRefusesWithoutTerminal(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{Host: "nas.local", KnownHosts: filepath.Join(t.TempDir(), "known_hosts"), HostKeyCheck: "tofu"}}
+	if err := ensureHostKey(cfg, RunOptions{NonInteractive: true}); errorExitCode(err) != exitRefused {
+		t.Errorf("ensureHostKey = %v, want exit code %d", err, exitRefused)
+	}
+	cfg.SSH.HostKeyCheck = "strict"
+	if err := ensureHostKey(cfg, RunOptions{NonInteractive: true}); err != nil {
+		t.Errorf("ensureHostKey with strict = %v; ssh does the checking", err)
+	}
+}
+
+func TestRenameKeys(t *testing.T) {
+	keys := "# 100.64.0.7:22 SSH-2.0-OpenSSH_9.6\n100.64.0.7 ssh-ed25519 AAAAC3Nz\n100.64.0.7 ecdsa-sha2-nistp256 AAAAE2Vj\n"
+	want := "# 100.64.0.7:22 SSH-2.0-OpenSSH_9.6\nmymac.local ssh-ed25519 AAAAC3Nz\nmymac.local ecdsa-sha2-nistp256 AAAAE2Vj\n"
+	if got := string(renameKeys([]byte(keys), "mymac.local")); got != want {
+		t.Errorf("renameKeys =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// How long prefetchICloud waits for brctl downloads, and how often it looks.
+var (
+	icloudWait = 10 * time.Minute
+	icloudPoll = 2 * time.Second
+)
+
+// icloudMode returns the category's icloud setting. Unset, remote paths
+// inside iCloud Drive (~/Library/Mobile Documents) are checked for
+// placeholders and others aren't.
+func icloudMode(cat config.Category) string {
+	if cat.ICloud != "" {
+		return cat.ICloud
+	}
+	if strings.Contains(cat.Remote, "Mobile Documents") {
+		return "warn"
+	}
+	return "off"
+}
+
+// placeholderName maps an iCloud placeholder, ".report.pdf.icloud", to the
+// file it stands for, "report.pdf".
+func placeholderName(p string) (string, bool) {
+	dir, base := path.Split(p)
+	name, ok := strings.CutSuffix(base, ".icloud")
+	if !ok || !strings.HasPrefix(name, ".") || len(name) < 2 {
+		return "", false
+	}
+	return dir + name[1:], true
+}
+
+// parsePlaceholders turns find -print0 output below root into the relative
+// paths of the files that are only in iCloud, minus the excluded ones.
+func parsePlaceholders(out []byte, root string, m *rsync.Matcher) []string {
+	prefix := strings.TrimRight(root, "/") + "/"
+	var names []string
+	for _, p := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		name, ok := placeholderName(strings.TrimPrefix(p, prefix))
+		if ok && !excludedWithParents(m, name, false) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func listPlaceholders(ctx context.Context, cfg *config.Config, cat config.Category, m *rsync.Matcher) ([]string, error) {
+	out, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("find %s -type f -name '.*.icloud' -print0", ssh.Quote(cat.Remote)))
+	if err != nil {
+		return nil, fmt.Errorf("look for iCloud placeholders: %w", err)
+	}
+	return parsePlaceholders(out, cat.Remote, m), nil
+}
+
+// prefetchICloud runs before a pull from a Mac. Files iCloud has evicted
+// exist there only as .<name>.icloud placeholders, which rsync copies
+// instead of the content. With icloud: download they are fetched with brctl
+// first; otherwise they're reported.
+func prefetchICloud(ctx context.Context, cfg *config.Config, cat config.Category, dryRun bool) error {
+	mode := icloudMode(cat)
+	if mode == "off" {
+		return nil
+	}
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	names, err := listPlaceholders(ctx, cfg, cat, m)
+	if err != nil {
+		return withExitCode(exitNetwork, err)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if mode != "download" || dryRun {
+		warnPlaceholders(names, "set icloud: download to fetch them first")
+		return nil
+	}
+	if system := remoteOS(ctx, cfg); system != "" && !strings.EqualFold(system, "darwin") {
+		return exitErrorf(exitConfig, "icloud: download needs brctl, which only exists on macOS (remote is %s)", system)
+	}
+
+	printAt(rsync.Normal, "Downloading %d file(s) from iCloud on %s\n", len(names), cfg.SSH.Host)
+	const batch = 200
+	for i := 0; i < len(names); i += batch {
+		var quoted []string
+		for _, n := range names[i:min(i+batch, len(names))] {
+			quoted = append(quoted, ssh.Quote(path.Join(cat.Remote, n)))
+		}
+		if _, err := ssh.RunContext(ctx, cfg.SSH, "for f in "+strings.Join(quoted, " ")+`; do brctl download "$f" || exit 1; done`); err != nil {
+			return withExitCode(exitNetwork, fmt.Errorf("brctl download: %w", err))
+		}
+	}
+
+	total := len(names)
+	deadline := time.Now().Add(icloudWait)
+	for len(names) > 0 && time.Now().Before(deadline) {
+		time.Sleep(icloudPoll)
+		if names, err = listPlaceholders(ctx, cfg, cat, m); err != nil {
+			return withExitCode(exitNetwork, err)
+		}
+		printAt(rsync.Normal, "\riCloud: %d of %d downloaded", total-len(names), total)
+	}
+	printAt(rsync.Normal, "\n")
+	if len(names) > 0 {
+		warnPlaceholders(names, fmt.Sprintf("still downloading after %s", icloudWait))
+	}
+	return nil
+}
+
+// warnPlaceholders reports files only their placeholders will be pulled for.
+func warnPlaceholders(names []string, hint string) {
+	fmt.Fprintf(os.Stderr, "warning: %d file(s) are only in iCloud and will be pulled as .icloud placeholders (%s):\n", len(names), hint)
+	for i, n := range names {
+		if i == 10 {
+			fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(names)-i)
+			break
+		}
+		fmt.Fprintln(os.Stderr, " ", n)
+	}
+	logger.Warn("iCloud placeholders", "count", len(names), "hint", hint)
+}
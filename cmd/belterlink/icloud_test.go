@@ -0,0 +1,43 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestParsePlaceholders(t *testing.T) {
+	root := "Library/Mobile Documents/com~apple~CloudDocs/Scores"
+	out := []byte(root + "/.Nocturne.pdf.icloud\x00" +
+		root + "/Bach/.Prelude 1.pdf.icloud\x00" +
+		root + "/drafts/.old.pdf.icloud\x00" +
+		root + "/notes.icloud\x00")
+	m, err := rsync.CategoryMatcher(config.Category{Exclude: []string{"drafts/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parsePlaceholders(out, root, m)
+	want := []string{"Nocturne.pdf", "Bach/Prelude 1.pdf"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("placeholders = %q, want %q", got, want)
+	}
+}
+
+func TestICloudMode(t *testing.T) {
+	tests := []struct {
+		cat  config.Category
+		want string
+	}{
+		{config.Category{Remote: "Library/Mobile Documents/com~apple~CloudDocs/Notes"}, "warn"},
+		{config.Category{Remote: "Library/Mobile Documents/com~apple~CloudDocs/Notes", ICloud: "off"}, "off"},
+		{config.Category{Remote: "Notes"}, "off"},
+		{config.Category{Remote: "iCloud/Notes", ICloud: "download"}, "download"},
+	}
+	for _, tt := range tests {
+		if got := icloudMode(tt.cat); got != tt.want {
+			t.Errorf("icloudMode(%+v) = %q, want %q", tt.cat, got, tt.want)
+		}
+	}
+}
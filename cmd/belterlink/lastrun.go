@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// lastRun is the result file written for each category after every run
+// that wasn't a dry run, for shell prompts and status bars to read.
+type lastRun struct {
+	RunSummary
+	Finished    time.Time `json:"finished"`
+	LastSuccess time.Time `json:"last_success,omitzero"` // kept across failed runs
+}
+
+// lastRunPath is <last_run_dir>/<Category>.json, by default in the state dir.
+func lastRunPath(cfg *config.Config, category string) string {
+	dir := cfg.LastRunDir
+	if dir == "" {
+		dir = filepath.Join(config.StateDir(cfg), "last")
+	}
+	return filepath.Join(dir, category+".json")
+}
+
+func readLastRun(cfg *config.Config, category string) (lastRun, error) {
+	var lr lastRun
+	b, err := os.ReadFile(lastRunPath(cfg, category))
+	if err != nil {
+		return lr, err
+	}
+	return lr, json.Unmarshal(b, &lr)
+}
+
+// recordLastRun replaces the category's result file with sum.
+func recordLastRun(cfg *config.Config, sum RunSummary, stats *rsync.Stats) error {
+	if sum.DryRun {
+		return nil
+	}
+	lr := lastRun{RunSummary: sum, Finished: time.Now()}
+	lr.Stats = stats
+	if sum.Status == "success" {
+		lr.LastSuccess = lr.Finished
+	} else if prev, err := readLastRun(cfg, sum.Category); err == nil {
+		lr.LastSuccess = prev.LastSuccess
+	}
+	b, err := json.MarshalIndent(lr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(lastRunPath(cfg, sum.Category), append(b, '\n'))
+}
+
+// lastFlags are the flags of "last".
+type lastFlags struct {
+	asJSON bool
+}
+
+func (f *lastFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.asJSON, "json", false, "print the result files as they are")
+}
+
+// runLastCommand implements "belterlink last [-json] <Category>...": the
+// outcome of each category's last run. It fails when one of them failed or
+// never ran, so prompts can just check the exit code.
+func runLastCommand(g *globals, args []string) error {
+	flags := newFlagSet("last")
+	g.register(flags)
+	var f lastFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() == 0 {
+		return exitErrorf(exitUsage, "usage: belterlink last [-json] <CategoryName>...")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	names, err := config.SelectCategories(cfg, flags.Args())
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	var errs []error
+	for _, name := range names {
+		lr, err := readLastRun(cfg, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("%s: never synced\n", name)
+			errs = append(errs, fmt.Errorf("%s: no run recorded", name))
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if f.asJSON {
+			b, _ := json.Marshal(lr)
+			fmt.Println(string(b))
+		} else {
+			fmt.Println(formatLastRun(lr, time.Now()))
+		}
+		if lr.Status != "success" {
+			errs = append(errs, fmt.Errorf("%s: last run failed", name))
+		}
+	}
+	if len(errs) > 0 {
+		return withExitCode(exitFailure, errors.Join(errs...))
+	}
+	return nil
+}
+
+func formatLastRun(lr lastRun, now time.Time) string {
+	ago := func(t time.Time) string { return now.Sub(t).Round(time.Second).String() + " ago" }
+	if lr.Status != "success" {
+		outcome := "failed"
+		if lr.Status == "aborted" {
+			outcome = "aborted"
+		}
+		s := fmt.Sprintf("%s: %s %s %s: %s", lr.Category, lr.Direction, outcome, ago(lr.Finished), lr.Error)
+		if !lr.LastSuccess.IsZero() {
+			s += fmt.Sprintf(" (last success %s)", ago(lr.LastSuccess))
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s: %s %s", lr.Category, lr.Direction, ago(lr.Finished))
+	if lr.Stats != nil {
+		s += fmt.Sprintf(", %d file(s), %s", lr.Stats.FilesTransferred, formatSize(lr.Stats.BytesTransferred))
+	}
+	return s
+}
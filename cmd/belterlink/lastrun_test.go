@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestRecordLastRun(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	ok := RunSummary{Category: "Notes", Direction: "pull", Status: "success", Started: time.Now()}
+	if err := recordLastRun(cfg, ok, &rsync.Stats{FilesTransferred: 2, BytesTransferred: 2048}); err != nil {
+		t.Fatalf("recordLastRun error: %v", err)
+	}
+	first, err := readLastRun(cfg, "Notes")
+	if err != nil {
+		t.Fatalf("readLastRun error: %v", err)
+	}
+	if first.LastSuccess.IsZero() || first.Stats == nil || first.Stats.FilesTransferred != 2 {
+		t.Fatalf("first run = %+v", first)
+	}
+
+	failed := RunSummary{Category: "Notes", Direction: "pull", Status: "failure", Error: "ssh: timeout", ExitCode: exitNetwork}
+	if err := recordLastRun(cfg, failed, nil); err != nil {
+		t.Fatalf("recordLastRun error: %v", err)
+	}
+	second, err := readLastRun(cfg, "Notes")
+	if err != nil {
+		t.Fatalf("readLastRun error: %v", err)
+	}
+	if second.Status != "failure" || !second.LastSuccess.Equal(first.LastSuccess) || second.Stats != nil {
+		t.Fatalf("failed run = %+v, want last success %v kept", second, first.LastSuccess)
+	}
+
+	dry := RunSummary{Category: "Piano", Direction: "push", Status: "success", DryRun: true}
+	if err := recordLastRun(cfg, dry, nil); err != nil {
+		t.Fatalf("recordLastRun error: %v", err)
+	}
+	if _, err := readLastRun(cfg, "Piano"); err == nil {
+		t.Fatalf("dry run was recorded")
+	}
+}
+
+func TestLastRunPath(t *testing.T) {
+	cfg := &config.Config{StateDir: "/state"}
+	if got, want := lastRunPath(cfg, "Notes"), filepath.Join("/state", "last", "Notes.json"); got != want {
+		t.Errorf("lastRunPath = %q, want %q", got, want)
+	}
+	cfg.LastRunDir = "/run/belterlink"
+	if got, want := lastRunPath(cfg, "Notes"), filepath.Join("/run/belterlink", "Notes.json"); got != want {
+		t.Errorf("lastRunPath = %q, want %q", got, want)
+	}
+}
+
+func TestFormatLastRun(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ok := lastRun{
+		RunSummary: RunSummary{Category: "Notes", Direction: "pull", Status: "success", Stats: &rsync.Stats{FilesTransferred: 4, BytesTransferred: 18637}},
+		Finished:   now.Add(-12 * time.Minute),
+	}
+	if got, want := formatLastRun(ok, now), "Notes: pull 12m0s ago, 4 file(s), 18.2K"; got != want {
+		t.Errorf("formatLastRun = %q, want %q", got, want)
+	}
+	failed := lastRun{
+		RunSummary:  RunSummary{Category: "Notes", Direction: "push", Status: "failure", Error: "ssh: timeout"},
+		Finished:    now.Add(-time.Minute),
+		LastSuccess: now.Add(-time.Hour),
+	}
+	if got, want := formatLastRun(failed, now), "Notes: push failed 1m0s ago: ssh: timeout (last success 1h0m0s ago)"; got != want {
+		t.Errorf("formatLastRun = %q, want %q", got, want)
+	}
+}
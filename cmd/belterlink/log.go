@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+const logFileName = "belterlink.log"
+
+// logger receives belterlink's own events. It discards everything until
+// setupLogging runs, so helpers can log unconditionally.
+var logger = slog.New(slog.DiscardHandler)
+
+// verbosity is how much belterlink prints, set by -q, -v and -vv. The log
+// file has its own level.
+var verbosity rsync.Verbosity
+
+// printAt prints to stdout when the verbosity is at least level: progress
+// at rsync.Normal, which -q silences, details at rsync.Verbose and up.
+func printAt(level rsync.Verbosity, format string, args ...any) {
+	if verbosity >= level {
+		fmt.Printf(format, args...)
+	}
+}
+
+// shellCommand joins args into a command line a POSIX shell runs as is.
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = ssh.Quote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// setupLogging points logger at the rotating log file. levelOverride (from
+// -log-level) wins over the config.
+func setupLogging(cfg config.Log, levelOverride string) (io.Closer, error) {
+	if cfg.Disable {
+		return io.NopCloser(nil), nil
+	}
+	levelName := cfg.Level
+	if levelOverride != "" {
+		levelName = levelOverride
+	}
+	level, err := parseLogLevel(levelName)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".belterlink", "logs")
+	}
+	maxSize := int64(cfg.MaxSizeMB) << 20
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+	maxAge := time.Duration(cfg.MaxAgeDays) * 24 * time.Hour
+	if maxAge <= 0 {
+		maxAge = 30 * 24 * time.Hour
+	}
+	w, err := openRotatingFile(dir, maxSize, maxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		logger = slog.New(runIDHandler{slog.NewTextHandler(w, opts)})
+	case "json":
+		logger = slog.New(runIDHandler{slog.NewJSONHandler(w, opts)})
+	default:
+		w.Close()
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", cfg.Format)
+	}
+	return w, nil
+}
+
+// currentRunID holds the ID of the run in progress, or "" between runs.
+var currentRunID atomic.Value
+
+// runIDHandler adds the ID of the run in progress to every record, so the
+// log lines of the run a notification is about can be found by its ID.
+type runIDHandler struct{ slog.Handler }
+
+func (h runIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, _ := currentRunID.Load().(string); id != "" {
+		r.AddAttrs(slog.String("run_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h runIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return runIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h runIDHandler) WithGroup(name string) slog.Handler {
+	return runIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logRunSummary writes the outcome of a run to the log.
+func logRunSummary(sum RunSummary, stats *rsync.Stats) {
+	attrs := []any{
+		"category", sum.Category,
+		"direction", sum.Direction,
+		"status", sum.Status,
+		"duration", time.Duration(sum.Duration * float64(time.Second)).Round(time.Millisecond),
+	}
+	if stats != nil {
+		attrs = append(attrs,
+			"files_scanned", stats.FilesScanned,
+			"files_created", stats.FilesCreated,
+			"files_transferred", stats.FilesTransferred,
+			"files_deleted", stats.FilesDeleted,
+			"bytes_transferred", stats.BytesTransferred,
+			"speedup", stats.Speedup)
+	}
+	if sum.Error != "" {
+		logger.Error("sync failed", append(attrs, "exit_code", sum.ExitCode, "error", sum.Error)...)
+		return
+	}
+	logger.Info("sync finished", attrs...)
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", name)
+}
+
+// rotatingFile appends to dir/belterlink.log and moves it aside as
+// belterlink-<timestamp>.log once it exceeds maxSize.
+type rotatingFile struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(dir string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{dir: dir, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	if r.size >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	r.prune()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(filepath.Join(r.dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := filepath.Join(r.dir, "belterlink-"+time.Now().Format("20060102T150405.000")+".log")
+	if err := os.Rename(filepath.Join(r.dir, logFileName), rotated); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// prune removes rotated logs older than maxAge.
+func (r *rotatingFile) prune() {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "belterlink-*.log"))
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err == nil && time.Since(info.ModTime()) > r.maxAge {
+			os.Remove(m)
+		}
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+		r.prune()
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileRotates(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openRotatingFile(dir, 64, time.Hour)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer w.Close()
+
+	line := []byte(strings.Repeat("x", 40) + "\n")
+	for range 3 {
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "belterlink-*.log"))
+	if len(rotated) == 0 {
+		t.Fatalf("expected a rotated log file in %s", dir)
+	}
+	info, err := os.Stat(filepath.Join(dir, logFileName))
+	if err != nil || info.Size() > 64 {
+		t.Fatalf("current log should be under the size limit: %v %v", info, err)
+	}
+}
+
+func TestRotatingFilePrunesOldLogs(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "belterlink-20200101T000000.000.log")
+	if err := os.WriteFile(old, []byte("old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openRotatingFile(dir, 1<<20, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	w.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be pruned", old)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, name := range []string{"", "debug", "INFO", "warn", "error"} {
+		if _, err := parseLogLevel(name); err != nil {
+			t.Fatalf("parseLogLevel(%q): %v", name, err)
+		}
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Fatalf("expected error for unknown level")
+	}
+}
+
+func TestRunIDHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(runIDHandler{slog.NewTextHandler(&buf, nil)}).With("category", "Notes")
+	currentRunID.Store("1a2b3c4d")
+	l.Info("during")
+	currentRunID.Store("")
+	l.Info("after")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "category=Notes run_id=1a2b3c4d") || strings.Contains(lines[1], "run_id") {
+		t.Fatalf("log:\n%s", buf.String())
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	got := shellCommand([]string{"rsync", "-e", "ssh -p 2222", "--exclude", "*.tmp", "/Users/me/My Notes/", "it's"})
+	want := `rsync -e 'ssh -p 2222' --exclude '*.tmp' '/Users/me/My Notes/' 'it'\''s'`
+	if got != want {
+		t.Fatalf("shellCommand = %s, want %s", got, want)
+	}
+}
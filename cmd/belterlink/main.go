@@ -0,0 +1,1350 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/crypt"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// RunOptions are the command-line settings for one run: the rsync options plus
+// the checks and path restrictions belterlink applies around rsync.
+type RunOptions struct {
+	rsync.Options
+
+	Yes            bool // skip interactive confirmations
+	NonInteractive bool // never prompt; refuse instead (the daemon)
+	Force          bool // skip the local source safety checks
+	Diff           bool // with DryRun: print a unified diff of the text files that would change
+
+	RunID string // identifies the run in the log and the audit log
+
+	Paths []string // restrict the transfer to these paths relative to the category root
+}
+
+// Overridden at build time with: -ldflags "-X main.version=vX.Y.Z"
+var version = "dev"
+
+func main() {
+	// started by ssh as SSH_ASKPASS, with the prompt as the only argument
+	if cfgPath := os.Getenv(askpassEnv); cfgPath != "" && len(os.Args) == 2 && strings.Contains(os.Args[1], " ") {
+		if err := runAskpass(cfgPath, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "belterlink:", err)
+			os.Exit(exitFailure)
+		}
+		return
+	}
+
+	// Flags
+	g := &globals{cfgPath: config.DefaultPath()}
+	g.register(flag.CommandLine)
+	g.sync.register(flag.CommandLine)
+	var sets stringList
+	flag.Var(&sets, "set", "override a setting for this run: `key=value`, or key+=value to add to a list (repeatable)")
+	showHelp := flag.Bool("help", false, "show help")
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) > 0 && os.Args[len(os.Args)-len(args)-1] != "--" {
+		if _, ok := findCommand(args[0]); !ok {
+			// belterlink Notes push -dry-run: the flags may also follow the
+			// categories and the direction (a command parses its own)
+			args, _ = parseInterleaved(flag.CommandLine, args) // exits on a bad flag
+		}
+	}
+
+	if *showVersion {
+		fmt.Println("belterlink: ", version)
+		return
+	}
+
+	if err := config.SetOverrides(sets); err != nil {
+		failCode(exitUsage, "%v", err)
+	}
+	if len(args) > 0 {
+		if c, ok := findCommand(args[0]); ok {
+			if err := c.run(g, args[1:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				failCode(errorExitCode(err), "%v", err)
+			}
+			return
+		}
+	}
+	if *showHelp || len(args) == 0 {
+		printHelp()
+		return
+	}
+	if err := runSync(g, args); err != nil {
+		failCode(errorExitCode(err), "%v", err)
+	}
+}
+
+// syncFlags are the flags of a run, given before the categories or
+// anywhere after the sync command.
+type syncFlags struct {
+	dryRun, diff, delete, checksum, yes, force bool
+	printCmdOnly, bg                           bool
+
+	paths     stringList
+	filesFrom string
+	retries   optionalInt
+}
+
+// register adds the flags to fs, with their current values as defaults.
+func (s *syncFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&s.dryRun, "dry-run", s.dryRun, "show what would change without writing")
+	fs.BoolVar(&s.diff, "diff", s.diff, "with -dry-run: show a unified diff of the text files that would change")
+	fs.BoolVar(&s.delete, "delete", s.delete, "delete files on destination that were deleted at source (can be defaulted in config)")
+	fs.BoolVar(&s.checksum, "checksum", s.checksum, "use checksums to detect changes (slower, can be defaulted in config)")
+	fs.BoolVar(&s.yes, "yes", s.yes, "don't ask for confirmation (e.g. when more than max_delete files would be deleted)")
+	fs.Var(&s.paths, "path", "only sync this file or directory, `rel`ative to the category root (repeatable)")
+	fs.StringVar(&s.filesFrom, "files-from", s.filesFrom, "only sync the paths listed in this `file`, one per line (- reads stdin)")
+	fs.BoolVar(&s.force, "force", s.force, "push even if the local directory is missing, empty or an unmounted mountpoint, or the remote looks too full")
+	fs.Var(&s.retries, "retries", "retry rsync up to `n` times on transient network failures (can be defaulted in config)")
+	fs.BoolVar(&s.printCmdOnly, "print-cmd-only", s.printCmdOnly, "print the rsync command of each category, quoted for a shell, instead of running it")
+	fs.BoolVar(&s.bg, "bg", s.bg, "run rsync at low CPU and disk priority with a bandwidth limit (can be defaulted in config as low_priority)")
+}
+
+// optionalInt is an int flag that tells whether it was given.
+type optionalInt struct {
+	n   int
+	set bool
+}
+
+func (o *optionalInt) String() string {
+	if o == nil || !o.set {
+		return ""
+	}
+	return strconv.Itoa(o.n)
+}
+
+func (o *optionalInt) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New("not a whole number")
+	}
+	o.n, o.set = n, true
+	return nil
+}
+
+// options are the RunOptions the flags ask for, without a direction.
+func (s syncFlags) options() RunOptions {
+	return RunOptions{
+		Options: rsync.Options{DryRun: s.dryRun, Delete: s.delete, Checksum: s.checksum, Verbosity: verbosity, LowPriority: s.bg},
+		Yes:     s.yes,
+		Force:   s.force,
+		Diff:    s.diff,
+		Paths:   s.paths,
+	}
+}
+
+// runSyncCommand implements "belterlink sync": the main form, with its
+// flags before, between or after the categories and the direction.
+func runSyncCommand(g *globals, args []string) error {
+	flags := newFlagSet("sync")
+	g.register(flags)
+	g.sync.register(flags)
+	rest, err := parseInterleaved(flags, args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	return runSync(g, rest)
+}
+
+// runSync runs the categories selected by args, the patterns followed by the
+// direction, one after the other.
+func runSync(g *globals, args []string) error {
+	s := g.sync
+	patterns, direction, err := parseArgs(args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if s.diff && !s.dryRun {
+		return exitErrorf(exitUsage, "-diff only works with -dry-run")
+	}
+
+	// Load config
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+
+	logFile, err := setupLogging(cfg.Log, g.logLevel)
+	if err != nil {
+		return exitErrorf(exitConfig, "logging: %v", err)
+	}
+	defer logFile.Close()
+
+	maxRetries := s.retries.n
+	if !s.retries.set && cfg.Defaults.Retries != nil {
+		maxRetries = *cfg.Defaults.Retries
+	}
+	opts := s.options()
+
+	if s.filesFrom != "" {
+		listed, err := readFileList(s.filesFrom)
+		if err != nil {
+			return exitErrorf(exitUsage, "files-from: %v", err)
+		}
+		if len(listed) == 0 {
+			printAt(rsync.Normal, "files-from: no paths listed; nothing to do\n")
+			return nil
+		}
+		opts.Paths = append(opts.Paths, listed...)
+	}
+
+	names, err := config.SelectCategories(cfg, patterns)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if cfg.SSH.User == "" || cfg.SSH.Host == "" {
+		// backend categories don't go through ssh
+		for _, name := range names {
+			if cfg.Categories[name].Backend == "" {
+				return exitErrorf(exitConfig, "ssh.user and ssh.host are required in config")
+			}
+		}
+	}
+	dirs, err := categoryDirections(cfg, names, direction)
+	if err != nil {
+		return err
+	}
+	if s.printCmdOnly {
+		// the command comes out the same offline: ssh.host as configured,
+		// and the options fitted to the cached probe, if there is one
+		cachedProbeOnly = true
+		for _, name := range names {
+			opts.Direction = dirs[name]
+			run, err := planRun(context.Background(), cfg, name, opts)
+			if err != nil {
+				return err
+			}
+			fmt.Println(run.command())
+		}
+		return nil
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	var summaries []RunSummary
+	exit := 0
+	for _, name := range names {
+		opts.Direction = dirs[name]
+		if len(names) > 1 {
+			printAt(rsync.Normal, "==> %s %s\n", name, opts.Direction)
+		}
+		sum, err := runCategory(ctx, cfg, name, opts, maxRetries)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s [run %s]: %v\n", name, sum.RunID, err)
+			if exit == 0 || errorExitCode(err) == exitAborted {
+				exit = errorExitCode(err)
+			}
+		}
+		summaries = append(summaries, sum)
+		if ctx.Err() != nil {
+			break // the remaining categories don't start
+		}
+	}
+	if len(summaries) > 1 && verbosity > rsync.Quiet || verbosity >= rsync.Verbose {
+		printSummaries(summaries)
+	}
+	if exit != 0 {
+		logFile.Close()
+		os.Exit(exit) // each failure was reported above
+	}
+	return nil
+}
+
+// runCategory syncs one category and reports the run to the log, the
+// notification sinks, the metrics file and the last-run file.
+func runCategory(ctx context.Context, cfg *config.Config, name string, opts RunOptions, maxRetries int) (RunSummary, error) {
+	started := time.Now()
+	opts.RunID = newRunID()
+	currentRunID.Store(opts.RunID)
+	defer currentRunID.Store("")
+	if t := config.RunTimeout(cfg, cfg.Categories[name]); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, t, runTimeoutError{t})
+		defer cancel()
+	}
+	logger.Info("sync started", "category", name, "direction", opts.Direction, "dry_run", opts.DryRun)
+	stats, err := syncCategory(ctx, cfg, name, opts, maxRetries)
+	sum := newRunSummary(name, opts, started, err)
+	sum.Stats = stats
+	if err == nil {
+		printAt(rsync.Normal, "%s\n", formatRunStats(sum))
+	}
+	logRunSummary(sum, stats)
+	sendNotifications(cfg, sum)
+	if merr := recordMetrics(cfg, sum, stats); merr != nil {
+		fmt.Fprintln(os.Stderr, "warning: metrics:", merr)
+		logger.Warn("metrics not recorded", "error", merr)
+	}
+	if lerr := recordLastRun(cfg, sum, stats); lerr != nil {
+		fmt.Fprintln(os.Stderr, "warning: last run:", lerr)
+		logger.Warn("last run not recorded", "error", lerr)
+	}
+	return sum, err
+}
+
+// formatRunStats is the line printed after each successful run, e.g.
+// "Notes push [run 1a2b3c4d]: 1204 files scanned, 2 created, 1 deleted, 5 transferred (12.1K), speedup 7515.82, 3.2s".
+func formatRunStats(sum RunSummary) string {
+	s := sum.Category + " " + sum.Direction
+	if sum.RunID != "" {
+		s += " [run " + sum.RunID + "]"
+	}
+	if sum.DryRun {
+		s += " (dry run)"
+	}
+	if st := sum.Stats; st != nil {
+		s += fmt.Sprintf(": %d files scanned, %d created, %d deleted, %d transferred (%s), speedup %.2f,",
+			st.FilesScanned, st.FilesCreated, st.FilesDeleted, st.FilesTransferred, formatSize(st.BytesTransferred), st.Speedup)
+	} else {
+		s += ":"
+	}
+	return s + fmt.Sprintf(" %.1fs", sum.Duration)
+}
+
+// printSummaries prints one line per category after a multi-category run.
+func printSummaries(summaries []RunSummary) {
+	width := 0
+	for _, s := range summaries {
+		width = max(width, len(s.Category))
+	}
+	fmt.Println("\nSummary:")
+	for _, s := range summaries {
+		status := "ok"
+		if s.Status != "success" {
+			status = fmt.Sprintf("FAILED (exit %d)", s.ExitCode)
+		}
+		fmt.Printf("  %-*s  %s  %s  %6.1fs  %s\n", width, s.Category, s.Direction, s.RunID, s.Duration, status)
+	}
+}
+
+// resolveRsyncOptions fills in the options of a run of cat that depend on
+// the config and on the rsyncs and systems at both ends.
+func resolveRsyncOptions(ctx context.Context, cfg *config.Config, cat config.Category, opts *RunOptions) error {
+	localVersion, remoteVersion := rsyncVersions(ctx, cfg)
+	prepareXattrs(ctx, cfg, cat, opts, localVersion, remoteVersion)
+	if config.GetBool(false, cat.NormalizeUnicode, config.GetBool(false, cfg.Defaults.NormalizeUnicode, false)) {
+		opts.Iconv = iconvCharsets(runtime.GOOS, remoteOS(ctx, cfg))
+	}
+	var err error
+	opts.Compress, opts.CompressChoice, err = rsync.ResolveCompression(cfg, cat, localVersion, remoteVersion)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	opts.WholeFile, err = rsync.ResolveWholeFile(cfg, cat)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if opts.TempDir, err = resolveTempDir(cfg, cat, opts.Direction); err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if rsync.Backup(cfg, cat) && !opts.DryRun && opts.RunID != "" {
+		opts.BackupDir = path.Join(rsync.BackupDir, opts.RunID)
+	}
+	opts.LowPriority = opts.LowPriority || rsync.LowPriority(cfg, cat)
+	return nil
+}
+
+// runRsync runs rsync with args, at low priority if opts ask for it.
+func runRsync(ctx context.Context, cfg *config.Config, opts rsync.Options, args []string, stdout io.Writer) error {
+	if opts.LowPriority {
+		return rsync.RunLowPriority(ctx, cfg, args, stdout)
+	}
+	return rsync.Run(ctx, cfg, args, stdout)
+}
+
+// rsyncCommand prepares rsync with args for a pass of its own (a preview or
+// a check), at low priority if opts ask for it, like the run itself.
+func rsyncCommand(ctx context.Context, cfg *config.Config, opts rsync.Options, args ...string) *exec.Cmd {
+	if opts.LowPriority {
+		return rsync.LowPriorityCommand(ctx, cfg, args...)
+	}
+	return rsync.Command(ctx, cfg, args...)
+}
+
+// categoryRsyncArgs returns the rsync arguments of a run of cat with opts as
+// resolved by resolveRsyncOptions, fitted to the rsyncs at both ends. A run
+// that isn't a dry run asks for --stats, for the metrics and the last-run
+// file.
+func categoryRsyncArgs(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions) ([]string, error) {
+	rsArgs, err := rsync.BuildArgs(cfg, cat, opts.Options)
+	if err != nil {
+		return nil, fmt.Errorf("build rsync args: %w", err)
+	}
+	rsArgs = adaptRsyncArgs(ctx, cfg, rsArgs)
+	// --stats must precede the paths
+	if !opts.DryRun && !slices.Contains(rsArgs, "--stats") {
+		rsArgs = rsync.InsertBeforePaths(rsArgs, "--stats")
+	}
+	return rsArgs, nil
+}
+
+// syncCategory runs the preflight checks and rsync for one category. Stats are
+// only returned when rsync was asked for them (metrics enabled).
+func syncCategory(ctx context.Context, cfg *config.Config, categoryName string, opts RunOptions, maxRetries int) (*rsync.Stats, error) {
+	cat, ok := cfg.Categories[categoryName]
+	if !ok {
+		return nil, exitErrorf(exitConfig, "category %q not found in config", categoryName)
+	}
+	if opts.Diff && (cat.Backend != "" || cat.Transport == "agent" || cat.Encrypted || cat.FromHost != "" || config.IsDaemonURL(cat.Remote) || cat.Mount != "" || cat.Drive != "") {
+		fmt.Fprintf(os.Stderr, "warning: -diff needs rsync over ssh and an unencrypted category on this machine; %s is shown without diffs\n", categoryName)
+	}
+	if ro := config.ReadonlySide(cat, opts.Direction); ro != "" {
+		side := "the remote"
+		if ro == "readonly_local" {
+			side = cat.Local
+		}
+		return nil, exitErrorf(exitRefused, "category %q has %s: refusing to %s, which would write to %s", categoryName, ro, opts.Direction, side)
+	}
+	if rsync.AppendOnly(cat) {
+		if opts.Direction == "sync" || opts.Direction == "backup" {
+			return nil, exitErrorf(exitUsage, "category %q is archive-append, which only pushes and pulls new files; use push or pull", categoryName)
+		}
+		if opts.Delete {
+			fmt.Fprintf(os.Stderr, "warning: %s is archive-append, which never deletes; -delete is ignored\n", categoryName)
+		}
+		opts.NoDelete = true
+	}
+	if cat.Backend != "" {
+		if opts.Direction == "sync" || opts.Direction == "backup" {
+			return nil, exitErrorf(exitUsage, "category %q uses the %s backend; %s needs rsync, use push or pull", categoryName, cat.Backend, opts.Direction)
+		}
+		return syncViaBackend(cfg, categoryName, cat, opts)
+	}
+	if cat.FromHost != "" {
+		return syncRemoteToRemote(ctx, cfg, categoryName, cat, opts, maxRetries)
+	}
+	if config.IsDaemonURL(cat.Remote) || cat.Mount != "" || cat.Drive != "" {
+		return syncWithoutSSH(ctx, cfg, categoryName, cat, opts, maxRetries)
+	}
+	if opts.Direction == "backup" && config.RemoteProfile(cfg).NoHardLinks {
+		return nil, exitErrorf(exitUsage, "category %q: ssh.profile %s can't hold the hard links backup snapshots share unchanged files through; use push", categoryName, cfg.SSH.Profile)
+	}
+	if err := pickAddress(cfg); err != nil {
+		return nil, err
+	}
+	if err := ensureHostKey(cfg, opts); err != nil {
+		return nil, err
+	}
+	if opts.Direction == "sync" {
+		if cat.Encrypted {
+			return nil, exitErrorf(exitUsage, "category %q is encrypted; sync needs to read the remote files, use push or pull", categoryName)
+		}
+		if len(cat.Transforms) > 0 {
+			return nil, exitErrorf(exitUsage, "category %q has transforms, which only apply to push and backup; use push or pull", categoryName)
+		}
+		return syncViaHub(ctx, cfg, categoryName, opts, maxRetries)
+	}
+	if cat.Transport == "agent" {
+		if opts.Direction == "backup" {
+			return nil, exitErrorf(exitUsage, "category %q uses transport: agent; backup needs rsync's --link-dest", categoryName)
+		}
+		return syncViaAgent(ctx, cfg, categoryName, cat, opts)
+	}
+	var snap *snapshot
+	if opts.Direction == "backup" {
+		if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+			return nil, err
+		}
+		var err error
+		if snap, err = prepareSnapshot(ctx, cfg, categoryName, &cat, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	live := cat.Local
+	if len(opts.Paths) > 0 {
+		list, err := writeFileList(cat.Local, opts.Paths)
+		if err != nil {
+			return nil, withExitCode(exitUsage, err)
+		}
+		defer os.Remove(list)
+		opts.FilesFrom = list
+	}
+	var staged *stagedPull
+	if cat.AtomicPull && opts.Direction == "pull" && !opts.DryRun {
+		if staged, err = prepareStaging(live); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(staged.dir) // a no-op once swapped in
+		cat.Local = staged.dir
+	}
+	var key *crypt.Key
+	var matcher *rsync.Matcher
+	if cat.Encrypted {
+		if opts.FilesFrom != "" {
+			return nil, exitErrorf(exitUsage, "category %q is encrypted; -path and -files-from can't select files in its encrypted mirror", categoryName)
+		}
+		if key, err = loadEncryptionKey(cfg, cat); err != nil {
+			return nil, exitErrorf(exitConfig, "category %q: encryption_key: %v", categoryName, err)
+		}
+		if matcher, err = rsync.CategoryMatcher(cat); err != nil {
+			return nil, withExitCode(exitConfig, err)
+		}
+		// the mirror starts as the local tree, so a pull into it changes
+		// exactly what a pull into the local tree would
+		mirror := encryptedMirror(cfg, categoryName)
+		if err := sealTree(key, live, mirror, matcher); err != nil {
+			return nil, fmt.Errorf("encrypt %s: %w", live, err)
+		}
+		cat.Local = mirror
+		cat.Exclude, cat.OnlyExtensions = nil, nil // applied by sealTree; rsync only sees encrypted names
+	}
+	if cat, err = applyTransforms(ctx, cfg, categoryName, cat, opts.Direction); err != nil {
+		return nil, err
+	}
+	warnAboutTarget(ctx, cfg, cat)
+	if err := resolveRsyncOptions(ctx, cfg, cat, &opts); err != nil {
+		return nil, err
+	}
+	if opts.TempDir != "" && !cat.Inplace && !opts.DryRun {
+		if err := checkTempDir(ctx, cfg, cat, opts.Direction, opts.TempDir); err != nil {
+			return nil, withExitCode(exitConfig, err)
+		}
+	}
+	rsArgs, err := categoryRsyncArgs(ctx, cfg, cat, opts)
+	if err != nil {
+		return nil, err
+	}
+	// capture the output for the metrics and the last-run file, and for
+	// case_collisions: warn
+	var captured *bytes.Buffer
+	if !opts.DryRun || caseCollisions(cfg, cat) == "warn" {
+		captured = &bytes.Buffer{}
+	}
+
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return nil, err
+	}
+
+	if err := checkClockSkew(ctx, cfg); err != nil {
+		return nil, withExitCode(preflightExitCode(err), err)
+	}
+
+	if err := checkAnchor(ctx, cfg.SSH, cat, opts.Direction); err != nil {
+		return nil, err
+	}
+
+	if err := checkDestinationNames(ctx, cfg, cat, opts, live); err != nil {
+		return nil, err
+	}
+
+	if opts.Direction == "pull" {
+		if err := prefetchICloud(ctx, cfg, cat, opts.DryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Direction == "push" {
+		if !opts.Force {
+			if err := checkLocalSource(live); err != nil {
+				return nil, withExitCode(exitRefused, fmt.Errorf("%w; re-run with -force if this is intended", err))
+			}
+		}
+		if err := ensureRemoteDir(ctx, cfg.SSH, cat, opts.DryRun); err != nil {
+			return nil, withExitCode(preflightExitCode(err), err)
+		}
+		if rsync.DetectRenames(cfg, cat) {
+			if err := moveRenamedOnRemote(ctx, cfg, categoryName, cat, opts.DryRun); err != nil {
+				return nil, err
+			}
+		}
+		if !opts.DryRun && !opts.Force && config.GetBool(false, cat.CheckSpace, config.GetBool(false, cfg.Defaults.CheckSpace, false)) {
+			if err := checkRemoteSpace(ctx, cfg, cat, opts.Options, rsArgs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if rsync.ResolveDelete(cfg, opts.Options) && !opts.DryRun {
+		rsArgs, err = confirmDeletions(ctx, cfg, cat, opts, rsArgs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cat.Git && opts.Direction == "push" && !opts.DryRun {
+		if err := gitCommit(live, "belterlink pre-push"); err != nil {
+			return nil, fmt.Errorf("git safety commit: %w", err)
+		}
+	}
+
+	var audit []auditEntry
+	if auditEnabled(cfg) && !opts.DryRun {
+		if audit, err = previewAudit(ctx, cfg, categoryName, cat, opts, rsArgs); err != nil {
+			warnAuditPreview(categoryName, err)
+		}
+	}
+
+	if opts.BackupDir != "" {
+		if err := pruneBackups(ctx, cfg, cat, receivingSide(opts.Direction), opts.RunID); err != nil {
+			return nil, fmt.Errorf("remove the backups of earlier runs: %w", err)
+		}
+	}
+
+	verifyAfter := !opts.DryRun && config.GetBool(false, cat.VerifyAfter, config.GetBool(false, cfg.Defaults.VerifyAfter, false))
+
+	if opts.Diff && !cat.Encrypted {
+		if err := printDryRunDiff(ctx, cfg, cat, opts, rsArgs); err != nil {
+			return nil, fmt.Errorf("diff: %w", err)
+		}
+	}
+
+	if staged != nil {
+		itemized, err := itemizedOutput(ctx, cfg, opts.Options, rsArgs, false)
+		if err != nil {
+			return nil, fmt.Errorf("atomic_pull: %w", err)
+		}
+		if err := staged.unshare(itemized); err != nil {
+			return nil, err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, abortedError(ctx)
+	}
+	printAt(rsync.Normal, "Running: %s\n", shellCommand(append([]string{rsync.Binary(cfg)}, rsArgs...)))
+	logger.Debug("running rsync", "args", rsArgs)
+
+	for attempt := 0; ; attempt++ {
+		var stdout io.Writer = os.Stdout
+		if verbosity == rsync.Quiet {
+			stdout = io.Discard
+		}
+		if captured != nil {
+			captured.Reset()
+			stdout = io.MultiWriter(stdout, captured)
+		}
+		err := runRsync(ctx, cfg, opts.Options, rsArgs, stdout)
+		if err == nil || attempt >= maxRetries || !rsync.IsRetryable(rsync.ExitCode(err)) || ctx.Err() != nil {
+			recordAudit(cfg, audit, err)
+		}
+		var stats *rsync.Stats
+		if captured != nil && !opts.DryRun {
+			st := rsync.ParseStats(captured.String())
+			stats = &st
+		}
+		if err == nil {
+			if captured != nil {
+				warnDestinationNames(ctx, cfg, cat, opts, live, captured.String())
+			}
+			if verifyAfter {
+				err = verifyTransfer(ctx, cfg, opts.Options, rsArgs)
+			}
+			if err == nil && snap != nil && !opts.DryRun {
+				err = snap.finish(ctx, cfg)
+			}
+			if cat.Encrypted {
+				if err == nil && opts.Direction == "pull" && !opts.DryRun {
+					err = openTree(key, cat.Local, live, matcher, rsync.ResolveDelete(cfg, opts.Options))
+				}
+				cat.Local = live
+			}
+			if staged != nil {
+				if err != nil {
+					return stats, err // verification failed: keep the live tree
+				}
+				if err := staged.swapIn(); err != nil {
+					return stats, err
+				}
+				cat.Local = live
+			}
+			if rsync.DetectRenames(cfg, cat) && !opts.DryRun {
+				if serr := saveInodes(cfg, categoryName, cat); serr != nil {
+					fmt.Fprintln(os.Stderr, "warning: saving file inodes:", serr)
+					logger.Warn("inodes not saved", "category", categoryName, "error", serr)
+				}
+			}
+			if cat.Git && opts.Direction == "pull" && !opts.DryRun {
+				if gerr := gitCommit(cat.Local, "belterlink post-pull"); gerr != nil {
+					fmt.Fprintln(os.Stderr, "warning: git commit after pull:", gerr)
+					logger.Warn("git commit after pull failed", "error", gerr)
+				}
+			}
+			return stats, err
+		}
+		if ctx.Err() != nil {
+			return stats, abortedError(ctx) // rsync was stopped; don't retry
+		}
+		code := rsync.ExitCode(err)
+		if attempt >= maxRetries || !rsync.IsRetryable(code) {
+			return stats, exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+		}
+		wait := backoff(attempt)
+		fmt.Fprintf(os.Stderr, "rsync failed with exit code %d (transient); retrying in %s (%d/%d)\n",
+			code, wait.Round(time.Millisecond), attempt+1, maxRetries)
+		logger.Warn("retrying rsync", "exit_code", code, "reason", explainRsyncExit(code), "wait", wait, "attempt", attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return stats, abortedError(ctx)
+		}
+	}
+}
+
+// Exit codes, so scripts wrapping belterlink can branch on the failure class.
+const (
+	exitFailure  = 1 // anything not covered below
+	exitUsage    = 2 // bad flags or arguments
+	exitConfig   = 3 // config missing/invalid, unknown category
+	exitNetwork  = 4 // ssh connection, socket or timeout problems
+	exitPartial  = 5 // partial transfer (e.g. permission denied, --max-delete hit)
+	exitVanished = 6 // source files vanished during the transfer
+	exitRefused  = 7 // a safety check refused to run (e.g. too many deletions)
+	exitDiffers  = 8 // verification found differences between the two sides
+	exitAborted  = 9 // stopped by SIGINT or SIGTERM
+)
+
+// exitError carries the exit code belterlink should terminate with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+func exitErrorf(code int, format string, a ...any) error {
+	return withExitCode(code, fmt.Errorf(format, a...))
+}
+
+// errorExitCode returns the exit code attached to err, defaulting to exitFailure.
+func errorExitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
+type rsyncExit struct {
+	desc string
+	code int // belterlink exit code
+}
+
+// rsyncExits maps rsync's exit codes (see rsync(1) EXIT VALUES) to an
+// explanation and belterlink's exit code.
+var rsyncExits = map[int]rsyncExit{
+	1:   {"syntax or usage error", exitFailure},
+	2:   {"protocol incompatibility between local and remote rsync", exitFailure},
+	3:   {"errors selecting input/output files or directories", exitFailure},
+	4:   {"requested action not supported by this rsync", exitFailure},
+	5:   {"error starting client-server protocol", exitNetwork},
+	6:   {"daemon unable to append to log file", exitFailure},
+	10:  {"error in socket I/O", exitNetwork},
+	11:  {"error in file I/O (disk full or read-only destination?)", exitFailure},
+	12:  {"error in rsync protocol data stream (connection dropped?)", exitNetwork},
+	13:  {"errors with program diagnostics", exitFailure},
+	14:  {"error in IPC code", exitFailure},
+	20:  {"received SIGUSR1 or SIGINT", exitFailure},
+	21:  {"some error returned by waitpid()", exitFailure},
+	22:  {"error allocating core memory buffers", exitFailure},
+	23:  {"partial transfer due to error (often permission denied)", exitPartial},
+	24:  {"partial transfer due to vanished source files", exitVanished},
+	25:  {"--max-delete limit stopped deletions", exitPartial},
+	30:  {"timeout in data send/receive", exitNetwork},
+	35:  {"timeout waiting for daemon connection", exitNetwork},
+	255: {"ssh connection failed (host unreachable or auth rejected?)", exitNetwork},
+}
+
+func explainRsyncExit(code int) string {
+	if e, ok := rsyncExits[code]; ok {
+		return e.desc
+	}
+	return "unknown error"
+}
+
+func rsyncExitCode(code int) int {
+	if e, ok := rsyncExits[code]; ok {
+		return e.code
+	}
+	return exitFailure
+}
+
+// preflightExitCode classifies errors from the ssh-based checks: ssh exiting
+// with 255 means we never reached the remote, anything else is a setup problem.
+func preflightExitCode(err error) int {
+	if rsync.ExitCode(err) == 255 {
+		return exitNetwork
+	}
+	return exitConfig
+}
+
+// backoff returns the delay before retry number attempt+1: exponential from
+// 2s, capped at one minute, with jitter so parallel jobs don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := time.Minute
+	if attempt < 5 {
+		d = min(2*time.Second<<attempt, time.Minute)
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// ensureRemoteDir makes sure a push has a sane destination: with create_remote
+// the directory is created, otherwise at least its parent must already exist so
+// a typo doesn't end up as a fresh directory in the wrong place.
+func ensureRemoteDir(ctx context.Context, s config.SSH, cat config.Category, dryRun bool) error {
+	dir := strings.TrimRight(cat.Remote, "/")
+	if dir == "" {
+		return nil
+	}
+	parent := path.Dir(dir)
+	script := fmt.Sprintf("if [ -d %s ]; then echo exists; elif [ -d %s ]; then echo parent; else echo missing; fi",
+		ssh.Quote(dir), ssh.Quote(parent))
+	out, err := ssh.RunContext(ctx, s, script)
+	if err != nil {
+		return fmt.Errorf("check remote directory: %w", err)
+	}
+	state := strings.TrimSpace(string(out))
+	if state == "exists" {
+		return nil
+	}
+	if cat.CreateRemote {
+		if dryRun {
+			printAt(rsync.Normal, "Would create remote directory: %s\n", dir)
+			return nil
+		}
+		printAt(rsync.Normal, "Creating remote directory: %s\n", dir)
+		if _, err := ssh.RunContext(ctx, s, "mkdir -p -- "+ssh.Quote(dir)); err != nil {
+			return fmt.Errorf("create remote directory: %w", err)
+		}
+		return nil
+	}
+	if state == "missing" {
+		return fmt.Errorf("remote parent directory %q does not exist on %s (typo in remote path? set create_remote: true to create it)", parent, s.Host)
+	}
+	return nil
+}
+
+// checkClockSkew guards --update: if the clocks disagree, mtime comparison can
+// silently pick the wrong side.
+func checkClockSkew(ctx context.Context, cfg *config.Config) error {
+	maxSkew := 5
+	if cfg.Defaults.MaxClockSkew != nil {
+		maxSkew = *cfg.Defaults.MaxClockSkew
+	}
+	if maxSkew <= 0 {
+		return nil
+	}
+	skew, err := ssh.ClockSkew(ctx, cfg.SSH)
+	if err != nil {
+		return fmt.Errorf("clock skew check: %w", err)
+	}
+	return evalClockSkew(skew, time.Duration(maxSkew)*time.Second, cfg.Defaults.ClockSkewAction)
+}
+
+func evalClockSkew(skew, limit time.Duration, action string) error {
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	// date +%s has one second resolution
+	if abs <= limit+time.Second {
+		return nil
+	}
+	msg := fmt.Sprintf("remote clock differs from local by %s (limit %s); --update may pick the wrong side", skew.Round(time.Second), limit)
+	switch action {
+	case "", "warn":
+		fmt.Fprintln(os.Stderr, "warning:", msg)
+		logger.Warn("clock skew", "skew", skew, "limit", limit)
+		return nil
+	case "abort":
+		return errors.New(msg)
+	default:
+		return fmt.Errorf("invalid clock_skew_action %q (want warn or abort)", action)
+	}
+}
+
+// directions are the last argument of the main form.
+var directions = []string{"push", "pull", "sync", "backup"}
+
+// directionAliases are the other names a direction goes by on the command
+// line.
+var directionAliases = map[string]string{"up": "push", "down": "pull"}
+
+// parseDirection returns the direction s names (case doesn't matter), or "".
+func parseDirection(s string) string {
+	s = strings.ToLower(s)
+	if d, ok := directionAliases[s]; ok {
+		return d
+	}
+	if slices.Contains(directions, s) {
+		return s
+	}
+	return ""
+}
+
+// parseArgs splits "<Category>... [push|pull|sync|backup]" into category
+// patterns and the direction; without one the direction is "", and each
+// category runs in its default_direction.
+func parseArgs(args []string) ([]string, string, error) {
+	if len(args) == 0 {
+		return nil, "", errors.New("missing required arguments: <CategoryName>... <push|pull|sync|backup>")
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return nil, "", fmt.Errorf("unexpected flag %q among the categories", arg)
+		}
+		if i < len(args)-1 && parseDirection(arg) != "" {
+			return nil, "", fmt.Errorf("the direction (%s) must come last", arg)
+		}
+	}
+	if direction := parseDirection(args[len(args)-1]); direction != "" {
+		if len(args) == 1 {
+			return nil, "", errors.New("missing required arguments: <CategoryName>... <push|pull|sync|backup>")
+		}
+		return args[:len(args)-1], direction, nil
+	}
+	return args, "", nil
+}
+
+// categoryDirections resolves the direction of each of names: the one given
+// on the command line, else the category's default_direction.
+func categoryDirections(cfg *config.Config, names []string, direction string) (map[string]string, error) {
+	dirs := map[string]string{}
+	for _, name := range names {
+		dirs[name] = cmp.Or(direction, cfg.Categories[name].DefaultDirection)
+		if dirs[name] == "" {
+			return nil, exitErrorf(exitUsage, "%s has no default_direction; say push, pull, sync or backup (or up, down)", name)
+		}
+	}
+	return dirs, nil
+}
+
+func fail(format string, a ...any) {
+	failCode(exitFailure, format, a...)
+}
+
+func failCode(code int, format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", a...)
+	os.Exit(code)
+}
+
+func printHelp() {
+	fmt.Print(`belterlink — simple, config-driven rsync wrapper (one-way by choice)
+
+USAGE:
+`)
+	printUsage(os.Stdout)
+	fmt.Print("\nFLAGS (before or after a command's name; a command's own flags: belterlink help <command>):\n")
+	printFlags(os.Stdout, flag.CommandLine)
+	fmt.Print(`
+EXAMPLES:
+  belterlink Notes push
+  belterlink -delete Notes push
+  belterlink Notes Piano push
+  belterlink 'Obsidian*' pull     (quote globs so the shell leaves them alone)
+  belterlink vault push           (a group from the config's groups: section)
+  belterlink -path Projects/ideas.md Notes push   (just one note)
+  belterlink -dry-run -diff Notes pull   (what a pull would change in each note, line by line)
+  belterlink -q Notes push        (silent unless something fails, for cron)
+  belterlink Notes push -dry-run  (flags may also come after the categories and the direction)
+  belterlink help restore         (a command's usage and flags; also: belterlink restore -h)
+  fd -e md --changed-within 1h | belterlink -files-from - Notes push
+  belterlink adhoc -local ~/Downloads/scans -remote me@nas:/srv/scans push -dry-run
+  belterlink verify Notes         (checksum comparison of both sides, no transfer)
+  belterlink check-names Notes    (names that differ only in Unicode normalization, NFC vs NFD)
+  belterlink manifest diff Notes  (local changes and bitrot since 'belterlink manifest Notes')
+  belterlink test-excludes Notes attachments/scan.pdf   (is it synced? which pattern skips it?)
+  belterlink -print-cmd-only Notes push   (print the rsync command, quoted for a shell, and exit)
+  belterlink -bg Photos push      (rsync under nice/ionice with a bandwidth limit, so the machine stays responsive)
+  belterlink explain Notes push   (the exact rsync and ssh commands, shell-quoted, and where each setting comes from)
+  belterlink config dump -format json   (the merged config with defaults filled in, for tools)
+  belterlink discover             (list the SSH hosts on the local network, e.g. a Mac with Remote Login on)
+  belterlink hostkey accept       (show ssh.host's fingerprints and add them to known_hosts)
+  belterlink probe -refresh       (look again at the remote's OS, rsync and filesystems; cached otherwise)
+  belterlink last Notes           (when Notes last synced and how it went; fails if it failed)
+  belterlink state export         (bundle the sync history for a new machine; state import <file> there)
+  belterlink undo Notes           (put back what the last run of Notes replaced or deleted)
+  belterlink Notes               (the category's default_direction; Notes up / Notes down = push / pull)
+  belterlink Notes backup         (a dated snapshot in backups/Notes/ on the remote, unchanged files hard-linked)
+  belterlink backups prune -keep-daily 7 -keep-weekly 4 Notes   (remove the snapshots that policy doesn't keep)
+  belterlink restore -at 2024-06-01T10:00 -path Projects/ideas.md Notes   (copy it back from that snapshot, into a staging dir)
+  belterlink daemon               (run daemon.jobs on schedule, control API on a Unix socket)
+  belterlink pause Notes          (hold back the daemon's scheduled runs of Notes; no name: all)
+  belterlink resume               (restart scheduled runs)
+  belterlink queue [clear]        (the daemon's current and waiting runs, or drop the waiting ones)
+  belterlink push-agent           (install this belterlink, or the build for the remote's OS/arch, on ssh.host)
+  belterlink agent                (remote side of transport: agent; started over ssh)
+  belterlink gen completion bash > /etc/bash_completion.d/belterlink   (also: gen man, zsh, fish)
+
+DIRECTION:
+  push  : local → remote
+  pull  : remote → local
+  sync  : pull, then push (hub-and-spoke: the ssh host is the hub all machines sync with;
+          deletions only with propagate_deletions)
+  backup: local → a new dated snapshot on the remote (rsync --link-dest against the last one)
+  up and down are short for push and pull. Without a direction, each category runs in its
+  default_direction.
+
+CONFIG SETUP (local machine):
+  1) Create folder:  ~/.belterlink/
+  2) Create file:    ~/.belterlink/config.yaml
+  3) Fill SSH + categories (see example below).
+  4) Ensure you can SSH between machines with key auth (no passwords).
+  5) Run: belterlink Notes push (or pull)
+
+CONFIG YAML EXAMPLE:
+
+ssh:
+  user: macuser
+  host: mymac.local     # or a reserved LAN IP like 192.168.1.50
+  addresses: [192.168.1.50, mymac.tailnet.ts.net]   # optional: tried in order after host; first to answer wins
+  port: 22
+  key: /home/linuxuser/.ssh/id_ed25519   # optional
+  multiplex: true       # optional: reuse one SSH connection across runs
+  host_key_check: tofu  # optional: strict (known hosts only) or tofu (confirm a new host once)
+  connect_timeout: 10s  # optional: give up on an unreachable host after this (ssh ConnectTimeout)
+  known_hosts: ~/.belterlink/known_hosts   # optional: default ~/.ssh/known_hosts
+  agent_command: belterlink agent   # optional: remote command for transport: agent
+  profile: termux       # optional: an Android phone's sshd (port 8022, no hard links, symlinks, perms or owners, --modify-window=2; no backup)
+
+rsync:
+  path: /opt/homebrew/bin/rsync          # optional: local rsync (default: rsync from PATH)
+  remote_path: /opt/homebrew/bin/rsync   # optional: rsync on the remote (--rsync-path)
+
+defaults:
+  delete: false
+  checksum: false
+  verbose: true
+  max_clock_skew: 5        # seconds; 0 disables the check
+  clock_skew_action: warn  # or abort
+  compress: auto           # true, false, or auto (only compress for non-LAN hosts)
+  resume: false            # keep partial files so interrupted transfers resume
+  retries: 3               # retry transient network failures
+  max_delete: 50           # with delete: confirm before removing more files than this
+  verify_after: false      # checksum both sides again after each transfer
+  check_space: false       # refuse a push that wouldn't fit on the remote filesystem (costs a dry run)
+  case_collisions: warn    # names the destination can't take (README.md vs Readme.md, aux.md, a:b): warn, fail or ignore
+  preserve_xattrs: false   # keep extended attributes and ACLs (-X -A, plus --crtimes between Macs)
+  normalize_unicode: false # convert accented file names between macOS (NFD) and Linux (NFC)
+  numeric_ids: false       # keep uids/gids as numbers instead of mapping user names
+  sparse: false            # keep holes in sparse files (VM images, databases)
+  whole_file: auto         # true, false, or auto (whole files for LAN hosts, delta transfer otherwise)
+  temp_dir: .belterlink-tmp # where rsync builds files before renaming them (relative to the destination)
+  modify_window: 0         # seconds mtimes may differ by and still match; 2 for FAT/exFAT/SMB targets
+  detect_renames: false    # move renamed files on the remote instead of sending them again
+  backup: false            # keep what each run replaces or deletes, for belterlink undo
+  run_timeout: 2h          # stop a run that takes longer (and rsync after this long without I/O)
+  low_priority: false      # run rsync under nice/ionice with a bandwidth limit (also -bg)
+  snapshots_dir: backups   # where the backup direction keeps its dated snapshots on the remote
+  rsync_args: ["--iconv=utf-8-mac,utf-8"]   # extra rsync options for every category
+
+categories:
+  Piano:
+    local:  /home/linuxuser/ObsidianVault/Piano
+    remote: /Users/macuser/Library/Mobile Documents/com~apple~CloudDocs/ObsidianVault/Piano
+    exclude:
+      - "*.wav"
+      - ".obsidian/workspace*"
+    create_remote: true   # optional: mkdir -p the remote path before pushing
+    compress: false       # optional: overrides defaults.compress
+    resume: true          # optional: resume interrupted transfers of large files
+    run_timeout: 6h       # optional: overrides defaults.run_timeout
+    low_priority: true    # optional: overrides defaults.low_priority
+    anchor: .obsidian/app.json  # optional: must exist in the source or nothing is synced
+    anchor_destination: true    # optional: ...and in the destination too
+    git: true                   # optional: git commit the local path before push / after pull
+    atomic_pull: true           # optional: pull into a staging copy, swap it in once complete
+    sync_git: false             # optional: transfer .git too (excluded by default)
+    use_gitignore: false        # optional: also skip what the tree's .gitignore files ignore
+    merge: markdown             # optional: with sync, three-way merge notes edited on both sides
+    conflict: keep-both         # optional: with sync, files changed on both sides (default newer-wins)
+    propagate_deletions: true   # optional: with sync, delete files deleted on the other side since the last sync
+    max_size: 100M              # optional: skip larger files (rsync --max-size; also min_size)
+    only_extensions: [md, png]  # optional: transfer only these file types
+    symlinks: safe              # optional: preserve (default), follow, skip, or safe (drop links leaving the tree)
+    chmod: Du=rwx,go=rx,Fu=rw,go=r   # optional: permissions on the receiving side (rsync --chmod)
+    owner: false                # optional: files belong to the receiving user (--no-owner --no-group); also perms: false
+    rsync_args: ["--chmod=Du=rwx"]   # optional: extra rsync options, after defaults.rsync_args
+    default_direction: push     # optional: what "belterlink Notes" does without a direction
+    mode: archive-append        # optional: only add new files to the destination, never replace or delete
+    readonly_remote: true       # optional: refuse push, sync and backup (readonly_local: refuse pull and sync)
+    transport: rsync            # optional: agent = belterlink's own engine, for remotes without rsync
+
+  Notes:
+    local:  /home/linuxuser/ObsidianVault/Notes
+    remote: /Users/macuser/Library/Mobile Documents/com~apple~CloudDocs/ObsidianVault/Notes
+    icloud: download   # optional: fetch files iCloud evicted on the Mac before pulling
+    exclude:
+      - ".obsidian/cache"
+      - ".DS_Store"
+
+EXIT CODES:
+  0 success, 1 other failure, 2 usage error, 3 config error,
+  4 network/ssh error, 5 partial transfer, 6 source files vanished,
+  7 refused by a safety check (max_delete, empty or unmounted local path, missing anchor,
+    names the destination can't take),
+  8 the two sides differ (verify, verify_after, scrub),
+  9 interrupted (SIGINT/SIGTERM: rsync is stopped and cleans up first; again to quit now)
+
+GROUPS (optional):
+
+groups:
+  vault: [Notes, Piano]   # belterlink vault push syncs both
+
+CATEGORY TEMPLATES (optional):
+
+templates:
+  base_vault:
+    exclude: [".trash/"]
+    delete: true
+categories:
+  Notes:
+    extends: base_vault   # the template's settings, overridden by the category's
+    local: ~/Notes/
+    remote: ~/vaults/Notes/
+
+NOTIFICATIONS (optional, e.g. for cron):
+
+notify:
+  on: [failure]          # success, failure and/or aborted
+  desktop: true          # notify-send / osascript
+  webhook:
+    url: https://hooks.example.com/belterlink   # POSTs a JSON run summary
+  email:
+    host: smtp.example.com
+    username: me@example.com
+    password: app-password
+    from: me@example.com
+    to: [me@example.com]
+  plugins:
+    - name: matrix       # runs belterlink-notify-matrix from PATH
+      options: {room: "#ops"}
+
+PLUGINS:
+  A category with backend: <name> is transferred by the belterlink-backend-<name>
+  executable on PATH instead of rsync; backend_options are passed to it. Plugins get
+  a JSON request on stdin and answer with JSON on stdout (see pkg/plugin).
+
+SECRETS (optional; secret:<name> works in ssh.key_passphrase, webhook url and headers,
+email password, plugin and backend options, encryption_key):
+
+secrets:
+  smtp: {keychain: belterlink-smtp}             # macOS Keychain / libsecret (secret-tool)
+  webhook: {command: pass show belterlink/hook} # first line of the output
+  sshkey: {env: BELTERLINK_KEY_PASSPHRASE}
+ssh:
+  key_passphrase: secret:sshkey   # answered through SSH_ASKPASS (OpenSSH 8.4+)
+notify:
+  email:
+    password: secret:smtp
+
+ENCRYPTION (optional, for remotes you don't fully trust):
+
+categories:
+  Journal:
+    local: ~/Journal
+    remote: ~/backup/journal
+    encrypted: true                     # contents and names are encrypted before they leave
+    encryption_key: ~/.belterlink/journal.key   # passphrase or random key; same on every machine
+
+  Push and pull go through an encrypted copy in <state_dir>/encrypted/<Category>;
+  sync, -path, merge, conflict, propagate_deletions and anchor aren't available.
+
+TRANSFORMS (optional, to push files slightly different from the working copy):
+
+categories:
+  Notes:
+    local: ~/Vault/Notes
+    remote: ~/Notes
+    transforms:
+      - match: ["*.jpg"]                # patterns as in exclude; the first match applies
+        command: exiftool -all= -o "$OUT" "$IN"   # run through sh: read $IN, write $OUT
+      - match: ["*.excalidraw"]
+        command: excalidraw-to-svg "$IN" > "$OUT"
+        alongside: .svg                 # keep the file and push the output next to it
+
+  A push sends a copy in <state_dir>/transformed/<Category>; the working copy is never
+  changed, and a pull leaves the rewritten files alone. Not for sync.
+
+REMOTE TO REMOTE (optional, e.g. moving a vault from an old Mac to a new NAS):
+
+categories:
+  Vault:
+    from_host: me@oldmac.local    # local is a path there instead of on this machine
+    local: ~/Vault                # ~/ is from_host's home
+    to_host: admin@nas.local:2222 # optional: remote is a path there (default ssh.host)
+    remote: /volume1/Vault
+    relay: local                  # default: through <state_dir>/relay/<Category>; or direct
+
+  push copies from_host to to_host, pull the other way. relay: local pulls into the
+  copy on this machine and pushes it on (a dry run lists both legs and downloads
+  nothing); relay: direct has from_host
+  run rsync to to_host over ssh with your agent forwarded (ssh -A). Only push and pull;
+  -path, encrypted, git, atomic_pull, backup and the sync options aren't available.
+
+RSYNC DAEMON (optional, for a NAS running rsyncd instead of taking ssh logins):
+
+categories:
+  Photos:
+    local: ~/Photos
+    remote: rsync://me@nas.local/photos/2026   # rsync://[user@]host[:port]/module/path
+    password_file: ~/.belterlink/rsyncd.secret # optional: the module's password (chmod 600)
+
+  Only push and pull; the remote checks that need ssh (probe, clock skew, free space,
+  create_remote, anchor, backup, detect_renames) aren't available.
+
+MOUNTED SHARES (optional, SMB/NFS mounted on this machine):
+
+categories:
+  Archive:
+    local: ~/Vault
+    mount: /mnt/nas              # must be mounted, or nothing is transferred
+    remote: archive/Vault        # inside the mount: /mnt/nas/archive/Vault
+    mount_command: mount /mnt/nas   # optional: run when it isn't (autofs needs nothing)
+
+  A copy between two local paths, after checking that mount is a mountpoint, so an
+  unmounted share's empty directory is never written to or taken for an empty share.
+  Only push and pull; the ssh-only options above aren't available.
+
+REMOVABLE DRIVES (optional, USB disks found wherever they're mounted):
+
+categories:
+  Photos-A:
+    local: ~/Pictures
+    drive: UUID=1234-ABCD        # or LABEL=Backup A; refused if it isn't plugged in
+    remote: belterlink/Pictures  # a path on the drive
+
+  Like a mount, with the mountpoint looked up by the filesystem's UUID or label on
+  each run. Give each disk of a rotating set its own category.
+
+DAEMON (optional, for belterlink daemon):
+
+daemon:
+  socket: ~/.belterlink/daemon.sock   # default
+  jobs:
+    - {category: Notes, direction: sync, every: 15m}
+    - {category: vault, direction: push, every: 1h}
+    - {category: Notes, direction: backup, every: 24h}
+  retry_offline: true   # default: retry runs that couldn't reach the remote
+  max_backoff: 15m      # default: longest wait between retries (from 30s, doubling)
+
+  curl --unix-socket ~/.belterlink/daemon.sock http://belterlink/status
+  API: GET /status, GET /history, POST /sync?category=Notes&direction=push,
+       POST /pause, POST /resume (optionally ?category=Notes), DELETE /queue
+
+  Per category, sync_window: "22:00-07:00" limits scheduled runs to that time of day
+  and not_on: [metered] skips them on a metered connection (phone hotspot).
+  A run that can't reach the remote is retried with backoff, and at once when the
+  network changes, so changes made offline still get synced.
+  Per category, scrub: weekly (daily, monthly, 72h) has the daemon compare both sides
+  by checksum that often, transferring nothing; differences are notified as failures
+  and kept in <state_dir>/scrub/<Category>.json.
+
+METRICS (optional, node_exporter textfile collector):
+
+metrics:
+  textfile: /var/lib/node_exporter/textfile_collector/belterlink.prom
+
+LAST RUN: every non-dry run writes <state_dir>/last/<Category>.json (status, times,
+stats); set last_run_dir: to put the files elsewhere. belterlink last Notes prints it.
+
+UNDO: with backup: true, rsync moves each file a run replaces or deletes into
+.belterlink-backup/<run ID>/ on the receiving side, keeping only the last run's.
+belterlink undo [-yes] [-dry-run] Notes moves them back; files the run created stay.
+
+LOGGING (optional; logs go to ~/.belterlink/logs/belterlink.log by default):
+
+log:
+  format: json           # text (default) or json
+  level: info
+  max_size_mb: 10        # rotate at this size
+  max_age_days: 30       # delete rotated logs older than this
+Each run's log lines carry its run_id, which the run's output, notifications, history
+and audit entries show too: grep run_id=<id> finds the whole run.
+
+AUDIT LOG (off by default): every file a run deletes or overwrites, with its size, mtime
+and the run ID, is appended as a JSON line to <state_dir>/audit.log. Each audited run
+does an extra rsync dry run first; if that fails the run goes ahead unaudited.
+
+audit:
+  enable: true
+  path: ~/.belterlink/audit.log
+
+PATHS:
+  ~, $VAR and ${VAR} are expanded in local, remote, ssh.key and other path fields.
+  In remote, ~/ means the remote home directory.
+
+SPLIT CONFIGS:
+  include: [hosts.yaml, categories/*.yaml]   # relative to the including file
+  Files in conf.d/*.yaml next to config.yaml are merged automatically.
+
+TOML AND JSON:
+  Any config file ending in .toml or .json (the main one, includes, conf.d, config.local)
+  is read as TOML or JSON, with the same keys as in YAML:
+    [categories.Notes]
+    local = "~/Notes"
+    remote = "~/vaults/Notes"
+  ~/.belterlink/config.toml or config.json is used when there's no config.yaml.
+
+ENCRYPTED CONFIG:
+  age -R ~/.belterlink/recipients.txt -o config.yaml.age config.yaml
+  Any config file ending in .age (config.yaml.age, includes, conf.d) is decrypted with
+  age at load time, with the identity in ~/.belterlink/age-identity.txt or
+  $BELTERLINK_AGE_IDENTITY, or printed by $BELTERLINK_AGE_IDENTITY_COMMAND (e.g. the
+  keychain). ~/.belterlink/config.yaml.age is used when there's no config.yaml.
+
+IGNORE FILE:
+  A .belterlinkignore at the root of a category's local path adds excludes in .gitignore
+  syntax (!pattern re-includes), so they travel with the data. The config's exclude list
+  still wins. belterlink test-excludes shows which line skips a path. use_gitignore: true
+  on a category applies the tree's .gitignore files as well.
+
+TEMPLATES AND PER-MACHINE OVERRIDES:
+  vars:
+    vault_root: /home/linuxuser/ObsidianVault
+  categories:
+    Notes:
+      local: "{{ .vault_root }}/Notes"
+  A config.local.yaml next to config.yaml is merged over it (maps merge, values replace),
+  so the shared file can stay in version control and each machine overrides vars.
+
+ENVIRONMENT OVERRIDES:
+  BELTERLINK_<KEYS> sets any setting, merged over config.local.yaml; values are YAML:
+    BELTERLINK_CONFIG=/etc/belterlink/config.yaml   (instead of -config)
+    BELTERLINK_SSH_HOST=backup.internal
+    BELTERLINK_DEFAULTS_DELETE=true
+    BELTERLINK_CATEGORIES_NOTES_EXCLUDE='["*.tmp"]'
+  Existing categories, groups and vars can be changed, not added.
+  -set categories.Notes.exclude+=*.pdf does the same for one run, over the environment.
+  belterlink config dump prints the result: includes, overrides and templates applied.
+
+NOTES:
+ - 'push' and 'pull' are one-way by design. If you edited both sides, the newer side wins
+   because rsync is called with --update (and optionally --checksum).
+ - Keep both machines' clocks in sync (NTP) to avoid timestamp confusion. Each run compares
+   the clocks over SSH and warns (or aborts) when they drift more than max_clock_skew.
+ - For iCloud paths on macOS, make sure files are downloaded (no .icloud placeholders).
+ - A push refuses to run when the local path is missing, empty or an unmounted
+   mountpoint (see /etc/fstab), or with check_space when what it would send doesn't fit
+   in the remote's free space; -force overrides this.
+
+`)
+}
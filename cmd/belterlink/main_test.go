@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestParseArgsValid(t *testing.T) {
+	categories, direction, err := parseArgs([]string{"Notes", "push"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(categories) != 1 || categories[0] != "Notes" || direction != "push" {
+		t.Fatalf("unexpected parse result: %q %q", categories, direction)
+	}
+}
+
+func TestParseArgsMultipleCategories(t *testing.T) {
+	categories, direction, err := parseArgs([]string{"Notes", "Obsidian*", "PULL"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(categories) != 2 || categories[1] != "Obsidian*" || direction != "pull" {
+		t.Fatalf("unexpected parse result: %q %q", categories, direction)
+	}
+}
+
+func TestParseArgsTooFew(t *testing.T) {
+	for _, args := range [][]string{nil, {"push"}} {
+		if _, _, err := parseArgs(args); err == nil {
+			t.Fatalf("expected error for missing args in %q", args)
+		}
+	}
+}
+
+func TestParseArgsDefaultDirection(t *testing.T) {
+	categories, direction, err := parseArgs([]string{"Notes", "Piano"})
+	if err != nil || len(categories) != 2 || direction != "" {
+		t.Fatalf("parseArgs = %q %q, %v; want both categories and no direction", categories, direction, err)
+	}
+	cfg := &config.Config{Categories: map[string]config.Category{
+		"Notes": {DefaultDirection: "push"},
+		"Piano": {DefaultDirection: "pull"},
+		"Misc":  {},
+	}}
+	dirs, err := categoryDirections(cfg, []string{"Notes", "Piano"}, "")
+	if err != nil || dirs["Notes"] != "push" || dirs["Piano"] != "pull" {
+		t.Fatalf("categoryDirections = %v, %v", dirs, err)
+	}
+	if dirs, err := categoryDirections(cfg, []string{"Notes", "Misc"}, "sync"); err != nil || dirs["Notes"] != "sync" || dirs["Misc"] != "sync" {
+		t.Fatalf("categoryDirections with a direction = %v, %v", dirs, err)
+	}
+	if _, err := categoryDirections(cfg, []string{"Misc"}, ""); err == nil {
+		t.Fatal("expected an error for a category without default_direction")
+	}
+}
+
+func TestParseArgsAliases(t *testing.T) {
+	for in, want := range map[string]string{"up": "push", "Down": "pull"} {
+		if _, direction, err := parseArgs([]string{"Notes", in}); err != nil || direction != want {
+			t.Errorf("parseArgs(Notes %s) = %q, %v; want %q", in, direction, err, want)
+		}
+	}
+}
+
+func TestParseArgsTooMany(t *testing.T) {
+	if _, _, err := parseArgs([]string{"Notes", "push", "extra"}); err == nil {
+		t.Fatalf("expected error for extra args")
+	}
+}
+
+func TestParseArgsFlagAfterArgs(t *testing.T) {
+	if _, _, err := parseArgs([]string{"Notes", "push", "-delete"}); err == nil {
+		t.Fatalf("expected error for flag after args")
+	}
+}
+
+func TestParseArgsDirectionNotLast(t *testing.T) {
+	if _, _, err := parseArgs([]string{"Notes", "push", "Piano"}); err == nil {
+		t.Fatalf("expected error for a direction before a category")
+	}
+}
+
+func TestEvalClockSkew(t *testing.T) {
+	limit := 5 * time.Second
+	if err := evalClockSkew(3*time.Second, limit, "abort"); err != nil {
+		t.Fatalf("unexpected error within limit: %v", err)
+	}
+	if err := evalClockSkew(-30*time.Second, limit, "abort"); err == nil {
+		t.Fatalf("expected abort for large negative skew")
+	}
+	if err := evalClockSkew(30*time.Second, limit, "warn"); err != nil {
+		t.Fatalf("warn should not fail: %v", err)
+	}
+	if err := evalClockSkew(30*time.Second, limit, "explode"); err == nil {
+		t.Fatalf("expected error for invalid action")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, max := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		d := backoff(attempt)
+		if d < max/2 || d > max {
+			t.Fatalf("backoff(%d) = %s, want within [%s, %s]", attempt, d, max/2, max)
+		}
+	}
+	if d := backoff(40); d > time.Minute {
+		t.Fatalf("backoff should be capped at a minute, got %s", d)
+	}
+}
+
+func TestRsyncExitCode(t *testing.T) {
+	tests := []struct {
+		rsync int
+		want  int
+	}{
+		{rsync: 23, want: exitPartial},
+		{rsync: 24, want: exitVanished},
+		{rsync: 12, want: exitNetwork},
+		{rsync: 255, want: exitNetwork},
+		{rsync: 3, want: exitFailure},
+		{rsync: 99, want: exitFailure},
+	}
+	for _, tt := range tests {
+		if got := rsyncExitCode(tt.rsync); got != tt.want {
+			t.Fatalf("rsyncExitCode(%d) = %d, want %d", tt.rsync, got, tt.want)
+		}
+	}
+	if got := explainRsyncExit(99); got != "unknown error" {
+		t.Fatalf("explainRsyncExit(99) = %q", got)
+	}
+}
+
+func TestFormatRunStats(t *testing.T) {
+	sum := RunSummary{Category: "Notes", Direction: "push", RunID: "1a2b3c4d", Duration: 3.21,
+		Stats: &rsync.Stats{FilesScanned: 1204, FilesCreated: 2, FilesDeleted: 1, FilesTransferred: 5, BytesTransferred: 12345, Speedup: 7515.82}}
+	want := "Notes push [run 1a2b3c4d]: 1204 files scanned, 2 created, 1 deleted, 5 transferred (12.1K), speedup 7515.82, 3.2s"
+	if got := formatRunStats(sum); got != want {
+		t.Errorf("formatRunStats = %q, want %q", got, want)
+	}
+	dry := RunSummary{Category: "Notes", Direction: "pull", DryRun: true, Duration: 0.5}
+	if got, want := formatRunStats(dry), "Notes pull (dry run): 0.5s"; got != want {
+		t.Errorf("formatRunStats = %q, want %q", got, want)
+	}
+}
+
+func TestParseArgsBackup(t *testing.T) {
+	if _, direction, err := parseArgs([]string{"Notes", "backup"}); err != nil || direction != "backup" {
+		t.Fatalf("parseArgs = %q, %v", direction, err)
+	}
+}
+
+func TestSyncCategoryReadonly(t *testing.T) {
+	cfg := &config.Config{Categories: map[string]config.Category{
+		"Reference": {Local: t.TempDir(), Remote: "/r", ReadonlyRemote: true},
+		"Mirror":    {Local: t.TempDir(), Remote: "/r", ReadonlyLocal: true},
+	}}
+	for _, tc := range []struct{ name, direction string }{{"Reference", "push"}, {"Reference", "sync"}, {"Mirror", "pull"}} {
+		opts := RunOptions{Options: rsync.Options{Direction: tc.direction}}
+		if _, err := syncCategory(context.Background(), cfg, tc.name, opts, 0); errorExitCode(err) != exitRefused {
+			t.Errorf("%s %s = %v, want a refusal", tc.name, tc.direction, err)
+		}
+	}
+}
+
+func TestSyncCategoryBackupTermux(t *testing.T) {
+	cfg := &config.Config{
+		SSH:        config.SSH{User: "u0_a123", Host: "phone.invalid", Port: 8022, Profile: "termux"},
+		Categories: map[string]config.Category{"Notes": {Local: t.TempDir(), Remote: "/sdcard/Notes"}},
+	}
+	opts := RunOptions{Options: rsync.Options{Direction: "backup"}}
+	if _, err := syncCategory(context.Background(), cfg, "Notes", opts, 0); errorExitCode(err) != exitUsage {
+		t.Fatalf("backup to a termux remote = %v, want a usage error", err)
+	}
+}
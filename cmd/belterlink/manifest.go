@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// Manifest records the SHA-256 of every file of a category's local tree.
+type Manifest struct {
+	Category string                   `json:"category"`
+	Root     string                   `json:"root"`
+	Created  time.Time                `json:"created"`
+	Files    map[string]ManifestEntry `json:"files"` // slash-separated path relative to Root
+}
+
+type ManifestEntry struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// ManifestChange is one line of a manifest diff.
+type ManifestChange struct {
+	Kind string // added, removed, modified or corrupted
+	Path string
+}
+
+const manifestUsage = `usage:
+  belterlink manifest <CategoryName>...        write a SHA-256 manifest of the local tree
+  belterlink manifest diff <CategoryName>...   report changes since the last manifest`
+
+// runManifestCommand implements "belterlink manifest [diff] <Category>...".
+func runManifestCommand(g *globals, args []string) error {
+	diff := len(args) > 0 && args[0] == "diff"
+	if diff {
+		args = args[1:]
+	}
+	flags := newFlagSet("manifest")
+	g.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return withExitCode(exitUsage, errors.New(manifestUsage))
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	names, err := config.SelectCategories(cfg, args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	var errs []error
+	for _, name := range names {
+		cat := cfg.Categories[name]
+		current, err := buildManifest(name, cat)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		file := manifestPath(cfg, name)
+		if !diff {
+			if err := writeManifest(file, current); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			fmt.Printf("%s: %d files recorded in %s\n", name, len(current.Files), file)
+			continue
+		}
+
+		previous, err := readManifest(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, exitErrorf(exitConfig, "%s: no manifest yet; run 'belterlink manifest %s' first", name, name))
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		changes := diffManifests(previous, current)
+		if len(changes) == 0 {
+			fmt.Printf("%s: unchanged since %s\n", name, previous.Created.Format(time.DateTime))
+			continue
+		}
+		fmt.Printf("%s: %d change(s) since %s\n", name, len(changes), previous.Created.Format(time.DateTime))
+		corrupted := 0
+		for _, c := range changes {
+			fmt.Printf("  %-10s %s\n", c.Kind, c.Path)
+			if c.Kind == "corrupted" {
+				corrupted++
+			}
+		}
+		if corrupted > 0 {
+			errs = append(errs, fmt.Errorf("%s: %d file(s) changed content without a new modification time (bitrot?)", name, corrupted))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func manifestPath(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "manifests", category+".json")
+}
+
+// buildManifest hashes the category's local tree, skipping built-in and
+// category excludes like a sync would.
+func buildManifest(name string, cat config.Category) (*Manifest, error) {
+	excludes, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Category: name, Root: cat.Local, Created: time.Now(), Files: map[string]ManifestEntry{}}
+	err = filepath.WalkDir(cat.Local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == cat.Local {
+			return nil
+		}
+		rel, err := filepath.Rel(cat.Local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excludes.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		m.Files[rel] = ManifestEntry{SHA256: sum, Size: info.Size(), ModTime: info.ModTime().UTC()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeManifest(path string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+func readManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// diffManifests lists what changed between two manifests. A file whose hash
+// changed while its size and modification time didn't is reported as
+// corrupted: legitimate edits update the mtime, bitrot doesn't.
+func diffManifests(old, cur *Manifest) []ManifestChange {
+	var changes []ManifestChange
+	for p, e := range cur.Files {
+		prev, ok := old.Files[p]
+		switch {
+		case !ok:
+			changes = append(changes, ManifestChange{"added", p})
+		case prev.SHA256 == e.SHA256:
+		case prev.Size == e.Size && prev.ModTime.Equal(e.ModTime):
+			changes = append(changes, ManifestChange{"corrupted", p})
+		default:
+			changes = append(changes, ManifestChange{"modified", p})
+		}
+	}
+	for p := range old.Files {
+		if _, ok := cur.Files[p]; !ok {
+			changes = append(changes, ManifestChange{"removed", p})
+		}
+	}
+	slices.SortFunc(changes, func(a, b ManifestChange) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestBuildManifestSkipsExcludes(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"note.md", "Daily/today.md", ".DS_Store", "audio/take.wav", ".obsidian/cache/x"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := buildManifest("Notes", config.Category{Local: dir, Exclude: []string{"*.wav"}})
+	if err != nil {
+		t.Fatalf("buildManifest: %v", err)
+	}
+	var got []string
+	for p := range m.Files {
+		got = append(got, p)
+	}
+	slices.Sort(got)
+	if want := []string{"Daily/today.md", "note.md"}; !slices.Equal(got, want) {
+		t.Fatalf("manifest files = %v, want %v", got, want)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	old := &Manifest{Files: map[string]ManifestEntry{
+		"same.md":    {SHA256: "a", Size: 1, ModTime: mtime},
+		"edited.md":  {SHA256: "b", Size: 1, ModTime: mtime},
+		"rotten.md":  {SHA256: "c", Size: 1, ModTime: mtime},
+		"deleted.md": {SHA256: "d", Size: 1, ModTime: mtime},
+	}}
+	cur := &Manifest{Files: map[string]ManifestEntry{
+		"same.md":   {SHA256: "a", Size: 1, ModTime: mtime.Add(time.Hour)},
+		"edited.md": {SHA256: "B", Size: 2, ModTime: mtime.Add(time.Hour)},
+		"rotten.md": {SHA256: "C", Size: 1, ModTime: mtime},
+		"new.md":    {SHA256: "e", Size: 1, ModTime: mtime},
+	}}
+	want := []ManifestChange{
+		{"removed", "deleted.md"},
+		{"modified", "edited.md"},
+		{"added", "new.md"},
+		{"corrupted", "rotten.md"},
+	}
+	if got := diffManifests(old, cur); !slices.Equal(got, want) {
+		t.Fatalf("diffManifests = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// mergeMarkdown runs before the pull pass of a sync when a category sets
+// merge: markdown. Notes changed on both sides since the last sync are
+// merged line by line against the copy saved after that sync, and the result
+// is written locally with a fresh mtime, so the pull (--update) keeps it and
+// the push sends it to the hub. Returns the number of notes with conflicts.
+func mergeMarkdown(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions) (int, error) {
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return 0, err
+	}
+	base := baseDir(cfg, name)
+	pull := rsync.Options{Direction: "pull", NoDelete: true, Verbosity: rsync.Quiet, LowPriority: rsync.LowPriority(cfg, cat)}
+	rsArgs, err := rsync.BuildArgs(cfg, cat, pull)
+	if err != nil {
+		return 0, err
+	}
+	rsArgs = slices.DeleteFunc(adaptRsyncArgs(ctx, cfg, rsArgs), func(a string) bool { return a == "--update" })
+	diffs, err := itemizedDryRun(ctx, cfg, pull, rsArgs, false)
+	if err != nil {
+		return 0, fmt.Errorf("find changed notes: %w", err)
+	}
+
+	// only notes that also changed locally since the last sync need a merge
+	var candidates []string
+	for _, d := range diffs {
+		if !strings.HasSuffix(strings.ToLower(d.Path), ".md") || (d.Kind != "differs" && d.Kind != "metadata") {
+			continue
+		}
+		baseText, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(d.Path)))
+		if err != nil {
+			continue // no common ancestor: newer wins as usual
+		}
+		localText, err := os.ReadFile(filepath.Join(cat.Local, filepath.FromSlash(d.Path)))
+		if err != nil || bytes.Equal(localText, baseText) {
+			continue
+		}
+		candidates = append(candidates, d.Path)
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	tmp, err := os.MkdirTemp("", "belterlink-merge-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := fetchRemoteFiles(ctx, cfg, cat, candidates, tmp); err != nil {
+		return 0, fmt.Errorf("fetch remote notes: %w", err)
+	}
+
+	conflicts := 0
+	for _, rel := range candidates {
+		p := filepath.FromSlash(rel)
+		baseText, _ := os.ReadFile(filepath.Join(base, p))
+		localText, _ := os.ReadFile(filepath.Join(cat.Local, p))
+		remoteText, err := os.ReadFile(filepath.Join(tmp, p))
+		if err != nil || bytes.Equal(remoteText, baseText) || bytes.Equal(remoteText, localText) {
+			continue // only changed locally; the push takes care of it
+		}
+		merged, clean, err := merge3(string(baseText), string(localText), string(remoteText))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v; newer copy wins\n", rel, err)
+			continue
+		}
+		switch {
+		case opts.DryRun && clean:
+			printAt(rsync.Normal, "Would merge: %s\n", rel)
+			continue
+		case opts.DryRun:
+			printAt(rsync.Normal, "Would merge with conflicts: %s\n", rel)
+			continue
+		case clean:
+			printAt(rsync.Normal, "Merged: %s\n", rel)
+		default:
+			fmt.Fprintln(os.Stderr, "Merge conflict (markers written):", rel)
+			conflicts++
+		}
+		logger.Info("merged note", "category", name, "path", rel, "conflicts", !clean)
+		dst := filepath.Join(cat.Local, p)
+		info, err := os.Stat(dst)
+		if err != nil {
+			return conflicts, err
+		}
+		if err := os.WriteFile(dst, []byte(merged), info.Mode().Perm()); err != nil {
+			return conflicts, err
+		}
+		now := time.Now()
+		if err := os.Chtimes(dst, now, now); err != nil {
+			return conflicts, err
+		}
+	}
+	return conflicts, nil
+}
+
+// fetchRemoteFiles copies the given category-relative files from the remote
+// into dir.
+func fetchRemoteFiles(ctx context.Context, cfg *config.Config, cat config.Category, files []string, dir string) error {
+	args := []string{"-a", "--protect-args", "--files-from=-", "-e", rsync.Shell(cfg.SSH)}
+	if cfg.Rsync.RemotePath != "" {
+		args = append(args, "--rsync-path="+cfg.Rsync.RemotePath)
+	}
+	cmd := rsync.Command(ctx, cfg, append(args, rsync.RemoteSpec(cfg.SSH, cat), dir+"/")...)
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	return nil
+}
+
+// baseDir holds the notes as they were after the last successful sync: the
+// common ancestor for the next merge.
+func baseDir(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "base", category)
+}
+
+// saveMergeBase replaces the saved base with the current local notes.
+func saveMergeBase(cfg *config.Config, name string, cat config.Category) error {
+	excludes, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return err
+	}
+	base := baseDir(cfg, name)
+	fresh := base + ".new"
+	if err := os.RemoveAll(fresh); err != nil {
+		return err
+	}
+	err = filepath.WalkDir(cat.Local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == cat.Local {
+			return err
+		}
+		rel, err := filepath.Rel(cat.Local, p)
+		if err != nil {
+			return err
+		}
+		if excludes.Match(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(strings.ToLower(p), ".md") {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(fresh, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return err
+		}
+		return os.WriteFile(dst, b, 0o600)
+	})
+	if err != nil {
+		os.RemoveAll(fresh)
+		return err
+	}
+	if err := os.RemoveAll(base); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(fresh, base); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// maxMergeCells bounds the LCS tables merge3 builds (lines × lines).
+const maxMergeCells = 16 << 20
+
+// merge3 merges the changes from base to local and from base to remote. Hunks
+// changed on only one side (or identically on both) are taken as is;
+// overlapping changes are written between git-style conflict markers and
+// clean is false.
+func merge3(base, local, remote string) (merged string, clean bool, err error) {
+	o, a, b := splitLines(base), splitLines(local), splitLines(remote)
+	if len(o)*max(len(a), len(b)) > maxMergeCells {
+		return "", false, errors.New("note too large to merge")
+	}
+	matchA, matchB := lcsMatch(o, a), lcsMatch(o, b)
+
+	var out strings.Builder
+	clean = true
+	oi, ai, bi := 0, 0, 0
+	for {
+		if oi < len(o) && matchA[oi] == ai && matchB[oi] == bi {
+			out.WriteString(o[oi])
+			oi, ai, bi = oi+1, ai+1, bi+1
+			continue
+		}
+		// the unstable chunk runs up to the next base line kept on both sides
+		next := oi
+		for next < len(o) && (matchA[next] < 0 || matchB[next] < 0) {
+			next++
+		}
+		endA, endB := len(a), len(b)
+		if next < len(o) {
+			endA, endB = matchA[next], matchB[next]
+		}
+		oc, ac, bc := o[oi:next], a[ai:endA], b[bi:endB]
+		switch {
+		case slices.Equal(ac, oc), slices.Equal(ac, bc):
+			writeLines(&out, bc)
+		case slices.Equal(bc, oc):
+			writeLines(&out, ac)
+		default:
+			clean = false
+			out.WriteString("<<<<<<< local\n")
+			writeLines(&out, ac)
+			ensureNewline(&out)
+			out.WriteString("=======\n")
+			writeLines(&out, bc)
+			ensureNewline(&out)
+			out.WriteString(">>>>>>> remote\n")
+		}
+		if next >= len(o) {
+			break
+		}
+		oi, ai, bi = next, endA, endB
+	}
+	return out.String(), clean, nil
+}
+
+// splitLines splits s into lines that keep their "\n".
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func writeLines(b *strings.Builder, lines []string) {
+	for _, l := range lines {
+		b.WriteString(l)
+	}
+}
+
+func ensureNewline(b *strings.Builder) {
+	if s := b.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+}
+
+// lcsMatch returns, for every line of o, the index of the line of a it is
+// paired with in a longest common subsequence, or -1.
+func lcsMatch(o, a []string) []int {
+	n, m := len(o), len(a)
+	// dp[i][j] is the LCS length of o[i:] and a[j:]
+	dp := make([][]int32, n+1)
+	for i := range dp {
+		dp[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if o[i] == a[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else {
+				dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+			}
+		}
+	}
+	match := make([]int, n)
+	i, j := 0, 0
+	for i < n {
+		switch {
+		case j < m && o[i] == a[j]:
+			match[i] = j
+			i, j = i+1, j+1
+		case j < m && dp[i][j+1] >= dp[i+1][j]:
+			j++
+		default:
+			match[i] = -1
+			i++
+		}
+	}
+	return match
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "# Title\n\nintro\n\n- one\n- two\n\noutro\n"
+	for _, tc := range []struct {
+		name          string
+		local, remote string
+		want          string
+		clean         bool
+	}{
+		{
+			name:   "disjoint edits",
+			local:  "# Title\n\nintro, edited here\n\n- one\n- two\n\noutro\n",
+			remote: "# Title\n\nintro\n\n- one\n- two\n- three\n\noutro\n",
+			want:   "# Title\n\nintro, edited here\n\n- one\n- two\n- three\n\noutro\n",
+			clean:  true,
+		},
+		{
+			name:   "same edit on both sides",
+			local:  "# Title\n\nintro\n\n- one\n- 2\n\noutro\n",
+			remote: "# Title\n\nintro\n\n- one\n- 2\n\noutro\n",
+			want:   "# Title\n\nintro\n\n- one\n- 2\n\noutro\n",
+			clean:  true,
+		},
+		{
+			name:   "overlapping edits",
+			local:  "# Title\n\nintro\n\n- one\n- local\n\noutro\n",
+			remote: "# Title\n\nintro\n\n- one\n- remote\n\noutro\n",
+			want:   "# Title\n\nintro\n\n- one\n<<<<<<< local\n- local\n=======\n- remote\n>>>>>>> remote\n\noutro\n",
+			clean:  false,
+		},
+		{
+			name:   "appended on both sides",
+			local:  base + "local tail\n",
+			remote: "remote head\n" + base,
+			want:   "remote head\n" + base + "local tail\n",
+			clean:  true,
+		},
+	} {
+		got, clean, err := merge3(base, tc.local, tc.remote)
+		if err != nil {
+			t.Fatalf("%s: merge3: %v", tc.name, err)
+		}
+		if got != tc.want || clean != tc.clean {
+			t.Fatalf("%s: merge3 = %q (clean %v), want %q (clean %v)", tc.name, got, clean, tc.want, tc.clean)
+		}
+	}
+}
+
+func TestSaveMergeBase(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "vault")
+	for _, f := range []string{"note.md", "Daily/today.md", "image.png", ".obsidian/cache/x.md"} {
+		p := filepath.Join(local, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{StateDir: filepath.Join(dir, "state")}
+	if err := saveMergeBase(cfg, "Notes", config.Category{Local: local}); err != nil {
+		t.Fatalf("saveMergeBase: %v", err)
+	}
+	base := baseDir(cfg, "Notes")
+	for f, want := range map[string]bool{"note.md": true, "Daily/today.md": true, "image.png": false, ".obsidian/cache/x.md": false} {
+		_, err := os.Stat(filepath.Join(base, filepath.FromSlash(f)))
+		if (err == nil) != want {
+			t.Fatalf("%s in base: %v, want %v", f, err == nil, want)
+		}
+	}
+}
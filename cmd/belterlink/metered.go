@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// meteredConnection reports whether this machine is online through a
+// metered connection such as a phone hotspot. NetworkManager knows (set by
+// the user, or guessed from the device); without it, the interface carrying
+// the default route is judged by its name.
+func meteredConnection() bool {
+	if out, err := exec.Command("nmcli", "-t", "-f", "GENERAL.STATE,GENERAL.METERED", "device", "show").Output(); err == nil {
+		if metered, ok := parseNmcliMetered(string(out)); ok {
+			return metered
+		}
+	}
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		return meteredInterface(defaultRouteInterface(string(data)))
+	}
+	return false
+}
+
+// parseNmcliMetered reads nmcli -t device show output, one block per device,
+// and reports whether a connected device is metered. ok is false when no
+// device is connected.
+func parseNmcliMetered(out string) (metered, ok bool) {
+	for _, block := range strings.Split(out, "\n\n") {
+		var connected, devMetered bool
+		for _, line := range strings.Split(block, "\n") {
+			key, val, _ := strings.Cut(line, ":")
+			switch key {
+			case "GENERAL.STATE":
+				connected = strings.Contains(val, "(connected)")
+			case "GENERAL.METERED":
+				devMetered = strings.HasPrefix(val, "yes")
+			}
+		}
+		if connected {
+			ok = true
+			metered = metered || devMetered
+		}
+	}
+	return metered, ok
+}
+
+// defaultRouteInterface finds the interface of the default route in
+// /proc/net/route.
+func defaultRouteInterface(routes string) string {
+	for _, line := range strings.Split(routes, "\n") {
+		f := strings.Fields(line)
+		if len(f) > 1 && f[1] == "00000000" {
+			return f[0]
+		}
+	}
+	return ""
+}
+
+// meteredInterface guesses from its name whether an interface is mobile
+// broadband or tethering: USB and Bluetooth tethering to a phone, modems.
+func meteredInterface(name string) bool {
+	for _, prefix := range []string{"wwan", "ppp", "usb", "rndis", "bnep"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseNmcliMetered(t *testing.T) {
+	out := "GENERAL.STATE:100 (connected)\nGENERAL.METERED:no (guessed)\n\n" +
+		"GENERAL.STATE:30 (disconnected)\nGENERAL.METERED:yes\n\n" +
+		"GENERAL.STATE:100 (connected)\nGENERAL.METERED:yes (guessed)\n"
+	if metered, ok := parseNmcliMetered(out); !metered || !ok {
+		t.Fatalf("metered = %v, ok = %v; want a metered connection", metered, ok)
+	}
+	if _, ok := parseNmcliMetered("GENERAL.STATE:20 (unavailable)\nGENERAL.METERED:unknown\n"); ok {
+		t.Fatal("expected no answer without a connected device")
+	}
+}
+
+func TestDefaultRouteInterface(t *testing.T) {
+	routes := "Iface\tDestination\tGateway \tFlags\n" +
+		"usb0\t0000A8C0\t00000000\t0001\n" +
+		"usb0\t00000000\t012BA8C0\t0003\n"
+	if got := defaultRouteInterface(routes); got != "usb0" || !meteredInterface(got) {
+		t.Fatalf("default route on %q", got)
+	}
+	if meteredInterface("wlp3s0") {
+		t.Fatal("wifi taken for metered")
+	}
+}
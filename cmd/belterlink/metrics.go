@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// categoryMetrics is the per-category state persisted between runs.
+type categoryMetrics struct {
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	Success     bool      `json:"success"`
+	Duration    float64   `json:"duration_seconds"`
+	Bytes       int64     `json:"bytes_transferred"`
+	Files       int64     `json:"files_changed"`
+	Failures    int64     `json:"failures"`
+}
+
+// recordMetrics updates the persisted counters for sum.Category and rewrites
+// the textfile. Metrics are best effort: problems are returned for a warning.
+func recordMetrics(cfg *config.Config, sum RunSummary, stats *rsync.Stats) error {
+	if cfg.Metrics.Textfile == "" || sum.DryRun {
+		return nil
+	}
+	statePath := filepath.Join(config.StateDir(cfg), "metrics.json")
+	all := map[string]categoryMetrics{}
+	b, err := os.ReadFile(statePath)
+	if err == nil {
+		if err := json.Unmarshal(b, &all); err != nil {
+			return fmt.Errorf("read %s: %w", statePath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	m := all[sum.Category]
+	m.LastRun = sum.Started
+	m.Duration = sum.Duration
+	m.Success = sum.Status == "success"
+	m.Bytes, m.Files = 0, 0
+	if stats != nil {
+		m.Bytes = stats.BytesTransferred
+		m.Files = stats.FilesTransferred + stats.FilesDeleted
+	}
+	if m.Success {
+		m.LastSuccess = sum.Started
+	} else {
+		m.Failures++
+	}
+	all[sum.Category] = m
+
+	b, err = json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statePath, b); err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.Metrics.Textfile, []byte(renderMetrics(all)))
+}
+
+// renderMetrics formats the state in the Prometheus text exposition format.
+func renderMetrics(all map[string]categoryMetrics) string {
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	metric := func(name, typ, help string, value func(categoryMetrics) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, cat := range names {
+			fmt.Fprintf(&b, "%s{category=%q} %s\n", name, cat, strconv.FormatFloat(value(all[cat]), 'f', -1, 64))
+		}
+	}
+	unix := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.Unix())
+	}
+	metric("belterlink_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync.",
+		func(m categoryMetrics) float64 { return unix(m.LastSuccess) })
+	metric("belterlink_last_run_timestamp_seconds", "gauge", "Unix time of the last sync attempt.",
+		func(m categoryMetrics) float64 { return unix(m.LastRun) })
+	metric("belterlink_last_run_success", "gauge", "Whether the last sync succeeded (1) or failed (0).",
+		func(m categoryMetrics) float64 {
+			if m.Success {
+				return 1
+			}
+			return 0
+		})
+	metric("belterlink_last_run_duration_seconds", "gauge", "Wall time of the last sync.",
+		func(m categoryMetrics) float64 { return m.Duration })
+	metric("belterlink_last_run_transferred_bytes", "gauge", "Bytes of file data transferred by the last sync.",
+		func(m categoryMetrics) float64 { return float64(m.Bytes) })
+	metric("belterlink_last_run_files_changed", "gauge", "Files transferred or deleted by the last sync.",
+		func(m categoryMetrics) float64 { return float64(m.Files) })
+	metric("belterlink_failures_total", "counter", "Failed syncs since metrics were first recorded.",
+		func(m categoryMetrics) float64 { return float64(m.Failures) })
+	return b.String()
+}
+
+// writeFileAtomic replaces path via a temp file + rename so readers (like
+// node_exporter) never see a half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		StateDir: filepath.Join(dir, "state"),
+		Metrics:  config.Metrics{Textfile: filepath.Join(dir, "belterlink.prom")},
+	}
+	started := time.Unix(1700000000, 0)
+	ok := RunSummary{Category: "Notes", Direction: "push", Status: "success", Started: started, Duration: 2}
+	if err := recordMetrics(cfg, ok, &rsync.Stats{FilesTransferred: 3, BytesTransferred: 42}); err != nil {
+		t.Fatalf("recordMetrics error: %v", err)
+	}
+	failed := RunSummary{Category: "Piano", Direction: "push", Status: "failure", Started: started}
+	if err := recordMetrics(cfg, failed, nil); err != nil {
+		t.Fatalf("recordMetrics error: %v", err)
+	}
+
+	b, err := os.ReadFile(cfg.Metrics.Textfile)
+	if err != nil {
+		t.Fatalf("read textfile: %v", err)
+	}
+	out := string(b)
+	for _, want := range []string{
+		`belterlink_last_success_timestamp_seconds{category="Notes"} 1700000000`,
+		`belterlink_last_run_transferred_bytes{category="Notes"} 42`,
+		`belterlink_failures_total{category="Piano"} 1`,
+		`belterlink_last_run_success{category="Piano"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("textfile missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// ensureMounted makes sure the share of a category with mount is mounted, so
+// a push doesn't fill the empty mountpoint directory and a pull doesn't take
+// it for a share whose files were all deleted. Looking into the mountpoint
+// first has autofs and macOS's automounter mount it; otherwise mount_command,
+// if set, is run once.
+func ensureMounted(cat config.Category) error {
+	os.ReadDir(cat.Mount) // triggers an automount
+	if isMountpoint(cat.Mount) {
+		return nil
+	}
+	if cat.MountCommand == "" {
+		return exitErrorf(exitRefused, "%s is not mounted; mount the share or set mount_command", cat.Mount)
+	}
+	printAt(rsync.Normal, "Mounting %s: %s\n", cat.Mount, cat.MountCommand)
+	logger.Info("mounting", "mount", cat.Mount, "command", cat.MountCommand)
+	cmd := exec.Command("sh", "-c", cat.MountCommand)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return exitErrorf(exitRefused, "mount_command for %s: %v", cat.Mount, err)
+	}
+	if !isMountpoint(cat.Mount) {
+		return exitErrorf(exitRefused, "%s is still not mounted after mount_command", cat.Mount)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestEnsureMounted(t *testing.T) {
+	if err := ensureMounted(config.Category{Mount: "/"}); err != nil {
+		t.Fatalf("ensureMounted(/) = %v", err)
+	}
+	dir := t.TempDir()
+	mnt := filepath.Join(dir, "nas")
+	if err := os.Mkdir(mnt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureMounted(config.Category{Mount: mnt}); errorExitCode(err) != exitRefused {
+		t.Fatalf("ensureMounted of an empty mountpoint = %v, want a refusal", err)
+	}
+	marker := filepath.Join(dir, "ran")
+	err := ensureMounted(config.Category{Mount: mnt, MountCommand: "touch " + marker})
+	if errorExitCode(err) != exitRefused {
+		t.Fatalf("ensureMounted after a mount_command that mounted nothing = %v, want a refusal", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal("mount_command didn't run")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/agent"
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// defaultAgentCommand starts the agent on the remote when ssh.agent_command
+// isn't set; belterlink must be on the remote's PATH.
+const defaultAgentCommand = "belterlink agent"
+
+// transferAction is one step of a native transfer.
+type transferAction struct {
+	Delete bool
+	Path   string // relative to the category root
+	Size   int64
+	Delta  bool // the destination has an older copy worth patching
+}
+
+// syncViaAgent transfers a category with belterlink's own engine, talking to
+// "belterlink agent" on the remote instead of rsync. It follows rsync's rules
+// as belterlink uses them: files are compared by size and modification time
+// (or checksum), newer files on the destination are kept (--update), and
+// deletions only happen with -delete.
+func syncViaAgent(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions) (*rsync.Stats, error) {
+	if opts.Direction == "push" && !opts.Force {
+		if err := checkLocalSource(cat.Local); err != nil {
+			return nil, withExitCode(exitRefused, fmt.Errorf("%w; re-run with -force if this is intended", err))
+		}
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return nil, err
+	}
+	client, _, err := dialAgent(cfg.SSH)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+	defer client.Close()
+
+	excludes := config.CategoryExcludes(cat)
+	matcher, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	local, err := listLocal(cat.Local, matcher)
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := client.List(cat.Remote, excludes)
+	if err != nil {
+		return nil, withExitCode(exitNetwork, err)
+	}
+	remote := map[string]agent.File{}
+	for _, f := range remoteFiles {
+		// the agent only knows the excludes; the ignore file applies here
+		if !excludedWithParents(matcher, f.Path, f.Dir) {
+			remote[f.Path] = f
+		}
+	}
+
+	src, dst := local, remote
+	if opts.Direction == "pull" {
+		src, dst = remote, local
+	}
+	useDelete := rsync.ResolveDelete(cfg, opts.Options)
+	checksum := config.GetBool(opts.Checksum, cfg.Defaults.Checksum, false)
+	same := func(rel string) bool {
+		l, lerr := hashFile(filepath.Join(cat.Local, filepath.FromSlash(rel)))
+		r, rerr := client.Hash(path.Join(cat.Remote, rel))
+		return lerr == nil && rerr == nil && l == r
+	}
+	plan := planTransfer(src, dst, opts.Paths, useDelete, checksum, same)
+
+	deletions := 0
+	for _, a := range plan {
+		if a.Delete {
+			deletions++
+		}
+	}
+	if !opts.DryRun {
+		if err := confirmDeletionCount(opts, deletions, maxDelete(cfg, cat)); err != nil {
+			return nil, err
+		}
+	}
+	if cat.Git && opts.Direction == "push" && !opts.DryRun {
+		if err := gitCommit(cat.Local, "belterlink pre-push"); err != nil {
+			return nil, fmt.Errorf("git safety commit: %w", err)
+		}
+	}
+
+	verbose := opts.Verbosity > rsync.Normal || opts.Verbosity == rsync.Normal && config.GetBool(false, cfg.Defaults.Verbose, true)
+	printAt(rsync.Normal, "Running: belterlink agent %s %s %s\n", opts.Direction, ssh.Quote(cat.Local), ssh.Quote(ssh.Target(cfg.SSH)+":"+cat.Remote))
+	stats := &rsync.Stats{}
+	for _, a := range plan {
+		if ctx.Err() != nil {
+			return stats, abortedError(ctx)
+		}
+		if verbose || opts.DryRun && opts.Verbosity > rsync.Quiet {
+			if a.Delete {
+				fmt.Println("deleting", a.Path)
+			} else {
+				fmt.Println(a.Path)
+			}
+		}
+		if opts.DryRun {
+			continue
+		}
+		localPath := filepath.Join(cat.Local, filepath.FromSlash(a.Path))
+		remotePath := path.Join(cat.Remote, a.Path)
+		n, err := transferFile(client, a, opts.Direction, localPath, remotePath)
+		if err != nil {
+			return stats, withExitCode(exitPartial, fmt.Errorf("%s: %w", a.Path, err))
+		}
+		if a.Delete {
+			stats.FilesDeleted++
+		} else {
+			stats.FilesTransferred++
+			stats.BytesTransferred += n
+		}
+	}
+
+	if cat.Git && opts.Direction == "pull" && !opts.DryRun {
+		if err := gitCommit(cat.Local, "belterlink post-pull"); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: git commit after pull:", err)
+			logger.Warn("git commit after pull failed", "error", err)
+		}
+	}
+	return stats, nil
+}
+
+// transferFile carries out one action of a plan in direction, returning
+// the bytes of file it brought over. An agent speaking a protocol version
+// without the delta ops gets whole files.
+func transferFile(client *agent.Client, a transferAction, direction, localPath, remotePath string) (int64, error) {
+	delta := a.Delta && client.Version() >= agent.DeltaVersion
+	switch {
+	case a.Delete && direction == "push":
+		return 0, client.Delete(remotePath)
+	case a.Delete:
+		return 0, os.Remove(localPath)
+	case direction == "push" && delta:
+		return sendDelta(client, localPath, remotePath, a.Size)
+	case direction == "push":
+		return client.Send(localPath, remotePath)
+	case delta:
+		return getDelta(client, remotePath, localPath, a.Size)
+	default:
+		return client.Get(remotePath, localPath)
+	}
+}
+
+// sendDelta pushes only the changed blocks of a large file, falling back to
+// a full copy if the remote copy went away in the meantime.
+func sendDelta(client *agent.Client, local, remote string, size int64) (int64, error) {
+	literal, err := client.SendDelta(local, remote)
+	if errors.Is(err, fs.ErrNotExist) {
+		return client.Send(local, remote)
+	}
+	if err == nil {
+		logger.Debug("delta transfer", "path", local, "size", size, "literal", literal)
+	}
+	return size, err
+}
+
+// getDelta is sendDelta for pulls.
+func getDelta(client *agent.Client, remote, local string, size int64) (int64, error) {
+	received, err := client.GetDelta(remote, local)
+	if errors.Is(err, fs.ErrNotExist) {
+		return client.Get(remote, local)
+	}
+	if err == nil {
+		logger.Debug("delta transfer", "path", local, "size", size, "received", received)
+	}
+	return size, err
+}
+
+// dialAgent starts the agent on the remote and agrees on a protocol version
+// with it, returning what the agent told about itself. An agent too old or
+// too new for this build is refused with a hint to replace it.
+func dialAgent(s config.SSH) (*agent.Client, agent.Hello, error) {
+	command := s.AgentCommand
+	if command == "" {
+		command = defaultAgentCommand
+	}
+	args := append(ssh.Args(s)[1:], ssh.Target(s), command)
+	client, err := agent.Dial("ssh", args...)
+	if err != nil {
+		return nil, agent.Hello{}, err
+	}
+	hello, err := client.Hello()
+	if err != nil {
+		client.Close()
+		if errors.Is(err, agent.ErrIncompatible) {
+			err = fmt.Errorf("%w; run 'belterlink push-agent' to install this build on the remote", err)
+		}
+		return nil, hello, err
+	}
+	switch {
+	case hello.Build == "":
+		printAt(rsync.Verbose, "Remote agent predates the version handshake; speaking protocol version 1\n")
+	case hello.Build != version:
+		printAt(rsync.Verbose, "Remote agent is belterlink %s (this is %s); speaking protocol version %d\n", hello.Build, version, hello.Version)
+	}
+	return client, hello, nil
+}
+
+// listLocal lists the local tree in the agent's format. A missing root is an
+// empty tree, so a first pull can create it.
+func listLocal(root string, excludes *rsync.Matcher) (map[string]agent.File, error) {
+	files := map[string]agent.File{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excludes.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = agent.File{Path: rel, Size: info.Size(), ModTime: info.ModTime().UTC(), Mode: info.Mode().Perm(), Dir: d.IsDir()}
+		return nil
+	})
+	return files, err
+}
+
+// planTransfer decides what to copy from src to dst and, with del, what to
+// delete from dst. paths restricts both to those subtrees. same is asked
+// about files with equal size and time when checksum is set. Large files the
+// destination already has an older copy of are marked for delta transfer.
+func planTransfer(src, dst map[string]agent.File, paths []string, del, checksum bool, same func(rel string) bool) []transferAction {
+	selected := func(rel string) bool {
+		if len(paths) == 0 {
+			return true
+		}
+		for _, p := range paths {
+			p = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+			if rel == p || strings.HasPrefix(rel, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var plan []transferAction
+	for _, rel := range slices.Sorted(maps.Keys(src)) {
+		f := src[rel]
+		if f.Dir || !selected(rel) {
+			continue
+		}
+		delta := false
+		if d, ok := dst[rel]; ok && !d.Dir {
+			delta = f.Size >= agent.DeltaMinSize
+			st, dt := f.ModTime.Truncate(time.Second), d.ModTime.Truncate(time.Second)
+			if dt.After(st) {
+				continue // --update: the destination is newer
+			}
+			if dt.Equal(st) && d.Size == f.Size && (!checksum || same(rel)) {
+				continue
+			}
+		}
+		plan = append(plan, transferAction{Path: rel, Size: f.Size, Delta: delta})
+	}
+	if !del {
+		return plan
+	}
+	// deepest first, so directories are empty by the time they're removed
+	gone := slices.Sorted(maps.Keys(dst))
+	slices.Reverse(gone)
+	for _, rel := range gone {
+		if _, ok := src[rel]; ok || !selected(rel) {
+			continue
+		}
+		plan = append(plan, transferAction{Delete: true, Path: rel})
+	}
+	return plan
+}
+
+func runAgentCommand(args []string) error {
+	flags := newFlagSet("agent")
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	if len(args) > 0 {
+		return exitErrorf(exitUsage, "usage: belterlink agent (started over ssh by transport: agent)")
+	}
+	agent.Build = version
+	return agent.Serve(os.Stdin, os.Stdout)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/agent"
+)
+
+func TestPlanTransfer(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	file := func(p string, size int64, mtime time.Time) agent.File {
+		return agent.File{Path: p, Size: size, ModTime: mtime}
+	}
+	src := map[string]agent.File{
+		"new.md":       file("new.md", 1, t0),
+		"same.md":      file("same.md", 5, t0),
+		"changed.md":   file("changed.md", 5, t0.Add(time.Hour)),
+		"older.md":     file("older.md", 5, t0),
+		"sub":          {Path: "sub", Dir: true},
+		"sub/inner.md": file("sub/inner.md", 2, t0),
+	}
+	dst := map[string]agent.File{
+		"same.md":    file("same.md", 5, t0.Add(300*time.Millisecond)), // same second
+		"changed.md": file("changed.md", 5, t0),
+		"older.md":   file("older.md", 9, t0.Add(time.Hour)), // newer on the destination: kept
+		"gone":       {Path: "gone", Dir: true},
+		"gone/x.md":  file("gone/x.md", 1, t0),
+	}
+
+	got := planTransfer(src, dst, nil, true, false, nil)
+	want := []transferAction{
+		{Path: "changed.md", Size: 5},
+		{Path: "new.md", Size: 1},
+		{Path: "sub/inner.md", Size: 2},
+		{Delete: true, Path: "gone/x.md"},
+		{Delete: true, Path: "gone"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("plan[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got := planTransfer(src, dst, []string{"sub/"}, true, false, nil); len(got) != 1 || got[0].Path != "sub/inner.md" {
+		t.Fatalf("plan restricted to sub/ = %+v", got)
+	}
+	differs := func(string) bool { return false }
+	if got := planTransfer(src, dst, []string{"same.md"}, false, true, differs); len(got) != 1 || got[0].Path != "same.md" {
+		t.Fatalf("checksum plan = %+v", got)
+	}
+
+	big := map[string]agent.File{"rec.wav": file("rec.wav", agent.DeltaMinSize, t0.Add(time.Hour))}
+	if got := planTransfer(big, map[string]agent.File{"rec.wav": file("rec.wav", 1, t0)}, nil, false, false, nil); len(got) != 1 || !got[0].Delta {
+		t.Fatalf("plan for a large changed file = %+v, want a delta", got)
+	}
+	if got := planTransfer(big, nil, nil, false, false, nil); len(got) != 1 || got[0].Delta {
+		t.Fatalf("plan for a new large file = %+v, want a full copy", got)
+	}
+}
+
+func TestTransferFileDelta(t *testing.T) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go agent.Serve(reqR, respW)
+	t.Cleanup(func() { reqW.Close() })
+	client := agent.NewClient(respR, reqW)
+	if _, err := client.Hello(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	local, remote := filepath.Join(dir, "local.wav"), filepath.Join(dir, "remote.wav")
+	recording := make([]byte, 2*agent.DeltaMinSize)
+	rand.New(rand.NewSource(1)).Read(recording)
+	os.WriteFile(remote, recording, 0o644)
+	grown := append(bytes.Clone(recording), "another minute"...)
+	os.WriteFile(local, grown, 0o644)
+
+	a := transferAction{Path: "rec.wav", Size: int64(len(grown)), Delta: true}
+	if n, err := transferFile(client, a, "push", local, remote); err != nil || n != a.Size {
+		t.Fatalf("delta push = %d, %v", n, err)
+	}
+	if got, _ := os.ReadFile(remote); !bytes.Equal(got, grown) {
+		t.Fatal("remote copy differs after a delta push")
+	}
+
+	// the remote copy went away since the listing: a full copy instead
+	os.Remove(remote)
+	if _, err := transferFile(client, a, "push", local, remote); err != nil {
+		t.Fatalf("delta push without a remote copy: %v", err)
+	}
+	if got, _ := os.ReadFile(remote); !bytes.Equal(got, grown) {
+		t.Fatal("remote copy differs after the fallback")
+	}
+
+	os.WriteFile(local, recording, 0o644)
+	if _, err := transferFile(client, a, "pull", local, remote); err != nil {
+		t.Fatalf("delta pull: %v", err)
+	}
+	if got, _ := os.ReadFile(local); !bytes.Equal(got, grown) {
+		t.Fatal("local copy differs after a delta pull")
+	}
+}
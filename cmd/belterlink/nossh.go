@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// syncWithoutSSH pushes or pulls a category whose remote is an rsync:// URL,
+// talking to the rsync daemon on the remote directly, or a path inside the
+// share mounted at mount or on the drive, copying between two local paths.
+// The checks that look at the remote over ssh are left out; the local ones
+// and the deletion preview stay.
+func syncWithoutSSH(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions, maxRetries int) (*rsync.Stats, error) {
+	kind, host := "mount", "localhost"
+	if config.IsDaemonURL(cat.Remote) {
+		u, err := url.Parse(cat.Remote)
+		if err != nil {
+			return nil, exitErrorf(exitConfig, "category %q: remote: %v", name, err)
+		}
+		kind, host = "an rsync:// remote", u.Hostname()
+	}
+	if cat.Drive != "" {
+		kind = "a drive"
+	}
+	if opts.Direction != "push" && opts.Direction != "pull" {
+		return nil, exitErrorf(exitUsage, "category %q has %s; %s needs ssh, use push or pull", name, kind, opts.Direction)
+	}
+	if cat.Drive != "" {
+		mnt, err := driveMountpoint(cat.Drive)
+		if err != nil {
+			return nil, err
+		}
+		printAt(rsync.Verbose, "Drive %s is mounted on %s\n", cat.Drive, mnt)
+		logger.Info("found drive", "drive", cat.Drive, "mount", mnt)
+		cat.Mount, cat.Remote = mnt, filepath.Join(mnt, cat.Remote)
+	}
+	if cat.Mount != "" {
+		if err := ensureMounted(cat); err != nil {
+			return nil, err
+		}
+		if fs := localFSType(cat.Mount); coarseTimeFS(fs) && rsync.ModifyWindow(cfg, cat) == 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s is %s, which keeps modification times to 2 seconds: set modify_window: 2 on %s, or unchanged files are sent again\n", cat.Mount, fs, name)
+		}
+	}
+	if len(opts.Paths) > 0 {
+		list, err := writeFileList(cat.Local, opts.Paths)
+		if err != nil {
+			return nil, withExitCode(exitUsage, err)
+		}
+		defer os.Remove(list)
+		opts.FilesFrom = list
+	}
+	if !opts.Force && (opts.Direction == "push" || cat.Mount != "") {
+		source := cat.Local
+		if opts.Direction == "pull" {
+			source = cat.Remote // on the share, which is as local as the local path
+		}
+		if err := checkLocalSource(source); err != nil {
+			return nil, withExitCode(exitRefused, fmt.Errorf("%w; re-run with -force if this is intended", err))
+		}
+	}
+
+	var err error
+	if cat, err = applyTransforms(ctx, cfg, name, cat, opts.Direction); err != nil {
+		return nil, err
+	}
+
+	if cat.CreateRemote && opts.Direction == "push" && !opts.DryRun {
+		if err := os.MkdirAll(cat.Remote, 0o755); err != nil {
+			return nil, fmt.Errorf("create %s: %w", cat.Remote, err)
+		}
+	}
+
+	// compress: auto and whole_file: auto go by the daemon's host
+	c := hostConfig(cfg, config.SSH{Host: host}, name, cat)
+	if opts.Compress, opts.CompressChoice, err = rsync.ResolveCompression(c, cat, rsync.LocalVersion(ctx, cfg), rsync.Version{}); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	if opts.WholeFile, err = rsync.ResolveWholeFile(c, cat); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	if opts.TempDir, err = resolveTempDir(cfg, cat, opts.Direction); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	opts.LowPriority = opts.LowPriority || rsync.LowPriority(cfg, cat)
+	rsArgs, err := rsync.BuildArgs(c, cat, opts.Options)
+	if err != nil {
+		return nil, fmt.Errorf("build rsync args: %w", err)
+	}
+	if !opts.DryRun && !slices.Contains(rsArgs, "--stats") {
+		rsArgs = rsync.InsertBeforePaths(rsArgs, "--stats")
+	}
+	if rsync.ResolveDelete(cfg, opts.Options) && !opts.DryRun {
+		if rsArgs, err = confirmDeletions(ctx, cfg, cat, opts, rsArgs); err != nil {
+			return nil, err
+		}
+	}
+	if cat.Git && opts.Direction == "push" && !opts.DryRun {
+		if err := gitCommit(cat.Local, "belterlink pre-push"); err != nil {
+			return nil, fmt.Errorf("git safety commit: %w", err)
+		}
+	}
+
+	printAt(rsync.Normal, "Running: %s\n", shellCommand(append([]string{rsync.Binary(cfg)}, rsArgs...)))
+	logger.Debug("running rsync", "args", rsArgs)
+	var captured bytes.Buffer
+	err = runRetrying(ctx, maxRetries, func() error {
+		captured.Reset()
+		return runRsync(ctx, cfg, opts.Options, rsArgs, rsyncOutput(&captured))
+	})
+	if err == nil && cat.Git && opts.Direction == "pull" && !opts.DryRun {
+		if gerr := gitCommit(cat.Local, "belterlink post-pull"); gerr != nil {
+			fmt.Fprintln(os.Stderr, "warning: git commit after pull:", gerr)
+			logger.Warn("git commit after pull failed", "error", gerr)
+		}
+	}
+	return transferStats(opts, captured.String()), err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/plugin"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// RunSummary describes one sync run; it is the JSON body sent to webhooks.
+type RunSummary struct {
+	Category  string    `json:"category"`
+	Direction string    `json:"direction"`
+	RunID     string    `json:"run_id,omitempty"`
+	Status    string    `json:"status"` // success or failure
+	Error     string    `json:"error,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+	DryRun    bool      `json:"dry_run"`
+	Started   time.Time `json:"started"`
+	Duration  float64   `json:"duration_seconds"`
+
+	Stats *rsync.Stats `json:"stats,omitempty"` // from rsync --stats, the agent or the backend; none for dry runs
+}
+
+func newRunSummary(category string, opts RunOptions, started time.Time, err error) RunSummary {
+	sum := RunSummary{
+		Category:  category,
+		Direction: opts.Direction,
+		RunID:     opts.RunID,
+		Status:    "success",
+		DryRun:    opts.DryRun,
+		Started:   started,
+		Duration:  time.Since(started).Seconds(),
+	}
+	if err != nil {
+		sum.Status = "failure"
+		sum.Error = err.Error()
+		sum.ExitCode = errorExitCode(err)
+		if sum.ExitCode == exitAborted {
+			sum.Status = "aborted"
+		}
+	}
+	return sum
+}
+
+func (s RunSummary) title() string {
+	return fmt.Sprintf("belterlink: %s %s %s", s.Category, s.Direction, s.Status)
+}
+
+func (s RunSummary) text() string {
+	msg := fmt.Sprintf("%s %s finished with %s after %.1fs", s.Category, s.Direction, s.Status, s.Duration)
+	if s.RunID != "" {
+		msg += " (run " + s.RunID + ")"
+	}
+	if s.Error != "" {
+		msg += "\n" + s.Error
+	}
+	return msg
+}
+
+// sendNotifications delivers the summary to every configured sink. Delivery
+// problems are reported but never change the run's outcome.
+func sendNotifications(cfg *config.Config, sum RunSummary) {
+	n := cfg.Notify
+	if !n.Wants(sum.Status) {
+		return
+	}
+	var errs []error
+	if n.Desktop {
+		errs = append(errs, notifyDesktop(sum))
+	}
+	if n.Webhook != nil {
+		errs = append(errs, notifyWebhook(cfg, *n.Webhook, sum))
+	}
+	if n.Email != nil {
+		errs = append(errs, notifyEmail(cfg, *n.Email, sum))
+	}
+	for _, p := range n.Plugins {
+		errs = append(errs, notifyPlugin(cfg, p, sum))
+	}
+	if err := errors.Join(errs...); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: notification failed:", err)
+		logger.Warn("notification failed", "error", err)
+	}
+}
+
+func notifyDesktop(sum RunSummary) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(sum.text()), appleScriptString(sum.title()))
+		cmd = exec.Command("osascript", "-e", script)
+	default:
+		cmd = exec.Command("notify-send", sum.title(), sum.text())
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("desktop: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func notifyWebhook(cfg *config.Config, w config.Webhook, sum RunSummary) error {
+	body, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	target, err := resolveSecret(cfg, w.URL)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	headers, err := resolveSecrets(cfg, w.Headers)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook: invalid url %s", w.URL)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err // without the URL, which may hold a token
+		}
+		return fmt.Errorf("webhook: %s: %w", w.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s returned %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// notifyPlugin hands the summary to a belterlink-notify-<name> executable.
+func notifyPlugin(cfg *config.Config, p config.NotifyPlugin, sum RunSummary) error {
+	body, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	options, err := resolveSecrets(cfg, p.Options)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Name, err)
+	}
+	req := plugin.NotifyRequest{Protocol: plugin.ProtocolVersion, Summary: body, Options: options}
+	return plugin.Call(plugin.KindNotify, p.Name, req, nil)
+}
+
+func notifyEmail(cfg *config.Config, e config.Email, sum RunSummary) error {
+	port := e.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if e.Username != "" {
+		password, err := resolveSecret(cfg, e.Password)
+		if err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+		auth = smtp.PlainAuth("", e.Username, password, e.Host)
+	}
+	msg := "From: " + e.From + "\r\n" +
+		"To: " + strings.Join(e.To, ", ") + "\r\n" +
+		"Subject: " + sum.title() + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(sum.text(), "\n", "\r\n") + "\r\n"
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(port))
+	if err := smtp.SendMail(addr, auth, e.From, e.To, []byte(msg)); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
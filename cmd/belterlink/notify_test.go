@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestNewRunSummaryFailure(t *testing.T) {
+	err := exitErrorf(exitNetwork, "rsync failed")
+	sum := newRunSummary("Notes", RunOptions{Options: rsync.Options{Direction: "push"}}, time.Now(), err)
+	if sum.Status != "failure" || sum.ExitCode != exitNetwork || sum.Error != "rsync failed" {
+		t.Fatalf("unexpected summary: %+v", sum)
+	}
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	var got RunSummary
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	sum := newRunSummary("Notes", RunOptions{Options: rsync.Options{Direction: "pull"}}, time.Now(), errors.New("boom"))
+	t.Setenv("BELTERLINK_TEST_WEBHOOK_AUTH", "Bearer x")
+	cfg := &config.Config{Secrets: map[string]config.Secret{"webhook-auth": {Env: "BELTERLINK_TEST_WEBHOOK_AUTH"}}}
+	err := notifyWebhook(cfg, config.Webhook{URL: srv.URL, Headers: map[string]string{"Authorization": "secret:webhook-auth"}}, sum)
+	if err != nil {
+		t.Fatalf("notifyWebhook error: %v", err)
+	}
+	if got.Category != "Notes" || got.Status != "failure" || auth != "Bearer x" {
+		t.Fatalf("unexpected webhook payload %+v (auth %q)", got, auth)
+	}
+}
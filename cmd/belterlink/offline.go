@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// firstBackoff is how long the daemon waits before retrying a run that
+// couldn't reach the remote; the wait doubles with every failure, up to
+// daemon.max_backoff.
+const (
+	firstBackoff      = 30 * time.Second
+	defaultMaxBackoff = 15 * time.Minute
+)
+
+// offlineRun is a run that failed because the remote was unreachable and
+// waits to be tried again, so changes made while offline still get synced.
+type offlineRun struct {
+	Category  string    `json:"category"`
+	Direction string    `json:"direction"`
+	Since     time.Time `json:"since"` // first failure
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// noteOutcome updates the offline queue after a run of name in direction:
+// a network failure (re)queues it with a longer wait, anything else takes
+// it off. A run stopped by run_timeout reached the remote and isn't retried.
+func (d *daemon) noteOutcome(name, direction string, err error, now time.Time) {
+	key := name + " " + direction
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	unreachable := errorExitCode(err) == exitNetwork && !errors.As(err, new(runTimeoutError))
+	if err == nil || !unreachable || !d.retryOffline() {
+		if r, ok := d.offline[key]; ok {
+			delete(d.offline, key)
+			if err == nil {
+				logger.Info("remote reachable again", "category", name, "direction", direction, "offline_for", now.Sub(r.Since).Round(time.Second).String())
+			}
+		}
+		return
+	}
+	r, ok := d.offline[key]
+	if !ok {
+		r = offlineRun{Category: name, Direction: direction, Since: now}
+	}
+	r.Attempts++
+	r.LastError = err.Error()
+	r.NextTry = now.Add(d.backoff(r.Attempts))
+	d.offline[key] = r
+	logger.Warn("remote unreachable, will retry", "category", name, "direction", direction, "attempts", r.Attempts, "next_try", r.NextTry.Format(time.RFC3339))
+}
+
+// retryOffline reports whether runs that couldn't reach the remote are
+// retried, as daemon.retry_offline says.
+func (d *daemon) retryOffline() bool {
+	return d.cfg.Daemon.RetryOffline == nil || *d.cfg.Daemon.RetryOffline
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (d *daemon) backoff(attempts int) time.Duration {
+	limit := defaultMaxBackoff
+	if d.cfg.Daemon.MaxBackoff != "" {
+		limit, _ = time.ParseDuration(d.cfg.Daemon.MaxBackoff) // validated by config.Load
+	}
+	wait := firstBackoff
+	for range attempts - 1 {
+		if wait >= limit {
+			break
+		}
+		wait *= 2
+	}
+	return min(wait, limit)
+}
+
+// dueRetries returns the offline runs to try again at now, oldest first. A
+// change in the machine's network addresses (Wi-Fi joined, VPN up) makes
+// them all due at once rather than at the end of their wait. Paused
+// scheduling holds them back like jobs.
+func (d *daemon) dueRetries(now time.Time) []offlineRun {
+	state := d.network()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.lastNetwork != nil && state != *d.lastNetwork
+	d.lastNetwork = &state
+	if d.paused {
+		return nil
+	}
+	var due []offlineRun
+	for key, r := range d.offline {
+		if changed || !now.Before(r.NextTry) {
+			r.NextTry = now.Add(d.backoff(r.Attempts + 1))
+			d.offline[key] = r
+			due = append(due, r)
+		}
+	}
+	if changed && len(due) > 0 {
+		logger.Info("network changed, retrying offline runs", "runs", len(due))
+	}
+	slices.SortFunc(due, func(a, b offlineRun) int { return a.Since.Compare(b.Since) })
+	return due
+}
+
+// networkState describes the machine's network addresses, so that the
+// daemon notices one coming up.
+func networkState() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var s []string
+	for _, a := range addrs {
+		if ip, ok := a.(*net.IPNet); ok && !ip.IP.IsLoopback() && !ip.IP.IsLinkLocalUnicast() {
+			s = append(s, ip.String())
+		}
+	}
+	slices.Sort(s)
+	return strings.Join(s, " ")
+}
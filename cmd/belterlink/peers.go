@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// peerState is what a peer reports about its last sync of a category. The
+// local copy lives in the state dir; the hub keeps one file per peer under
+// ~/.belterlink/peers/<category>/ so every spoke can see the others.
+type peerState struct {
+	Peer     string    `json:"peer"`
+	LastSync time.Time `json:"last_sync"`
+	Pulled   int64     `json:"files_pulled"`
+	Pushed   int64     `json:"files_pushed"`
+}
+
+// syncViaHub implements the "sync" direction: pull what other peers pushed
+// to the hub, then push local changes. Deletions are only propagated with
+// propagate_deletions, which tells a deleted file from one that is merely
+// missing by the state saved after the last sync.
+func syncViaHub(ctx context.Context, cfg *config.Config, name string, opts RunOptions, maxRetries int) (*rsync.Stats, error) {
+	if rsync.ResolveDelete(cfg, opts.Options) {
+		fmt.Fprintln(os.Stderr, "warning: sync ignores delete; set propagate_deletions on the category instead")
+	}
+	opts.NoDelete = true
+
+	cat := cfg.Categories[name]
+	if err := resolveConflicts(ctx, cfg, name, cat, opts); err != nil {
+		return nil, err
+	}
+	tombstones, err := propagateDeletions(ctx, cfg, name, cat, opts)
+	if err != nil {
+		return nil, fmt.Errorf("propagate deletions: %w", err)
+	}
+	conflicts := 0
+	if cat.Merge == "markdown" {
+		if conflicts, err = mergeMarkdown(ctx, cfg, name, cat, opts); err != nil {
+			return nil, fmt.Errorf("merge notes: %w", err)
+		}
+	}
+
+	total := &rsync.Stats{}
+	var pulled, pushed int64
+	for _, dir := range []string{"pull", "push"} {
+		opts.Direction = dir
+		printAt(rsync.Normal, "--> %s %s\n", name, dir)
+		stats, err := syncCategory(ctx, cfg, name, opts, maxRetries)
+		if stats != nil {
+			total.Add(*stats)
+			if dir == "pull" {
+				pulled = stats.FilesTransferred
+			} else {
+				pushed = stats.FilesTransferred
+			}
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	if opts.DryRun {
+		return total, nil
+	}
+	if conflictPolicy(cat) != "newer-wins" || cat.PropagateDeletions {
+		if err := saveSyncedState(cfg, name, cat, tombstones); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: saving sync state:", err)
+			logger.Warn("sync state not saved", "category", name, "error", err)
+		}
+	}
+	if cat.Merge == "markdown" {
+		if err := saveMergeBase(cfg, name, cat); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: saving merge base:", err)
+			logger.Warn("merge base not saved", "category", name, "error", err)
+		}
+		if conflicts > 0 {
+			fmt.Fprintf(os.Stderr, "warning: %d note(s) contain conflict markers; resolve them and sync again\n", conflicts)
+		}
+	}
+
+	st := peerState{Peer: peerName(cfg), LastSync: time.Now().UTC(), Pulled: pulled, Pushed: pushed}
+	if err := recordPeerState(ctx, cfg, name, st); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: peer state:", err)
+		logger.Warn("peer state not recorded", "category", name, "error", err)
+	}
+	peers, err := remotePeerStates(ctx, cfg.SSH, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: peer state:", err)
+		return total, nil
+	}
+	printPeers(peers, st.Peer, staleAfter(cfg.Topology))
+	return total, nil
+}
+
+func peerName(cfg *config.Config) string {
+	if cfg.Topology.Name != "" {
+		return cfg.Topology.Name
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return host
+}
+
+func staleAfter(t config.Topology) time.Duration {
+	switch {
+	case t.StaleHours < 0:
+		return 0
+	case t.StaleHours == 0:
+		return 72 * time.Hour
+	}
+	return time.Duration(t.StaleHours) * time.Hour
+}
+
+// remotePeerDir is relative to the remote home, where ssh commands start.
+func remotePeerDir(category string) string {
+	return path.Join(".belterlink", "peers", category)
+}
+
+func localPeerStatePath(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "peers", category+".json")
+}
+
+// recordPeerState stores st locally and on the hub.
+func recordPeerState(ctx context.Context, cfg *config.Config, category string, st peerState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(localPeerStatePath(cfg, category), append(b, '\n')); err != nil {
+		return err
+	}
+	dir := remotePeerDir(category)
+	script := fmt.Sprintf("mkdir -p %s && printf '%%s\\n' %s > %s",
+		ssh.Quote(dir), ssh.Quote(string(b)), ssh.Quote(path.Join(dir, st.Peer+".json")))
+	if _, err := ssh.RunContext(ctx, cfg.SSH, script); err != nil {
+		return fmt.Errorf("update hub: %w", err)
+	}
+	return nil
+}
+
+// remotePeerStates reads every peer's state for category from the hub.
+func remotePeerStates(ctx context.Context, s config.SSH, category string) ([]peerState, error) {
+	script := fmt.Sprintf("for f in %s/*.json; do [ -f \"$f\" ] && cat \"$f\"; done; true", ssh.Quote(remotePeerDir(category)))
+	out, err := ssh.RunContext(ctx, s, script)
+	if err != nil {
+		return nil, fmt.Errorf("read peers from hub: %w", err)
+	}
+	return parsePeerStates(out), nil
+}
+
+func parsePeerStates(out []byte) []peerState {
+	var peers []peerState
+	for _, line := range strings.Split(string(out), "\n") {
+		var st peerState
+		if json.Unmarshal([]byte(line), &st) == nil && st.Peer != "" {
+			peers = append(peers, st)
+		}
+	}
+	slices.SortFunc(peers, func(a, b peerState) int { return strings.Compare(a.Peer, b.Peer) })
+	return peers
+}
+
+func printPeers(peers []peerState, self string, stale time.Duration) {
+	if len(peers) == 0 {
+		return
+	}
+	fmt.Println("Peers:")
+	for _, p := range peers {
+		age := time.Since(p.LastSync).Round(time.Minute)
+		note := ""
+		switch {
+		case p.Peer == self:
+			note = " (this machine)"
+		case stale > 0 && age > stale:
+			note = " (stale: changes from this peer may be missing)"
+		}
+		fmt.Printf("  %-16s last sync %s ago%s\n", p.Peer, age, note)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestParsePeerStates(t *testing.T) {
+	out := `{"peer":"nas","last_sync":"2024-05-01T10:00:00Z","files_pulled":1,"files_pushed":0}
+{"peer":"laptop","last_sync":"2024-05-02T10:00:00Z","files_pulled":0,"files_pushed":3}
+not json
+`
+	peers := parsePeerStates([]byte(out))
+	if len(peers) != 2 || peers[0].Peer != "laptop" || peers[1].Peer != "nas" {
+		t.Fatalf("parsePeerStates = %+v", peers)
+	}
+	if peers[0].Pushed != 3 || !peers[0].LastSync.Equal(time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected laptop state: %+v", peers[0])
+	}
+}
+
+func TestStaleAfter(t *testing.T) {
+	for _, tc := range []struct {
+		hours int
+		want  time.Duration
+	}{
+		{0, 72 * time.Hour},
+		{-1, 0},
+		{6, 6 * time.Hour},
+	} {
+		if got := staleAfter(config.Topology{StaleHours: tc.hours}); got != tc.want {
+			t.Fatalf("staleAfter(%d) = %v, want %v", tc.hours, got, tc.want)
+		}
+	}
+}
+
+func TestParseArgsSync(t *testing.T) {
+	_, direction, err := parseArgs([]string{"Notes", "sync"})
+	if err != nil || direction != "sync" {
+		t.Fatalf("parseArgs sync = %q, %v", direction, err)
+	}
+}
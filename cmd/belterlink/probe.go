@@ -0,0 +1,483 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// probeMaxAge is how long a probe is trusted before a sync probes again.
+const probeMaxAge = 30 * 24 * time.Hour
+
+// remoteProbe is what belterlink found out about a remote by looking, kept
+// in the state dir so that only the first sync to it has to ask.
+type remoteProbe struct {
+	Host         string                  `json:"host"` // as in known_hosts
+	Probed       time.Time               `json:"probed"`
+	OS           string                  `json:"os,omitempty"`    // uname -s
+	Shell        string                  `json:"shell,omitempty"` // the login shell
+	RemoteBinary string                  `json:"remote_binary"`   // rsync.remote_path, or rsync, when probed
+	RsyncPath    string                  `json:"rsync_path,omitempty"`
+	Rsync        rsync.Version           `json:"rsync"`
+	OtherRsyncs  []string                `json:"other_rsyncs,omitempty"` // installed besides RsyncPath
+	Targets      map[string]probedTarget `json:"targets,omitempty"`      // by category remote path
+
+	fresh bool // probed by this process
+}
+
+// probedTarget describes the filesystem a category's remote path is on, or
+// would be once created.
+type probedTarget struct {
+	MountPoint      string `json:"mount_point,omitempty"`
+	FSType          string `json:"fs_type,omitempty"`
+	CaseInsensitive *bool  `json:"case_insensitive,omitempty"` // nil: couldn't tell (not writable)
+}
+
+var (
+	probesMu sync.Mutex
+	probes   = map[string]*remoteProbe{} // by cache file, for the life of the process
+
+	// cachedProbeOnly keeps remoteInfo off the network: it returns the
+	// cached probe, however old, or an error. -print-cmd-only sets it.
+	cachedProbeOnly bool
+)
+
+// probePath is <state dir>/probe/<user>@<host>.json.
+func probePath(cfg *config.Config) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("/\\:[]", r) {
+			return '_'
+		}
+		return r
+	}, cfg.SSH.User+"@"+ssh.KnownHostsName(cfg.SSH))
+	return filepath.Join(config.StateDir(cfg), "probe", name+".json")
+}
+
+// remoteInfo returns what's known about the remote. It probes the remote
+// when it never was, when the probe is older than probeMaxAge, when
+// rsync.remote_path has changed since, or when a category's remote path is
+// new to it; refresh probes regardless. With cachedProbeOnly it never
+// probes.
+func remoteInfo(ctx context.Context, cfg *config.Config, refresh bool) (*remoteProbe, error) {
+	path := probePath(cfg)
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	if cachedProbeOnly {
+		return cachedProbe(path)
+	}
+	if p, ok := probes[path]; ok && !refresh && time.Since(p.Probed) < probeMaxAge {
+		return p, nil
+	}
+	dirs := remoteDirs(cfg)
+	p := new(remoteProbe)
+	b, err := os.ReadFile(path)
+	if refresh || err != nil || json.Unmarshal(b, p) != nil || time.Since(p.Probed) > probeMaxAge ||
+		p.RemoteBinary != rsync.RemoteBinary(cfg) || !probeCovers(p, dirs) {
+		if p, err = probeRemote(ctx, cfg, dirs); err != nil {
+			return nil, err
+		}
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, append(b, '\n')); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: probe not cached:", err)
+		}
+	}
+	probes[path] = p
+	return p, nil
+}
+
+// cachedProbe returns the probe cached in path, as is.
+func cachedProbe(path string) (*remoteProbe, error) {
+	if p, ok := probes[path]; ok {
+		return p, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(remoteProbe)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	probes[path] = p
+	return p, nil
+}
+
+// remoteDirs lists the remote paths of the categories that go through ssh
+// to ssh.host.
+func remoteDirs(cfg *config.Config) []string {
+	var dirs []string
+	for _, cat := range cfg.Categories {
+		if cat.Backend == "" && cat.ToHost == "" && cat.Remote != "" && cat.Mount == "" && cat.Drive == "" && !config.IsDaemonURL(cat.Remote) && !slices.Contains(dirs, cat.Remote) {
+			dirs = append(dirs, cat.Remote)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+func probeCovers(p *remoteProbe, dirs []string) bool {
+	for _, d := range dirs {
+		if _, ok := p.Targets[d]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// probeRemote looks at the remote in one ssh round trip.
+func probeRemote(ctx context.Context, cfg *config.Config, dirs []string) (*remoteProbe, error) {
+	binary := rsync.RemoteBinary(cfg)
+	out, err := ssh.RunContext(ctx, cfg.SSH, probeScript(binary, dirs))
+	if err != nil {
+		return nil, withExitCode(exitNetwork, fmt.Errorf("probe %s: %w", ssh.KnownHostsName(cfg.SSH), err))
+	}
+	p := parseProbe(string(out), dirs)
+	p.Host, p.Probed, p.RemoteBinary, p.fresh = ssh.KnownHostsName(cfg.SSH), time.Now().UTC(), binary, true
+	logger.Info("remote probed", "host", p.Host, "os", p.OS, "rsync", p.Rsync.String(), "rsync_path", p.RsyncPath)
+	return p, nil
+}
+
+// probeScript prints, in sections: the OS, shell and rsync, rsync
+// --version, each directory's df line (of the nearest existing parent) and
+// case sensitivity, and the mount table. Case sensitivity is found by
+// creating a directory and looking it up in upper case, on the same
+// filesystem but outside the directory, which may be a tree belterlink must
+// not write to: next to it, in $TMPDIR or $HOME, or at the mount point.
+func probeScript(binary string, dirs []string) string {
+	var b strings.Builder
+	q := ssh.Quote(binary)
+	fmt.Fprintf(&b, "echo \"os $(uname -s)\"\necho \"shell $SHELL\"\necho \"rsync_path $(command -v %s)\"\n", q)
+	b.WriteString("for r in /opt/homebrew/bin/rsync /usr/local/bin/rsync /usr/bin/rsync; do [ -x \"$r\" ] && echo \"rsync_other $r\"; done\n")
+	fmt.Fprintf(&b, "echo '--- rsync'\n%s --version 2>/dev/null\n", q)
+	for i, d := range dirs {
+		fmt.Fprintf(&b, "echo '--- target %d'\nt=%s\nd=$t\n", i, ssh.Quote(d))
+		b.WriteString(`while [ ! -d "$d" ] && [ "$d" != / ] && [ "$d" != . ]; do d=$(dirname "$d"); done
+df -P "$d" 2>/dev/null | tail -n 1
+m=$(df -P "$d" 2>/dev/null | tail -n 1 | sed 's/^.*% //')
+for c in "$(dirname "$d")" "${TMPDIR:-/tmp}" "$HOME" "$m"; do
+case "$c/" in "$t"/*) continue ;; esac
+[ -n "$m" ] && [ "$(df -P "$c" 2>/dev/null | tail -n 1 | sed 's/^.*% //')" = "$m" ] || continue
+p=$(mktemp -d "$c/.belterlink-case-XXXXXX" 2>/dev/null) || continue
+if [ -e "$(dirname "$p")/$(basename "$p" | tr a-z A-Z)" ]; then echo case insensitive; else echo case sensitive; fi
+rmdir "$p"; break
+done
+`)
+	}
+	b.WriteString("echo '--- mount'\nmount\n")
+	return b.String()
+}
+
+// parseProbe reads the output of probeScript.
+func parseProbe(out string, dirs []string) *remoteProbe {
+	p := &remoteProbe{Targets: map[string]probedTarget{}}
+	targets := make([]probedTarget, len(dirs))
+	var version, mounts []string
+	section, target := "", -1
+	for _, line := range strings.Split(out, "\n") {
+		if name, ok := strings.CutPrefix(line, "--- "); ok {
+			section = name
+			if n, ok := strings.CutPrefix(name, "target "); ok {
+				section = "target"
+				target, _ = strconv.Atoi(n)
+			}
+			continue
+		}
+		switch section {
+		case "":
+			key, val, _ := strings.Cut(line, " ")
+			switch key {
+			case "os":
+				p.OS = val
+			case "shell":
+				p.Shell = val
+			case "rsync_path":
+				p.RsyncPath = val
+			case "rsync_other":
+				p.OtherRsyncs = append(p.OtherRsyncs, val)
+			}
+		case "rsync":
+			version = append(version, line)
+		case "target":
+			if target < 0 || target >= len(targets) {
+				continue
+			}
+			if v, ok := strings.CutPrefix(line, "case "); ok {
+				ci := v == "insensitive"
+				targets[target].CaseInsensitive = &ci
+			} else if f := strings.Fields(line); len(f) >= 6 {
+				targets[target].MountPoint = strings.Join(f[5:], " ")
+			}
+		case "mount":
+			mounts = append(mounts, line)
+		}
+	}
+	p.Rsync = rsync.ParseVersion(strings.Join(version, "\n"))
+	p.OtherRsyncs = slices.DeleteFunc(p.OtherRsyncs, func(r string) bool { return r == p.RsyncPath })
+	types := parseMounts(mounts)
+	for i, d := range dirs {
+		t := targets[i]
+		t.FSType = types[t.MountPoint]
+		p.Targets[d] = t
+	}
+	return p
+}
+
+// parseMounts maps mount points to filesystem types, from mount output as
+// Linux ("/dev/sda1 on /mnt/usb type vfat (rw,...)") or macOS
+// ("/dev/disk3s5 on /System/Volumes/Data (apfs, local, ...)") prints it.
+func parseMounts(lines []string) map[string]string {
+	types := map[string]string{}
+	for _, line := range lines {
+		_, rest, ok := strings.Cut(line, " on ")
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(rest, " type "); i >= 0 {
+			if f := strings.Fields(rest[i+len(" type "):]); len(f) > 0 {
+				types[rest[:i]] = f[0]
+			}
+		} else if i := strings.LastIndex(rest, " ("); i >= 0 {
+			typ, _, _ := strings.Cut(rest[i+2:], ",")
+			types[rest[:i]] = strings.TrimSuffix(typ, ")")
+		}
+	}
+	return types
+}
+
+// coarseTimes lists filesystems that keep modification times to 2 seconds.
+var coarseTimes = []string{"vfat", "msdos", "exfat", "fat", "fat32"}
+
+func coarseTimeFS(fsType string) bool {
+	return slices.Contains(coarseTimes, strings.ToLower(fsType))
+}
+
+// targetWarnings tells what to watch out for when syncing local to the
+// probed remote path. localCI is whether the local filesystem ignores case,
+// nil if unknown; window is the category's modify_window.
+func targetWarnings(p *remoteProbe, remote string, localCI *bool, window int) []string {
+	t, ok := p.Targets[remote]
+	if !ok {
+		return nil
+	}
+	var warnings []string
+	if t.CaseInsensitive != nil && *t.CaseInsensitive && localCI != nil && !*localCI {
+		warnings = append(warnings, fmt.Sprintf("%s on %s is on a case-insensitive filesystem (%s) but the local one isn't: files whose names differ only in case overwrite each other there",
+			remote, p.Host, cmp.Or(t.FSType, "unknown type")))
+	}
+	if coarseTimeFS(t.FSType) && window == 0 {
+		warnings = append(warnings, fmt.Sprintf("%s on %s is on %s, which keeps modification times to 2 seconds: set modify_window: 2 on the category, or unchanged files are sent again",
+			remote, p.Host, t.FSType))
+	}
+	return warnings
+}
+
+// warnAboutTarget prints the category's targetWarnings: the first time the
+// remote is probed, and with -v after that, as they rarely change.
+func warnAboutTarget(ctx context.Context, cfg *config.Config, cat config.Category) {
+	p, err := remoteInfo(ctx, cfg, false)
+	if err != nil {
+		return
+	}
+	for _, w := range targetWarnings(p, cat.Remote, localCaseInsensitive(cfg, cat.Local), rsync.ModifyWindow(cfg, cat)) {
+		logger.Warn(w)
+		if p.fresh || verbosity >= rsync.Verbose {
+			fmt.Fprintln(os.Stderr, "warning:", w)
+		}
+	}
+}
+
+// localCasePath is where the case sensitivity of this machine's
+// filesystems is kept, by mount point and device.
+func localCasePath(cfg *config.Config) string {
+	return filepath.Join(config.StateDir(cfg), "probe", "local-case.json")
+}
+
+// localCaseInsensitive reports whether dir's filesystem ignores case; nil if
+// it can't tell. It finds out once per filesystem, by creating a directory
+// and looking it up in upper case. That happens outside dir, which may be a
+// tree belterlink must not write to (readonly_local, archive-append): in
+// the state dir, the temp dir, next to dir or at its mount point, whichever
+// is on the same filesystem. Failing that, a Windows filesystem is taken to
+// ignore case.
+func localCaseInsensitive(cfg *config.Config, dir string) *bool {
+	var st syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil {
+		return nil
+	}
+	mount := filesystemTop(dir, uint64(st.Dev))
+	key := fmt.Sprintf("%s@%d", mount, st.Dev)
+	cache := map[string]bool{}
+	if b, err := os.ReadFile(localCasePath(cfg)); err == nil {
+		json.Unmarshal(b, &cache)
+	}
+	if ci, ok := cache[key]; ok {
+		return &ci
+	}
+	for _, c := range []string{config.StateDir(cfg), os.TempDir(), filepath.Dir(dir), mount} {
+		var cst syscall.Stat_t
+		if inside(c, dir) || syscall.Stat(c, &cst) != nil || cst.Dev != st.Dev {
+			continue
+		}
+		probe, err := os.MkdirTemp(c, ".belterlink-case-")
+		if err != nil {
+			continue
+		}
+		_, err = os.Stat(filepath.Join(filepath.Dir(probe), strings.ToUpper(filepath.Base(probe))))
+		os.Remove(probe)
+		ci := err == nil
+		cache[key] = ci
+		if b, err := json.MarshalIndent(cache, "", "  "); err == nil {
+			writeFileAtomic(localCasePath(cfg), append(b, '\n'))
+		}
+		return &ci
+	}
+	if slices.Contains(windowsFilesystems, strings.ToLower(localFSType(dir))) {
+		ci := true
+		return &ci
+	}
+	return nil
+}
+
+// filesystemTop is the top directory of the filesystem dir, on device dev,
+// is on: its mount point.
+func filesystemTop(dir string, dev uint64) string {
+	dir, _ = filepath.Abs(dir)
+	for {
+		parent := filepath.Dir(dir)
+		var st syscall.Stat_t
+		if parent == dir || syscall.Stat(parent, &st) != nil || uint64(st.Dev) != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// inside reports whether path is dir or below it.
+func inside(path, dir string) bool {
+	path, _ = filepath.Abs(path)
+	dir, _ = filepath.Abs(dir)
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+const probeUsage = "usage: belterlink probe [-refresh] [-json] [host]"
+
+// probeFlags are the flags of "probe".
+type probeFlags struct {
+	refresh, asJSON bool
+}
+
+func (f *probeFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.refresh, "refresh", false, "probe again even if the cached probe is recent")
+	fs.BoolVar(&f.asJSON, "json", false, "print the probe as JSON")
+}
+
+// runProbeCommand implements "belterlink probe": what belterlink knows
+// about the remote, from the cache unless -refresh (or there is none). The
+// host defaults to ssh.host; another one is probed with the configured user
+// and port, and without the categories' paths.
+func runProbeCommand(g *globals, args []string) error {
+	flags := newFlagSet("probe")
+	g.register(flags)
+	var f probeFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() > 1 {
+		return exitErrorf(exitUsage, probeUsage)
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	if h := flags.Arg(0); h != "" && h != cfg.SSH.Host && h != cfg.SSH.HostKeyAlias {
+		c := *cfg
+		c.SSH.Host, c.SSH.Addresses, c.SSH.HostKeyAlias = h, nil, ""
+		c.Categories = nil
+		cfg = &c
+	}
+	if cfg.SSH.User == "" || cfg.SSH.Host == "" {
+		return exitErrorf(exitConfig, "ssh.user and ssh.host are required in config")
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+	p, err := remoteInfo(context.Background(), cfg, f.refresh)
+	if err != nil {
+		return err
+	}
+	if f.asJSON {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+	}
+	printProbe(os.Stdout, cfg, p, time.Now())
+	return nil
+}
+
+// printProbe shows a probe, with each target's categories and warnings.
+func printProbe(w io.Writer, cfg *config.Config, p *remoteProbe, now time.Time) {
+	fmt.Fprintf(w, "%s (probed %s, %s ago; belterlink probe -refresh to look again)\n",
+		p.Host, p.Probed.Local().Format("2006-01-02 15:04"), now.Sub(p.Probed).Round(time.Minute))
+	fmt.Fprintf(w, "  os:     %s\n", cmp.Or(p.OS, "unknown"))
+	fmt.Fprintf(w, "  shell:  %s\n", cmp.Or(p.Shell, "unknown"))
+	switch {
+	case p.RsyncPath == "":
+		fmt.Fprintf(w, "  rsync:  %s not found (transport: agent works without it)\n", p.RemoteBinary)
+	default:
+		fmt.Fprintf(w, "  rsync:  %s, %s\n", p.RsyncPath, p.Rsync)
+	}
+	if len(p.OtherRsyncs) > 0 {
+		fmt.Fprintf(w, "          also installed: %s (rsync.remote_path picks one)\n", strings.Join(p.OtherRsyncs, ", "))
+	}
+	byRemote := map[string][]string{}
+	for name, cat := range cfg.Categories {
+		byRemote[cat.Remote] = append(byRemote[cat.Remote], name)
+	}
+	for _, remote := range slices.Sorted(maps.Keys(p.Targets)) {
+		t := p.Targets[remote]
+		names := byRemote[remote]
+		slices.Sort(names)
+		casing := "case unknown"
+		if t.CaseInsensitive != nil {
+			casing = map[bool]string{true: "case-insensitive", false: "case-sensitive"}[*t.CaseInsensitive]
+		}
+		fmt.Fprintf(w, "  %-12s %s: %s on %s, %s\n", strings.Join(names, ","), remote, cmp.Or(t.FSType, "unknown filesystem"), cmp.Or(t.MountPoint, "?"), casing)
+		if len(names) > 0 {
+			cat := cfg.Categories[names[0]]
+			for _, warning := range targetWarnings(p, remote, localCaseInsensitive(cfg, cat.Local), rsync.ModifyWindow(cfg, cat)) {
+				fmt.Fprintf(w, "               warning: %s\n", warning)
+			}
+		}
+	}
+	if len(p.Targets) == 0 {
+		fmt.Fprintln(w, "  (no category paths probed)")
+	}
+}
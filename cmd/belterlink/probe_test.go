@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+const macProbe = `os Darwin
+shell /bin/zsh
+rsync_path /usr/bin/rsync
+rsync_other /opt/homebrew/bin/rsync
+rsync_other /usr/bin/rsync
+--- rsync
+rsync  version 2.6.9  protocol version 29
+--- target 0
+/dev/disk3s5   971350180 523456789 447893391    54%    /System/Volumes/Data
+case insensitive
+--- target 1
+/dev/disk4s1      60000000   1000000  59000000     2%    /Volumes/USB Stick
+--- mount
+/dev/disk3s1s1 on / (apfs, sealed, local, read-only, journaled)
+/dev/disk3s5 on /System/Volumes/Data (apfs, local, journaled, nobrowse, protect)
+/dev/disk4s1 on /Volumes/USB Stick (exfat, local, nodev, nosuid, noowners)
+`
+
+func TestParseProbe(t *testing.T) {
+	dirs := []string{"/Users/me/Notes", "/Volumes/USB Stick/Backup"}
+	p := parseProbe(macProbe, dirs)
+	if p.OS != "Darwin" || p.Shell != "/bin/zsh" || p.RsyncPath != "/usr/bin/rsync" || !p.Rsync.Known() || p.Rsync.AtLeast(3, 0, 0) {
+		t.Fatalf("probe = %+v", p)
+	}
+	if len(p.OtherRsyncs) != 1 || p.OtherRsyncs[0] != "/opt/homebrew/bin/rsync" {
+		t.Errorf("other rsyncs = %q", p.OtherRsyncs)
+	}
+	notes := p.Targets[dirs[0]]
+	if notes.FSType != "apfs" || notes.MountPoint != "/System/Volumes/Data" || notes.CaseInsensitive == nil || !*notes.CaseInsensitive {
+		t.Errorf("Notes target = %+v", notes)
+	}
+	usb := p.Targets[dirs[1]]
+	if usb.FSType != "exfat" || usb.MountPoint != "/Volumes/USB Stick" || usb.CaseInsensitive != nil {
+		t.Errorf("USB target = %+v", usb)
+	}
+}
+
+func TestParseMountsLinux(t *testing.T) {
+	types := parseMounts([]string{
+		"/dev/nvme0n1p2 on / type ext4 (rw,relatime)",
+		"/dev/sdb1 on /media/me/MY DISK type vfat (rw,nosuid,nodev)",
+	})
+	if types["/"] != "ext4" || types["/media/me/MY DISK"] != "vfat" {
+		t.Errorf("types = %v", types)
+	}
+}
+
+func TestTargetWarnings(t *testing.T) {
+	p := parseProbe(macProbe, []string{"/Users/me/Notes", "/Volumes/USB Stick/Backup"})
+	p.Host = "mymac.local"
+	yes, no := true, false
+	if w := targetWarnings(p, "/Users/me/Notes", &no, 0); len(w) != 1 || !strings.Contains(w[0], "case-insensitive") {
+		t.Errorf("warnings for a case-sensitive local tree = %q", w)
+	}
+	if w := targetWarnings(p, "/Users/me/Notes", &yes, 0); len(w) != 0 {
+		t.Errorf("warnings between two case-insensitive trees = %q", w)
+	}
+	if w := targetWarnings(p, "/Volumes/USB Stick/Backup", nil, 0); len(w) != 1 || !strings.Contains(w[0], "modify_window: 2") {
+		t.Errorf("warnings for exfat = %q", w)
+	}
+	if w := targetWarnings(p, "/Volumes/USB Stick/Backup", nil, 2); len(w) != 0 {
+		t.Errorf("warnings for exfat with modify_window = %q", w)
+	}
+}
+
+func TestPrintProbe(t *testing.T) {
+	p := parseProbe(macProbe, []string{"/Users/me/Notes"})
+	p.Host, p.RemoteBinary = "mymac.local", "rsync"
+	p.Probed = time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	cfg := &config.Config{Categories: map[string]config.Category{"Notes": {Local: t.TempDir(), Remote: "/Users/me/Notes"}}}
+	var out bytes.Buffer
+	printProbe(&out, cfg, p, p.Probed.Add(3*time.Hour))
+	for _, want := range []string{
+		"3h0m0s ago",
+		"rsync:  /usr/bin/rsync, 2.6.9",
+		"also installed: /opt/homebrew/bin/rsync",
+		"Notes        /Users/me/Notes: apfs on /System/Volumes/Data, case-insensitive",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLocalCaseInsensitive(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	tree := t.TempDir()
+	ci := localCaseInsensitive(cfg, tree)
+	if ci == nil {
+		t.Fatal("no answer for a temp dir")
+	}
+	if entries, _ := os.ReadDir(tree); len(entries) != 0 {
+		t.Errorf("the probe left %d entries in the tree", len(entries))
+	}
+	if _, err := os.Stat(localCasePath(cfg)); err != nil {
+		t.Fatalf("result not cached: %v", err)
+	}
+	// another tree on the same filesystem is answered from the cache
+	b, _ := os.ReadFile(localCasePath(cfg))
+	flipped := strings.NewReplacer("true", "false", "false", "true").Replace(string(b))
+	if err := os.WriteFile(localCasePath(cfg), []byte(flipped), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := localCaseInsensitive(cfg, t.TempDir()); got == nil || *got == *ci {
+		t.Errorf("second probe = %v, want the cached %v", got, !*ci)
+	}
+}
+
+func TestProbeScriptLeavesTargetAlone(t *testing.T) {
+	tree := filepath.Join(t.TempDir(), "tree")
+	if err := os.Mkdir(tree, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sh", "-c", probeScript("rsync", []string{tree})).Output()
+	if err != nil {
+		t.Fatalf("probe script: %v", err)
+	}
+	p := parseProbe(string(out), []string{tree})
+	if p.Targets[tree].CaseInsensitive == nil {
+		t.Errorf("no case sensitivity in:\n%s", out)
+	}
+	if entries, _ := os.ReadDir(tree); len(entries) != 0 {
+		t.Errorf("the probe left %d entries in the tree", len(entries))
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(tree)); len(entries) != 1 {
+		t.Errorf("the probe left %d entries next to the tree", len(entries)-1)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+const pushAgentUsage = "usage: belterlink push-agent [-binary <file>] [-dest <path>] [[<user>@]<host>]"
+
+// defaultAgentDest is where push-agent installs the binary, relative to the
+// remote home; install.sh uses the same place.
+const defaultAgentDest = ".local/bin/belterlink"
+
+// pushAgentFlags are the flags of "push-agent".
+type pushAgentFlags struct {
+	binary, dest string
+}
+
+func (f *pushAgentFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.binary, "binary", "", "upload this binary (default: this one, or belterlink-<os>-<arch> next to it)")
+	fs.StringVar(&f.dest, "dest", defaultAgentDest, "where to install it on the remote; relative paths start at the remote home")
+}
+
+// runPushAgentCommand implements "belterlink push-agent": it installs a
+// belterlink binary built for the remote's OS and architecture there, so
+// transport: agent works (again) after the remote got a new machine or this
+// one a new version. The host defaults to the one in the config.
+func runPushAgentCommand(g *globals, args []string) error {
+	flags := newFlagSet("push-agent")
+	g.register(flags)
+	var f pushAgentFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() > 1 || f.dest == "" {
+		return withExitCode(exitUsage, errors.New(pushAgentUsage))
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	if host := flags.Arg(0); host != "" {
+		if user, h, ok := strings.Cut(host, "@"); ok {
+			cfg.SSH.User, host = user, h
+		}
+		cfg.SSH.Host, cfg.SSH.Addresses, cfg.SSH.HostKeyAlias = host, nil, ""
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+
+	out, err := ssh.Run(cfg.SSH, "uname -sm")
+	if err != nil {
+		return exitErrorf(preflightExitCode(err), "detect the remote platform: %v", err)
+	}
+	goos, goarch, err := remotePlatform(string(out))
+	if err != nil {
+		return err
+	}
+	local, err := agentBinary(f.binary, goos, goarch)
+	if err != nil {
+		return err
+	}
+	printAt(rsync.Normal, "Installing %s (%s/%s) to %s:%s\n", local, goos, goarch, cfg.SSH.Host, f.dest)
+	if err := uploadAgent(cfg.SSH, local, f.dest); err != nil {
+		return withExitCode(exitNetwork, err)
+	}
+	logger.Info("agent installed", "host", cfg.SSH.Host, "dest", f.dest, "os", goos, "arch", goarch)
+
+	// check the agent answers the way syncs will start it, or else directly
+	if client, hello, err := dialAgent(cfg.SSH); err == nil {
+		client.Close()
+		if hello.Build == version {
+			fmt.Printf("Installed belterlink %s on %s, protocol version %d\n", version, cfg.SSH.Host, hello.Version)
+			return nil
+		}
+	}
+	direct := cfg.SSH
+	direct.AgentCommand = ssh.Quote(f.dest) + " agent"
+	client, _, err := dialAgent(direct)
+	if err != nil {
+		return fmt.Errorf("the installed agent doesn't start: %w", err)
+	}
+	client.Close()
+	fmt.Printf("Installed belterlink %s on %s, but syncs start %q, which runs another belterlink.\n",
+		version, cfg.SSH.Host, cmp.Or(cfg.SSH.AgentCommand, defaultAgentCommand))
+	fmt.Printf("Put %s on the remote's PATH, or set in the config:\n\n  ssh:\n    agent_command: %s\n", path.Dir(f.dest), direct.AgentCommand)
+	return nil
+}
+
+// remotePlatform maps the output of "uname -sm" to GOOS and GOARCH.
+func remotePlatform(uname string) (goos, goarch string, err error) {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected output from uname on the remote: %q", strings.TrimSpace(uname))
+	}
+	switch fields[0] {
+	case "Linux":
+		goos = "linux"
+	case "Darwin":
+		goos = "darwin"
+	case "FreeBSD":
+		goos = "freebsd"
+	default:
+		return "", "", fmt.Errorf("no belterlink build for the remote's OS (%s)", fields[0])
+	}
+	switch m := fields[1]; {
+	case m == "x86_64" || m == "amd64":
+		goarch = "amd64"
+	case m == "aarch64" || m == "arm64":
+		goarch = "arm64"
+	case strings.HasPrefix(m, "armv"):
+		goarch = "arm"
+	case m == "i386" || m == "i686":
+		goarch = "386"
+	default:
+		return "", "", fmt.Errorf("no belterlink build for the remote's architecture (%s)", m)
+	}
+	return goos, goarch, nil
+}
+
+// agentBinary picks the binary to install on a goos/goarch remote: the one
+// given, this one if it was built for the same platform, or a
+// belterlink-<os>-<arch> next to it, as the release assets are named.
+func agentBinary(given, goos, goarch string) (string, error) {
+	if given != "" {
+		if _, err := os.Stat(given); err != nil {
+			return "", withExitCode(exitUsage, err)
+		}
+		return given, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return self, nil
+	}
+	name := fmt.Sprintf("belterlink-%s-%s", goos, goarch)
+	p := filepath.Join(filepath.Dir(self), name)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	return "", exitErrorf(exitUsage, "the remote is %s/%s and this belterlink is built for %s/%s; download %s from the releases "+
+		"or build it with 'GOOS=%s GOARCH=%s go build -o %s ./cmd/belterlink', then put it next to this binary or pass -binary",
+		goos, goarch, runtime.GOOS, runtime.GOARCH, name, goos, goarch, name)
+}
+
+// uploadAgent copies local to dest on the remote through a temporary name, so
+// an agent running there keeps its binary until the new one is complete.
+func uploadAgent(s config.SSH, local, dest string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	q, tmp := ssh.Quote(dest), ssh.Quote(dest+".tmp")
+	script := fmt.Sprintf("mkdir -p %s && cat > %s && chmod 755 %s && mv -f %s %s", ssh.Quote(path.Dir(dest)), tmp, tmp, tmp, q)
+	cmd := exec.Command("ssh", append(ssh.Args(s)[1:], ssh.Target(s), script)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = f, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("upload to %s:%s: %w", s.Host, dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRemotePlatform(t *testing.T) {
+	for uname, want := range map[string][2]string{
+		"Linux x86_64\n":  {"linux", "amd64"},
+		"Linux aarch64\n": {"linux", "arm64"},
+		"Linux armv7l\n":  {"linux", "arm"},
+		"Darwin arm64\n":  {"darwin", "arm64"},
+		"FreeBSD amd64\n": {"freebsd", "amd64"},
+	} {
+		goos, goarch, err := remotePlatform(uname)
+		if err != nil || goos != want[0] || goarch != want[1] {
+			t.Errorf("remotePlatform(%q) = %s/%s, %v; want %s/%s", uname, goos, goarch, err, want[0], want[1])
+		}
+	}
+	for _, uname := range []string{"", "MINGW64_NT-10.0 x86_64", "Linux riscv64", "Linux"} {
+		if _, _, err := remotePlatform(uname); err == nil {
+			t.Errorf("remotePlatform(%q): expected an error", uname)
+		}
+	}
+}
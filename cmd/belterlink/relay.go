@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// relayEnd is one end of a transfer between two remotes: a host and the
+// category's directory there.
+type relayEnd struct {
+	ssh config.SSH
+	dir string
+}
+
+func (e relayEnd) spec() string {
+	return rsync.RemoteSpec(e.ssh, config.Category{Remote: e.dir})
+}
+
+// relayStaging is the copy relay: local keeps of a category with from_host.
+// It stays between runs, so each relay only moves what changed.
+func relayStaging(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "relay", category)
+}
+
+// syncRemoteToRemote pushes or pulls a category with from_host: a push copies
+// its local path on from_host to its remote path on to_host, a pull the other
+// way. With relay: local the files go through a copy on this machine, pulled
+// from the sending host and then pushed to the receiving one; with relay:
+// direct, from_host runs rsync to to_host itself, logging in with the ssh
+// agent forwarded to it.
+func syncRemoteToRemote(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions, maxRetries int) (*rsync.Stats, error) {
+	if opts.Direction != "push" && opts.Direction != "pull" {
+		return nil, exitErrorf(exitUsage, "category %q has from_host; %s needs its files on this machine, use push or pull", name, opts.Direction)
+	}
+	if opts.FilesFrom != "" || len(opts.Paths) > 0 {
+		return nil, exitErrorf(exitUsage, "category %q has from_host; -path and -files-from need its files on this machine", name)
+	}
+	from, err := config.HostSSH(cfg.SSH, cat.FromHost)
+	if err != nil {
+		return nil, exitErrorf(exitConfig, "category %q: from_host: %v", name, err)
+	}
+	var to config.SSH
+	if cat.ToHost == "" {
+		if err := pickAddress(cfg); err != nil {
+			return nil, err
+		}
+		to = cfg.SSH
+	} else if to, err = config.HostSSH(cfg.SSH, cat.ToHost); err != nil {
+		return nil, exitErrorf(exitConfig, "category %q: to_host: %v", name, err)
+	}
+	if err := ssh.EnsureControlDir(from); err != nil {
+		return nil, err
+	}
+	hosts := []config.SSH{from, to}
+	if cat.Relay == "direct" {
+		hosts = hosts[:1] // to_host is for from_host to trust
+	}
+	for _, s := range hosts {
+		if err := ensureHostKey(hostConfig(cfg, s, name, cat), opts); err != nil {
+			return nil, err
+		}
+	}
+	ignoreDir, err := fetchIgnoreFile(ctx, from, cat.Local)
+	if err != nil {
+		return nil, withExitCode(preflightExitCode(err), err)
+	}
+	defer os.RemoveAll(ignoreDir)
+	if cat.Relay == "direct" {
+		return relayDirect(ctx, cfg, name, cat, opts, maxRetries, from, to, ignoreDir)
+	}
+	send, recv := relayEnd{from, cat.Local}, relayEnd{to, cat.Remote}
+	if opts.Direction == "pull" {
+		send, recv = recv, send
+	}
+	return relayLocal(ctx, cfg, name, cat, opts, maxRetries, send, recv, ignoreDir)
+}
+
+// relayLocal mirrors the sending end into the category's copy on this
+// machine, then pushes the copy to the receiving end. A dry run downloads
+// nothing: the first leg lists what the copy would fetch, and the second
+// what the receiving end would get from the copy as the last relay left it.
+func relayLocal(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions, maxRetries int, send, recv relayEnd, ignoreDir string) (*rsync.Stats, error) {
+	staging := relayStaging(cfg, name)
+	if err := os.MkdirAll(staging, 0o700); err != nil {
+		return nil, fmt.Errorf("create relay copy: %w", err)
+	}
+	inCat := cat
+	inCat.Remote = send.dir
+	inCfg := hostConfig(cfg, send.ssh, name, inCat)
+	in := opts
+	in.Direction, in.Delete = "pull", true // the copy always mirrors the sending end
+	if err := resolveRsyncOptions(ctx, inCfg, inCat, &in); err != nil {
+		return nil, err
+	}
+	in.TempDir = "" // temp_dir is for the receiving end
+	inArgs, err := relayArgs(ctx, inCfg, inCat, in, ignoreDir, send.spec(), staging+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	outCat := cat
+	outCat.Remote = recv.dir
+	outCfg := hostConfig(cfg, recv.ssh, name, outCat)
+	out := opts
+	out.Direction = "push"
+	if err := resolveRsyncOptions(ctx, outCfg, outCat, &out); err != nil {
+		return nil, err
+	}
+	outArgs, err := relayArgs(ctx, outCfg, outCat, out, ignoreDir, staging+"/", recv.spec())
+	if err != nil {
+		return nil, err
+	}
+
+	printAt(rsync.Normal, "Relaying %s from %s to %s through %s\n", name, ssh.Target(send.ssh), ssh.Target(recv.ssh), staging)
+	printAt(rsync.Normal, "Running: %s\n", shellCommand(append([]string{rsync.Binary(cfg)}, inArgs...)))
+	err = runRetrying(ctx, maxRetries, func() error {
+		return runRsync(ctx, inCfg, in.Options, inArgs, rsyncOutput(nil))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		if checkLocalSource(staging) != nil {
+			printAt(rsync.Normal, "Nothing relayed yet: the receiving end would get all of the above\n")
+			return nil, nil
+		}
+		printAt(rsync.Normal, "The receiving end, from the copy as the last relay left it:\n")
+	} else if !opts.Force {
+		if err := checkLocalSource(staging); err != nil {
+			return nil, withExitCode(exitRefused, fmt.Errorf("%s on %s: %w; re-run with -force if this is intended", send.dir, send.ssh.Host, err))
+		}
+	}
+	if rsync.ResolveDelete(cfg, opts.Options) && !opts.DryRun {
+		if outArgs, err = confirmDeletions(ctx, outCfg, outCat, out, outArgs); err != nil {
+			return nil, err
+		}
+	}
+	printAt(rsync.Normal, "Running: %s\n", shellCommand(append([]string{rsync.Binary(cfg)}, outArgs...)))
+	var captured bytes.Buffer
+	err = runRetrying(ctx, maxRetries, func() error {
+		captured.Reset()
+		return runRsync(ctx, outCfg, out.Options, outArgs, rsyncOutput(&captured))
+	})
+	return transferStats(opts, captured.String()), err
+}
+
+// relayDirect has from_host run rsync to or from to_host over ssh. Options
+// aren't fitted to the rsyncs at the ends, which belterlink doesn't probe
+// from there.
+func relayDirect(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions, maxRetries int, from, to config.SSH, ignoreDir string) (*rsync.Stats, error) {
+	// from_host's ssh to to_host: its own keys and known_hosts, or ours
+	// through the forwarded agent
+	hop := config.SSH{User: to.User, Host: to.Host, Port: to.Port, ConnectTimeout: to.ConnectTimeout}
+	c := hostConfig(cfg, hop, name, cat)
+	var err error
+	if opts.Compress, opts.CompressChoice, err = rsync.ResolveCompression(c, cat, rsync.Version{}, rsync.Version{}); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	if opts.WholeFile, err = rsync.ResolveWholeFile(c, cat); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	// both ends are remote, so a ~ in temp_dir can't be expanded here
+	if opts.TempDir, err = resolveTempDir(c, cat, "push"); err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	local, remote := strings.TrimRight(cat.Local, "/")+"/", relayEnd{to, cat.Remote}.spec()
+	src, dst := local, remote
+	if opts.Direction == "pull" {
+		src, dst = remote, local
+	}
+	cat.Local = ignoreDir
+	rsArgs, err := rsync.BuildArgs(c, cat, opts.Options)
+	if err != nil {
+		return nil, fmt.Errorf("build rsync args: %w", err)
+	}
+	rsArgs = append(rsArgs[:len(rsArgs)-2], src, dst)
+	if !opts.DryRun && !slices.Contains(rsArgs, "--stats") {
+		rsArgs = rsync.InsertBeforePaths(rsArgs, "--stats")
+	}
+	if limit := maxDelete(cfg, cat); limit > 0 && rsync.ResolveDelete(cfg, opts.Options) {
+		// there's no preview to confirm from; rsync stops at the limit
+		rsArgs = rsync.InsertBeforePaths(rsArgs, "--max-delete="+strconv.Itoa(limit))
+	}
+	command := shellCommand(append([]string{rsync.RemoteBinary(cfg)}, rsArgs...))
+	sshArgs := append(ssh.Args(from), "-A", ssh.Target(from), command)
+	printAt(rsync.Normal, "Running: %s\n", shellCommand(sshArgs))
+	var captured bytes.Buffer
+	err = runRetrying(ctx, maxRetries, func() error {
+		captured.Reset()
+		cmd := exec.Command(sshArgs[0], sshArgs[1:]...)
+		cmd.Stdout, cmd.Stderr = rsyncOutput(&captured), os.Stderr
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		stop := context.AfterFunc(ctx, func() { cmd.Process.Signal(syscall.SIGTERM) })
+		defer stop()
+		return cmd.Wait()
+	})
+	return transferStats(opts, captured.String()), err
+}
+
+// hostConfig is cfg for transfers with the host s, knowing only the category
+// called name as cat, so a probe of s looks at cat's remote path alone.
+func hostConfig(cfg *config.Config, s config.SSH, name string, cat config.Category) *config.Config {
+	c := *cfg
+	c.SSH = s
+	cat.ToHost = "" // its remote path is on s
+	c.Categories = map[string]config.Category{name: cat}
+	return &c
+}
+
+// relayArgs returns the rsync arguments of a transfer of cat from src to
+// dst, with the rules of the ignore file fetched into ignoreDir.
+func relayArgs(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions, ignoreDir, src, dst string) ([]string, error) {
+	cat.Local = ignoreDir
+	rsArgs, err := categoryRsyncArgs(ctx, cfg, cat, opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(rsArgs[:len(rsArgs)-2], src, dst), nil
+}
+
+// fetchIgnoreFile copies the ignore file at the root of dir on from_host, if
+// there is one, into a new temporary directory, where BuildArgs reads it.
+func fetchIgnoreFile(ctx context.Context, from config.SSH, dir string) (string, error) {
+	out, err := ssh.RunContext(ctx, from, "cat "+ssh.Quote(path.Join(dir, rsync.IgnoreFile))+" 2>/dev/null || true")
+	if err != nil {
+		return "", fmt.Errorf("read %s on %s: %w", rsync.IgnoreFile, from.Host, err)
+	}
+	tmp, err := os.MkdirTemp("", "belterlink-relay-")
+	if err != nil {
+		return "", err
+	}
+	if len(out) > 0 {
+		if err := os.WriteFile(filepath.Join(tmp, rsync.IgnoreFile), out, 0o600); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	return tmp, nil
+}
+
+// rsyncOutput is where a transfer's output goes: stdout unless quiet, and
+// captured, if not nil, for the stats.
+func rsyncOutput(captured *bytes.Buffer) io.Writer {
+	var stdout io.Writer = os.Stdout
+	if verbosity == rsync.Quiet {
+		stdout = io.Discard
+	}
+	if captured != nil {
+		return io.MultiWriter(stdout, captured)
+	}
+	return stdout
+}
+
+// transferStats parses the stats in a transfer's output, unless it was a dry
+// run.
+func transferStats(opts RunOptions, output string) *rsync.Stats {
+	if opts.DryRun {
+		return nil
+	}
+	st := rsync.ParseStats(output)
+	return &st
+}
+
+// runRetrying runs a transfer until it succeeds or fails for good, retrying
+// transient failures with backoff like a run of rsync does.
+func runRetrying(ctx context.Context, maxRetries int, run func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := run()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return abortedError(ctx)
+		}
+		code := rsync.ExitCode(err)
+		if attempt >= maxRetries || !rsync.IsRetryable(code) {
+			return exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+		}
+		wait := backoff(attempt)
+		fmt.Fprintf(os.Stderr, "rsync failed with exit code %d (transient); retrying in %s (%d/%d)\n",
+			code, wait.Round(time.Millisecond), attempt+1, maxRetries)
+		logger.Warn("retrying rsync", "exit_code", code, "reason", explainRsyncExit(code), "wait", wait, "attempt", attempt+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return abortedError(ctx)
+		}
+	}
+}
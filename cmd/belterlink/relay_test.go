@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestHostConfig(t *testing.T) {
+	cfg := &config.Config{
+		SSH: config.SSH{User: "me", Host: "nas"},
+		Categories: map[string]config.Category{
+			"Notes": {Local: "/l/Notes", Remote: "/data/Notes"},
+			"Vault": {Local: "Vault", Remote: "/volume1/Vault", FromHost: "oldmac", ToHost: "nas2"},
+		},
+	}
+	if got := remoteDirs(cfg); !slices.Equal(got, []string{"/data/Notes"}) {
+		t.Errorf("remoteDirs = %v, want only the remotes on ssh.host", got)
+	}
+	from := config.SSH{User: "ann", Host: "oldmac", Port: 22}
+	cat := cfg.Categories["Vault"]
+	cat.Remote = cat.Local
+	c := hostConfig(cfg, from, "Vault", cat)
+	if got := remoteDirs(c); !slices.Equal(got, []string{"Vault"}) {
+		t.Errorf("remoteDirs of from_host = %v, want the category's path there", got)
+	}
+	if c.SSH.Host != "oldmac" || cfg.SSH.Host != "nas" || len(cfg.Categories) != 2 {
+		t.Errorf("hostConfig changed cfg or kept its host: %+v, %+v", c.SSH, cfg.SSH)
+	}
+	if got, want := (relayEnd{from, "Vault"}).spec(), "ann@oldmac:Vault/"; got != want {
+		t.Errorf("spec = %s, want %s", got, want)
+	}
+}
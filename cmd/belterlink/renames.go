@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// inodeEntry identifies a local file across renames.
+type inodeEntry struct {
+	Ino     uint64    `json:"ino"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+type rename struct {
+	From, To string
+}
+
+func inodesPath(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "inodes", category+".json")
+}
+
+// listInodes lists the local regular files of cat with their inodes.
+func listInodes(cat config.Category) (map[string]inodeEntry, error) {
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]inodeEntry{}
+	err = filepath.WalkDir(cat.Local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == cat.Local {
+			return err
+		}
+		rel, err := filepath.Rel(cat.Local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if m.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			files[rel] = inodeEntry{Ino: uint64(st.Ino), Size: info.Size(), ModTime: info.ModTime().UTC()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// saveInodes records the local files after a successful run, for the next
+// push to find what was renamed since.
+func saveInodes(cfg *config.Config, name string, cat config.Category) error {
+	files, err := listInodes(cat)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(inodesPath(cfg, name), append(b, '\n'))
+}
+
+// findRenames pairs files that disappeared since before with new files of
+// the same inode, size and mtime: the same file under a new name.
+func findRenames(before, now map[string]inodeEntry) []rename {
+	gone := map[uint64]string{}
+	for rel, e := range before {
+		if _, ok := now[rel]; !ok {
+			gone[e.Ino] = rel
+		}
+	}
+	var renames []rename
+	for _, rel := range slices.Sorted(maps.Keys(now)) {
+		if _, ok := before[rel]; ok {
+			continue
+		}
+		e := now[rel]
+		from, ok := gone[e.Ino]
+		if !ok {
+			continue
+		}
+		if was := before[from]; was.Size == e.Size && was.ModTime.Equal(e.ModTime) {
+			renames = append(renames, rename{From: from, To: rel})
+			delete(gone, e.Ino)
+		}
+	}
+	return renames
+}
+
+// moveRenamedOnRemote runs before a push with detect_renames: files renamed
+// or moved locally since the last run are moved the same way on the remote,
+// so rsync finds them in place instead of sending them again (and deleting
+// the old copies with -delete). A move is skipped when the old name is gone
+// on the remote or the new one taken; rsync still checks every moved file.
+func moveRenamedOnRemote(ctx context.Context, cfg *config.Config, name string, cat config.Category, dryRun bool) error {
+	b, err := os.ReadFile(inodesPath(cfg, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // first run: nothing to compare with yet
+	} else if err != nil {
+		return err
+	}
+	var before map[string]inodeEntry
+	if err := json.Unmarshal(b, &before); err != nil {
+		return fmt.Errorf("read %s: %w", inodesPath(cfg, name), err)
+	}
+	now, err := listInodes(cat)
+	if err != nil {
+		return err
+	}
+	renames := findRenames(before, now)
+	if dryRun {
+		for _, r := range renames {
+			printAt(rsync.Normal, "Would move on the remote: %s -> %s\n", r.From, r.To)
+		}
+		return nil
+	}
+
+	const batch = 100
+	for i := 0; i < len(renames); i += batch {
+		var script []string
+		for _, r := range renames[i:min(i+batch, len(renames))] {
+			printAt(rsync.Normal, "Moving on the remote: %s -> %s\n", r.From, r.To)
+			from, to := ssh.Quote(path.Join(cat.Remote, r.From)), ssh.Quote(path.Join(cat.Remote, r.To))
+			script = append(script, fmt.Sprintf("if [ -f %s ] && [ ! -e %s ]; then mkdir -p -- %s && mv -- %s %s; fi",
+				from, to, ssh.Quote(path.Dir(path.Join(cat.Remote, r.To))), from, to))
+		}
+		if _, err := ssh.RunContext(ctx, cfg.SSH, strings.Join(script, "\n")); err != nil {
+			return withExitCode(exitNetwork, fmt.Errorf("move renamed files on the remote: %w", err))
+		}
+	}
+	if len(renames) > 0 {
+		logger.Info("renames applied on the remote", "category", name, "files", len(renames))
+	}
+	return nil
+}
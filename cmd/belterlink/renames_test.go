@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestFindRenames(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	before := map[string]inodeEntry{
+		"Inbox/idea.md": {Ino: 1, Size: 10, ModTime: t0},
+		"take.wav":      {Ino: 2, Size: 500 << 20, ModTime: t0},
+		"draft.md":      {Ino: 3, Size: 5, ModTime: t0},
+		"kept.md":       {Ino: 4, Size: 1, ModTime: t0},
+		"rewritten.md":  {Ino: 5, Size: 8, ModTime: t0},
+	}
+	now := map[string]inodeEntry{
+		"Projects/idea.md": {Ino: 1, Size: 10, ModTime: t0},
+		"Audio/take-1.wav": {Ino: 2, Size: 500 << 20, ModTime: t0},
+		"draft-renamed.md": {Ino: 3, Size: 6, ModTime: t0.Add(time.Minute)}, // edited too: sent anew
+		"kept.md":          {Ino: 4, Size: 1, ModTime: t0},
+		"new.md":           {Ino: 5, Size: 8, ModTime: t0}, // a reused inode looks like a rename; rsync still checks it
+	}
+	got := findRenames(before, now)
+	want := []rename{{"take.wav", "Audio/take-1.wav"}, {"Inbox/idea.md", "Projects/idea.md"}, {"rewritten.md", "new.md"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("renames = %v, want %v", got, want)
+	}
+}
+
+func TestListInodesFollowsRename(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.md"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cat := config.Category{Local: dir}
+	before, err := listInodes(cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "a.md"), filepath.Join(dir, "sub", "b.md")); err != nil {
+		t.Fatal(err)
+	}
+	now, err := listInodes(cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := findRenames(before, now); len(got) != 1 || got[0] != (rename{"a.md", "sub/b.md"}) {
+		t.Fatalf("renames = %v", got)
+	}
+}
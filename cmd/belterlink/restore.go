@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+const restoreUsage = "usage: belterlink restore [-at <time>] [-path <rel>]... [-to <dir> | -in-place [-yes]] [-dry-run] <CategoryName>"
+
+// restoreTimeLayouts are the forms -at takes, in local time, besides a
+// snapshot's own name.
+var restoreTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// restoreFlags are the flags of "restore".
+type restoreFlags struct {
+	at, to               string
+	paths                stringList
+	inPlace, yes, dryRun bool
+}
+
+func (f *restoreFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.at, "at", "", "restore the last snapshot taken at or before this time, e.g. 2024-06-01T10:00 (default: the newest)")
+	fs.Var(&f.paths, "path", "only restore this file or directory, relative to the category root (repeatable)")
+	fs.StringVar(&f.to, "to", "", "restore into this directory (default: <state_dir>/restore/<Category>/<snapshot>)")
+	fs.BoolVar(&f.inPlace, "in-place", false, "restore into the category's local path, replacing the current versions")
+	fs.BoolVar(&f.yes, "yes", false, "with -in-place: restore without asking")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "only list the files that would be restored")
+}
+
+// runRestoreCommand implements "belterlink restore": it copies a snapshot
+// made by the backup direction, or some paths of it, back to this machine.
+// By default the files go to a staging directory, to be looked at and
+// copied over by hand; -in-place puts them straight into the local tree,
+// replacing the current versions but deleting nothing.
+func runRestoreCommand(g *globals, args []string) error {
+	flags := newFlagSet("restore")
+	g.register(flags)
+	var f restoreFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 || f.inPlace && f.to != "" {
+		return withExitCode(exitUsage, errors.New(restoreUsage))
+	}
+	when, err := parseRestoreTime(f.at)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	name := flags.Arg(0)
+	cat, ok := cfg.Categories[name]
+	if !ok {
+		return exitErrorf(exitConfig, "category %q not found in config", name)
+	}
+	if cat.Encrypted {
+		return exitErrorf(exitUsage, "category %q is encrypted; its snapshots hold ciphertext that restore can't open", name)
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+
+	root := snapshotsRoot(cfg, name)
+	done, _, err := listSnapshots(context.Background(), cfg, root)
+	if err != nil {
+		return exitErrorf(preflightExitCode(err), "list snapshots: %v", err)
+	}
+	snap, err := pickSnapshot(done, when)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	dest := f.to
+	switch {
+	case f.inPlace:
+		if cat.ReadonlyLocal {
+			return exitErrorf(exitRefused, "category %q has readonly_local: refusing to restore into %s; restore elsewhere with -to", name, cat.Local)
+		}
+		dest = cat.Local
+	case dest == "":
+		dest = filepath.Join(config.StateDir(cfg), "restore", name, snap)
+	}
+
+	opts := rsync.Options{Direction: "pull", DryRun: f.dryRun, NoDelete: true, Verbosity: verbosity}
+	if len(f.paths) > 0 {
+		list, err := writeFileList(cat.Local, f.paths)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		defer os.Remove(list)
+		opts.FilesFrom = list
+	}
+	src := restoreSource(cat, path.Join(root, snap), dest)
+	rsArgs, err := rsync.BuildArgs(cfg, src, opts)
+	if err != nil {
+		return fmt.Errorf("build rsync args: %w", err)
+	}
+	// the snapshot's version wins, even over a newer local file
+	rsArgs = slices.DeleteFunc(adaptRsyncArgs(context.Background(), cfg, rsArgs), func(a string) bool { return a == "--update" })
+
+	if f.inPlace && !f.dryRun && !f.yes {
+		if !isTerminal(os.Stdin) {
+			return exitErrorf(exitRefused, "no terminal to confirm the restore on; re-run with -yes")
+		}
+		if !askYesNo(fmt.Sprintf("Restore snapshot %s into %s, replacing the current versions?", snap, dest)) {
+			return exitErrorf(exitRefused, "nothing restored")
+		}
+	}
+	if !f.dryRun {
+		if err := os.MkdirAll(dest, 0o755); err != nil {
+			return err
+		}
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	var audit []auditEntry
+	if f.inPlace && auditEnabled(cfg) && !f.dryRun {
+		if audit, err = previewAudit(ctx, cfg, name, src, RunOptions{Options: opts}, rsArgs); err != nil {
+			warnAuditPreview(name, err)
+		}
+	}
+	printAt(rsync.Normal, "Restoring %s from snapshot %s into %s\n", name, snap, dest)
+	err = rsync.Run(ctx, cfg, rsArgs, os.Stdout)
+	if f.inPlace {
+		recordAudit(cfg, audit, err)
+	}
+	if ctx.Err() != nil {
+		return abortedError(ctx)
+	}
+	if err != nil {
+		code := rsync.ExitCode(err)
+		return exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	if !f.dryRun {
+		logger.Info("restored", "category", name, "snapshot", snap, "into", dest, "paths", len(f.paths))
+		fmt.Printf("Restored snapshot %s of %s into %s\n", snap, name, dest)
+	}
+	return nil
+}
+
+// parseRestoreTime reads -at: a snapshot name, a time in one of
+// restoreTimeLayouts, or a date, which stands for the end of that day. The
+// zero time means "the newest".
+func parseRestoreTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(snapshotLayout, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range restoreTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("-at %q: want a time like 2024-06-01T10:00, a date, or a snapshot name", s)
+}
+
+// pickSnapshot returns the newest of snapshots (oldest first) taken at or
+// before at, or the newest of all when at is zero.
+func pickSnapshot(snapshots []string, at time.Time) (string, error) {
+	if len(snapshots) == 0 {
+		return "", errors.New("no snapshots yet; make one with 'belterlink <Category> backup'")
+	}
+	if at.IsZero() {
+		return snapshots[len(snapshots)-1], nil
+	}
+	for _, s := range slices.Backward(snapshots) {
+		if t, _ := time.Parse(snapshotLayout, s); !t.After(at) {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot taken at or before %s; the oldest is %s", at.Local().Format(time.DateTime), snapshots[0])
+}
+
+// restoreSource is cat as the pull of the snapshot at snapDir into dest
+// sees it: nothing is kept for undo, and for an archive-append category the
+// snapshot's version still replaces the one dest has.
+func restoreSource(cat config.Category, snapDir, dest string) config.Category {
+	no := false
+	cat.Remote, cat.Local = snapDir, dest
+	cat.Backup, cat.DetectRenames = &no, &no
+	cat.Mode = ""
+	return cat
+}
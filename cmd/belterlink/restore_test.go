@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestParseRestoreTime(t *testing.T) {
+	for in, want := range map[string]time.Time{
+		"":                    {},
+		"2024-06-01T10:00":    time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local),
+		"2024-06-01 10:00:30": time.Date(2024, 6, 1, 10, 0, 30, 0, time.Local),
+		"2024-06-01":          time.Date(2024, 6, 1, 23, 59, 59, 0, time.Local),
+		"2024-06-01T080004Z":  time.Date(2024, 6, 1, 8, 0, 4, 0, time.UTC),
+	} {
+		got, err := parseRestoreTime(in)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseRestoreTime(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseRestoreTime("last tuesday"); err == nil {
+		t.Error("expected an error for an unknown form")
+	}
+}
+
+func TestPickSnapshot(t *testing.T) {
+	snaps := []string{"2024-05-30T080000Z", "2024-05-31T080000Z", "2024-06-01T080000Z"}
+	for _, c := range []struct {
+		at   time.Time
+		want string
+	}{
+		{time.Time{}, "2024-06-01T080000Z"},
+		{time.Date(2024, 5, 31, 8, 0, 0, 0, time.UTC), "2024-05-31T080000Z"},
+		{time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC), "2024-05-31T080000Z"},
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "2024-06-01T080000Z"},
+	} {
+		if got, err := pickSnapshot(snaps, c.at); err != nil || got != c.want {
+			t.Errorf("pickSnapshot(%v) = %q, %v; want %q", c.at, got, err, c.want)
+		}
+	}
+	if _, err := pickSnapshot(snaps, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected an error before the oldest snapshot")
+	}
+	if _, err := pickSnapshot(nil, time.Time{}); err == nil {
+		t.Error("expected an error without snapshots")
+	}
+}
+
+func TestRestoreSourceArchiveAppend(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h"}}
+	cat := config.Category{Local: "/l", Remote: "/r", Mode: "archive-append"}
+	args, err := rsync.BuildArgs(cfg, restoreSource(cat, "backups/Photos/2024-06-01T080004Z", "/l"), rsync.Options{Direction: "pull", NoDelete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(args, "--ignore-existing") {
+		t.Fatalf("restoring an archive-append category would skip every file it has: %v", args)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+var (
+	versionsMu sync.Mutex
+	versions   = map[string][2]rsync.Version{} // by local rsync, remote and remote rsync
+)
+
+// rsyncVersions finds out the rsyncs on both ends, once per remote for the
+// life of the process. The remote's comes from its probe.
+func rsyncVersions(ctx context.Context, cfg *config.Config) (local, remote rsync.Version) {
+	key := strings.Join([]string{rsync.Binary(cfg), ssh.Target(cfg.SSH), rsync.RemoteBinary(cfg)}, "\x00")
+	versionsMu.Lock()
+	defer versionsMu.Unlock()
+	if v, ok := versions[key]; ok {
+		return v[0], v[1]
+	}
+	local = rsync.LocalVersion(ctx, cfg)
+	var others []string
+	if p, err := remoteInfo(ctx, cfg, false); err == nil {
+		remote, others = p.Rsync, p.OtherRsyncs
+	}
+	logger.Debug("rsync versions", "local", local.String(), "remote", remote.String())
+	printAt(rsync.Verbose, "rsync versions: %s (local), %s (remote)\n", local, remote)
+	if local.Known() && !local.AtLeast(3, 0, 0) {
+		fmt.Fprintf(os.Stderr, "warning: local rsync is %s; set rsync.path to a newer one (e.g. /opt/homebrew/bin/rsync)\n", local)
+	}
+	if remote.Known() && !remote.AtLeast(3, 0, 0) {
+		if len(others) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: remote rsync is %s; %s is installed there too, set rsync.remote_path to it\n", remote, others[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: remote rsync is %s; set rsync.remote_path to a newer one (e.g. /opt/homebrew/bin/rsync)\n", remote)
+		}
+	}
+	versions[key] = [2]rsync.Version{local, remote}
+	return local, remote
+}
+
+// remoteOS returns the remote's uname -s ("Darwin", "Linux"), or "" if it
+// can't be determined. It comes from the remote's probe.
+func remoteOS(ctx context.Context, cfg *config.Config) string {
+	p, err := remoteInfo(ctx, cfg, false)
+	if err != nil {
+		return ""
+	}
+	return p.OS
+}
+
+// adaptRsyncArgs fits rsArgs to the rsyncs on both ends, warning about the
+// options it has to leave out.
+func adaptRsyncArgs(ctx context.Context, cfg *config.Config, rsArgs []string) []string {
+	local, remote := rsyncVersions(ctx, cfg)
+	rsArgs, dropped := rsync.Adapt(rsArgs, local, remote)
+	for _, a := range dropped {
+		fmt.Fprintf(os.Stderr, "warning: leaving out %s: not supported by rsync %s (local) / %s (remote)\n", a, local, remote)
+		logger.Warn("rsync option not supported", "option", a, "local", local.String(), "remote", remote.String())
+	}
+	return rsArgs
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// confirmDeletions previews a deleting run and, when it would remove more
+// than max_delete files, asks before going ahead. The returned args carry
+// --max-delete so rsync itself stops if reality exceeds what was confirmed.
+func confirmDeletions(ctx context.Context, cfg *config.Config, cat config.Category, opts RunOptions, rsArgs []string) ([]string, error) {
+	limit := maxDelete(cfg, cat)
+	if limit <= 0 {
+		return rsArgs, nil
+	}
+
+	var out bytes.Buffer
+	preview := rsyncCommand(ctx, cfg, opts.Options, rsync.InsertBeforePaths(rsArgs, "--dry-run", "--itemize-changes")...)
+	preview.Stdout = &out
+	preview.Stderr = os.Stderr
+	if err := preview.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return nil, exitErrorf(rsyncExitCode(code), "deletion preview failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	deletions := rsync.CountDeletions(out.String())
+	if deletions <= limit {
+		return rsync.InsertBeforePaths(rsArgs, "--max-delete="+strconv.Itoa(limit)), nil
+	}
+
+	if err := confirmDeletionCount(opts, deletions, limit); err != nil {
+		return nil, err
+	}
+	return rsync.InsertBeforePaths(rsArgs, "--max-delete="+strconv.Itoa(deletions)), nil
+}
+
+// maxDelete is the category's max_delete, else the default; 0 means no limit.
+func maxDelete(cfg *config.Config, cat config.Category) int {
+	if cat.MaxDelete != nil {
+		return *cat.MaxDelete
+	}
+	if cfg.Defaults.MaxDelete != nil {
+		return *cfg.Defaults.MaxDelete
+	}
+	return 0
+}
+
+// confirmDeletionCount asks before deleting more than limit files, unless
+// -yes was given; without a terminal to ask on, it refuses.
+func confirmDeletionCount(opts RunOptions, deletions, limit int) error {
+	if limit <= 0 || deletions <= limit {
+		return nil
+	}
+	msg := fmt.Sprintf("%d files would be deleted, more than max_delete (%d)", deletions, limit)
+	logger.Warn("deletion threshold exceeded", "deletions", deletions, "max_delete", limit)
+	if !opts.Yes {
+		if opts.NonInteractive || !isTerminal(os.Stdin) {
+			return exitErrorf(exitRefused, "%s; re-run with -yes to allow", msg)
+		}
+		if !askYesNo(msg + ". Continue?") {
+			return exitErrorf(exitRefused, "aborted: %s", msg)
+		}
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func askYesNo(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// checkLocalSource refuses to use a local directory as the source of a push
+// when it is missing, empty, or sits below an fstab mountpoint that isn't
+// mounted: pushing that (especially with delete) would wipe the remote.
+func checkLocalSource(local string) error {
+	info, err := os.Stat(local)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("local path %s does not exist", local)
+	} else if err != nil {
+		return fmt.Errorf("local path %s: %w", local, err)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	if mnt := unmountedMountpoint(local, fstabMountpoints("/etc/fstab")); mnt != "" {
+		return fmt.Errorf("local path %s is on %s, which is not mounted", local, mnt)
+	}
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		return fmt.Errorf("local path %s: %w", local, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("local path %s is empty", local)
+	}
+	return nil
+}
+
+// fstabMountpoints lists the mountpoints configured in an fstab file.
+func fstabMountpoints(path string) []string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var mounts []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if mnt := fields[1]; strings.HasPrefix(mnt, "/") && mnt != "/" {
+			mounts = append(mounts, filepath.Clean(mnt))
+		}
+	}
+	return mounts
+}
+
+// unmountedMountpoint returns the deepest of mounts containing dir that is
+// not currently a mountpoint, or "" if there is none.
+func unmountedMountpoint(dir string, mounts []string) string {
+	dir = filepath.Clean(dir)
+	best := ""
+	for _, m := range mounts {
+		if (dir == m || strings.HasPrefix(dir, m+string(filepath.Separator))) && len(m) > len(best) {
+			best = m
+		}
+	}
+	if best == "" || isMountpoint(best) {
+		return ""
+	}
+	return best
+}
+
+// isMountpoint reports whether dir lives on a different device than its
+// parent. A missing dir counts as not mounted.
+func isMountpoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino
+}
+
+// checkAnchor verifies that the category's anchor file exists in the source
+// (and, with anchor_destination, in the destination), so a path that exists
+// but points at the wrong vault is caught before anything is transferred.
+func checkAnchor(ctx context.Context, s config.SSH, cat config.Category, direction string) error {
+	if cat.Anchor == "" {
+		return nil
+	}
+	localAnchor := filepath.Join(cat.Local, filepath.FromSlash(cat.Anchor))
+	remoteAnchor := path.Join(cat.Remote, cat.Anchor)
+	sourceIsLocal := direction == "push"
+	if sourceIsLocal || cat.AnchorDestination {
+		if _, err := os.Stat(localAnchor); err != nil {
+			return exitErrorf(exitRefused, "anchor %s not found locally (is %s the right directory?)", localAnchor, cat.Local)
+		}
+	}
+	if !sourceIsLocal || cat.AnchorDestination {
+		out, err := ssh.RunContext(ctx, s, fmt.Sprintf("if [ -e %s ]; then echo found; fi", ssh.Quote(remoteAnchor)))
+		if err != nil {
+			return withExitCode(preflightExitCode(err), fmt.Errorf("check remote anchor: %w", err))
+		}
+		if strings.TrimSpace(string(out)) != "found" {
+			return exitErrorf(exitRefused, "anchor %s not found on %s (is %s the right directory?)", remoteAnchor, s.Host, cat.Remote)
+		}
+	}
+	return nil
+}
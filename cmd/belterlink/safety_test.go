@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestCheckLocalSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkLocalSource(dir); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("expected empty directory error, got %v", err)
+	}
+	if err := checkLocalSource(filepath.Join(dir, "missing")); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing directory error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "note.md"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLocalSource(dir); err != nil {
+		t.Fatalf("checkLocalSource: %v", err)
+	}
+}
+
+func TestUnmountedMountpoint(t *testing.T) {
+	dir := t.TempDir()
+	mnt := filepath.Join(dir, "nas")
+	if err := os.Mkdir(mnt, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	fstab := filepath.Join(dir, "fstab")
+	content := "# comment\nUUID=abc / ext4 defaults 0 1\nnas:/vol " + mnt + " nfs defaults 0 0\n"
+	if err := os.WriteFile(fstab, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mounts := fstabMountpoints(fstab)
+	if len(mounts) != 1 || mounts[0] != mnt {
+		t.Fatalf("fstabMountpoints = %v", mounts)
+	}
+	if got := unmountedMountpoint(filepath.Join(mnt, "Vault"), mounts); got != mnt {
+		t.Fatalf("unmountedMountpoint = %q, want %q", got, mnt)
+	}
+	if got := unmountedMountpoint(filepath.Join(dir, "nasty"), mounts); got != "" {
+		t.Fatalf("unmountedMountpoint matched a sibling: %q", got)
+	}
+}
+
+func TestCheckAnchorLocal(t *testing.T) {
+	dir := t.TempDir()
+	cat := config.Category{Local: dir, Remote: "/vault", Anchor: ".obsidian/app.json"}
+	err := checkAnchor(context.Background(), config.SSH{}, cat, "push")
+	if err == nil || errorExitCode(err) != exitRefused {
+		t.Fatalf("expected refusal for missing anchor, got %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".obsidian"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".obsidian", "app.json"), []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAnchor(context.Background(), config.SSH{}, cat, "push"); err != nil {
+		t.Fatalf("checkAnchor: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// scrubResult is what the last scrub of a category found. The daemon
+// schedules the next scrub from it, so a restart doesn't put it off.
+type scrubResult struct {
+	RunSummary
+	Differences []rsync.Difference `json:"differences,omitempty"`
+}
+
+// scrubPath is <state>/scrub/<Category>.json.
+func scrubPath(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "scrub", category+".json")
+}
+
+func readScrub(cfg *config.Config, category string) (scrubResult, error) {
+	var r scrubResult
+	b, err := os.ReadFile(scrubPath(cfg, category))
+	if err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(b, &r)
+}
+
+// scrubCategory implements scrub: a checksum comparison of both sides, like
+// "belterlink verify", that transfers nothing. A difference is either a
+// change not synced yet or a file that rotted or got damaged on one side,
+// which only reading every byte finds; either way the scrub fails (exit code
+// 8) and is notified like a failed run. The result goes to the log, the
+// daemon's history and the scrub file. When ctx is done the scrub stops; an
+// aborted scrub isn't recorded in the scrub file, so the next one isn't put
+// off.
+func scrubCategory(ctx context.Context, cfg *config.Config, name string) (RunSummary, error) {
+	started := time.Now()
+	opts := RunOptions{Options: rsync.Options{Direction: "scrub"}}
+	opts.RunID = newRunID()
+	currentRunID.Store(opts.RunID)
+	defer currentRunID.Store("")
+	logger.Info("scrub started", "category", name)
+
+	diffs, err := scrubDifferences(ctx, cfg, cfg.Categories[name])
+	if ctx.Err() != nil {
+		err = abortedError(ctx)
+	} else if err == nil && len(diffs) > 0 {
+		for _, d := range diffs {
+			logger.Warn("scrub found a difference", "category", name, "kind", d.Kind, "path", d.Path)
+		}
+		err = exitErrorf(exitDiffers, "scrub: local and remote differ in %d file(s), e.g. %s (%s)", len(diffs), diffs[0].Path, diffs[0].Kind)
+	}
+	sum := newRunSummary(name, opts, started, err)
+	logRunSummary(sum, nil)
+	sendNotifications(cfg, sum)
+	if ctx.Err() != nil {
+		return sum, err
+	}
+	b, merr := json.MarshalIndent(scrubResult{RunSummary: sum, Differences: diffs}, "", "  ")
+	if merr == nil {
+		merr = writeFileAtomic(scrubPath(cfg, name), append(b, '\n'))
+	}
+	if merr != nil {
+		logger.Warn("scrub result not recorded", "category", name, "error", merr)
+	}
+	return sum, err
+}
+
+func scrubDifferences(ctx context.Context, cfg *config.Config, cat config.Category) ([]rsync.Difference, error) {
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return nil, err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return nil, err
+	}
+	diffs, err := verifyCategory(ctx, cfg, cat)
+	if err != nil {
+		return nil, fmt.Errorf("scrub: %w", err)
+	}
+	return diffs, nil
+}
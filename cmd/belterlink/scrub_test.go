@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// scrubConfig is a category whose remote is already probed, so that a scrub
+// gets as far as rsync without ssh; the rsync it runs doesn't exist.
+func scrubConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := &config.Config{
+		StateDir:   t.TempDir(),
+		SSH:        config.SSH{User: "me", Host: "scrub.invalid"},
+		Rsync:      config.Rsync{Path: filepath.Join(t.TempDir(), "rsync")},
+		Categories: map[string]config.Category{"Photos": {Local: t.TempDir(), Remote: "Archive", Scrub: "weekly"}},
+	}
+	p := remoteProbe{Probed: time.Now().UTC(), RemoteBinary: "rsync", Targets: map[string]probedTarget{"Archive": {}}}
+	b, _ := json.Marshal(p)
+	if err := writeFileAtomic(probePath(cfg), b); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestScrubCategoryRecordsResult(t *testing.T) {
+	cfg := scrubConfig(t)
+	sum, err := scrubCategory(context.Background(), cfg, "Photos")
+	if err == nil || sum.Status != "failure" || sum.Direction != "scrub" {
+		t.Fatalf("scrub with a missing rsync = %+v, %v; want a failure", sum, err)
+	}
+	r, err := readScrub(cfg, "Photos")
+	if err != nil {
+		t.Fatalf("readScrub: %v", err)
+	}
+	if r.RunID != sum.RunID || r.Status != "failure" {
+		t.Errorf("recorded scrub %+v, want the failed run %s", r.RunSummary, sum.RunID)
+	}
+}
+
+func TestScrubCategoryAborted(t *testing.T) {
+	cfg := scrubConfig(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(interruptedError{os.Interrupt})
+	sum, err := scrubCategory(ctx, cfg, "Photos")
+	if errorExitCode(err) != exitAborted || sum.Status != "aborted" {
+		t.Fatalf("scrub after shutdown = %+v, %v; want it aborted", sum, err)
+	}
+	if _, err := readScrub(cfg, "Photos"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("an aborted scrub was recorded (%v); the next one would be put off", err)
+	}
+	// so the daemon still scrubs it on schedule
+	now := time.Now()
+	if j := scrubJob(cfg, "Photos", time.Hour, now); !j.NextRun.Equal(now.Add(time.Hour)) {
+		t.Errorf("next scrub %v, want one interval from now", j.NextRun)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// askpassEnv tells a belterlink started by ssh as SSH_ASKPASS which config to
+// take the key passphrase from.
+const askpassEnv = "BELTERLINK_ASKPASS_CONFIG"
+
+// secretCache keeps looked-up secrets for the rest of the process, so a
+// daemon or a multi-category run asks the keychain once.
+var secretCache = struct {
+	sync.Mutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// resolveSecret returns value, or the secret it names if it is a
+// secret:<name> reference.
+func resolveSecret(cfg *config.Config, value string) (string, error) {
+	name, ok := config.SecretRef(value)
+	if !ok {
+		return value, nil
+	}
+	secretCache.Lock()
+	defer secretCache.Unlock()
+	if v, ok := secretCache.values[name]; ok {
+		return v, nil
+	}
+	s, ok := cfg.Secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q is not defined in secrets", name)
+	}
+	v, err := lookupSecret(s)
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", name, err)
+	}
+	secretCache.values[name] = v
+	return v, nil
+}
+
+// resolveSecrets is resolveSecret for the values of a map; the map itself is
+// left alone.
+func resolveSecrets(cfg *config.Config, values map[string]string) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		resolved, err := resolveSecret(cfg, v)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = resolved
+	}
+	return out, nil
+}
+
+func lookupSecret(s config.Secret) (string, error) {
+	switch {
+	case s.Env != "":
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("$%s is not set", s.Env)
+		}
+		return v, nil
+	case s.Command != "":
+		return secretOutput(exec.Command("sh", "-c", s.Command))
+	default:
+		args := keychainCommand(runtime.GOOS, s)
+		return secretOutput(exec.Command(args[0], args[1:]...))
+	}
+}
+
+// keychainCommand looks a password up in the macOS Keychain or, elsewhere,
+// through libsecret (GNOME Keyring, KeePassXC).
+func keychainCommand(goos string, s config.Secret) []string {
+	if goos == "darwin" {
+		args := []string{"security", "find-generic-password", "-s", s.Keychain}
+		if s.Account != "" {
+			args = append(args, "-a", s.Account)
+		}
+		return append(args, "-w")
+	}
+	args := []string{"secret-tool", "lookup", "service", s.Keychain}
+	if s.Account != "" {
+		args = append(args, "account", s.Account)
+	}
+	return args
+}
+
+// secretOutput runs cmd and returns the first line it prints, the way pass
+// keeps the password on the first line of an entry.
+func secretOutput(cmd *exec.Cmd) (string, error) {
+	cmd.Stderr = os.Stderr // prompts of pinentry and the like
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" {
+		return "", fmt.Errorf("%s printed nothing", cmd.Args[0])
+	}
+	return line, nil
+}
+
+// prepareKeyPassphrase makes belterlink itself the SSH_ASKPASS program of
+// the ssh processes it starts when ssh.key_passphrase is set, so the key's
+// passphrase comes from the secret instead of a prompt. The secret is only
+// looked up if ssh asks for it. Commands that run ssh call it once they've
+// loaded cfg from cfgPath. An SSH_ASKPASS the environment already has is
+// left to answer instead.
+func prepareKeyPassphrase(cfg *config.Config, cfgPath string) {
+	if cfg.SSH.KeyPassphrase == "" {
+		return
+	}
+	if os.Getenv("SSH_ASKPASS") != "" && os.Getenv(askpassEnv) == "" {
+		printAt(rsync.Verbose, "SSH_ASKPASS is set; it answers ssh's passphrase prompts instead of ssh.key_passphrase\n")
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	os.Setenv("SSH_ASKPASS", exe)
+	os.Setenv("SSH_ASKPASS_REQUIRE", "force") // OpenSSH 8.4+: even with a terminal
+	os.Setenv(askpassEnv, cfgPath)
+}
+
+// runAskpass answers ssh's passphrase prompt with ssh.key_passphrase. Any
+// other question, such as an unknown host key, gets no answer, which ssh
+// takes as a no.
+func runAskpass(cfgPath string, args []string) error {
+	if len(args) == 0 || !strings.Contains(strings.ToLower(args[0]), "passphrase") {
+		return errors.New("askpass: only key passphrases are answered")
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	passphrase, err := resolveSecret(cfg, cfg.SSH.KeyPassphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println(passphrase)
+	return nil
+}
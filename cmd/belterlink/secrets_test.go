@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestResolveSecret(t *testing.T) {
+	cfg := &config.Config{Secrets: map[string]config.Secret{
+		"pass":  {Command: "printf 'hunter2\\nurl: example.org\\n'"},
+		"unset": {Env: "BELTERLINK_TEST_UNSET_SECRET"},
+	}}
+	for value, want := range map[string]string{"plain": "plain", "secret:pass": "hunter2"} {
+		got, err := resolveSecret(cfg, value)
+		if err != nil || got != want {
+			t.Errorf("resolveSecret(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"secret:unset", "secret:missing"} {
+		if _, err := resolveSecret(cfg, value); err == nil {
+			t.Errorf("resolveSecret(%q) succeeded", value)
+		}
+	}
+}
+
+func TestKeychainCommand(t *testing.T) {
+	s := config.Secret{Keychain: "belterlink-smtp", Account: "me"}
+	if got, want := keychainCommand("darwin", s), []string{"security", "find-generic-password", "-s", "belterlink-smtp", "-a", "me", "-w"}; !slices.Equal(got, want) {
+		t.Errorf("darwin: %q, want %q", got, want)
+	}
+	if got, want := keychainCommand("linux", s), []string{"secret-tool", "lookup", "service", "belterlink-smtp", "account", "me"}; !slices.Equal(got, want) {
+		t.Errorf("linux: %q, want %q", got, want)
+	}
+}
+
+func TestRunAskpassRefusesOtherPrompts(t *testing.T) {
+	if err := runAskpass("/nonexistent", []string{"Are you sure you want to continue connecting (yes/no/[fingerprint])?"}); err == nil {
+		t.Errorf("runAskpass answered a host key prompt")
+	}
+}
+
+func TestPrepareKeyPassphrase(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{KeyPassphrase: "secret:sshkey"}}
+	t.Setenv("SSH_ASKPASS", "")
+	t.Setenv("SSH_ASKPASS_REQUIRE", "")
+	t.Setenv(askpassEnv, "")
+	prepareKeyPassphrase(cfg, "/etc/belterlink.yaml")
+	if os.Getenv("SSH_ASKPASS") == "" || os.Getenv("SSH_ASKPASS_REQUIRE") != "force" || os.Getenv(askpassEnv) != "/etc/belterlink.yaml" {
+		t.Fatalf("askpass not set up: SSH_ASKPASS=%q SSH_ASKPASS_REQUIRE=%q", os.Getenv("SSH_ASKPASS"), os.Getenv("SSH_ASKPASS_REQUIRE"))
+	}
+
+	// the user's own askpass program is left alone, and not forced on ssh
+	t.Setenv("SSH_ASKPASS", "/usr/bin/ksshaskpass")
+	t.Setenv("SSH_ASKPASS_REQUIRE", "")
+	t.Setenv(askpassEnv, "")
+	prepareKeyPassphrase(cfg, "/etc/belterlink.yaml")
+	if os.Getenv("SSH_ASKPASS") != "/usr/bin/ksshaskpass" || os.Getenv("SSH_ASKPASS_REQUIRE") != "" || os.Getenv(askpassEnv) != "" {
+		t.Errorf("a set SSH_ASKPASS was replaced: SSH_ASKPASS=%q SSH_ASKPASS_REQUIRE=%q", os.Getenv("SSH_ASKPASS"), os.Getenv("SSH_ASKPASS_REQUIRE"))
+	}
+}
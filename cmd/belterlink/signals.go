@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// interruptedError is why a run was stopped: the signal belterlink got.
+type interruptedError struct{ sig os.Signal }
+
+func (e interruptedError) Error() string {
+	return fmt.Sprintf("interrupted (%s)", e.sig)
+}
+
+// interruptContext is cancelled by the first SIGINT or SIGTERM, with an
+// interruptedError as its cause. Runs then stop rsync and wait for it to
+// clean up before exiting with exitAborted; a second signal quits at once.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			fmt.Fprintf(os.Stderr, "\nbelterlink: %s; stopping once rsync has cleaned up (again to quit now)\n", s)
+			logger.Warn("interrupted", "signal", s.String())
+			cancel(interruptedError{s})
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+// runTimeoutError is why a run that took longer than run_timeout was stopped.
+type runTimeoutError struct{ timeout time.Duration }
+
+func (e runTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s (run_timeout)", e.timeout)
+}
+
+// abortedError is the error of a run ctx stopped: aborted by a signal, or a
+// failure if it ran out of time.
+func abortedError(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if errors.As(cause, new(runTimeoutError)) {
+		return withExitCode(exitNetwork, cause)
+	}
+	return withExitCode(exitAborted, cause)
+}
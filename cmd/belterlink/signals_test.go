@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterruptContext(t *testing.T) {
+	ctx, stop := interruptContext()
+	defer stop()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM didn't cancel the context")
+	}
+	var ie interruptedError
+	if !errors.As(context.Cause(ctx), &ie) || ie.sig != syscall.SIGTERM {
+		t.Fatalf("cause = %v", context.Cause(ctx))
+	}
+	if code := errorExitCode(abortedError(ctx)); code != exitAborted {
+		t.Fatalf("exit code = %d, want %d", code, exitAborted)
+	}
+	if sum := newRunSummary("Notes", RunOptions{}, time.Now(), abortedError(ctx)); sum.Status != "aborted" {
+		t.Fatalf("status = %q, want aborted", sum.Status)
+	}
+}
+
+func TestAbortedErrorTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeoutCause(context.Background(), time.Millisecond, runTimeoutError{time.Millisecond})
+	defer cancel()
+	<-ctx.Done()
+	err := abortedError(ctx)
+	if code := errorExitCode(err); code != exitNetwork {
+		t.Fatalf("exit code = %d, want %d", code, exitNetwork)
+	}
+	if sum := newRunSummary("Notes", RunOptions{}, time.Now(), err); sum.Status != "failure" {
+		t.Fatalf("status = %q, want failure", sum.Status)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// snapshotLayout names the backup direction's snapshots: the UTC time the
+// run started, which sorts by age and has no colons for SMB or exFAT.
+const snapshotLayout = "2006-01-02T150405Z"
+
+// partialSuffix marks a snapshot whose run hasn't finished; it's renamed
+// once rsync succeeded, so a listed snapshot is always complete.
+const partialSuffix = ".partial"
+
+// snapshotsRoot is the remote directory of a category's snapshots,
+// <snapshots_dir>/<Category>.
+func snapshotsRoot(cfg *config.Config, name string) string {
+	return path.Join(cmp.Or(cfg.Defaults.SnapshotsDir, "backups"), name)
+}
+
+// snapshot is the run of the backup direction in progress.
+type snapshot struct {
+	dir   string // where rsync writes, <root>/<time>.partial
+	final string // where the snapshot ends up, <root>/<time>
+}
+
+// prepareSnapshot turns a backup of cat into a push into a new snapshot
+// directory: rsync hard-links the files that haven't changed since the last
+// snapshot (--link-dest), so each snapshot is a full tree but only takes
+// the space of what changed. Snapshots left unfinished by an earlier run
+// are removed. Nothing is deleted or kept for undo, and the checks that
+// look at the destination (anchor_destination, detect_renames) don't apply
+// to a fresh directory.
+func prepareSnapshot(ctx context.Context, cfg *config.Config, name string, cat *config.Category, opts *RunOptions) (*snapshot, error) {
+	root := snapshotsRoot(cfg, name)
+	done, partial, err := listSnapshots(ctx, cfg, root)
+	if err != nil {
+		return nil, withExitCode(preflightExitCode(err), fmt.Errorf("list snapshots: %w", err))
+	}
+	if len(partial) > 0 && !opts.DryRun {
+		printAt(rsync.Normal, "Removing %d unfinished snapshot(s) of %s\n", len(partial), name)
+		if err := removeSnapshots(ctx, cfg, root, partial); err != nil {
+			return nil, fmt.Errorf("remove unfinished snapshots: %w", err)
+		}
+	}
+	stamp := time.Now().UTC().Format(snapshotLayout)
+	if slices.Contains(done, stamp) {
+		return nil, exitErrorf(exitRefused, "snapshot %s of %s already exists; wait a second and try again", stamp, name)
+	}
+	s := &snapshot{dir: path.Join(root, stamp+partialSuffix), final: path.Join(root, stamp)}
+	if len(done) > 0 {
+		opts.LinkDest = "../" + done[len(done)-1]
+		printAt(rsync.Normal, "Backing up %s to %s (unchanged files linked to %s)\n", name, s.final, done[len(done)-1])
+	} else {
+		printAt(rsync.Normal, "Backing up %s to %s (first snapshot, everything is copied)\n", name, s.final)
+	}
+	no := false
+	cat.Remote = s.dir
+	cat.CreateRemote = true
+	cat.AnchorDestination = false
+	cat.DetectRenames, cat.Backup = &no, &no
+	opts.Direction = "push"
+	opts.NoDelete = true
+	return s, nil
+}
+
+// finish moves the snapshot into place once rsync succeeded.
+func (s *snapshot) finish(ctx context.Context, cfg *config.Config) error {
+	if _, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("mv -- %s %s", ssh.Quote(s.dir), ssh.Quote(s.final))); err != nil {
+		return fmt.Errorf("finish snapshot %s: %w", s.final, err)
+	}
+	logger.Info("snapshot finished", "snapshot", s.final)
+	return nil
+}
+
+// listSnapshots returns the names of the finished snapshots under root,
+// oldest first, and those of the unfinished ones. Anything else there is
+// left alone.
+func listSnapshots(ctx context.Context, cfg *config.Config, root string) (done, partial []string, err error) {
+	q := ssh.Quote(root)
+	out, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("if [ -d %s ]; then ls -1A %s; fi", q, q))
+	if err != nil {
+		return nil, nil, err
+	}
+	done, partial = parseSnapshots(string(out))
+	return done, partial, nil
+}
+
+func parseSnapshots(ls string) (done, partial []string) {
+	for name := range strings.Lines(ls) {
+		name = strings.TrimSpace(name)
+		stamp, unfinished := strings.CutSuffix(name, partialSuffix)
+		if _, err := time.Parse(snapshotLayout, stamp); err != nil {
+			continue
+		}
+		if unfinished {
+			partial = append(partial, name)
+		} else {
+			done = append(done, name)
+		}
+	}
+	slices.Sort(done)
+	return done, partial
+}
+
+func removeSnapshots(ctx context.Context, cfg *config.Config, root string, names []string) error {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = ssh.Quote(path.Join(root, n))
+	}
+	_, err := ssh.RunContext(ctx, cfg.SSH, "rm -rf -- "+strings.Join(quoted, " "))
+	return err
+}
+
+// retention is how many snapshots "backups prune" keeps: the newest keepLast,
+// and the newest of each of the last keepDaily days, keepWeekly weeks and
+// keepMonthly months that have one.
+type retention struct {
+	keepLast, keepDaily, keepWeekly, keepMonthly int
+}
+
+// expire splits snapshots (names, oldest first) into those r keeps and those
+// it doesn't. The newest is always kept. Days, weeks and months are local
+// time; weeks are ISO weeks.
+func (r retention) expire(snapshots []string) (keep, remove []string) {
+	buckets := []struct {
+		left int
+		last string
+		key  func(time.Time) string
+	}{
+		{r.keepDaily, "", func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{r.keepWeekly, "", func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", y, w) }},
+		{r.keepMonthly, "", func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	last := r.keepLast
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		t, _ := time.Parse(snapshotLayout, snapshots[i]) // listed by parseSnapshots
+		t = t.Local()
+		kept := i == len(snapshots)-1 || last > 0
+		last--
+		for j := range buckets {
+			b := &buckets[j]
+			if k := b.key(t); b.left > 0 && k != b.last {
+				b.last = k
+				b.left--
+				kept = true
+			}
+		}
+		if kept {
+			keep = append(keep, snapshots[i])
+		} else {
+			remove = append(remove, snapshots[i])
+		}
+	}
+	slices.Reverse(keep)
+	slices.Reverse(remove)
+	return keep, remove
+}
+
+const backupsUsage = "usage: belterlink backups <CategoryName>...\n" +
+	"       belterlink backups prune [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-dry-run] <CategoryName>..."
+
+// pruneFlags are the flags of "backups prune".
+type pruneFlags struct {
+	retention
+	dryRun bool
+}
+
+func (f *pruneFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&f.keepLast, "keep-last", 0, "prune: keep the newest `n` snapshots")
+	fs.IntVar(&f.keepDaily, "keep-daily", 0, "prune: keep the newest snapshot of each of the last `n` days")
+	fs.IntVar(&f.keepWeekly, "keep-weekly", 0, "prune: keep the newest snapshot of each of the last `n` weeks")
+	fs.IntVar(&f.keepMonthly, "keep-monthly", 0, "prune: keep the newest snapshot of each of the last `n` months")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "prune: only list the snapshots that would be removed")
+}
+
+// runBackupsCommand implements "belterlink backups": the snapshots the
+// backup direction made of each category, and "backups prune", which
+// removes those a retention policy doesn't keep. Thanks to the hard links,
+// removing a snapshot frees only what no other snapshot shares.
+func runBackupsCommand(g *globals, args []string) error {
+	prune := len(args) > 0 && args[0] == "prune"
+	if prune {
+		args = args[1:]
+	}
+	flags := newFlagSet("backups")
+	g.register(flags)
+	var f pruneFlags
+	if prune {
+		f.register(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() == 0 || min(f.keepLast, f.keepDaily, f.keepWeekly, f.keepMonthly) < 0 {
+		return withExitCode(exitUsage, errors.New(backupsUsage))
+	}
+	if prune && f.retention == (retention{}) {
+		return exitErrorf(exitUsage, "backups prune: say what to keep, e.g. -keep-daily 7 -keep-weekly 4")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	names, err := config.SelectCategories(cfg, flags.Args())
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var errs []error
+	for _, name := range names {
+		root := snapshotsRoot(cfg, name)
+		done, partial, err := listSnapshots(ctx, cfg, root)
+		if err != nil {
+			errs = append(errs, exitErrorf(preflightExitCode(err), "%s: list snapshots: %v", name, err))
+			continue
+		}
+		if !prune {
+			fmt.Printf("%s: %d snapshot(s) in %s\n", name, len(done), root)
+			for _, s := range done {
+				t, _ := time.Parse(snapshotLayout, s)
+				fmt.Printf("  %s  (%s)\n", s, t.Local().Format(time.DateTime))
+			}
+			for _, s := range partial {
+				fmt.Printf("  %s  (unfinished; removed by the next backup)\n", s)
+			}
+			continue
+		}
+		keep, remove := f.expire(done)
+		if len(remove) == 0 {
+			fmt.Printf("%s: keeping all %d snapshot(s)\n", name, len(keep))
+			continue
+		}
+		verb := "removing"
+		if f.dryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%s: keeping %d snapshot(s), %s %d:\n", name, len(keep), verb, len(remove))
+		for _, s := range remove {
+			fmt.Println("  " + s)
+		}
+		if f.dryRun {
+			continue
+		}
+		if err := removeSnapshots(ctx, cfg, root, remove); err != nil {
+			errs = append(errs, exitErrorf(preflightExitCode(err), "%s: remove snapshots: %v", name, err))
+			continue
+		}
+		logger.Info("snapshots pruned", "category", name, "removed", len(remove), "kept", len(keep))
+	}
+	return errors.Join(errs...)
+}
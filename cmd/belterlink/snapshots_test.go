@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshots(t *testing.T) {
+	ls := "2024-05-10T120000Z\n2024-05-09T120000Z\n2024-05-11T080000Z.partial\nnotes.txt\n.DS_Store\n"
+	done, partial := parseSnapshots(ls)
+	if want := []string{"2024-05-09T120000Z", "2024-05-10T120000Z"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done = %q, want %q", done, want)
+	}
+	if want := []string{"2024-05-11T080000Z.partial"}; !reflect.DeepEqual(partial, want) {
+		t.Errorf("partial = %q, want %q", partial, want)
+	}
+}
+
+func TestRetentionExpire(t *testing.T) {
+	stamp := func(month time.Month, day, hour int) string {
+		return time.Date(2024, month, day, hour, 0, 0, 0, time.Local).UTC().Format(snapshotLayout)
+	}
+	var snaps []string
+	for d := time.Date(2024, 4, 1, 0, 0, 0, 0, time.Local); d.Month() != 5 || d.Day() <= 10; d = d.AddDate(0, 0, 1) {
+		snaps = append(snaps, stamp(d.Month(), d.Day(), 12))
+	}
+	snaps = append(snaps, stamp(5, 10, 8))
+	slices.Sort(snaps)
+
+	keep, remove := retention{keepDaily: 7, keepWeekly: 4}.expire(snaps)
+	want := []string{stamp(4, 21, 12), stamp(4, 28, 12)} // the weeks before the last 7 days
+	for day := 4; day <= 10; day++ {
+		want = append(want, stamp(5, day, 12))
+	}
+	if !reflect.DeepEqual(keep, want) {
+		t.Errorf("keep = %q, want %q", keep, want)
+	}
+	if len(keep)+len(remove) != len(snaps) || !slices.Contains(remove, stamp(5, 10, 8)) {
+		t.Errorf("remove = %q", remove)
+	}
+
+	keep, _ = retention{keepLast: 2}.expire(snaps)
+	if want := snaps[len(snaps)-2:]; !reflect.DeepEqual(keep, want) {
+		t.Errorf("keep-last 2 = %q, want %q", keep, want)
+	}
+	// the newest snapshot survives any policy
+	if keep, _ = (retention{keepMonthly: 1}).expire(snaps[:1]); len(keep) != 1 {
+		t.Errorf("keep = %q, want the only snapshot", keep)
+	}
+}
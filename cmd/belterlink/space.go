@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// checkRemoteSpace runs before a push: a dry run with --stats tells how much
+// rsync would send, and df how much room the remote filesystem has left. A
+// push that can't fit is refused instead of failing halfway with a full
+// disk. Deletions aren't counted, so the estimate errs on the safe side.
+func checkRemoteSpace(ctx context.Context, cfg *config.Config, cat config.Category, opts rsync.Options, rsArgs []string) error {
+	rsArgs = withoutOutputArgs(rsArgs)
+	var out bytes.Buffer
+	preview := rsyncCommand(ctx, cfg, opts, rsync.InsertBeforePaths(rsArgs, "--dry-run", "--stats")...)
+	preview.Stdout = &out
+	preview.Stderr = os.Stderr
+	if err := preview.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return exitErrorf(rsyncExitCode(code), "space check failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	need := rsync.ParseStats(out.String()).BytesTransferred
+	if need == 0 {
+		return nil
+	}
+
+	dest := strings.TrimRight(cat.Remote, "/")
+	if dest == "" {
+		dest = "."
+	}
+	df, err := ssh.RunContext(ctx, cfg.SSH, "df -Pk -- "+ssh.Quote(dest))
+	if err != nil {
+		logger.Warn("free space on the remote unknown", "error", err)
+		return nil
+	}
+	free, ok := dfAvailable(string(df))
+	if !ok {
+		return nil
+	}
+	logger.Debug("remote space", "need", need, "free", free)
+	printAt(rsync.Verbose, "Remote space: %s needed, %s free\n", formatSize(need), formatSize(free))
+	if need > free {
+		return exitErrorf(exitRefused, "push needs about %s on %s:%s but only %s is free; free up space or re-run with -force",
+			formatSize(need), cfg.SSH.Host, dest, formatSize(free))
+	}
+	return nil
+}
+
+// dfAvailable reads the free bytes from df -Pk output.
+func dfAvailable(out string) (int64, bool) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return 0, false
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return kb * 1024, true
+}
+
+// formatSize prints a byte count the way df -h does, e.g. 1.5G.
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestDfAvailable(t *testing.T) {
+	out := "Filesystem     1024-blocks    Used Available Capacity Mounted on\n" +
+		"/dev/sda1         41152736 39000000   2152736      95% /\n"
+	if got, ok := dfAvailable(out); !ok || got != 2152736*1024 {
+		t.Fatalf("dfAvailable = %d, %v", got, ok)
+	}
+	if _, ok := dfAvailable("df: /nope: No such file or directory"); ok {
+		t.Fatal("expected garbage to be rejected")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		512:           "512B",
+		1536:          "1.5K",
+		3 << 30:       "3.0G",
+		5<<40 + 1<<39: "5.5T",
+	}
+	for n, want := range tests {
+		if got := formatSize(n); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+const stateUsage = "usage: belterlink state export [-o <file>] [<CategoryName>...]\n" +
+	"       belterlink state import [-force] <file> [<CategoryName>...]"
+
+// stateBundleInfo is the first entry of a state bundle.
+const stateBundleInfo = "belterlink-state.json"
+
+// stateBundle describes a bundle: where and when it was made, and the
+// categories it has state for.
+type stateBundle struct {
+	Version    int       `json:"version"`
+	Exported   time.Time `json:"exported"`
+	Host       string    `json:"host,omitempty"`
+	Categories []string  `json:"categories"`
+}
+
+// stateKinds are the per-category state a bundle carries: what the last
+// sync saw (conflict detection and tombstones), the manifest, the last-run
+// file and the merge base. Inode numbers, the encrypted mirror and the probe
+// cache describe this machine or can be rebuilt, so they stay behind.
+var stateKinds = []string{"synced", "manifests", "last", "base"}
+
+// statePath is where this machine keeps kind for category; for base it's a
+// directory.
+func statePath(cfg *config.Config, kind, category string) string {
+	switch kind {
+	case "synced":
+		return syncedStatePath(cfg, category)
+	case "manifests":
+		return manifestPath(cfg, category)
+	case "last":
+		return lastRunPath(cfg, category)
+	default:
+		return baseDir(cfg, category)
+	}
+}
+
+// stateFlags are the flags of "state export" and "state import".
+type stateFlags struct {
+	out   string
+	force bool
+}
+
+// register adds the flags of action, or of both if it's empty.
+func (f *stateFlags) register(fs *flag.FlagSet, action string) {
+	if action != "import" {
+		fs.StringVar(&f.out, "o", "", "export: write the bundle to this file (- for stdout; default belterlink-state-<host>-<date>.tar.gz)")
+	}
+	if action != "export" {
+		fs.BoolVar(&f.force, "force", false, "import: replace the state this machine already has")
+	}
+}
+
+// runStateCommand implements "belterlink state export|import": a portable
+// bundle (a .tar.gz) of the categories' sync state, so that a reinstalled
+// or new machine starts with the history the others have instead of seeing
+// every file as new.
+func runStateCommand(g *globals, args []string) error {
+	if helpFirst("state", args) {
+		return flag.ErrHelp
+	}
+	if len(args) == 0 || args[0] != "export" && args[0] != "import" {
+		return withExitCode(exitUsage, errors.New(stateUsage))
+	}
+	flags := newFlagSet("state " + args[0])
+	g.register(flags)
+	var f stateFlags
+	f.register(flags, args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	if args[0] == "export" {
+		names, err := stateCategories(cfg, flags.Args())
+		if err != nil {
+			return err
+		}
+		return exportState(cfg, names, f.out)
+	}
+	if flags.NArg() == 0 {
+		return withExitCode(exitUsage, errors.New(stateUsage))
+	}
+	names, err := stateCategories(cfg, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	return importState(cfg, flags.Arg(0), names, f.force)
+}
+
+// stateCategories selects the categories named by patterns, or all of them.
+func stateCategories(cfg *config.Config, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return slices.Sorted(maps.Keys(cfg.Categories)), nil
+	}
+	names, err := config.SelectCategories(cfg, patterns)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	return names, nil
+}
+
+func exportState(cfg *config.Config, names []string, out string) error {
+	host, _ := os.Hostname()
+	if out == "" {
+		out = fmt.Sprintf("belterlink-state-%s-%s.tar.gz", shortHost(host), time.Now().Format(time.DateOnly))
+	}
+	files, err := collectState(cfg, names)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no sync state to export yet")
+	}
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bundle := stateBundle{Version: 1, Exported: time.Now(), Host: host, Categories: slices.Sorted(maps.Keys(files))}
+	if err := writeStateBundle(w, bundle, files); err != nil {
+		return fmt.Errorf("write %s: %w", out, err)
+	}
+	if out != "-" {
+		fmt.Printf("Exported the state of %s to %s\n", strings.Join(bundle.Categories, ", "), out)
+	}
+	return nil
+}
+
+// shortHost is host without its domain, for file names and messages.
+func shortHost(host string) string {
+	if host == "" {
+		return "unknown"
+	}
+	return strings.Split(host, ".")[0]
+}
+
+// collectState finds the state files of names, as bundle paths
+// (<kind>/<Category>.json, base/<Category>/<rel>) to local paths.
+// Categories without any state are left out.
+func collectState(cfg *config.Config, names []string) (map[string]map[string]string, error) {
+	files := map[string]map[string]string{}
+	add := func(name, entry, local string) {
+		if files[name] == nil {
+			files[name] = map[string]string{}
+		}
+		files[name][entry] = local
+	}
+	for _, name := range names {
+		for _, kind := range stateKinds {
+			p := statePath(cfg, kind, name)
+			if kind != "base" {
+				if _, err := os.Stat(p); err == nil {
+					add(name, kind+"/"+name+".json", p)
+				}
+				continue
+			}
+			err := filepath.WalkDir(p, func(local string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() {
+					return err
+				}
+				rel, err := filepath.Rel(p, local)
+				add(name, path.Join("base", name, filepath.ToSlash(rel)), local)
+				return err
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+func writeStateBundle(w io.Writer, bundle stateBundle, files map[string]map[string]string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	info, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addTarFile(tw, stateBundleInfo, info, bundle.Exported); err != nil {
+		return err
+	}
+	for _, name := range bundle.Categories {
+		for _, entry := range slices.Sorted(maps.Keys(files[name])) {
+			local := files[name][entry]
+			b, err := os.ReadFile(local)
+			if err != nil {
+				return err
+			}
+			st, err := os.Stat(local)
+			if err != nil {
+				return err
+			}
+			if err := addTarFile(tw, entry, b, st.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: mtime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readStateBundle reads a bundle into memory: its description and, per
+// category, the files by bundle path. Entries that aren't state of a
+// category in names, or that would land outside the state, are skipped.
+func readStateBundle(r io.Reader, names []string) (stateBundle, map[string]map[string][]byte, error) {
+	var bundle stateBundle
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return bundle, nil, fmt.Errorf("not a state bundle: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]map[string][]byte{}
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return bundle, nil, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return bundle, nil, err
+		}
+		if first {
+			if hdr.Name != stateBundleInfo || json.Unmarshal(b, &bundle) != nil || bundle.Version != 1 {
+				return bundle, nil, errors.New("not a belterlink state bundle (or one from a newer version)")
+			}
+			continue
+		}
+		name, ok := bundleCategory(hdr.Name)
+		if !ok || hdr.Typeflag != tar.TypeReg || !slices.Contains(names, name) {
+			continue
+		}
+		if files[name] == nil {
+			files[name] = map[string][]byte{}
+		}
+		files[name][hdr.Name] = b
+	}
+	return bundle, files, nil
+}
+
+// bundleCategory returns the category a bundle path is state of, if it's a
+// path a bundle may have.
+func bundleCategory(entry string) (string, bool) {
+	if !filepath.IsLocal(entry) || path.Clean(entry) != entry {
+		return "", false
+	}
+	kind, rest, _ := strings.Cut(entry, "/")
+	if kind == "base" {
+		name, rel, ok := strings.Cut(rest, "/")
+		return name, ok && name != "" && rel != ""
+	}
+	name, ok := strings.CutSuffix(rest, ".json")
+	return name, ok && slices.Contains(stateKinds, kind) && name != "" && !strings.Contains(name, "/")
+}
+
+// importState puts a bundle's state for names in place. A category this
+// machine already has state for is skipped unless force is set; then its
+// state is replaced as a whole, merge base included. The synced state is
+// cut down to the files this machine has; see pruneSyncedState.
+func importState(cfg *config.Config, file string, names []string, force bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bundle, files, err := readStateBundle(f, names)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("%s: %w", file, err))
+	}
+	fmt.Printf("State exported from %s on %s\n", shortHost(bundle.Host), bundle.Exported.Local().Format(time.DateTime))
+	var imported, skipped []string
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if !force && hasState(cfg, name) {
+			skipped = append(skipped, name)
+			continue
+		}
+		if err := os.RemoveAll(baseDir(cfg, name)); err != nil {
+			return err
+		}
+		for entry, b := range files[name] {
+			kind, rest, _ := strings.Cut(entry, "/")
+			local := statePath(cfg, kind, name)
+			if kind == "base" {
+				local = filepath.Join(local, filepath.FromSlash(strings.TrimPrefix(rest, name+"/")))
+			}
+			if kind == "synced" {
+				var dropped int
+				if b, dropped, err = pruneSyncedState(cfg.Categories[name], b); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if dropped > 0 {
+					fmt.Printf("  %s: %d file(s) not here yet, left out of the sync state\n", name, dropped)
+				}
+			}
+			if err := writeFileAtomic(local, b); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		fmt.Printf("  %s: %d file(s)\n", name, len(files[name]))
+		logger.Info("state imported", "category", name, "files", len(files[name]), "from", bundle.Host)
+		imported = append(imported, name)
+	}
+	if len(imported) > 0 {
+		fmt.Printf("Imported the state of %s\n", strings.Join(imported, ", "))
+	} else if len(skipped) == 0 {
+		return fmt.Errorf("%s has no state for %s", file, strings.Join(names, ", "))
+	}
+	if len(skipped) > 0 {
+		return exitErrorf(exitRefused, "this machine already has state for %s; re-run with -force to replace it", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// pruneSyncedState drops the entries of an imported synced state for files
+// this machine doesn't have, tombstones included. Another machine's state
+// says what both sides had after its last sync; on a machine that has only
+// part of the tree, every file missing here would read as deleted here, and
+// propagate_deletions would delete it on the hub. What's left only covers
+// files both machines have, and the first full pull fills in the rest.
+func pruneSyncedState(cat config.Category, b []byte) ([]byte, int, error) {
+	var state map[string]syncedFile
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, 0, fmt.Errorf("synced state: %w", err)
+	}
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, 0, withExitCode(exitConfig, err)
+	}
+	local, err := listLocal(cat.Local, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	kept := map[string]syncedFile{}
+	for rel, f := range state {
+		if l, ok := local[rel]; ok && !l.Dir {
+			kept[rel] = f
+		}
+	}
+	b, err = json.Marshal(kept)
+	return append(b, '\n'), len(state) - len(kept), err
+}
+
+// hasState reports whether this machine has any state for the category.
+func hasState(cfg *config.Config, name string) bool {
+	for _, kind := range stateKinds {
+		if _, err := os.Stat(statePath(cfg, kind, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestStateExportImport(t *testing.T) {
+	cats := map[string]config.Category{"Notes": {}, "Piano": {}}
+	from := &config.Config{StateDir: t.TempDir(), Categories: cats}
+	for p, data := range map[string]string{
+		syncedStatePath(from, "Notes"):                       `{"a.md":{}}`,
+		lastRunPath(from, "Notes"):                           `{"status":"success"}`,
+		filepath.Join(baseDir(from, "Notes"), "x/a.md"):      "# a\n",
+		filepath.Join(from.StateDir, "inodes", "Notes.json"): "{}",
+	} {
+		if err := writeFileAtomic(p, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle := filepath.Join(t.TempDir(), "state.tar.gz")
+	if err := exportState(from, []string{"Notes", "Piano"}, bundle); err != nil {
+		t.Fatalf("exportState: %v", err)
+	}
+
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "a.md"), []byte("# a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	to := &config.Config{StateDir: t.TempDir(), Categories: map[string]config.Category{"Notes": {Local: local}, "Piano": {}}}
+	if err := writeFileAtomic(filepath.Join(baseDir(to, "Notes"), "stale.md"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := importState(to, bundle, []string{"Notes", "Piano"}, false); errorExitCode(err) != exitRefused {
+		t.Fatalf("import over existing state = %v, want it refused", err)
+	}
+	if err := importState(to, bundle, []string{"Notes"}, true); err != nil {
+		t.Fatalf("importState -force: %v", err)
+	}
+	for p, want := range map[string]string{
+		syncedStatePath(to, "Notes"):                  `{"a.md":{"size":0,"mtime":"0001-01-01T00:00:00Z"}}` + "\n",
+		lastRunPath(to, "Notes"):                      `{"status":"success"}`,
+		filepath.Join(baseDir(to, "Notes"), "x/a.md"): "# a\n",
+	} {
+		if b, err := os.ReadFile(p); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", p, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(baseDir(to, "Notes"), "stale.md")); err == nil {
+		t.Error("the old merge base survived the import")
+	}
+	if _, err := os.Stat(filepath.Join(to.StateDir, "inodes", "Notes.json")); err == nil {
+		t.Error("inode numbers were carried over")
+	}
+}
+
+func TestStateImportPartialTree(t *testing.T) {
+	gone := time.Now().UTC()
+	state := map[string]syncedFile{
+		"a.md":        {Size: 4, ModTime: gone},
+		"sub/b.md":    {Size: 4, ModTime: gone},
+		"old.md":      {Size: 4, ModTime: gone, Deleted: gone},
+		"not-here.md": {Size: 4, ModTime: gone},
+	}
+	from := &config.Config{StateDir: t.TempDir(), Categories: map[string]config.Category{"Notes": {}}}
+	b, _ := json.Marshal(state)
+	if err := writeFileAtomic(syncedStatePath(from, "Notes"), b); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "state.tar.gz")
+	if err := exportState(from, []string{"Notes"}, bundle); err != nil {
+		t.Fatalf("exportState: %v", err)
+	}
+
+	// the new machine has only part of the tree so far
+	local := t.TempDir()
+	for _, rel := range []string{"a.md", "sub/b.md"} {
+		if err := writeFileAtomic(filepath.Join(local, rel), []byte("# x\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat := config.Category{Local: local, PropagateDeletions: true}
+	to := &config.Config{StateDir: t.TempDir(), Categories: map[string]config.Category{"Notes": cat}}
+	if err := importState(to, bundle, []string{"Notes"}, false); err != nil {
+		t.Fatalf("importState: %v", err)
+	}
+	got, err := loadSyncedState(to, "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["a.md"] != state["a.md"] || got["sub/b.md"] != state["sub/b.md"] {
+		t.Errorf("imported synced state = %v, want only a.md and sub/b.md", got)
+	}
+
+	// the hub has everything; nothing reads as deleted here
+	remote := map[string]rsync.Entry{}
+	for rel, f := range state {
+		remote[rel] = rsync.Entry{Size: f.Size, ModTime: f.ModTime}
+	}
+	files, err := listLocal(local, noExcludes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := planDeletions(got, files, remote, time.Now()); len(plan.Remote) > 0 {
+		t.Errorf("after import into a partial tree, deletions planned on the hub: %v", plan.Remote)
+	}
+}
+
+func TestBundleCategory(t *testing.T) {
+	for entry, want := range map[string]string{
+		"synced/Notes.json":    "Notes",
+		"last/Notes.json":      "Notes",
+		"base/Notes/x/a.md":    "Notes",
+		"base/Notes":           "",
+		"inodes/Notes.json":    "",
+		"synced/../Notes.json": "",
+		"../synced/Notes.json": "",
+		"/synced/Notes.json":   "",
+	} {
+		if got, ok := bundleCategory(entry); got != want && ok || !ok && want != "" {
+			t.Errorf("bundleCategory(%q) = %q, %v; want %q", entry, got, ok, want)
+		}
+	}
+}
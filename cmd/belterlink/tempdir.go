@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// resolveTempDir returns the temp_dir for a run, expanded for the receiving
+// side: the local machine for pulls, the remote for pushes. Relative paths
+// are left to rsync, which resolves them against the destination directory.
+func resolveTempDir(cfg *config.Config, cat config.Category, direction string) (string, error) {
+	dir := cat.TempDir
+	if dir == "" {
+		dir = cfg.Defaults.TempDir
+	}
+	if dir == "" {
+		return "", nil
+	}
+	dir, err := config.ExpandEnv(dir)
+	if err != nil {
+		return "", fmt.Errorf("temp_dir: %w", err)
+	}
+	if strings.HasPrefix(dir, "~") {
+		if direction == "push" {
+			return "", fmt.Errorf("temp_dir %q: the remote home can't be expanded for a push; use an absolute path or one relative to the destination", dir)
+		}
+		return config.ExpandPath(dir)
+	}
+	return dir, nil
+}
+
+// checkTempDir makes sure the temp_dir exists on the receiving side and is on
+// the destination's filesystem, so rsync can still rename finished files
+// into place rather than copying them over, which leaves half-written files
+// behind for sync clients such as iCloud to pick up.
+func checkTempDir(ctx context.Context, cfg *config.Config, cat config.Category, direction, tempDir string) error {
+	dest, join := cat.Local, filepath.Join
+	df := func(p string) ([]byte, error) { return exec.CommandContext(ctx, "df", "-P", p).Output() }
+	if direction == "push" {
+		dest, join = cat.Remote, path.Join
+		df = func(p string) ([]byte, error) { return ssh.RunContext(ctx, cfg.SSH, "df -P -- "+ssh.Quote(p)) }
+	}
+	full := tempDir
+	if !path.IsAbs(tempDir) {
+		full = join(dest, tempDir)
+	}
+
+	out, err := df(full)
+	if err != nil {
+		return fmt.Errorf("temp_dir %s: not found on the receiving side: %w", full, err)
+	}
+	tempMount := mountPoint(string(out))
+	out, err = df(dest)
+	if err != nil {
+		return nil // a destination created by this run; rsync reports real problems itself
+	}
+	if destMount := mountPoint(string(out)); tempMount != destMount {
+		return fmt.Errorf("temp_dir %s is on %s but the destination %s is on %s; pick a temp_dir on the same filesystem", full, tempMount, dest, destMount)
+	}
+	return nil
+}
+
+// mountPoint extracts the "Mounted on" column from df -P output.
+func mountPoint(dfOutput string) string {
+	lines := strings.Split(strings.TrimSpace(dfOutput), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return ""
+	}
+	return strings.Join(fields[5:], " ")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestMountPoint(t *testing.T) {
+	out := "Filesystem     1024-blocks      Used Available Capacity Mounted on\n" +
+		"/dev/disk3s5     971350180 612345678 359004502      64% /System/Volumes/My Data\n"
+	if got := mountPoint(out); got != "/System/Volumes/My Data" {
+		t.Fatalf("mountPoint = %q", got)
+	}
+	if got := mountPoint("garbage"); got != "" {
+		t.Fatalf("mountPoint of garbage = %q, want empty", got)
+	}
+}
+
+func TestResolveTempDir(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	cfg := &config.Config{Defaults: config.Defaults{TempDir: "~/.cache/belterlink"}}
+	if got, err := resolveTempDir(cfg, config.Category{}, "pull"); err != nil || got != "/home/me/.cache/belterlink" {
+		t.Fatalf("pull = %q, %v", got, err)
+	}
+	if _, err := resolveTempDir(cfg, config.Category{}, "push"); err == nil {
+		t.Fatal("expected ~ to be rejected for a push")
+	}
+	if got, _ := resolveTempDir(cfg, config.Category{TempDir: ".tmp"}, "push"); got != ".tmp" {
+		t.Fatalf("category temp_dir = %q, want it to override the default", got)
+	}
+}
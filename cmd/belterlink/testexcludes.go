@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// runTestExcludesCommand implements "belterlink test-excludes <Category>
+// [path...]": it shows which paths the built-in and category excludes and
+// the ignore file skip, and by which pattern.
+func runTestExcludesCommand(g *globals, args []string) error {
+	flags := newFlagSet("test-excludes")
+	g.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return exitErrorf(exitUsage, "usage: belterlink test-excludes <CategoryName> [path...]")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	name, err := config.ResolveCategory(cfg.Categories, args[0])
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	cat := cfg.Categories[name]
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	if len(args) > 1 {
+		for _, p := range args[1:] {
+			rel, isDir, err := categoryRelPath(cat.Local, p)
+			if err != nil {
+				return withExitCode(exitUsage, err)
+			}
+			if reason, excluded := explainExclude(m, rel, isDir); excluded {
+				fmt.Printf("excluded  %s  (%s)\n", rel, reason)
+			} else {
+				fmt.Printf("included  %s\n", rel)
+			}
+		}
+		return nil
+	}
+
+	skipped := 0
+	err = filepath.WalkDir(cat.Local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == cat.Local {
+			return err
+		}
+		rel, err := filepath.Rel(cat.Local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		pattern, excluded := m.MatchPattern(rel, d.IsDir())
+		if !excluded {
+			return nil
+		}
+		skipped++
+		if d.IsDir() {
+			fmt.Printf("excluded  %s/  (pattern %q, with everything inside)\n", rel, pattern)
+			return filepath.SkipDir
+		}
+		fmt.Printf("excluded  %s  (pattern %q)\n", rel, pattern)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d excluded path(s) under %s\n", name, skipped, cat.Local)
+	return nil
+}
+
+// categoryRelPath turns a user-supplied path (absolute, or relative to the
+// category's local root) into a slash-separated path relative to the root.
+func categoryRelPath(local, p string) (rel string, isDir bool, err error) {
+	full := p
+	if !filepath.IsAbs(p) {
+		full = filepath.Join(local, p)
+	}
+	rel, err = filepath.Rel(local, full)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false, fmt.Errorf("%s is not inside %s", p, local)
+	}
+	info, statErr := os.Stat(full)
+	switch {
+	case statErr == nil:
+		isDir = info.IsDir()
+	case errors.Is(statErr, fs.ErrNotExist):
+		isDir = strings.HasSuffix(p, "/")
+	default:
+		return "", false, statErr
+	}
+	return filepath.ToSlash(rel), isDir, nil
+}
+
+// explainExclude reports why rel is excluded, including when it is only
+// excluded because one of its parent directories is.
+func explainExclude(m *rsync.Matcher, rel string, isDir bool) (string, bool) {
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := path.Join(parts[:i]...)
+		if pattern, ok := m.MatchPattern(dir, true); ok {
+			return fmt.Sprintf("parent %s/ matches pattern %q", dir, pattern), true
+		}
+	}
+	if pattern, ok := m.MatchPattern(rel, isDir); ok {
+		return fmt.Sprintf("pattern %q", pattern), true
+	}
+	return "", false
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestExplainExclude(t *testing.T) {
+	m, err := rsync.NewMatcher(config.CategoryExcludes(config.Category{Exclude: []string{"*.wav"}}))
+	if err != nil {
+		t.Fatalf("newExcludeMatcher: %v", err)
+	}
+	for _, tc := range []struct {
+		path, want string
+		excluded   bool
+	}{
+		{"audio/take.wav", `pattern "*.wav"`, true},
+		{".obsidian/cache/index.json", `parent .obsidian/cache/ matches pattern ".obsidian/cache"`, true},
+		{"attachments/image.png", "", false},
+	} {
+		got, excluded := explainExclude(m, tc.path, false)
+		if got != tc.want || excluded != tc.excluded {
+			t.Fatalf("explainExclude(%q) = %q, %v; want %q, %v", tc.path, got, excluded, tc.want, tc.excluded)
+		}
+	}
+}
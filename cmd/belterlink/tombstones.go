@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/agent"
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// deletionPlan is what propagate_deletions does before a sync.
+type deletionPlan struct {
+	Remote     []string              // deleted here: delete on the hub
+	Local      []string              // deleted on the hub: delete here
+	Tombstones map[string]syncedFile // to remember once the sync succeeds
+}
+
+// planDeletions compares both sides with the state of the last sync. A file
+// that was there and is now missing on one side was deleted on that side;
+// the deletion is carried over unless the other side changed the file since,
+// in which case the changed copy is synced back instead. A tombstoned file
+// that shows up again unchanged (restored from an old copy, say) is deleted
+// again rather than resurrected.
+func planDeletions(state map[string]syncedFile, local map[string]agent.File, remote map[string]rsync.Entry, now time.Time) deletionPlan {
+	plan := deletionPlan{Tombstones: map[string]syncedFile{}}
+	for _, rel := range slices.Sorted(maps.Keys(state)) {
+		was := state[rel]
+		l, inLocal := local[rel]
+		inLocal = inLocal && !l.Dir
+		r, inRemote := remote[rel]
+		localSame := inLocal && !was.changedSince(l.Size, l.ModTime)
+		remoteSame := inRemote && !was.changedSince(r.Size, r.ModTime)
+
+		if !was.Deleted.IsZero() {
+			if localSame {
+				plan.Local = append(plan.Local, rel)
+			}
+			if remoteSame {
+				plan.Remote = append(plan.Remote, rel)
+			}
+			continue
+		}
+		tombstone := was
+		tombstone.Deleted = now
+		switch {
+		case !inLocal && !inRemote:
+			plan.Tombstones[rel] = tombstone
+		case !inLocal && remoteSame:
+			plan.Remote = append(plan.Remote, rel)
+			plan.Tombstones[rel] = tombstone
+		case !inRemote && localSame:
+			plan.Local = append(plan.Local, rel)
+			plan.Tombstones[rel] = tombstone
+		}
+	}
+	return plan
+}
+
+// propagateDeletions implements propagate_deletions before the passes of a
+// sync and returns the tombstones to save once the sync succeeded. Nothing
+// happens before the first sync with it recorded a state. Like any deleting
+// run, more deletions than max_delete need confirming.
+func propagateDeletions(ctx context.Context, cfg *config.Config, name string, cat config.Category, opts RunOptions) (map[string]syncedFile, error) {
+	if !cat.PropagateDeletions {
+		return nil, nil
+	}
+	state, err := loadSyncedState(cfg, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read sync state: %w", err)
+	}
+	if !opts.Force {
+		// a vanished mount must not read as everything deleted
+		if err := checkLocalSource(cat.Local); err != nil {
+			return nil, withExitCode(exitRefused, fmt.Errorf("%w; re-run with -force if this is intended", err))
+		}
+	}
+	m, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	local, err := listLocal(cat.Local, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return nil, err
+	}
+	remote, err := listRemoteFiles(ctx, cfg, cat, nil)
+	if err != nil {
+		return nil, fmt.Errorf("list remote files: %w", err)
+	}
+	plan := planDeletions(state, local, remote, time.Now().UTC())
+
+	if opts.DryRun {
+		for _, rel := range plan.Remote {
+			printAt(rsync.Normal, "Would delete on the hub: %s\n", rel)
+		}
+		for _, rel := range plan.Local {
+			printAt(rsync.Normal, "Would delete locally: %s\n", rel)
+		}
+		return nil, nil
+	}
+	if err := confirmDeletionCount(opts, len(plan.Remote)+len(plan.Local), maxDelete(cfg, cat)); err != nil {
+		return nil, err
+	}
+	var audit []auditEntry
+	for _, rel := range plan.Remote {
+		r := remote[rel]
+		audit = append(audit, auditEntry{RunID: opts.RunID, Category: name, Direction: opts.Direction, Action: "delete", Side: "remote", Path: rel, Size: r.Size, ModTime: r.ModTime})
+	}
+	for _, rel := range plan.Local {
+		l := local[rel]
+		audit = append(audit, auditEntry{RunID: opts.RunID, Category: name, Direction: opts.Direction, Action: "delete", Side: "local", Path: rel, Size: l.Size, ModTime: l.ModTime})
+	}
+	err = deleteRemoteFiles(ctx, cfg, cat, plan.Remote)
+	for _, rel := range plan.Local {
+		if err != nil {
+			break
+		}
+		printAt(rsync.Normal, "Deleting locally: %s\n", rel)
+		if rerr := os.Remove(filepath.Join(cat.Local, filepath.FromSlash(rel))); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+			err = rerr
+		}
+	}
+	if auditEnabled(cfg) {
+		recordAudit(cfg, audit, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n := len(plan.Remote) + len(plan.Local); n > 0 {
+		logger.Info("deletions propagated", "category", name, "remote", len(plan.Remote), "local", len(plan.Local))
+	}
+	return plan.Tombstones, nil
+}
+
+// deleteRemoteFiles removes category-relative files on the remote, a batch
+// per ssh call.
+func deleteRemoteFiles(ctx context.Context, cfg *config.Config, cat config.Category, files []string) error {
+	const batch = 200
+	for i := 0; i < len(files); i += batch {
+		var quoted []string
+		for _, rel := range files[i:min(i+batch, len(files))] {
+			printAt(rsync.Normal, "Deleting on the hub: %s\n", rel)
+			quoted = append(quoted, ssh.Quote(path.Join(cat.Remote, rel)))
+		}
+		if _, err := ssh.RunContext(ctx, cfg.SSH, "rm -f -- "+strings.Join(quoted, " ")); err != nil {
+			return withExitCode(exitNetwork, fmt.Errorf("delete on the hub: %w", err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/agent"
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestPlanDeletions(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	now := t0.Add(48 * time.Hour)
+	was := syncedFile{Size: 5, ModTime: t0}
+	state := map[string]syncedFile{
+		"deleted-here.md":    was,
+		"deleted-there.md":   was,
+		"edited-there.md":    was, // deleted here, but edited on the hub since
+		"edited-here.md":     was, // deleted on the hub, but edited here since
+		"deleted-both.md":    was,
+		"kept.md":            was,
+		"restored.md":        {Size: 5, ModTime: t0, Deleted: t0.Add(time.Hour)},
+		"recreated-there.md": {Size: 5, ModTime: t0, Deleted: t0.Add(time.Hour)},
+	}
+	same := agent.File{Size: 5, ModTime: t0}
+	local := map[string]agent.File{
+		"deleted-there.md": same,
+		"edited-here.md":   {Size: 9, ModTime: t0.Add(time.Hour)},
+		"kept.md":          same,
+		"restored.md":      same,
+	}
+	remote := map[string]rsync.Entry{
+		"deleted-here.md":    {Size: 5, ModTime: t0},
+		"edited-there.md":    {Size: 7, ModTime: t0.Add(time.Hour)},
+		"kept.md":            {Size: 5, ModTime: t0},
+		"recreated-there.md": {Size: 3, ModTime: t0.Add(24 * time.Hour)},
+	}
+
+	plan := planDeletions(state, local, remote, now)
+	if want := []string{"deleted-here.md"}; !slices.Equal(plan.Remote, want) {
+		t.Errorf("remote deletions = %q, want %q", plan.Remote, want)
+	}
+	if want := []string{"deleted-there.md", "restored.md"}; !slices.Equal(plan.Local, want) {
+		t.Errorf("local deletions = %q, want %q", plan.Local, want)
+	}
+	for _, rel := range []string{"deleted-here.md", "deleted-there.md", "deleted-both.md"} {
+		if !plan.Tombstones[rel].Deleted.Equal(now) {
+			t.Errorf("no tombstone for %s", rel)
+		}
+	}
+	if len(plan.Tombstones) != 3 {
+		t.Errorf("tombstones = %v", plan.Tombstones)
+	}
+}
+
+func TestSavedTombstonesExpire(t *testing.T) {
+	cfg := &config.Config{StateDir: t.TempDir()}
+	cat := config.Category{Local: t.TempDir(), PropagateDeletions: true}
+	tombstones := map[string]syncedFile{
+		"fresh.md": {Size: 1, Deleted: time.Now()},
+		"old.md":   {Size: 1, Deleted: time.Now().Add(-tombstoneTTL - time.Hour)},
+	}
+	if err := saveSyncedState(cfg, "Notes", cat, tombstones); err != nil {
+		t.Fatal(err)
+	}
+	// tombstones survive the next save without being passed again
+	if err := saveSyncedState(cfg, "Notes", cat, nil); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadSyncedState(cfg, "Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["fresh.md"]; !ok || len(state) != 1 {
+		t.Fatalf("state = %+v, want only the fresh tombstone", state)
+	}
+}
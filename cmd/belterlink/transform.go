@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// transformStaging is where a category with transforms keeps the copy of
+// its local tree that a push sends: hard links to the local files no
+// transform rewrites, and the transforms' output for the others.
+func transformStaging(cfg *config.Config, category string) string {
+	return filepath.Join(config.StateDir(cfg), "transformed", category)
+}
+
+// applyTransforms fits cat to its transforms for a run in direction: a push
+// or backup sends the staging copy, and a pull leaves the files they rewrite
+// alone.
+func applyTransforms(ctx context.Context, cfg *config.Config, name string, cat config.Category, direction string) (config.Category, error) {
+	if len(cat.Transforms) == 0 {
+		return cat, nil
+	}
+	switch direction {
+	case "push", "backup":
+		staging := transformStaging(cfg, name)
+		if err := stageTransforms(ctx, cat, cat.Local, staging); err != nil {
+			return cat, fmt.Errorf("transform %s: %w", cat.Local, err)
+		}
+		cat.Local = staging
+	case "pull":
+		cat.Exclude = append(slices.Clone(cat.Exclude), transformedPatterns(cat)...)
+	}
+	return cat, nil
+}
+
+// stageTransforms brings staging in line with the local tree. A transform's
+// output gets the mtime of its input, so it only runs again for files that
+// changed since; anything no longer in the local tree is removed.
+func stageTransforms(ctx context.Context, cat config.Category, local, staging string) error {
+	excludes, err := rsync.CategoryMatcher(cat)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	matchers := make([]*rsync.Matcher, len(cat.Transforms))
+	for i, t := range cat.Transforms {
+		if matchers[i], err = rsync.NewMatcher(t.Match); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("transforms[%d]: %w", i, err))
+		}
+	}
+	files, err := listLocal(local, excludes)
+	if err != nil {
+		return err
+	}
+	want := map[string]bool{}
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		f := files[rel]
+		want[rel] = true
+		src := filepath.Join(local, filepath.FromSlash(rel))
+		dst := filepath.Join(staging, filepath.FromSlash(rel))
+		if f.Dir {
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		i := slices.IndexFunc(matchers, func(m *rsync.Matcher) bool { return m.Match(rel, false) })
+		if i < 0 || cat.Transforms[i].Alongside != "" {
+			if err := linkInto(src, dst, f.Size, f.ModTime); err != nil {
+				return err
+			}
+			if i < 0 {
+				continue
+			}
+		}
+		t := cat.Transforms[i]
+		rel, dst = rel+t.Alongside, dst+t.Alongside
+		want[rel] = true
+		if transformed(src, dst, f.ModTime) {
+			continue
+		}
+		printAt(rsync.Verbose, "Transforming %s\n", rel)
+		logger.Debug("running transform", "file", rel, "command", t.Command)
+		if err := runTransform(ctx, t.Command, src, dst, f.Mode, f.ModTime); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	if err := os.MkdirAll(staging, 0o700); err != nil {
+		return err
+	}
+	staged, err := listLocal(staging, noExcludes())
+	if err != nil {
+		return err
+	}
+	return removeUnlisted(staging, staged, want)
+}
+
+// linkInto makes dst a hard link to src, or where that fails (staging on
+// another filesystem) a copy.
+func linkInto(src, dst string, size int64, mtime time.Time) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	if sameFile(dst, size, mtime) {
+		return nil
+	}
+	return transformFile(src, dst, srcInfo.Mode().Perm(), mtime, func(w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// transformed reports whether dst holds a transform's output for src as it
+// is now, rather than a link to src itself (the transform is new).
+func transformed(src, dst string, mtime time.Time) bool {
+	dstInfo, err := os.Stat(dst)
+	if err != nil || dstInfo.ModTime().Unix() != mtime.Unix() {
+		return false
+	}
+	srcInfo, err := os.Stat(src)
+	return err == nil && !os.SameFile(srcInfo, dstInfo)
+}
+
+// runTransform runs command with $IN set to src and $OUT to a new file next
+// to dst, with dst's extension (for tools that pick the format by it), and
+// renames that into place.
+func runTransform(ctx context.Context, command, src, dst string, perm os.FileMode, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".belterlink-*"+filepath.Ext(dst))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	out := tmp.Name()
+	os.Remove(out) // some tools refuse to overwrite
+	defer os.Remove(out)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "IN="+src, "OUT="+out)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("transform %q: %v", command, err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		return fmt.Errorf("transform %q wrote nothing to $OUT", command)
+	}
+	if err := os.Chmod(out, perm); err != nil {
+		return err
+	}
+	if err := os.Chtimes(out, mtime, mtime); err != nil {
+		return err
+	}
+	return os.Rename(out, dst)
+}
+
+// transformedPatterns are the exclude patterns a pull of cat adds, so the
+// remote's rewritten files don't replace the local originals: the files the
+// transforms rewrite, and the outputs of the ones with alongside.
+func transformedPatterns(cat config.Category) []string {
+	var patterns []string
+	for _, t := range cat.Transforms {
+		for _, m := range t.Match {
+			if t.Alongside == "" {
+				patterns = append(patterns, m)
+			} else if !strings.HasSuffix(m, "/") {
+				patterns = append(patterns, m+t.Alongside)
+			}
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestStageTransforms(t *testing.T) {
+	dir := t.TempDir()
+	local, staging, runs := filepath.Join(dir, "local"), filepath.Join(dir, "staging"), filepath.Join(dir, "runs")
+	for rel, data := range map[string]string{"note.md": "plain", "img/photo.jpg": "exif", "Drawing.excalidraw": "{}", "gone.jpg": "x"} {
+		p := filepath.Join(local, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat := config.Category{Transforms: []config.Transform{
+		{Match: []string{"*.jpg"}, Command: `echo run >> ` + runs + `; tr a-z A-Z < "$IN" > "$OUT"`},
+		{Match: []string{"*.excalidraw"}, Command: `echo "<svg/>" > "$OUT"`, Alongside: ".svg"},
+	}}
+	if err := stageTransforms(context.Background(), cat, local, staging); err != nil {
+		t.Fatalf("stageTransforms: %v", err)
+	}
+	if err := os.Remove(filepath.Join(local, "gone.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stageTransforms(context.Background(), cat, local, staging); err != nil {
+		t.Fatalf("stageTransforms again: %v", err)
+	}
+
+	for rel, want := range map[string]string{"note.md": "plain", "img/photo.jpg": "EXIF", "Drawing.excalidraw": "{}", "Drawing.excalidraw.svg": "<svg/>\n"} {
+		got, err := os.ReadFile(filepath.Join(staging, rel))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", rel, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, "gone.jpg")); !os.IsNotExist(err) {
+		t.Error("gone.jpg is still staged after it was deleted locally")
+	}
+	if got, _ := os.ReadFile(filepath.Join(local, "img/photo.jpg")); string(got) != "exif" {
+		t.Errorf("the local file was changed to %q", got)
+	}
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 2 {
+		t.Errorf("the jpg transform ran %d times, want once per file", strings.Count(string(data), "run"))
+	}
+	a, _ := os.Stat(filepath.Join(local, "note.md"))
+	b, _ := os.Stat(filepath.Join(staging, "note.md"))
+	if !os.SameFile(a, b) {
+		t.Error("an untransformed file was copied instead of linked")
+	}
+
+	// a changed photo runs the transform again
+	cat.Transforms[0].Command = "true"
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(local, "img/photo.jpg"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := stageTransforms(context.Background(), cat, local, staging); err == nil || !strings.Contains(err.Error(), "wrote nothing") {
+		t.Errorf("a transform without output: err = %v", err)
+	}
+}
+
+func TestTransformedPatterns(t *testing.T) {
+	cat := config.Category{Transforms: []config.Transform{
+		{Match: []string{"*.jpg", "*.jpeg"}, Command: "x"},
+		{Match: []string{"*.excalidraw"}, Command: "y", Alongside: ".svg"},
+	}}
+	want := []string{"*.jpg", "*.jpeg", "*.excalidraw.svg"}
+	if got := transformedPatterns(cat); !reflect.DeepEqual(got, want) {
+		t.Errorf("transformedPatterns = %v, want %v", got, want)
+	}
+}
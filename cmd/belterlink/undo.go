@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// receivingSide is the side a push or pull writes to.
+func receivingSide(direction string) string {
+	if direction == "push" {
+		return "remote"
+	}
+	return "local"
+}
+
+// backupSides are the sides a run in direction wrote to, and so kept
+// backups on; sync pulls and then pushes under the same run ID.
+func backupSides(direction string) []string {
+	if direction == "sync" {
+		return []string{"local", "remote"}
+	}
+	return []string{receivingSide(direction)}
+}
+
+// backupRoot is where a side keeps the backups of one run.
+func backupRoot(cat config.Category, side, runID string) string {
+	if side == "remote" {
+		return path.Join(strings.TrimRight(cat.Remote, "/"), rsync.BackupDir, runID)
+	}
+	return filepath.Join(cat.Local, rsync.BackupDir, runID)
+}
+
+// pruneBackups removes the backups of every run but keep from side: undo
+// only goes back one run, and backups would otherwise pile up.
+func pruneBackups(ctx context.Context, cfg *config.Config, cat config.Category, side, keep string) error {
+	if side == "remote" {
+		dir := ssh.Quote(path.Dir(backupRoot(cat, side, keep)))
+		_, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("if [ -d %s ]; then find %s -mindepth 1 -maxdepth 1 ! -name %s -exec rm -rf {} +; fi",
+			dir, dir, ssh.Quote(keep)))
+		return err
+	}
+	dir := filepath.Dir(backupRoot(cat, side, keep))
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackups returns the files side kept from run, with their size and
+// mtime from before the run.
+func listBackups(ctx context.Context, cfg *config.Config, cat config.Category, side, runID string) (map[string]rsync.Entry, error) {
+	root := backupRoot(cat, side, runID)
+	if side == "remote" {
+		out, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("if [ -d %s ]; then echo found; fi", ssh.Quote(root)))
+		if err != nil {
+			return nil, withExitCode(exitNetwork, err)
+		}
+		if strings.TrimSpace(string(out)) != "found" {
+			return nil, nil
+		}
+		backups := cat
+		backups.Remote = root
+		return listRemoteFiles(ctx, cfg, backups, nil)
+	}
+	if _, err := os.Stat(root); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	files, err := listLocal(root, noExcludes())
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]rsync.Entry{}
+	for rel, f := range files {
+		if !f.Dir {
+			entries[rel] = rsync.Entry{Path: rel, Size: f.Size, ModTime: f.ModTime}
+		}
+	}
+	return entries, nil
+}
+
+// restoreBackups moves the backups of run back into side's tree, replacing
+// what is there now, and removes the emptied backup directory.
+func restoreBackups(ctx context.Context, cfg *config.Config, cat config.Category, side, runID string) error {
+	root := backupRoot(cat, side, runID)
+	if side == "remote" {
+		dest := strings.TrimRight(cat.Remote, "/")
+		if dest == "" {
+			dest = "."
+		}
+		_, err := ssh.RunContext(ctx, cfg.SSH, fmt.Sprintf("%s -a --remove-source-files %s %s && rm -rf -- %s",
+			ssh.Quote(rsync.RemoteBinary(cfg)), ssh.Quote(root+"/"), ssh.Quote(dest+"/"), ssh.Quote(root)))
+		return err
+	}
+	cmd := rsync.Command(ctx, cfg, "-a", "--remove-source-files", root+"/", strings.TrimRight(cat.Local, "/")+"/")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	return os.RemoveAll(root)
+}
+
+// undoAudit lists the files a restore is about to overwrite on side.
+func undoAudit(ctx context.Context, cfg *config.Config, name string, cat config.Category, side, runID string, files []string) ([]auditEntry, error) {
+	current := map[string]rsync.Entry{}
+	if side == "remote" {
+		var err error
+		if current, err = listRemoteFiles(ctx, cfg, cat, files); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, rel := range files {
+			if info, err := os.Lstat(filepath.Join(cat.Local, filepath.FromSlash(rel))); err == nil && !info.IsDir() {
+				current[rel] = rsync.Entry{Path: rel, Size: info.Size(), ModTime: info.ModTime().UTC()}
+			}
+		}
+	}
+	var entries []auditEntry
+	for _, rel := range files {
+		if c, ok := current[rel]; ok {
+			entries = append(entries, auditEntry{RunID: runID, Category: name, Direction: "undo", Action: "overwrite", Side: side, Path: rel, Size: c.Size, ModTime: c.ModTime})
+		}
+	}
+	return entries, nil
+}
+
+// undoFlags are the flags of "undo".
+type undoFlags struct {
+	yes, dryRun bool
+}
+
+func (f *undoFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.yes, "yes", false, "restore without asking")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "only list the files that would be restored")
+}
+
+// runUndoCommand implements "belterlink undo [-yes] [-dry-run] <Category>":
+// the files the category's last run replaced or deleted are moved back from
+// the backups that backup: true keeps. Files the run created stay.
+func runUndoCommand(g *globals, args []string) error {
+	flags := newFlagSet("undo")
+	g.register(flags)
+	var f undoFlags
+	f.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 {
+		return exitErrorf(exitUsage, "usage: belterlink undo [-yes] [-dry-run] <CategoryName>")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	name := flags.Arg(0)
+	cat, ok := cfg.Categories[name]
+	if !ok {
+		return exitErrorf(exitConfig, "category %q not found in config", name)
+	}
+	last, err := readLastRun(cfg, name)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && last.RunID == "" {
+		return fmt.Errorf("%s: no run to undo", name)
+	} else if err != nil {
+		return err
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if slices.Contains(backupSides(last.Direction), "remote") {
+		if err := pickAddress(cfg); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	backups := map[string][]string{}
+	total := 0
+	for _, side := range backupSides(last.Direction) {
+		entries, err := listBackups(ctx, cfg, cat, side, last.RunID)
+		if err != nil {
+			return err
+		}
+		backups[side] = slices.Sorted(maps.Keys(entries))
+		total += len(entries)
+	}
+	if total == 0 {
+		return fmt.Errorf("%s: the last run (%s, %s) kept no backups; it changed nothing or backup isn't enabled", name, last.RunID, last.Direction)
+	}
+	for _, side := range backupSides(last.Direction) {
+		if len(backups[side]) > 0 && (side == "remote" && cat.ReadonlyRemote || side == "local" && cat.ReadonlyLocal) {
+			return exitErrorf(exitRefused, "category %q has readonly_%s: refusing to restore into the %s copy", name, side, side)
+		}
+	}
+	fmt.Printf("The last run of %s (%s %s at %s) replaced or deleted %d files:\n",
+		name, last.RunID, last.Direction, last.Started.Local().Format(time.DateTime), total)
+	for _, side := range backupSides(last.Direction) {
+		for _, rel := range backups[side] {
+			fmt.Printf("  %s: %s\n", side, rel)
+		}
+	}
+	if f.dryRun {
+		return nil
+	}
+	if !f.yes {
+		if !isTerminal(os.Stdin) {
+			return exitErrorf(exitRefused, "no terminal to confirm the restore on; re-run with -yes")
+		}
+		if !askYesNo("Restore them, replacing the current versions?") {
+			return exitErrorf(exitRefused, "nothing restored")
+		}
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	for _, side := range backupSides(last.Direction) {
+		if len(backups[side]) == 0 {
+			continue
+		}
+		var audit []auditEntry
+		if auditEnabled(cfg) {
+			var err error
+			if audit, err = undoAudit(ctx, cfg, name, cat, side, last.RunID, backups[side]); err != nil {
+				return err
+			}
+		}
+		err := restoreBackups(ctx, cfg, cat, side, last.RunID)
+		if auditEnabled(cfg) {
+			recordAudit(cfg, audit, err)
+		}
+		if err != nil {
+			return fmt.Errorf("restore %s files: %w", side, err)
+		}
+	}
+	fmt.Printf("Restored %d files of run %s\n", total, last.RunID)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+func TestBackupSides(t *testing.T) {
+	for dir, want := range map[string][]string{
+		"push": {"remote"},
+		"pull": {"local"},
+		"sync": {"local", "remote"},
+	} {
+		if got := backupSides(dir); !slices.Equal(got, want) {
+			t.Errorf("backupSides(%q) = %v, want %v", dir, got, want)
+		}
+	}
+}
+
+func TestLocalBackups(t *testing.T) {
+	root := t.TempDir()
+	cat := config.Category{Local: root, Remote: "~/Notes"}
+	if got := backupRoot(cat, "remote", "abcd1234"); got != "~/Notes/"+rsync.BackupDir+"/abcd1234" {
+		t.Fatalf("remote backup root = %q", got)
+	}
+	for _, p := range []string{"old0001/a.md", "abcd1234/Projects/ideas.md", "abcd1234/b.md"} {
+		p = filepath.Join(root, rsync.BackupDir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneBackups(context.Background(), nil, cat, "local", "abcd1234"); err != nil {
+		t.Fatalf("pruneBackups error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, rsync.BackupDir, "old0001")); !os.IsNotExist(err) {
+		t.Fatalf("backups of an earlier run not pruned: %v", err)
+	}
+	entries, err := listBackups(context.Background(), nil, cat, "local", "abcd1234")
+	if err != nil {
+		t.Fatalf("listBackups error: %v", err)
+	}
+	if len(entries) != 2 || entries["Projects/ideas.md"].Size != 3 {
+		t.Fatalf("backups = %+v, want b.md and Projects/ideas.md", entries)
+	}
+	if entries, err := listBackups(context.Background(), nil, cat, "local", "missing0"); err != nil || len(entries) != 0 {
+		t.Fatalf("backups of a run without any = %v, %v", entries, err)
+	}
+}
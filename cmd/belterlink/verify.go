@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// runVerifyCommand implements "belterlink verify <Category>...": a checksum
+// comparison of both sides that transfers nothing.
+func runVerifyCommand(g *globals, patterns []string) error {
+	flags := newFlagSet("verify")
+	g.register(flags)
+	if err := flags.Parse(patterns); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	patterns = flags.Args()
+	if len(patterns) == 0 {
+		return exitErrorf(exitUsage, "usage: belterlink verify <CategoryName>...")
+	}
+	cfg, err := config.Load(g.cfgPath)
+	if err != nil {
+		return exitErrorf(exitConfig, "load config: %v", err)
+	}
+	prepareKeyPassphrase(cfg, g.cfgPath)
+	if cfg.SSH.User == "" || cfg.SSH.Host == "" {
+		return exitErrorf(exitConfig, "ssh.user and ssh.host are required in config")
+	}
+	names, err := config.SelectCategories(cfg, patterns)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if err := ssh.EnsureControlDir(cfg.SSH); err != nil {
+		return err
+	}
+	if err := pickAddress(cfg); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var errs []error
+	for _, name := range names {
+		diffs, err := verifyCategory(ctx, cfg, cfg.Categories[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if len(diffs) == 0 {
+			fmt.Printf("%s: in sync\n", name)
+			continue
+		}
+		fmt.Printf("%s: %d difference(s)\n", name, len(diffs))
+		for _, d := range diffs {
+			fmt.Printf("  %-12s %s\n", d.Kind, d.Path)
+		}
+		errs = append(errs, exitErrorf(exitDiffers, "%s: local and remote differ", name))
+	}
+	return errors.Join(errs...)
+}
+
+// verifyCategory runs a checksumming dry-run push and classifies what rsync
+// would change.
+func verifyCategory(ctx context.Context, cfg *config.Config, cat config.Category) ([]rsync.Difference, error) {
+	opts := rsync.Options{Direction: "push", DryRun: true, Checksum: true, Delete: true, Verbosity: rsync.Quiet, LowPriority: rsync.LowPriority(cfg, cat)}
+	rsArgs, err := rsync.BuildArgs(cfg, cat, opts)
+	if err != nil {
+		return nil, err
+	}
+	// report newer remote files and excluded files as differences too
+	rsArgs = slices.DeleteFunc(adaptRsyncArgs(ctx, cfg, rsArgs), func(a string) bool {
+		return a == "--update" || a == "--delete-excluded"
+	})
+	return itemizedDryRun(ctx, cfg, opts, rsArgs, true)
+}
+
+// withoutOutputArgs drops the options -v and -vv add from rsArgs, so a run
+// whose output is parsed only prints what it asks for.
+func withoutOutputArgs(rsArgs []string) []string {
+	return slices.DeleteFunc(slices.Clone(rsArgs), func(a string) bool {
+		return a == "-v" || a == "-vv" || a == "--stats" || strings.HasPrefix(a, "--debug=")
+	})
+}
+
+// itemizedDryRun reruns rsArgs of a run with opts as a dry run (comparing by
+// checksum if asked) and returns what rsync would change.
+func itemizedDryRun(ctx context.Context, cfg *config.Config, opts rsync.Options, rsArgs []string, checksum bool) ([]rsync.Difference, error) {
+	out, err := itemizedOutput(ctx, cfg, opts, rsArgs, checksum)
+	if err != nil {
+		return nil, err
+	}
+	return rsync.ParseItemized(out, opts.Direction), nil
+}
+
+// itemizedOutput is itemizedDryRun's rsync --itemize-changes output.
+func itemizedOutput(ctx context.Context, cfg *config.Config, opts rsync.Options, rsArgs []string, checksum bool) (string, error) {
+	rsArgs = withoutOutputArgs(rsArgs)
+	rsArgs = rsync.InsertBeforePaths(rsArgs, "--dry-run", "--itemize-changes")
+	if checksum {
+		rsArgs = rsync.InsertBeforePaths(rsArgs, "--checksum")
+	}
+
+	var out bytes.Buffer
+	cmd := rsyncCommand(ctx, cfg, opts, rsArgs...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		code := rsync.ExitCode(err)
+		return "", exitErrorf(rsyncExitCode(code), "rsync failed: %v (%s)", err, explainRsyncExit(code))
+	}
+	return out.String(), nil
+}
+
+// verifyTransfer implements verify_after: once rsync succeeded, a checksum
+// dry run with the same arguments must find nothing left to transfer.
+func verifyTransfer(ctx context.Context, cfg *config.Config, opts rsync.Options, rsArgs []string) error {
+	fmt.Println("Verifying transfer by checksum...")
+	diffs, err := itemizedDryRun(ctx, cfg, opts, rsArgs, true)
+	if err != nil {
+		return fmt.Errorf("verify after transfer: %w", err)
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	for _, d := range diffs {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", d.Kind, d.Path)
+	}
+	logger.Error("verification after transfer failed", "differences", len(diffs))
+	return exitErrorf(exitDiffers, "verification after transfer found %d difference(s)", len(diffs))
+}
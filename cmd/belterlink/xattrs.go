@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// prepareXattrs handles preserve_xattrs before a transfer: it turns on
+// --crtimes when both rsyncs support it and warns about the metadata a
+// macOS ↔ Linux transfer will lose.
+func prepareXattrs(ctx context.Context, cfg *config.Config, cat config.Category, opts *RunOptions, local, remote rsync.Version) {
+	if !config.GetBool(false, cat.PreserveXattrs, config.GetBool(false, cfg.Defaults.PreserveXattrs, false)) {
+		return
+	}
+	opts.CreationTimes = local.Has("crtimes") && remote.Has("crtimes")
+	for _, w := range metadataWarnings(runtime.GOOS, remoteOS(ctx, cfg), opts.CreationTimes) {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+		logger.Warn(w)
+	}
+}
+
+// metadataWarnings lists what preserve_xattrs can't keep when one side is a
+// Mac and the other isn't. The OS names are as GOOS or uname -s report them.
+func metadataWarnings(localOS, remoteOS string, crtimes bool) []string {
+	localMac, remoteMac := strings.EqualFold(localOS, "darwin"), strings.EqualFold(remoteOS, "darwin")
+	if !localMac && !remoteMac {
+		return nil
+	}
+	var warnings []string
+	if !crtimes {
+		warnings = append(warnings, "creation times are not kept: rsync can only preserve them between Macs (rsync 3.2 or newer on both)")
+	}
+	if localMac != remoteMac && remoteOS != "" {
+		warnings = append(warnings,
+			"syncing between APFS and a Linux filesystem: extended attributes larger than the filesystem allows (about 4 KiB per file on ext4), such as resource forks, are lost",
+			"macOS ACLs have no Linux equivalent and are not transferred")
+	}
+	return warnings
+}
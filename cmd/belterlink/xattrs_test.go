@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestMetadataWarnings(t *testing.T) {
+	if w := metadataWarnings("linux", "Linux", false); len(w) != 0 {
+		t.Fatalf("Linux to Linux: %q", w)
+	}
+	if w := metadataWarnings("darwin", "Darwin", true); len(w) != 0 {
+		t.Fatalf("Mac to Mac with --crtimes: %q", w)
+	}
+	if w := metadataWarnings("darwin", "Darwin", false); len(w) != 1 {
+		t.Fatalf("Mac to Mac without --crtimes: %q", w)
+	}
+	if w := metadataWarnings("linux", "Darwin", false); len(w) != 3 {
+		t.Fatalf("Linux to Mac: %q", w)
+	}
+	if w := metadataWarnings("darwin", "", false); len(w) != 1 {
+		t.Fatalf("unknown remote: %q", w)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeClient connects a client to an in-process agent.
+func pipeClient(t *testing.T) *Client {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- Serve(reqR, respW) }()
+	t.Cleanup(func() {
+		reqW.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return NewClient(respR, reqW)
+}
+
+func TestSendGetRoundTrip(t *testing.T) {
+	c := pipeClient(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	data := bytes.Repeat([]byte("belterlink"), ChunkSize/4) // spans several chunks
+	mtime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(src, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(src, mtime, mtime)
+
+	remote := filepath.Join(dir, "remote", "sub", "copy.bin")
+	if n, err := c.Send(src, remote); err != nil || n != int64(len(data)) {
+		t.Fatalf("Send = %d, %v", n, err)
+	}
+	st, err := c.Stat(remote)
+	if err != nil || st.Size != int64(len(data)) || !st.ModTime.Equal(mtime) || st.Mode != 0o640 {
+		t.Fatalf("Stat = %+v, %v", st, err)
+	}
+
+	back := filepath.Join(dir, "back", "copy.bin")
+	if n, err := c.Get(remote, back); err != nil || n != int64(len(data)) {
+		t.Fatalf("Get = %d, %v", n, err)
+	}
+	got, _ := os.ReadFile(back)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip changed the content")
+	}
+	if sum, err := c.Hash(remote); err != nil || sum != mustHash(t, back) {
+		t.Fatalf("Hash = %q, %v", sum, err)
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	c := pipeClient(t)
+	root := t.TempDir()
+	for _, p := range []string{"a.md", "sub/b.md", ".DS_Store", "cache/x"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0o755)
+		os.WriteFile(filepath.Join(root, p), []byte(p), 0o644)
+	}
+	files, err := c.List(root, []string{".DS_Store", "cache/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	if want := []string{"a.md", "sub", "sub/b.md"}; !slices.Equal(paths, want) {
+		t.Fatalf("List = %v, want %v", paths, want)
+	}
+	if files, err := c.List(filepath.Join(root, "missing"), nil); err != nil || len(files) != 0 {
+		t.Fatalf("List of a missing root = %v, %v", files, err)
+	}
+
+	if err := c.Delete(filepath.Join(root, "a.md")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(filepath.Join(root, "a.md")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat after Delete = %v, want ErrNotExist", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	c := pipeClient(t)
+	h, err := c.Hello()
+	if err != nil || h.Version != ProtocolVersion || h.OS != runtime.GOOS || h.Arch != runtime.GOARCH || h.Build != Build {
+		t.Fatalf("Hello = %+v, %v", h, err)
+	}
+	for _, r := range [][2]int{{1, 1}, {1, ProtocolVersion + 5}, {ProtocolVersion + 1, ProtocolVersion + 5}} {
+		want := min(r[1], ProtocolVersion)
+		if r[0] > ProtocolVersion {
+			want = 0
+		}
+		if got := negotiate(r[0], r[1]); got != want {
+			t.Errorf("negotiate(%d, %d) = %d, want %d", r[0], r[1], got, want)
+		}
+	}
+}
+
+func TestHelloOldAgent(t *testing.T) {
+	// an agent from before the handshake only knows the file operations
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go func() {
+		var req Request
+		readFrame(reqR, &req)
+		writeFrame(respW, Response{Error: fmt.Sprintf("unknown operation %q", req.Op)})
+	}()
+	h, err := NewClient(respR, reqW).Hello()
+	if err != nil || h.Version != 1 || h.Build != "" {
+		t.Fatalf("Hello = %+v, %v; want version 1", h, err)
+	}
+}
+
+func TestDeltaNeedsVersion2(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "f")
+	os.WriteFile(p, []byte("data"), 0o644)
+
+	// no hello: the session speaks version 1, which may lack the delta ops
+	c := pipeClient(t)
+	if _, err := c.SendDelta(p, p); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("SendDelta in a version 1 session = %v, want ErrIncompatible", err)
+	}
+	if _, err := c.call(Request{Op: OpSignature, Path: p}); err == nil || !strings.Contains(err.Error(), "needs protocol version 2") {
+		t.Errorf("the agent answered signature in a version 1 session: %v", err)
+	}
+	if _, err := c.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != DeltaVersion {
+		t.Fatalf("Version = %d after hello, want %d", c.Version(), DeltaVersion)
+	}
+	if _, err := c.SendDelta(p, p); err != nil {
+		t.Errorf("SendDelta after hello: %v", err)
+	}
+}
+
+func mustHash(t *testing.T, p string) string {
+	t.Helper()
+	sum, err := hashFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
@@ -0,0 +1,339 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Client talks to one agent session.
+type Client struct {
+	r       io.Reader
+	w       io.Writer
+	cmd     *exec.Cmd
+	in      io.Closer
+	version int // the protocol version of the session
+}
+
+// NewClient speaks the protocol over r and w, e.g. pipes to an in-process
+// Serve.
+func NewClient(r io.Reader, w io.Writer) *Client {
+	return &Client{r: r, w: w, version: 1}
+}
+
+// Dial starts the agent with the given command line (usually ssh ... host
+// belterlink agent) and connects to its stdin and stdout.
+func Dial(name string, args ...string) (*Client, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start agent: %w", err)
+	}
+	return &Client{r: r, w: w, cmd: cmd, in: w, version: 1}, nil
+}
+
+// Close ends the session and waits for a dialed agent to exit.
+func (c *Client) Close() error {
+	if c.cmd == nil {
+		return nil
+	}
+	c.in.Close()
+	return c.cmd.Wait()
+}
+
+func (c *Client) call(req Request) (Response, error) {
+	if err := writeFrame(c.w, req); err != nil {
+		return Response{}, fmt.Errorf("agent: %w", err)
+	}
+	var resp Response
+	if err := readFrame(c.r, &resp); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("connection closed (is belterlink installed on the remote? belterlink push-agent installs it)")
+		}
+		return Response{}, fmt.Errorf("agent: %w", err)
+	}
+	if resp.Error != "" {
+		err := errors.New(resp.Error)
+		if resp.NotExist {
+			err = fmt.Errorf("%w: %s", fs.ErrNotExist, resp.Error)
+		}
+		return resp, err
+	}
+	return resp, nil
+}
+
+// ErrIncompatible is returned by Hello when the agent and the client have no
+// protocol version in common.
+var ErrIncompatible = errors.New("agent: no protocol version in common")
+
+// Hello agrees with the agent on the protocol version to speak and returns
+// what the agent told about itself. An agent from before the handshake is
+// taken to speak version 1; its build, OS and architecture are unknown.
+func (c *Client) Hello() (Hello, error) {
+	resp, err := c.call(Request{Op: OpHello, Version: ProtocolVersion, MinVersion: MinProtocolVersion})
+	if err != nil {
+		if resp.Error == fmt.Sprintf("unknown operation %q", OpHello) {
+			return Hello{Version: 1, MinVersion: 1, MaxVersion: 1}, nil
+		}
+		return Hello{}, err
+	}
+	if resp.Hello == nil {
+		return Hello{}, errors.New("agent: no answer to hello")
+	}
+	h := *resp.Hello
+	if h.Version == 0 {
+		return h, fmt.Errorf("%w: the remote agent (belterlink %s) speaks versions %d to %d, this build %d to %d",
+			ErrIncompatible, h.Build, h.MinVersion, h.MaxVersion, MinProtocolVersion, ProtocolVersion)
+	}
+	c.version = h.Version
+	return h, nil
+}
+
+// Version is the protocol version the session speaks: 1 until Hello agrees
+// on another.
+func (c *Client) Version() int {
+	return c.version
+}
+
+// require refuses op unless the session speaks at least version v.
+func (c *Client) require(op string, v int) error {
+	if c.version < v {
+		return fmt.Errorf("%w: %s needs protocol version %d, the session speaks %d", ErrIncompatible, op, v, c.version)
+	}
+	return nil
+}
+
+// List returns every file and directory below root, minus the excluded ones.
+func (c *Client) List(root string, exclude []string) ([]File, error) {
+	resp, err := c.call(Request{Op: OpList, Path: root, Exclude: exclude})
+	return resp.Files, err
+}
+
+// Stat describes one remote file.
+func (c *Client) Stat(p string) (File, error) {
+	resp, err := c.call(Request{Op: OpStat, Path: p})
+	if err != nil {
+		return File{}, err
+	}
+	return *resp.File, nil
+}
+
+// Hash returns the hex SHA-256 of a remote file.
+func (c *Client) Hash(p string) (string, error) {
+	resp, err := c.call(Request{Op: OpHash, Path: p})
+	return resp.Hash, err
+}
+
+// Delete removes a remote file or empty directory.
+func (c *Client) Delete(p string) error {
+	_, err := c.call(Request{Op: OpDelete, Path: p})
+	return err
+}
+
+// Send copies the local file to remote, keeping its modification time and
+// permissions. The remote file is replaced only once all of it arrived.
+func (c *Client) Send(local, remote string) (int64, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, ChunkSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		done := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !done {
+			return off, err
+		}
+		req := Request{Op: OpSend, Path: remote, Offset: off, Data: buf[:n], Done: done}
+		if done {
+			req.ModTime, req.Mode = info.ModTime(), info.Mode().Perm()
+		}
+		if _, err := c.call(req); err != nil {
+			return off, err
+		}
+		off += int64(n)
+		if done {
+			return off, nil
+		}
+	}
+}
+
+// Get copies the remote file to local through a temporary file next to it,
+// setting the modification time and permissions the agent reported.
+func (c *Client) Get(remote, local string) (int64, error) {
+	st, err := c.Stat(remote)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".belterlink-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // a no-op once renamed
+	var off int64
+	for {
+		resp, err := c.call(Request{Op: OpGet, Path: remote, Offset: off})
+		if err != nil {
+			f.Close()
+			return off, err
+		}
+		if _, err := f.Write(resp.Data); err != nil {
+			f.Close()
+			return off, err
+		}
+		off += int64(len(resp.Data))
+		if resp.EOF {
+			break
+		}
+	}
+	if err := errors.Join(f.Chmod(st.Mode), f.Close()); err != nil {
+		return off, err
+	}
+	if err := os.Chtimes(f.Name(), st.ModTime, st.ModTime); err != nil {
+		return off, err
+	}
+	return off, os.Rename(f.Name(), local)
+}
+
+// SendDelta updates an existing remote copy of local by sending only the
+// blocks that changed. It returns the literal bytes sent.
+func (c *Client) SendDelta(local, remote string) (int64, error) {
+	if err := c.require(OpSignature, DeltaVersion); err != nil {
+		return 0, err
+	}
+	sig, err := c.call(Request{Op: OpSignature, Path: remote})
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		batch   []Op
+		pending int // literal bytes in batch
+		literal int64
+		start   = true
+	)
+	flush := func(done bool) error {
+		req := Request{Op: OpPatch, Path: remote, Start: start, BlockSize: sig.BlockSize, Ops: batch, Done: done}
+		if done {
+			req.ModTime, req.Mode = info.ModTime(), info.Mode().Perm()
+		}
+		_, err := c.call(req)
+		batch, pending, start = nil, 0, false
+		return err
+	}
+	err = Delta(sig.Sigs, sig.BlockSize, f, func(op Op) error {
+		batch = append(batch, op)
+		pending += len(op.Data)
+		literal += int64(len(op.Data))
+		if pending >= ChunkSize || len(batch) >= 4096 {
+			return flush(false)
+		}
+		return nil
+	})
+	if err != nil {
+		return literal, err
+	}
+	return literal, flush(true)
+}
+
+// GetDelta updates the local copy of remote by fetching only the blocks
+// that changed. It returns the bytes of delta received.
+func (c *Client) GetDelta(remote, local string) (int64, error) {
+	if err := c.require(OpDelta, DeltaVersion); err != nil {
+		return 0, err
+	}
+	st, err := c.Stat(remote)
+	if err != nil {
+		return 0, err
+	}
+	old, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+	bs := BlockSize(st.Size)
+	sigs, err := Signature(old, bs)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.call(Request{Op: OpDelta, Path: remote, BlockSize: bs, Sigs: sigs})
+	if err != nil {
+		return 0, err
+	}
+	defer c.Delete(resp.DeltaPath)
+
+	deltaFile, err := os.CreateTemp("", "belterlink-delta-*")
+	if err != nil {
+		return 0, err
+	}
+	deltaFile.Close()
+	defer os.Remove(deltaFile.Name())
+	n, err := c.Get(resp.DeltaPath, deltaFile.Name())
+	if err != nil {
+		return n, err
+	}
+
+	ops, err := os.Open(deltaFile.Name())
+	if err != nil {
+		return n, err
+	}
+	defer ops.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".belterlink-*")
+	if err != nil {
+		return n, err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+	r := bufio.NewReader(ops)
+	w := bufio.NewWriter(tmp)
+	for {
+		var op Op
+		if err := readFrame(r, &op); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			tmp.Close()
+			return n, err
+		}
+		if err := Patch(old, bs, []Op{op}, w); err != nil {
+			tmp.Close()
+			return n, err
+		}
+	}
+	if err := errors.Join(w.Flush(), tmp.Chmod(st.Mode), tmp.Close()); err != nil {
+		return n, err
+	}
+	if err := os.Chtimes(tmp.Name(), st.ModTime, st.ModTime); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), local)
+}
@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+)
+
+// Delta transfer, as in rsync and librsync: the side holding the old copy
+// sends a signature (a weak rolling checksum and a strong hash per block),
+// the side holding the new copy answers with the blocks it can reuse and the
+// literal bytes in between, and the old side rebuilds the new file from both.
+
+// DeltaMinSize is the smallest file worth a delta transfer; below it the
+// signature round trip costs more than it saves.
+const DeltaMinSize = 1 << 20
+
+// BlockSig identifies one block of the old file.
+type BlockSig struct {
+	Weak   uint32 `json:"w"`
+	Strong []byte `json:"s"` // first 16 bytes of the SHA-256
+}
+
+// Op is one instruction for rebuilding the new file: copy Count blocks from
+// the old file starting at Block, or write Data.
+type Op struct {
+	Block int64  `json:"b,omitempty"`
+	Count int64  `json:"n,omitempty"`
+	Data  []byte `json:"d,omitempty"`
+}
+
+// BlockSize picks the block size for a file of the given size the way rsync
+// does: about the square root of the size, between 2 KiB and 128 KiB.
+func BlockSize(size int64) int {
+	b := int(math.Sqrt(float64(size))) &^ 7
+	return min(max(b, 2<<10), 128<<10)
+}
+
+// Signature reads the old file and returns the signature of each block.
+func Signature(r io.Reader, blockSize int) ([]BlockSig, error) {
+	var sigs []BlockSig
+	buf := make([]byte, blockSize)
+	br := bufio.NewReaderSize(r, 1<<16)
+	for {
+		n, err := io.ReadFull(br, buf)
+		if n > 0 {
+			sigs = append(sigs, BlockSig{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sigs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Delta reads the new file and calls emit with the ops that rebuild it from
+// the old file described by sigs. Literal data is flushed at least every
+// ChunkSize bytes, so emit can forward ops without holding the whole file.
+func Delta(sigs []BlockSig, blockSize int, r io.Reader, emit func(Op) error) error {
+	index := make(map[uint32][]int, len(sigs))
+	for i, s := range sigs {
+		index[s.Weak] = append(index[s.Weak], i)
+	}
+
+	var (
+		data    []byte // unprocessed input; the window starts at pos
+		pos     int
+		lit     int // start of pending literal bytes
+		eof     bool
+		pending Op // block run not emitted yet
+	)
+	flushRun := func() error {
+		if pending.Count == 0 {
+			return nil
+		}
+		err := emit(pending)
+		pending = Op{}
+		return err
+	}
+	flushLiteral := func() error {
+		if pos == lit {
+			return nil
+		}
+		if err := flushRun(); err != nil {
+			return err
+		}
+		err := emit(Op{Data: append([]byte(nil), data[lit:pos]...)})
+		lit = pos
+		return err
+	}
+	fill := func() error {
+		// keep the pending literal and the window, read more behind them
+		data = append(data[:0], data[lit:]...)
+		pos -= lit
+		lit = 0
+		if cap(data) < 2*ChunkSize {
+			grown := make([]byte, len(data), 2*ChunkSize)
+			copy(grown, data)
+			data = grown
+		}
+		for !eof && len(data) < cap(data) {
+			n, err := r.Read(data[len(data):cap(data)])
+			data = data[:len(data)+n]
+			if errors.Is(err, io.EOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	var roll rolling
+	rolled := false
+	for {
+		if len(data)-pos < blockSize && !eof {
+			if pos-lit >= ChunkSize {
+				if err := flushLiteral(); err != nil {
+					return err
+				}
+			}
+			if err := fill(); err != nil {
+				return err
+			}
+		}
+		avail := len(data) - pos
+		if avail == 0 {
+			break
+		}
+		n := min(blockSize, avail)
+		if !rolled {
+			roll = newRolling(data[pos : pos+n])
+			rolled = true
+		}
+		if i, ok := match(index, sigs, roll.sum(), data[pos:pos+n]); ok {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+			if pending.Count > 0 && pending.Block+pending.Count == int64(i) {
+				pending.Count++
+			} else {
+				if err := flushRun(); err != nil {
+					return err
+				}
+				pending = Op{Block: int64(i), Count: 1}
+			}
+			pos += n
+			lit = pos
+			rolled = false
+			continue
+		}
+		// no match: the first byte of the window becomes literal data
+		switch {
+		case pos+n < len(data):
+			roll.roll(data[pos], data[pos+n])
+		case eof:
+			roll.drop(data[pos])
+		default:
+			rolled = false // the window reaches past what's read; recompute after the next fill
+		}
+		pos++
+		if pos-lit >= ChunkSize {
+			if err := flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flushLiteral(); err != nil {
+		return err
+	}
+	return flushRun()
+}
+
+func match(index map[uint32][]int, sigs []BlockSig, weak uint32, block []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(block)
+	for _, i := range candidates {
+		if string(sigs[i].Strong) == string(strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Patch writes the new file to w from the old file and ops.
+func Patch(old io.ReaderAt, blockSize int, ops []Op, w io.Writer) error {
+	buf := make([]byte, blockSize)
+	for _, op := range ops {
+		if op.Count == 0 {
+			if _, err := w.Write(op.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		for b := op.Block; b < op.Block+op.Count; b++ {
+			n, err := old.ReadAt(buf, b*int64(blockSize))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			if n == 0 {
+				return errors.New("delta refers past the end of the old file")
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func strongSum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:16]
+}
+
+func weakSum(b []byte) uint32 {
+	r := newRolling(b)
+	return r.sum()
+}
+
+// rolling is rsync's weak checksum over a window of bytes, which can slide
+// one byte at a time in constant time.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(window []byte) rolling {
+	var r rolling
+	r.n = uint32(len(window))
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+// roll slides the window one byte: out leaves at the front, in enters at the back.
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// drop shrinks the window by its first byte, at the end of the file.
+func (r *rolling) drop(out byte) {
+	r.b -= r.n * uint32(out)
+	r.a -= uint32(out)
+	r.n--
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// rebuild runs a delta of newData against oldData and returns the patched
+// result and the literal bytes it needed.
+func rebuild(t *testing.T, oldData, newData []byte) ([]byte, int) {
+	t.Helper()
+	bs := BlockSize(int64(len(newData)))
+	sigs, err := Signature(bytes.NewReader(oldData), bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []Op
+	literal := 0
+	err = Delta(sigs, bs, bytes.NewReader(newData), func(op Op) error {
+		ops = append(ops, op)
+		literal += len(op.Data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Patch(bytes.NewReader(oldData), bs, ops, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes(), literal
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := randomBytes(3*ChunkSize+123, 1)
+	tests := []struct {
+		name       string
+		new        []byte
+		maxLiteral int
+	}{
+		{"unchanged", old, 0},
+		{"appended", append(bytes.Clone(old), randomBytes(5000, 2)...), 5000 + 128<<10},
+		{"prepended", append(randomBytes(777, 3), old...), 777 + 128<<10},
+		{"edited", func() []byte {
+			b := bytes.Clone(old)
+			copy(b[ChunkSize:], "changed in the middle")
+			return b
+		}(), 2 * 128 << 10},
+		{"truncated", old[:ChunkSize+5], 128 << 10},
+		{"unrelated", randomBytes(ChunkSize, 4), ChunkSize},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, literal := rebuild(t, old, tt.new)
+			if !bytes.Equal(got, tt.new) {
+				t.Fatalf("patched file differs from the new one (%d vs %d bytes)", len(got), len(tt.new))
+			}
+			if literal > tt.maxLiteral {
+				t.Fatalf("sent %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestRollingMatchesWeakSum(t *testing.T) {
+	data := randomBytes(100, 5)
+	r := newRolling(data[:16])
+	for i := 1; i+16 <= len(data); i++ {
+		r.roll(data[i-1], data[i+15])
+		if r.sum() != weakSum(data[i:i+16]) {
+			t.Fatalf("rolled sum at %d differs from a fresh one", i)
+		}
+	}
+	r.drop(data[len(data)-16])
+	if r.sum() != weakSum(data[len(data)-15:]) {
+		t.Fatalf("dropped sum differs from a fresh one")
+	}
+}
+
+func TestSendGetDelta(t *testing.T) {
+	c := pipeClient(t)
+	if _, err := c.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	recording := randomBytes(2*DeltaMinSize, 6)
+	local := filepath.Join(dir, "local.wav")
+	remote := filepath.Join(dir, "remote.wav")
+	os.WriteFile(local, recording, 0o644)
+	os.WriteFile(remote, recording, 0o644)
+
+	// push an appended recording
+	grown := append(bytes.Clone(recording), randomBytes(4096, 7)...)
+	mtime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	os.WriteFile(local, grown, 0o600)
+	os.Chmod(local, 0o600)
+	os.Chtimes(local, mtime, mtime)
+	literal, err := c.SendDelta(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if literal >= int64(len(grown))/2 {
+		t.Fatalf("SendDelta sent %d literal bytes for a %d byte append", literal, 4096)
+	}
+	if got, _ := os.ReadFile(remote); !bytes.Equal(got, grown) {
+		t.Fatalf("remote copy differs after SendDelta")
+	}
+	if st, err := c.Stat(remote); err != nil || !st.ModTime.Equal(mtime) || st.Mode != 0o600 {
+		t.Fatalf("Stat after SendDelta = %+v, %v", st, err)
+	}
+
+	// and pull a further change back
+	edited := bytes.Clone(grown)
+	copy(edited[DeltaMinSize:], "a marker in the middle")
+	os.WriteFile(remote, edited, 0o644)
+	os.WriteFile(local, recording, 0o644)
+	received, err := c.GetDelta(remote, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received >= int64(len(edited))/2 {
+		t.Fatalf("GetDelta received %d bytes of delta", received)
+	}
+	if got, _ := os.ReadFile(local); !bytes.Equal(got, edited) {
+		t.Fatalf("local copy differs after GetDelta")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
@@ -0,0 +1,157 @@
+// Package agent implements the protocol belterlink speaks with a copy of
+// itself running on the remote ("belterlink agent") over the stdin and stdout
+// of an ssh session, so hosts without rsync can be synced too.
+//
+// Every message is a frame: a 4-byte big-endian length followed by that many
+// bytes of JSON. The client sends one Request and reads one Response at a
+// time; file contents travel in chunks of at most ChunkSize bytes.
+//
+// A session starts with OpHello, in which both sides agree on the protocol
+// version to speak.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// ProtocolVersion is the newest version of the protocol this build speaks,
+// MinProtocolVersion the oldest. Version 1 is the protocol from before the
+// handshake: a side that doesn't know OpHello speaks it, and a session
+// speaks it until OpHello agrees on another. Version 2 adds OpHello and the
+// delta ops, which not every version 1 agent knows.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// DeltaVersion is the protocol version OpSignature, OpPatch and OpDelta need.
+const DeltaVersion = 2
+
+// Build is the belterlink version the agent reports in the handshake; main
+// sets it.
+var Build = "dev"
+
+// ChunkSize is the most file data carried by one frame.
+const ChunkSize = 1 << 20
+
+// maxFrame bounds a frame so a corrupt length can't exhaust memory; a chunk
+// of data grows by a third when base64-encoded in the JSON, and signatures of
+// very large files take a few tens of megabytes.
+const maxFrame = 64 << 20
+
+// Operations.
+const (
+	OpHello  = "hello"  // agree on a protocol version; the agent describes itself
+	OpList   = "list"   // every file and directory under Path
+	OpStat   = "stat"   // one file
+	OpHash   = "hash"   // SHA-256 of one file
+	OpSend   = "send"   // write a chunk of a file (client → agent)
+	OpGet    = "get"    // read a chunk of a file (agent → client)
+	OpDelete = "delete" // remove a file or an empty directory
+
+	OpSignature = "signature" // block signatures of a file, for a delta push
+	OpPatch     = "patch"     // rebuild a file from its old copy and ops (client → agent)
+	OpDelta     = "delta"     // write the ops rebuilding a file from a signature to a temporary file, for a delta pull
+)
+
+// Request is sent by the client.
+type Request struct {
+	Op      string      `json:"op"`
+	Path    string      `json:"path"`              // absolute, or relative to the remote home
+	Exclude []string    `json:"exclude,omitempty"` // list: rsync-style patterns to skip
+	Offset  int64       `json:"offset,omitempty"`  // send, get: where the chunk starts
+	Data    []byte      `json:"data,omitempty"`    // send: the chunk
+	Done    bool        `json:"done,omitempty"`    // send: last chunk; the file is put in place
+	ModTime time.Time   `json:"mtime,omitzero"`    // send: set with the last chunk
+	Mode    fs.FileMode `json:"mode,omitempty"`    // send: permission bits
+
+	Start     bool       `json:"start,omitempty"`      // patch: first batch of ops
+	BlockSize int        `json:"block_size,omitempty"` // patch, delta
+	Sigs      []BlockSig `json:"sigs,omitempty"`       // delta: signature of the client's copy
+	Ops       []Op       `json:"ops,omitempty"`        // patch: a batch of ops
+
+	Version    int `json:"version,omitempty"`     // hello: the newest version the client speaks
+	MinVersion int `json:"min_version,omitempty"` // hello: the oldest
+}
+
+// Response answers one Request. Error is set instead of the other fields
+// when the operation failed.
+type Response struct {
+	Error    string `json:"error,omitempty"`
+	NotExist bool   `json:"not_exist,omitempty"` // the error is a missing file
+	Files    []File `json:"files,omitempty"`     // list
+	File     *File  `json:"file,omitempty"`      // stat
+	Hash     string `json:"hash,omitempty"`      // hash: hex SHA-256
+	Data     []byte `json:"data,omitempty"`      // get
+	EOF      bool   `json:"eof,omitempty"`       // get: Data ends the file
+
+	BlockSize int        `json:"block_size,omitempty"` // signature
+	Sigs      []BlockSig `json:"sigs,omitempty"`       // signature
+	DeltaPath string     `json:"delta_path,omitempty"` // delta: framed ops to fetch with get, then delete
+
+	Hello *Hello `json:"hello,omitempty"` // hello
+}
+
+// Hello is the agent's side of the handshake.
+type Hello struct {
+	Version    int    `json:"version"`     // the version both sides speak from now on; 0 if there is none
+	MinVersion int    `json:"min_version"` // the versions the agent speaks
+	MaxVersion int    `json:"max_version"`
+	Build      string `json:"build,omitempty"` // the agent's belterlink version
+	OS         string `json:"os,omitempty"`    // GOOS and GOARCH of the agent's binary
+	Arch       string `json:"arch,omitempty"`
+}
+
+// negotiate picks the newest version both sides speak, given the range the
+// client speaks, or 0 if the ranges don't overlap.
+func negotiate(lo, hi int) int {
+	v := min(hi, ProtocolVersion)
+	if v < max(lo, MinProtocolVersion) {
+		return 0
+	}
+	return v
+}
+
+// File describes a file or directory on either side.
+type File struct {
+	Path    string      `json:"path"` // slash-separated, relative to the listed root
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    fs.FileMode `json:"mode"`
+	Dir     bool        `json:"dir,omitempty"`
+}
+
+func writeFrame(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readFrame(r io.Reader, v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrame {
+		return fmt.Errorf("agent: frame of %d bytes exceeds the limit", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,340 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/rsync"
+)
+
+// server is the agent side of a session.
+type server struct {
+	version int // the protocol version of the session
+	home    string
+	partial map[string]*os.File    // files being received, by destination path
+	patches map[string]*patchState // files being rebuilt from deltas, by destination path
+}
+
+type patchState struct {
+	old       *os.File
+	tmp       *os.File
+	blockSize int
+}
+
+// Serve answers requests from r on w until r is closed. Files being received
+// when the session ends are discarded.
+func Serve(r io.Reader, w io.Writer) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	s := &server{version: 1, home: home, partial: map[string]*os.File{}, patches: map[string]*patchState{}}
+	defer s.discardPartial()
+	for {
+		var req Request
+		if err := readFrame(r, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		resp, err := s.handle(req)
+		if err != nil {
+			resp = Response{Error: err.Error(), NotExist: errors.Is(err, fs.ErrNotExist)}
+		}
+		if err := writeFrame(w, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	// like ssh and rsync, relative paths start at the home directory
+	return filepath.Join(s.home, p)
+}
+
+func (s *server) handle(req Request) (Response, error) {
+	p := s.resolve(req.Path)
+	switch req.Op {
+	case OpSignature, OpPatch, OpDelta:
+		if s.version < DeltaVersion {
+			return Response{}, fmt.Errorf("%s needs protocol version %d, the session speaks %d (start it with %s)", req.Op, DeltaVersion, s.version, OpHello)
+		}
+	}
+	switch req.Op {
+	case OpHello:
+		v := negotiate(req.MinVersion, req.Version)
+		if v != 0 {
+			s.version = v
+		}
+		return Response{Hello: &Hello{
+			Version:    v,
+			MinVersion: MinProtocolVersion,
+			MaxVersion: ProtocolVersion,
+			Build:      Build,
+			OS:         runtime.GOOS,
+			Arch:       runtime.GOARCH,
+		}}, nil
+	case OpList:
+		files, err := list(p, req.Exclude)
+		return Response{Files: files}, err
+	case OpStat:
+		info, err := os.Stat(p)
+		if err != nil {
+			return Response{}, err
+		}
+		f := fileInfo(filepath.Base(p), info)
+		return Response{File: &f}, nil
+	case OpHash:
+		sum, err := hashFile(p)
+		return Response{Hash: sum}, err
+	case OpSend:
+		return Response{}, s.receive(p, req)
+	case OpGet:
+		return readChunk(p, req.Offset)
+	case OpDelete:
+		return Response{}, os.Remove(p)
+	case OpSignature:
+		return signature(p)
+	case OpPatch:
+		return Response{}, s.patch(p, req)
+	case OpDelta:
+		return writeDelta(p, req)
+	}
+	return Response{}, fmt.Errorf("unknown operation %q", req.Op)
+}
+
+// list walks root and returns everything below it that isn't excluded. A
+// missing root is an empty tree, so a first push can create it.
+func list(root string, exclude []string) ([]File, error) {
+	m, err := rsync.NewMatcher(exclude)
+	if err != nil {
+		return nil, err
+	}
+	files := []File{}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if m.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, fileInfo(rel, info))
+		return nil
+	})
+	return files, err
+}
+
+func fileInfo(rel string, info fs.FileInfo) File {
+	return File{Path: rel, Size: info.Size(), ModTime: info.ModTime().UTC(), Mode: info.Mode().Perm(), Dir: info.IsDir()}
+}
+
+// receive appends a chunk to the temporary file next to p and moves it into
+// place after the last one, so readers never see a half-written file.
+func (s *server) receive(p string, req Request) error {
+	f := s.partial[p]
+	if req.Offset == 0 {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		var err error
+		f, err = os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".belterlink-*")
+		if err != nil {
+			return err
+		}
+		s.partial[p] = f
+	}
+	if f == nil {
+		return fmt.Errorf("%s: chunk at offset %d without a start", p, req.Offset)
+	}
+	if _, err := f.WriteAt(req.Data, req.Offset); err != nil {
+		return err
+	}
+	if !req.Done {
+		return nil
+	}
+	delete(s.partial, p)
+	err := finish(f, p, req.Mode, req.ModTime)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// finish closes a fully written temporary file and renames it to p.
+func finish(f *os.File, p string, mode fs.FileMode, mtime time.Time) error {
+	if mode == 0 {
+		mode = 0o644
+	}
+	err := errors.Join(f.Chmod(mode), f.Close())
+	if err == nil && !mtime.IsZero() {
+		err = os.Chtimes(f.Name(), mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	return err
+}
+
+func (s *server) discardPartial() {
+	for _, f := range s.partial {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	for _, ps := range s.patches {
+		ps.old.Close()
+		ps.tmp.Close()
+		os.Remove(ps.tmp.Name())
+	}
+}
+
+func signature(p string) (Response, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Response{}, err
+	}
+	bs := BlockSize(info.Size())
+	sigs, err := Signature(f, bs)
+	return Response{BlockSize: bs, Sigs: sigs}, err
+}
+
+// patch applies a batch of ops to the temporary copy of p, reading reused
+// blocks from the current p, and moves it into place after the last batch.
+func (s *server) patch(p string, req Request) error {
+	ps := s.patches[p]
+	if req.Start {
+		if ps != nil {
+			ps.old.Close()
+			ps.tmp.Close()
+			os.Remove(ps.tmp.Name())
+		}
+		old, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".belterlink-*")
+		if err != nil {
+			old.Close()
+			return err
+		}
+		ps = &patchState{old: old, tmp: tmp, blockSize: req.BlockSize}
+		s.patches[p] = ps
+	}
+	if ps == nil {
+		return fmt.Errorf("%s: patch without a start", p)
+	}
+	err := Patch(ps.old, ps.blockSize, req.Ops, ps.tmp)
+	if err == nil && !req.Done {
+		return nil
+	}
+	delete(s.patches, p)
+	ps.old.Close()
+	if err == nil {
+		err = finish(ps.tmp, p, req.Mode, req.ModTime)
+	} else {
+		ps.tmp.Close()
+	}
+	if err != nil {
+		os.Remove(ps.tmp.Name())
+	}
+	return err
+}
+
+// writeDelta computes the ops rebuilding p from the client's signature and
+// stores them, framed, in a temporary file the client fetches with get.
+func writeDelta(p string, req Request) (Response, error) {
+	if req.BlockSize <= 0 {
+		return Response{}, errors.New("delta needs a block size")
+	}
+	src, err := os.Open(p)
+	if err != nil {
+		return Response{}, err
+	}
+	defer src.Close()
+	out, err := os.CreateTemp("", "belterlink-delta-*")
+	if err != nil {
+		return Response{}, err
+	}
+	w := bufio.NewWriter(out)
+	err = Delta(req.Sigs, req.BlockSize, src, func(op Op) error { return writeFrame(w, op) })
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return Response{}, err
+	}
+	return Response{DeltaPath: out.Name()}, nil
+}
+
+func readChunk(p string, offset int64) (Response, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Response{}, err
+	}
+	defer f.Close()
+	buf := make([]byte, ChunkSize)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Response{}, err
+	}
+	return Response{Data: buf[:n], EOF: n < ChunkSize}, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EncryptedExt marks a config file encrypted with age
+// (https://age-encryption.org), e.g. config.yaml.age. It is decrypted in
+// memory when the config is loaded; the plaintext never touches the disk.
+const EncryptedExt = ".age"
+
+// IsEncrypted reports whether path is an age-encrypted config file.
+func IsEncrypted(path string) bool {
+	return strings.HasSuffix(path, EncryptedExt)
+}
+
+// ageIdentity says where age gets the identity (private key) from:
+// $BELTERLINK_AGE_IDENTITY_COMMAND prints it, e.g. from the keychain, or
+// $BELTERLINK_AGE_IDENTITY or ~/.belterlink/age-identity.txt hold it. With
+// neither, age asks for the passphrase of a passphrase-encrypted file.
+func ageIdentity() (file, command string) {
+	if c := os.Getenv("BELTERLINK_AGE_IDENTITY_COMMAND"); c != "" {
+		return "-", c
+	}
+	if f := os.Getenv("BELTERLINK_AGE_IDENTITY"); f != "" {
+		return f, ""
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		f := filepath.Join(home, ".belterlink", "age-identity.txt")
+		if _, err := os.Stat(f); err == nil {
+			return f, ""
+		}
+	}
+	return "", ""
+}
+
+// decrypted keeps decrypted files for the rest of the process, so loading
+// the config twice doesn't ask for a passphrase twice.
+var decrypted = struct {
+	sync.Mutex
+	files map[string][]byte
+}{files: map[string][]byte{}}
+
+// decryptConfig runs age --decrypt on an encrypted config file.
+func decryptConfig(path string) ([]byte, error) {
+	decrypted.Lock()
+	defer decrypted.Unlock()
+	if b, ok := decrypted.files[path]; ok {
+		return b, nil
+	}
+	args := []string{"--decrypt"}
+	identity, command := ageIdentity()
+	if identity != "" {
+		args = append(args, "--identity", identity)
+	}
+	cmd := exec.Command("age", append(args, path)...)
+	if command != "" {
+		key, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: BELTERLINK_AGE_IDENTITY_COMMAND: %w", path, err)
+		}
+		cmd.Stdin = bytes.NewReader(key)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s: decrypting needs age (https://age-encryption.org) on PATH", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: age --decrypt: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	decrypted.files[path] = out
+	return out, nil
+}
@@ -0,0 +1,1440 @@
+// Package config loads and validates belterlink's configuration, written in
+// YAML, TOML or JSON.
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/plugin"
+	"gopkg.in/yaml.v3"
+)
+
+type SSH struct {
+	User string `yaml:"user"`
+	Host string `yaml:"host"` // hostname or IP (e.g., mymac.local)
+	// Addresses to try in order, e.g. the LAN IP, then a Tailscale name, then
+	// a public one; each run connects to the first that answers. host, if
+	// also set, is tried first.
+	Addresses []string `yaml:"addresses,omitempty"`
+	Port      int      `yaml:"port,omitempty"` // default 22
+	Key       string   `yaml:"key,omitempty"`  // path to private key (optional)
+
+	KeyPassphrase string `yaml:"key_passphrase,omitempty"` // secret:<name> for key's passphrase, given to ssh through SSH_ASKPASS
+
+	KnownHosts   string `yaml:"known_hosts,omitempty"`    // host keys file (default ~/.ssh/known_hosts); ~ and $VARS are expanded
+	HostKeyCheck string `yaml:"host_key_check,omitempty"` // strict (known keys only) or tofu (confirm a new host's fingerprint once); default: ssh's own setting
+	HostKeyAlias string `yaml:"host_key_alias,omitempty"` // name the host's keys are under in known_hosts (default with addresses: host, else the first address)
+
+	// Connection multiplexing: one master connection is kept open and reused
+	// by later rsync/ssh invocations, skipping the handshake and auth each time.
+	Multiplex      bool   `yaml:"multiplex,omitempty"`
+	ControlPath    string `yaml:"control_path,omitempty"`    // default ~/.belterlink/cm-%C
+	ControlPersist string `yaml:"control_persist,omitempty"` // how long an idle master stays open (default 60s)
+
+	AgentCommand string `yaml:"agent_command,omitempty"` // remote command for transport: agent (default "belterlink agent")
+
+	ConnectTimeout string `yaml:"connect_timeout,omitempty"` // give up connecting after this long, e.g. 10s (ssh ConnectTimeout)
+
+	Profile string `yaml:"profile,omitempty"` // what the remote is, when it needs other settings: termux (Android)
+}
+
+// Profile is what a kind of remote needs from belterlink's settings; the
+// config can still override each of them.
+type Profile struct {
+	Port         int    // ssh port when ssh.port isn't set
+	NoHardLinks  bool   // the storage can't hold hard links, so rsync doesn't try (no -H)
+	NoOwnership  bool   // perms and owner default to false
+	ModifyWindow int    // default modify_window
+	Symlinks     string // default symlinks
+}
+
+// Profiles are the kinds of remote ssh.profile can name.
+var Profiles = map[string]Profile{
+	// sshd on an Android phone: a non-root user on FAT-like storage under
+	// /sdcard, which keeps neither permissions, owners, hard links nor
+	// symlinks and stores mtimes in 2 second steps
+	"termux": {Port: 8022, NoHardLinks: true, NoOwnership: true, ModifyWindow: 2, Symlinks: "skip"},
+}
+
+// RemoteProfile returns the profile of cfg's remote, or the zero Profile.
+func RemoteProfile(cfg *Config) Profile {
+	return Profiles[cfg.SSH.Profile]
+}
+
+type Category struct {
+	Local   string   `yaml:"local"`             // absolute path recommended; ~ and $VARS are expanded
+	Remote  string   `yaml:"remote"`            // absolute path on remote; ~/ is the remote home
+	Exclude []string `yaml:"exclude,omitempty"` // extra excludes for this category
+	Extends string   `yaml:"extends,omitempty"` // name of a template in templates: whose settings this category starts from
+
+	DefaultDirection string `yaml:"default_direction,omitempty"` // push, pull, sync or backup: what "belterlink <Category>" does without a direction
+	Mode             string `yaml:"mode,omitempty"`              // archive-append: only ever add new files to the receiving side
+	ReadonlyRemote   bool   `yaml:"readonly_remote,omitempty"`   // refuse to push, sync or back up: nothing is ever written to the remote
+	ReadonlyLocal    bool   `yaml:"readonly_local,omitempty"`    // refuse to pull or sync: nothing is ever written to the local path
+
+	UseGitignore bool `yaml:"use_gitignore,omitempty"` // also exclude what the tree's .gitignore files ignore
+
+	CreateRemote bool   `yaml:"create_remote,omitempty"` // mkdir -p the remote path before pushing
+	Compress     string `yaml:"compress,omitempty"`      // true, false or auto (overrides defaults.compress)
+	Resume       *bool  `yaml:"resume,omitempty"`        // keep partial files so interrupted transfers resume (overrides defaults.resume)
+	MaxDelete    *int   `yaml:"max_delete,omitempty"`    // confirm when a deleting run would remove more files (overrides defaults.max_delete)
+	VerifyAfter  *bool  `yaml:"verify_after,omitempty"`  // checksum both sides after the transfer (overrides defaults.verify_after)
+	CheckSpace   *bool  `yaml:"check_space,omitempty"`   // make sure a push fits on the remote (overrides defaults.check_space)
+	Git          bool   `yaml:"git,omitempty"`           // commit the local path before pushing and after pulling
+	SyncGit      bool   `yaml:"sync_git,omitempty"`      // transfer .git too (excluded by default)
+	Merge        string `yaml:"merge,omitempty"`         // markdown: three-way merge notes changed on both sides (sync only)
+	Conflict     string `yaml:"conflict,omitempty"`      // files changed on both sides (sync only): newer-wins, local-wins, remote-wins, keep-both or abort
+
+	PropagateDeletions bool `yaml:"propagate_deletions,omitempty"` // sync deletes files deleted on the other side since the last sync
+
+	CaseCollisions string `yaml:"case_collisions,omitempty"` // warn (default), fail or ignore (overrides defaults.case_collisions)
+
+	PreserveXattrs   *bool `yaml:"preserve_xattrs,omitempty"`   // keep extended attributes and ACLs (overrides defaults.preserve_xattrs)
+	NormalizeUnicode *bool `yaml:"normalize_unicode,omitempty"` // convert file names between macOS NFD and NFC (overrides defaults.normalize_unicode)
+
+	Symlinks string `yaml:"symlinks,omitempty"` // preserve (default), follow, skip or safe
+	ICloud   string `yaml:"icloud,omitempty"`   // placeholders of evicted iCloud files on pull: warn, download or off
+
+	Chmod      string `yaml:"chmod,omitempty"`       // rsync --chmod, e.g. Du=rwx,go=rx,Fu=rw,go=r (overrides defaults.chmod)
+	Chown      string `yaml:"chown,omitempty"`       // rsync --chown user:group (overrides defaults.chown)
+	NumericIDs *bool  `yaml:"numeric_ids,omitempty"` // overrides defaults.numeric_ids
+	Perms      *bool  `yaml:"perms,omitempty"`       // overrides defaults.perms
+	Owner      *bool  `yaml:"owner,omitempty"`       // overrides defaults.owner
+
+	Sparse    *bool  `yaml:"sparse,omitempty"`     // overrides defaults.sparse
+	WholeFile string `yaml:"whole_file,omitempty"` // true, false or auto (overrides defaults.whole_file)
+	Inplace   bool   `yaml:"inplace,omitempty"`    // write into the destination file directly; see the README before using it
+	TempDir   string `yaml:"temp_dir,omitempty"`   // rsync --temp-dir on the receiving side (overrides defaults.temp_dir)
+
+	ModifyWindow *int `yaml:"modify_window,omitempty"` // overrides defaults.modify_window
+
+	DetectRenames *bool `yaml:"detect_renames,omitempty"` // overrides defaults.detect_renames
+	AtomicPull    bool  `yaml:"atomic_pull,omitempty"`    // pull into a staging copy and swap it in only once the pull succeeded
+	Backup        *bool `yaml:"backup,omitempty"`         // keep what the last run replaced or deleted, for undo (overrides defaults.backup)
+
+	Transport string `yaml:"transport,omitempty"` // rsync (default) or agent: belterlink's own engine, for remotes without rsync
+
+	Encrypted     bool   `yaml:"encrypted,omitempty"`      // encrypt contents and names before pushing; the remote only ever stores ciphertext
+	EncryptionKey string `yaml:"encryption_key,omitempty"` // key file for encrypted: a passphrase or random key, the same on every machine
+
+	SyncWindow string   `yaml:"sync_window,omitempty"` // daemon runs only in this daily window, e.g. "22:00-07:00"
+	NotOn      []string `yaml:"not_on,omitempty"`      // daemon skips runs on these connections: metered
+	Scrub      string   `yaml:"scrub,omitempty"`       // daemon compares both sides by checksum this often: daily, weekly, monthly or e.g. 72h
+
+	RsyncArgs []string `yaml:"rsync_args,omitempty"` // extra rsync options, after defaults.rsync_args and belterlink's own
+
+	Backend        string            `yaml:"backend,omitempty"`         // transfer with the belterlink-backend-<name> plugin instead of rsync
+	BackendOptions map[string]string `yaml:"backend_options,omitempty"` // passed to the backend plugin as-is
+
+	MaxSize        string   `yaml:"max_size,omitempty"`        // skip files larger than this (rsync --max-size, e.g. 100M)
+	MinSize        string   `yaml:"min_size,omitempty"`        // skip files smaller than this (rsync --min-size)
+	OnlyExtensions []string `yaml:"only_extensions,omitempty"` // transfer only files with these extensions, e.g. [md, png]
+
+	Anchor            string `yaml:"anchor,omitempty"`             // relative path that must exist in the source before syncing
+	AnchorDestination bool   `yaml:"anchor_destination,omitempty"` // require the anchor in the destination too
+
+	RunTimeout string `yaml:"run_timeout,omitempty"` // overrides defaults.run_timeout
+
+	LowPriority *bool `yaml:"low_priority,omitempty"` // overrides defaults.low_priority
+
+	// Remote-to-remote: local is a path on from_host instead of this machine,
+	// and remote one on to_host instead of ssh.host; both [user@]host[:port].
+	FromHost string `yaml:"from_host,omitempty"`
+	ToHost   string `yaml:"to_host,omitempty"`
+	Relay    string `yaml:"relay,omitempty"` // local (default): through a copy on this machine; direct: from_host runs rsync to to_host itself
+
+	PasswordFile string `yaml:"password_file,omitempty"` // for an rsync:// remote: file with the module's password (rsync --password-file)
+
+	// A share mounted on this machine (SMB, NFS) as the destination: remote is
+	// then a path inside the mountpoint, and the share must be mounted there.
+	Mount        string `yaml:"mount,omitempty"`
+	MountCommand string `yaml:"mount_command,omitempty"` // run through sh when mount isn't mounted, e.g. "mount /mnt/nas"
+
+	// A removable drive as the destination, named by its filesystem's
+	// UUID=... or LABEL=...: remote is a path on it, wherever it's mounted.
+	Drive string `yaml:"drive,omitempty"`
+
+	// Rewrite matching files before a push, in a copy of the local tree, so
+	// the remote's copy differs from the working copy (see Transform).
+	Transforms []Transform `yaml:"transforms,omitempty"`
+}
+
+// Transform is a command run on each local file that matches before it's
+// pushed: through sh, with $IN the local file and $OUT the file to write for
+// the remote. With alongside, the original is pushed unchanged and the output
+// goes next to it, under its name plus that suffix.
+type Transform struct {
+	Match     []string `yaml:"match"`               // exclude-style patterns, e.g. "*.jpg"
+	Command   string   `yaml:"command"`             // e.g. exiftool -all= -o "$OUT" "$IN"
+	Alongside string   `yaml:"alongside,omitempty"` // e.g. .svg: Drawing.excalidraw gets a Drawing.excalidraw.svg
+}
+
+type Defaults struct {
+	Delete      *bool  `yaml:"delete,omitempty"`       // mirror deletions
+	Checksum    *bool  `yaml:"checksum,omitempty"`     // compare by checksum (slower, safer)
+	Verbose     *bool  `yaml:"verbose,omitempty"`      // rsync -v
+	Compress    string `yaml:"compress,omitempty"`     // true, false or auto (compress only for non-LAN hosts)
+	Resume      *bool  `yaml:"resume,omitempty"`       // --partial into .belterlink-partial
+	Retries     *int   `yaml:"retries,omitempty"`      // re-run rsync this many times on transient failures
+	MaxDelete   *int   `yaml:"max_delete,omitempty"`   // deletions allowed without confirmation (0: no limit)
+	VerifyAfter *bool  `yaml:"verify_after,omitempty"` // rerun a checksum dry run after the transfer; fail on leftovers
+	CheckSpace  *bool  `yaml:"check_space,omitempty"`  // dry-run a push and compare its size with the remote's free space (default false)
+	// names that would be one file on a case-insensitive destination, or
+	// reserved on a Windows filesystem: warn (default), fail or ignore
+	CaseCollisions string `yaml:"case_collisions,omitempty"`
+
+	PreserveXattrs   *bool `yaml:"preserve_xattrs,omitempty"`   // rsync -X -A (and --crtimes where both ends support it)
+	NormalizeUnicode *bool `yaml:"normalize_unicode,omitempty"` // rsync --iconv=utf-8-mac,utf-8 when exactly one side is a Mac
+
+	Chmod      string `yaml:"chmod,omitempty"`       // rsync --chmod applied to every transferred file
+	Chown      string `yaml:"chown,omitempty"`       // rsync --chown: owner and group on the receiving side
+	NumericIDs *bool  `yaml:"numeric_ids,omitempty"` // rsync --numeric-ids: keep uids/gids instead of mapping names
+	Perms      *bool  `yaml:"perms,omitempty"`       // false: --no-perms, new files get the receiver's default permissions
+	Owner      *bool  `yaml:"owner,omitempty"`       // false: --no-owner --no-group, files belong to the receiving user
+
+	Sparse    *bool  `yaml:"sparse,omitempty"`     // rsync --sparse: keep holes in VM images and database files
+	WholeFile string `yaml:"whole_file,omitempty"` // true (--whole-file), false (delta transfer) or auto (whole files for LAN hosts)
+	TempDir   string `yaml:"temp_dir,omitempty"`   // rsync --temp-dir: where the receiver builds files before renaming them into place
+
+	ModifyWindow *int `yaml:"modify_window,omitempty"` // rsync --modify-window: seconds mtimes may differ by, e.g. 2 for FAT and exFAT
+
+	DetectRenames *bool `yaml:"detect_renames,omitempty"` // move renamed files on the remote before a push instead of sending them again (plus rsync --fuzzy)
+	Backup        *bool `yaml:"backup,omitempty"`         // rsync --backup into .belterlink-backup/<run ID> on the receiving side, for belterlink undo
+
+	RunTimeout string `yaml:"run_timeout,omitempty"` // stop a run that takes longer than this, e.g. 2h; also rsync --timeout
+
+	LowPriority *bool `yaml:"low_priority,omitempty"` // run rsync with nice, ionice and a --bwlimit, so it doesn't slow the machine down
+
+	SnapshotsDir string `yaml:"snapshots_dir,omitempty"` // remote directory of the backup direction's dated snapshots (default backups)
+
+	MaxClockSkew    *int   `yaml:"max_clock_skew,omitempty"`    // seconds of local/remote drift tolerated (default 5, 0 disables)
+	ClockSkewAction string `yaml:"clock_skew_action,omitempty"` // warn (default) or abort
+
+	RsyncArgs []string `yaml:"rsync_args,omitempty"` // extra rsync options for every category, e.g. [--iconv=utf-8-mac,utf-8]
+}
+
+type Config struct {
+	SSH        SSH                 `yaml:"ssh"`
+	Categories map[string]Category `yaml:"categories"`
+	Templates  map[string]Category `yaml:"templates,omitempty"` // shared settings categories extend; never synced themselves
+	Groups     map[string][]string `yaml:"groups,omitempty"`    // name -> member categories (or globs)
+	Defaults   Defaults            `yaml:"defaults,omitempty"`
+	Notify     Notify              `yaml:"notify,omitempty"`
+	Metrics    Metrics             `yaml:"metrics,omitempty"`
+	StateDir   string              `yaml:"state_dir,omitempty"`    // default ~/.belterlink/state
+	LastRunDir string              `yaml:"last_run_dir,omitempty"` // <Category>.json with each category's last result (default <state_dir>/last)
+	Log        Log                 `yaml:"log,omitempty"`
+	Audit      Audit               `yaml:"audit,omitempty"`
+	Vars       map[string]any      `yaml:"vars,omitempty"` // values for {{ .name }} templates in other fields
+	Topology   Topology            `yaml:"topology,omitempty"`
+	Daemon     Daemon              `yaml:"daemon,omitempty"`
+	Rsync      Rsync               `yaml:"rsync,omitempty"`
+	Secrets    map[string]Secret   `yaml:"secrets,omitempty"` // name -> where to look it up, for secret:<name> values
+}
+
+// Rsync locates the rsync binaries, e.g. homebrew's rsync 3.x on macOS, whose
+// system rsync 2.6.9 lacks many newer options.
+type Rsync struct {
+	Path       string `yaml:"path,omitempty"`        // local rsync (default: rsync from PATH); ~ and $VARS are expanded
+	RemotePath string `yaml:"remote_path,omitempty"` // rsync on the remote, passed as --rsync-path
+}
+
+// Daemon configures "belterlink daemon": scheduled runs plus a control API
+// on a Unix socket.
+type Daemon struct {
+	Socket       string `yaml:"socket,omitempty"` // default ~/.belterlink/daemon.sock
+	Jobs         []Job  `yaml:"jobs,omitempty"`
+	RetryOffline *bool  `yaml:"retry_offline,omitempty"` // retry runs that couldn't reach the remote (default true)
+	MaxBackoff   string `yaml:"max_backoff,omitempty"`   // longest wait between those retries (default 15m)
+}
+
+// Job runs a category or group at a fixed interval.
+type Job struct {
+	Category  string `yaml:"category"`  // category, group or glob, as on the command line
+	Direction string `yaml:"direction"` // push, pull or sync
+	Every     string `yaml:"every"`     // interval, e.g. 15m or 1h
+}
+
+// Topology describes this machine's place in a hub-and-spoke setup: every
+// machine syncs with the hub configured under ssh, never with each other.
+type Topology struct {
+	Name       string `yaml:"name,omitempty"`        // this machine's peer name (default: hostname)
+	StaleHours int    `yaml:"stale_hours,omitempty"` // warn about peers that haven't synced for this long (default 72, -1 disables)
+}
+
+type Notify struct {
+	On      []string       `yaml:"on,omitempty"`      // events to notify about: success, failure (default: failure)
+	Desktop bool           `yaml:"desktop,omitempty"` // notify-send (Linux) / osascript (macOS)
+	Webhook *Webhook       `yaml:"webhook,omitempty"`
+	Email   *Email         `yaml:"email,omitempty"`
+	Plugins []NotifyPlugin `yaml:"plugins,omitempty"` // belterlink-notify-<name> executables on PATH
+}
+
+type NotifyPlugin struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+type Webhook struct {
+	URL     string            `yaml:"url"`               // receives a POST with the JSON run summary
+	Headers map[string]string `yaml:"headers,omitempty"` // e.g. Authorization
+}
+
+type Email struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port,omitempty"` // default 587
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Wants reports whether the configured policy covers a run with this status.
+func (n Notify) Wants(status string) bool {
+	if len(n.On) == 0 {
+		return status == "failure"
+	}
+	return slices.Contains(n.On, status)
+}
+
+type Metrics struct {
+	// Textfile is written for node_exporter's textfile collector after every
+	// non-dry run, e.g. /var/lib/node_exporter/textfile_collector/belterlink.prom.
+	Textfile string `yaml:"textfile,omitempty"`
+}
+
+// Audit configures the audit log: every file a run deletes or overwrites,
+// kept apart from the normal log and never rotated. It's off unless enabled,
+// as it costs each run an extra dry run.
+type Audit struct {
+	Path   string `yaml:"path,omitempty"` // default <state_dir>/audit.log
+	Enable bool   `yaml:"enable,omitempty"`
+}
+
+type Log struct {
+	Dir        string `yaml:"dir,omitempty"`          // default ~/.belterlink/logs
+	Format     string `yaml:"format,omitempty"`       // text (default) or json
+	Level      string `yaml:"level,omitempty"`        // debug, info (default), warn, error
+	MaxSizeMB  int    `yaml:"max_size_mb,omitempty"`  // rotate when the log grows past this (default 10)
+	MaxAgeDays int    `yaml:"max_age_days,omitempty"` // delete rotated logs older than this (default 30)
+	Disable    bool   `yaml:"disable,omitempty"`
+}
+
+// Built-in safe excludes for Obsidian/macOS; users can add more in category
+var BuiltinExcludes = []string{
+	".DS_Store",
+	"._*",
+	".Trash*",
+	".obsidian/cache",
+	".git",
+	"*.icloud", // iCloud placeholders
+}
+
+// CategoryExcludes returns the built-in excludes followed by the category's
+// own; sync_git lets .git through.
+func CategoryExcludes(cat Category) []string {
+	excludes := slices.Clone(BuiltinExcludes)
+	if cat.SyncGit {
+		excludes = slices.DeleteFunc(excludes, func(e string) bool { return e == ".git" })
+	}
+	return append(excludes, cat.Exclude...)
+}
+
+// NormalizeExtension accepts "md", ".md" and "*.md".
+func NormalizeExtension(ext string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(ext, "*"), ".")
+}
+
+func DefaultPath() string {
+	if p := os.Getenv(EnvPrefix + "CONFIG"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "./config.yaml"
+	}
+	// the first that exists, YAML first and each before its encrypted form
+	dir := filepath.Join(home, ".belterlink")
+	for _, name := range []string{"config.yaml", "config.toml", "config.json"} {
+		for _, p := range []string{filepath.Join(dir, name), filepath.Join(dir, name) + EncryptedExt} {
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// StateDir is where belterlink keeps data between runs.
+func StateDir(cfg *Config) string {
+	if cfg.StateDir != "" {
+		return cfg.StateDir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".belterlink-state"
+	}
+	return filepath.Join(home, ".belterlink", "state")
+}
+
+// HostSSH returns the ssh settings for another host, given as
+// [user@]host[:port] as in from_host and to_host: base's, with the user
+// unless spec names one, but without base's addresses and host key alias.
+func HostSSH(base SSH, spec string) (SSH, error) {
+	s := base
+	s.Addresses, s.HostKeyAlias, s.Port = nil, "", 22
+	host := spec
+	if user, rest, ok := strings.Cut(spec, "@"); ok {
+		s.User, host = user, rest
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return SSH{}, fmt.Errorf("invalid port in %q", spec)
+		}
+		host, s.Port = h, n
+	}
+	s.Host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if s.User == "" || s.Host == "" || strings.ContainsAny(s.Host, "@/ ") {
+		return SSH{}, fmt.Errorf("invalid host %q (want [user@]host[:port])", spec)
+	}
+	return s, nil
+}
+
+// RunTimeout is how long a run of cat may take, or 0 for no limit.
+func RunTimeout(cfg *Config, cat Category) time.Duration {
+	d, _ := time.ParseDuration(cmp.Or(cat.RunTimeout, cfg.Defaults.RunTimeout)) // validated by Load
+	return d
+}
+
+// scrubIntervals are the names scrub takes besides durations.
+var scrubIntervals = map[string]time.Duration{"daily": 24 * time.Hour, "weekly": 7 * 24 * time.Hour, "monthly": 30 * 24 * time.Hour}
+
+// ScrubInterval is how often the daemon scrubs cat, or 0 if it doesn't.
+func ScrubInterval(cat Category) time.Duration {
+	if d, ok := scrubIntervals[cat.Scrub]; ok {
+		return d
+	}
+	d, _ := time.ParseDuration(cat.Scrub) // validated by Load
+	return d
+}
+
+func checkRunTimeout(where, timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(timeout); err != nil || d <= 0 {
+		return fmt.Errorf("%s: invalid run_timeout %q (e.g. 30m or 2h)", where, timeout)
+	}
+	return nil
+}
+
+func GetBool(cli bool, def *bool, fallback bool) bool {
+	// If user passed CLI true, honor it; if false + def is set, use def; else fallback
+	if cli {
+		return true
+	}
+	if def != nil {
+		return *def
+	}
+	return fallback
+}
+
+// rsyncSize matches the sizes rsync's --max-size and --min-size accept.
+var rsyncSize = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([KMGTPkmgtp][iI]?)?[bB]?([+-]1)?$`)
+
+func Load(path string) (*Config, error) {
+	seen := map[string]bool{}
+	raw, err := loadConfigTree(path, seen)
+	if err != nil {
+		return nil, err
+	}
+	// drop-in files, e.g. categories generated by other tooling
+	confd := filepath.Join(filepath.Dir(path), "conf.d")
+	var dropins []string
+	for _, exts := range formats {
+		for _, ext := range exts {
+			for _, pattern := range []string{"*" + ext, "*" + ext + EncryptedExt} {
+				matches, _ := filepath.Glob(filepath.Join(confd, pattern))
+				dropins = append(dropins, matches...)
+			}
+		}
+	}
+	slices.Sort(dropins)
+	for _, p := range dropins {
+		m, err := loadConfigTree(p, seen)
+		if err != nil {
+			return nil, err
+		}
+		mergeMaps(raw, m)
+	}
+	// machine-specific overrides (config.local.yaml next to config.yaml) go last
+	localPath := localOverridePath(path)
+	if _, err := os.Stat(localPath); err == nil {
+		local, err := loadConfigTree(localPath, seen)
+		if err != nil {
+			return nil, err
+		}
+		mergeMaps(raw, local)
+	}
+	// and BELTERLINK_* environment variables over everything
+	if err := applyEnv(raw, os.Environ()); err != nil {
+		return nil, err
+	}
+	// and -set over that
+	if err := applyOverrides(raw, true); err != nil {
+		return nil, err
+	}
+	vars, _ := raw["vars"].(map[string]any)
+	if err := renderTemplates(raw, vars); err != nil {
+		return nil, err
+	}
+	if err := applyExtends(raw); err != nil {
+		return nil, err
+	}
+	if err := applyOverrides(raw, false); err != nil {
+		return nil, err
+	}
+
+	// round-trip through YAML to decode the merged tree into the typed config
+	b, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if _, ok := Profiles[cfg.SSH.Profile]; !ok && cfg.SSH.Profile != "" {
+		return nil, fmt.Errorf("ssh: invalid profile %q (want termux)", cfg.SSH.Profile)
+	}
+	if cfg.SSH.Port == 0 {
+		cfg.SSH.Port = cmp.Or(RemoteProfile(&cfg).Port, 22)
+	}
+	if slices.Contains(cfg.SSH.Addresses, "") {
+		return nil, errors.New("ssh: addresses has an empty entry")
+	}
+	if len(cfg.SSH.Addresses) > 0 {
+		// one known_hosts entry for the host, whichever address is used
+		if cfg.SSH.Host != "" {
+			cfg.SSH.Addresses = slices.Insert(slices.DeleteFunc(cfg.SSH.Addresses, func(a string) bool { return a == cfg.SSH.Host }), 0, cfg.SSH.Host)
+		}
+		cfg.SSH.Host = cfg.SSH.Addresses[0]
+		if cfg.SSH.HostKeyAlias == "" {
+			cfg.SSH.HostKeyAlias = cfg.SSH.Host
+		}
+	}
+	if cfg.Categories == nil || len(cfg.Categories) == 0 {
+		return nil, errors.New("no categories defined")
+	}
+	for g, members := range cfg.Groups {
+		if _, clash := cfg.Categories[g]; clash {
+			return nil, fmt.Errorf("group %q has the same name as a category", g)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("group %q has no members", g)
+		}
+	}
+	if err := checkRsyncArgs("defaults.rsync_args", cfg.Defaults.RsyncArgs); err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"", "strict", "tofu"}, cfg.SSH.HostKeyCheck) {
+		return nil, fmt.Errorf("ssh: invalid host_key_check %q (want strict or tofu)", cfg.SSH.HostKeyCheck)
+	}
+	if cfg.SSH.ConnectTimeout != "" {
+		if d, err := time.ParseDuration(cfg.SSH.ConnectTimeout); err != nil || d < time.Second {
+			return nil, fmt.Errorf("ssh: invalid connect_timeout %q (e.g. 10s, at least 1s)", cfg.SSH.ConnectTimeout)
+		}
+	}
+	if err := checkRunTimeout("defaults", cfg.Defaults.RunTimeout); err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"", "fail", "warn", "ignore"}, cfg.Defaults.CaseCollisions) {
+		return nil, fmt.Errorf("defaults: invalid case_collisions %q (want fail, warn or ignore)", cfg.Defaults.CaseCollisions)
+	}
+	if w := cfg.Defaults.ModifyWindow; w != nil && *w < 0 {
+		return nil, fmt.Errorf("defaults: invalid modify_window %d (want seconds, 0 or more)", *w)
+	}
+	if cfg.Defaults.Chmod != "" && !rsyncChmod.MatchString(cfg.Defaults.Chmod) {
+		return nil, fmt.Errorf("defaults: invalid chmod %q (e.g. Du=rwx,go=rx,Fu=rw,go=r or D755,F644)", cfg.Defaults.Chmod)
+	}
+	if cfg.Defaults.Chown != "" && !rsyncChown.MatchString(cfg.Defaults.Chown) {
+		return nil, fmt.Errorf("defaults: invalid chown %q (want user, user:group or :group)", cfg.Defaults.Chown)
+	}
+	for name, cat := range cfg.Categories {
+		if err := checkRsyncArgs(fmt.Sprintf("category %q: rsync_args", name), cat.RsyncArgs); err != nil {
+			return nil, err
+		}
+		if err := checkRunTimeout(fmt.Sprintf("category %q", name), cat.RunTimeout); err != nil {
+			return nil, err
+		}
+		if cat.Anchor != "" && (filepath.IsAbs(cat.Anchor) || !filepath.IsLocal(cat.Anchor)) {
+			return nil, fmt.Errorf("category %q: anchor must be a path inside the category, got %q", name, cat.Anchor)
+		}
+		for _, size := range []string{cat.MaxSize, cat.MinSize} {
+			if size != "" && !rsyncSize.MatchString(size) {
+				return nil, fmt.Errorf("category %q: invalid size %q (e.g. 500K, 100M, 1.5G)", name, size)
+			}
+		}
+		if w := cat.ModifyWindow; w != nil && *w < 0 {
+			return nil, fmt.Errorf("category %q: invalid modify_window %d (want seconds, 0 or more)", name, *w)
+		}
+		if cat.Chmod != "" && !rsyncChmod.MatchString(cat.Chmod) {
+			return nil, fmt.Errorf("category %q: invalid chmod %q (e.g. Du=rwx,go=rx,Fu=rw,go=r or D755,F644)", name, cat.Chmod)
+		}
+		if cat.Chown != "" && !rsyncChown.MatchString(cat.Chown) {
+			return nil, fmt.Errorf("category %q: invalid chown %q (want user, user:group or :group)", name, cat.Chown)
+		}
+		if cat.Inplace && GetBool(false, cat.Resume, GetBool(false, cfg.Defaults.Resume, false)) {
+			return nil, fmt.Errorf("category %q: inplace can't be combined with resume (rsync's --partial-dir)", name)
+		}
+		if cat.Inplace && cat.AtomicPull {
+			return nil, fmt.Errorf("category %q: inplace writes into the files atomic_pull shares with the live tree; use one or the other", name)
+		}
+		if cat.Inplace && cat.TempDir != "" {
+			return nil, fmt.Errorf("category %q: inplace writes no temporary files; drop temp_dir", name)
+		}
+		if !slices.Contains([]string{"", "push", "pull", "sync", "backup"}, cat.DefaultDirection) {
+			return nil, fmt.Errorf("category %q: invalid default_direction %q (want push, pull, sync or backup)", name, cat.DefaultDirection)
+		}
+		if ro := ReadonlySide(cat, cat.DefaultDirection); ro != "" {
+			return nil, fmt.Errorf("category %q: default_direction %s writes where %s forbids it", name, cat.DefaultDirection, ro)
+		}
+		if !slices.Contains([]string{"", "fail", "warn", "ignore"}, cat.CaseCollisions) {
+			return nil, fmt.Errorf("category %q: invalid case_collisions %q (want fail, warn or ignore)", name, cat.CaseCollisions)
+		}
+		if _, ok := scrubIntervals[cat.Scrub]; cat.Scrub != "" && !ok {
+			if d, err := time.ParseDuration(cat.Scrub); err != nil || d < time.Hour {
+				return nil, fmt.Errorf("category %q: invalid scrub %q (daily, weekly, monthly or e.g. 72h, at least 1h)", name, cat.Scrub)
+			}
+		}
+		if !slices.Contains([]string{"", "preserve", "follow", "skip", "safe"}, cat.Symlinks) {
+			return nil, fmt.Errorf("category %q: invalid symlinks %q (want preserve, follow, skip or safe)", name, cat.Symlinks)
+		}
+		if cat.SyncWindow != "" {
+			if _, err := ParseWindow(cat.SyncWindow); err != nil {
+				return nil, fmt.Errorf("category %q: sync_window: %w", name, err)
+			}
+		}
+		for _, n := range cat.NotOn {
+			if n != "metered" {
+				return nil, fmt.Errorf("category %q: invalid not_on %q (want metered)", name, n)
+			}
+		}
+		if !slices.Contains([]string{"", "warn", "download", "off"}, cat.ICloud) {
+			return nil, fmt.Errorf("category %q: invalid icloud %q (want warn, download or off)", name, cat.ICloud)
+		}
+		if !slices.Contains([]string{"", "newer-wins", "local-wins", "remote-wins", "keep-both", "abort"}, cat.Conflict) {
+			return nil, fmt.Errorf("category %q: invalid conflict %q (want newer-wins, local-wins, remote-wins, keep-both or abort)", name, cat.Conflict)
+		}
+		if cat.Merge != "" && cat.Merge != "markdown" {
+			return nil, fmt.Errorf("category %q: invalid merge %q (want markdown)", name, cat.Merge)
+		}
+		if cat.Encrypted {
+			if cat.EncryptionKey == "" {
+				return nil, fmt.Errorf("category %q: encrypted needs encryption_key (a key file)", name)
+			}
+			var clash []string
+			for _, o := range []struct {
+				name string
+				set  bool
+			}{
+				{"merge", cat.Merge != ""},
+				{"conflict", cat.Conflict != ""},
+				{"propagate_deletions", cat.PropagateDeletions},
+				{"atomic_pull", cat.AtomicPull},
+				{"detect_renames", GetBool(false, cat.DetectRenames, false)},
+				{"backup", GetBool(false, cat.Backup, false)},
+				{"anchor", cat.Anchor != ""},
+				{"backend", cat.Backend != ""},
+				{"transforms", len(cat.Transforms) > 0},
+			} {
+				if o.set {
+					clash = append(clash, o.name)
+				}
+			}
+			if len(clash) > 0 {
+				return nil, fmt.Errorf("category %q: encrypted can't be combined with %s", name, strings.Join(clash, ", "))
+			}
+		}
+		switch cat.Transport {
+		case "", "rsync":
+		case "agent":
+			if cat.Symlinks != "" && cat.Symlinks != "skip" {
+				return nil, fmt.Errorf("category %q: transport: agent skips symlinks; symlinks: %s needs transport: rsync", name, cat.Symlinks)
+			}
+			if opts := rsyncOnlyOptions(cat); len(opts) > 0 {
+				return nil, fmt.Errorf("category %q: %s need transport: rsync", name, strings.Join(opts, ", "))
+			}
+		default:
+			return nil, fmt.Errorf("category %q: invalid transport %q (want rsync or agent)", name, cat.Transport)
+		}
+		if err := checkRemoteToRemote(cfg.SSH, cat); err != nil {
+			return nil, fmt.Errorf("category %q: %w", name, err)
+		}
+		if err := checkDaemonRemote(cat); err != nil {
+			return nil, fmt.Errorf("category %q: %w", name, err)
+		}
+		if err := checkMount(cat); err != nil {
+			return nil, fmt.Errorf("category %q: %w", name, err)
+		}
+		if err := checkTransforms(cat); err != nil {
+			return nil, fmt.Errorf("category %q: %w", name, err)
+		}
+		if err := checkArchiveAppend(cat, cfg.Defaults.RsyncArgs); err != nil {
+			return nil, fmt.Errorf("category %q: %w", name, err)
+		}
+		if cat.Backend != "" {
+			if !plugin.ValidName(cat.Backend) {
+				return nil, fmt.Errorf("category %q: invalid backend %q", name, cat.Backend)
+			}
+			if cat.Merge != "" {
+				return nil, fmt.Errorf("category %q: merge needs rsync and can't be combined with a backend", name)
+			}
+			if len(cat.Transforms) > 0 {
+				return nil, fmt.Errorf("category %q: transforms need rsync and can't be combined with a backend", name)
+			}
+		}
+	}
+	for i, job := range cfg.Daemon.Jobs {
+		if job.Category == "" {
+			return nil, fmt.Errorf("daemon.jobs[%d]: category is required", i)
+		}
+		if !slices.Contains([]string{"push", "pull", "sync", "backup"}, job.Direction) {
+			return nil, fmt.Errorf("daemon.jobs[%d]: invalid direction %q (want push, pull, sync or backup)", i, job.Direction)
+		}
+		if d, err := time.ParseDuration(job.Every); err != nil || d < time.Minute {
+			return nil, fmt.Errorf("daemon.jobs[%d]: invalid every %q (e.g. 15m, at least 1m)", i, job.Every)
+		}
+		if ro := ReadonlySide(cfg.Categories[job.Category], job.Direction); ro != "" {
+			return nil, fmt.Errorf("daemon.jobs[%d]: category %q has %s, so it can't %s", i, job.Category, ro, job.Direction)
+		}
+	}
+	if cfg.Daemon.MaxBackoff != "" {
+		if d, err := time.ParseDuration(cfg.Daemon.MaxBackoff); err != nil || d < time.Minute {
+			return nil, fmt.Errorf("daemon: invalid max_backoff %q (e.g. 15m, at least 1m)", cfg.Daemon.MaxBackoff)
+		}
+	}
+	for _, p := range cfg.Notify.Plugins {
+		if !plugin.ValidName(p.Name) {
+			return nil, fmt.Errorf("notify.plugins: invalid plugin name %q", p.Name)
+		}
+	}
+	if err := checkSecrets(&cfg); err != nil {
+		return nil, err
+	}
+	if err := expandConfigPaths(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// rsyncChmod matches rsync's --chmod syntax: comma-separated symbolic modes
+// or octal modes, each optionally limited to directories (D) or files (F).
+var rsyncChmod = regexp.MustCompile(`^[DF]?([ugoa]*[-+=][rwxXst]*|[0-7]{3,4})(,[DF]?([ugoa]*[-+=][rwxXst]*|[0-7]{3,4}))*$`)
+
+// rsyncChown matches user, user:group and :group.
+var rsyncChown = regexp.MustCompile(`^([^:\s]+(:[^:\s]+)?|:[^:\s]+)$`)
+
+// rsyncOnlyOptions lists the options set on cat that only the rsync transport
+// implements.
+func rsyncOnlyOptions(cat Category) []string {
+	var set []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"merge", cat.Merge != ""},
+		{"conflict", cat.Conflict != ""},
+		{"propagate_deletions", cat.PropagateDeletions},
+		{"only_extensions", len(cat.OnlyExtensions) > 0},
+		{"max_size", cat.MaxSize != ""},
+		{"min_size", cat.MinSize != ""},
+		{"preserve_xattrs", cat.PreserveXattrs != nil},
+		{"normalize_unicode", cat.NormalizeUnicode != nil},
+		{"rsync_args", len(cat.RsyncArgs) > 0},
+		{"chmod", cat.Chmod != ""},
+		{"chown", cat.Chown != ""},
+		{"numeric_ids", cat.NumericIDs != nil},
+		{"perms", cat.Perms != nil},
+		{"owner", cat.Owner != nil},
+		{"sparse", cat.Sparse != nil},
+		{"modify_window", cat.ModifyWindow != nil},
+		{"low_priority", cat.LowPriority != nil},
+		{"whole_file", cat.WholeFile != ""},
+		{"inplace", cat.Inplace},
+		{"check_space", cat.CheckSpace != nil},
+		{"case_collisions", cat.CaseCollisions != ""},
+		{"icloud", cat.ICloud != ""},
+		{"temp_dir", cat.TempDir != ""},
+		{"transforms", len(cat.Transforms) > 0},
+		{"mode", cat.Mode != ""},
+		{"atomic_pull", cat.AtomicPull},
+		{"detect_renames", cat.DetectRenames != nil},
+		{"encrypted", cat.Encrypted},
+		{"backup", cat.Backup != nil},
+	} {
+		if o.set {
+			set = append(set, o.name)
+		}
+	}
+	return set
+}
+
+// checkRemoteToRemote checks the hosts of a category with from_host, which
+// take the user from s unless they name one, and that it only uses what
+// works without its files on this machine.
+func checkRemoteToRemote(s SSH, cat Category) error {
+	if cat.FromHost == "" {
+		if cat.ToHost != "" || cat.Relay != "" {
+			return errors.New("to_host and relay need from_host")
+		}
+		return nil
+	}
+	for _, h := range []string{cat.FromHost, cat.ToHost} {
+		if _, err := HostSSH(s, h); h != "" && err != nil {
+			return err
+		}
+	}
+	if !slices.Contains([]string{"", "local", "direct"}, cat.Relay) {
+		return fmt.Errorf("invalid relay %q (want local or direct)", cat.Relay)
+	}
+	if cat.DefaultDirection == "sync" || cat.DefaultDirection == "backup" {
+		return fmt.Errorf("from_host only pushes and pulls, not %s", cat.DefaultDirection)
+	}
+	var clash []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"transport: agent", cat.Transport == "agent"},
+		{"backend", cat.Backend != ""},
+		{"encrypted", cat.Encrypted},
+		{"atomic_pull", cat.AtomicPull},
+		{"git", cat.Git},
+		{"use_gitignore", cat.UseGitignore},
+		{"merge", cat.Merge != ""},
+		{"conflict", cat.Conflict != ""},
+		{"propagate_deletions", cat.PropagateDeletions},
+		{"detect_renames", GetBool(false, cat.DetectRenames, false)},
+		{"backup", GetBool(false, cat.Backup, false)},
+		{"anchor", cat.Anchor != ""},
+		{"icloud", cat.ICloud != ""},
+		{"transforms", len(cat.Transforms) > 0},
+	} {
+		if o.set {
+			clash = append(clash, o.name)
+		}
+	}
+	if len(clash) > 0 {
+		return fmt.Errorf("from_host can't be combined with %s", strings.Join(clash, ", "))
+	}
+	return nil
+}
+
+// IsDaemonURL reports whether remote is an rsync://host/module/path URL, for
+// a remote that runs an rsync daemon instead of taking ssh logins.
+func IsDaemonURL(remote string) bool {
+	return strings.HasPrefix(remote, "rsync://")
+}
+
+// checkDaemonRemote checks the URL of a category with an rsync:// remote and
+// that it only uses what works without ssh.
+func checkDaemonRemote(cat Category) error {
+	if !IsDaemonURL(cat.Remote) {
+		if cat.PasswordFile != "" {
+			return errors.New("password_file needs an rsync:// remote")
+		}
+		return nil
+	}
+	u, err := url.Parse(cat.Remote)
+	if err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	if u.Hostname() == "" || strings.Trim(u.Path, "/") == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid remote %q (want rsync://[user@]host[:port]/module[/path])", cat.Remote)
+	}
+	if _, ok := u.User.Password(); ok {
+		return errors.New("remote: put the password in password_file, not the URL")
+	}
+	if cat.DefaultDirection == "sync" || cat.DefaultDirection == "backup" {
+		return fmt.Errorf("an rsync:// remote only pushes and pulls, not %s", cat.DefaultDirection)
+	}
+	clash := sshOnlyOptions(cat)
+	if cat.CreateRemote {
+		clash = append(clash, "create_remote")
+	}
+	if len(clash) > 0 {
+		return fmt.Errorf("an rsync:// remote can't be combined with %s, which need ssh", strings.Join(clash, ", "))
+	}
+	return nil
+}
+
+// checkMount checks a category with mount or drive, whose remote must be a
+// path inside the mountpoint.
+func checkMount(cat Category) error {
+	if cat.MountCommand != "" && cat.Mount == "" {
+		return errors.New("mount_command needs mount")
+	}
+	what := "mount"
+	switch {
+	case cat.Drive != "" && cat.Mount != "":
+		return errors.New("set mount or drive, not both")
+	case cat.Drive != "":
+		if _, _, err := ParseDrive(cat.Drive); err != nil {
+			return err
+		}
+		what = "drive"
+	case cat.Mount == "":
+		return nil
+	}
+	if IsDaemonURL(cat.Remote) {
+		return fmt.Errorf("%s can't be combined with an rsync:// remote", what)
+	}
+	if strings.HasPrefix(cat.Remote, "/") || strings.HasPrefix(cat.Remote, "~") {
+		return fmt.Errorf("with %s, remote is a path inside the mountpoint, got %q", what, cat.Remote)
+	}
+	if cat.DefaultDirection == "sync" || cat.DefaultDirection == "backup" {
+		return fmt.Errorf("%s only pushes and pulls, not %s", what, cat.DefaultDirection)
+	}
+	if clash := sshOnlyOptions(cat); len(clash) > 0 {
+		return fmt.Errorf("%s can't be combined with %s, which need ssh", what, strings.Join(clash, ", "))
+	}
+	return nil
+}
+
+// ReadonlySide returns readonly_remote or readonly_local if cat has the one
+// that forbids a run in direction, which writes to the remote for push, sync
+// and backup, and to the local path for pull and sync; "" if it's allowed.
+func ReadonlySide(cat Category, direction string) string {
+	switch {
+	case cat.ReadonlyRemote && slices.Contains([]string{"push", "sync", "backup"}, direction):
+		return "readonly_remote"
+	case cat.ReadonlyLocal && slices.Contains([]string{"pull", "sync"}, direction):
+		return "readonly_local"
+	}
+	return ""
+}
+
+// checkTransforms checks a category's transforms, which rewrite files on
+// their way to the remote and so only fit a push (or a pull that leaves
+// them alone).
+func checkTransforms(cat Category) error {
+	for i, t := range cat.Transforms {
+		switch {
+		case len(t.Match) == 0:
+			return fmt.Errorf("transforms[%d]: match is required", i)
+		case strings.TrimSpace(t.Command) == "":
+			return fmt.Errorf("transforms[%d]: command is required", i)
+		case strings.Contains(t.Alongside, "/"):
+			return fmt.Errorf("transforms[%d]: alongside is a suffix for the file name, got %q", i, t.Alongside)
+		}
+	}
+	if len(cat.Transforms) > 0 && cat.DefaultDirection == "sync" {
+		return errors.New("transforms only apply to push and backup, not sync")
+	}
+	return nil
+}
+
+// checkArchiveAppend checks a category with mode: archive-append, whose
+// rsync may only ever add files: nothing that deletes, moves or replaces
+// files on the receiving side can be set, in rsync_args either.
+func checkArchiveAppend(cat Category, defaultArgs []string) error {
+	switch cat.Mode {
+	case "":
+		return nil
+	case "archive-append":
+	default:
+		return fmt.Errorf("invalid mode %q (want archive-append)", cat.Mode)
+	}
+	if cat.DefaultDirection == "sync" || cat.DefaultDirection == "backup" {
+		return fmt.Errorf("mode: archive-append only pushes and pulls, not %s", cat.DefaultDirection)
+	}
+	var clash []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"backend", cat.Backend != ""},
+		{"propagate_deletions", cat.PropagateDeletions},
+		{"detect_renames", GetBool(false, cat.DetectRenames, false)},
+	} {
+		if o.set {
+			clash = append(clash, o.name)
+		}
+	}
+	if len(clash) > 0 {
+		return fmt.Errorf("mode: archive-append can't be combined with %s", strings.Join(clash, ", "))
+	}
+	for _, a := range slices.Concat(defaultArgs, cat.RsyncArgs) {
+		if opt, _, _ := strings.Cut(a, "="); slices.Contains(appendUnsafeArgs, opt) || strings.HasPrefix(opt, "--del") {
+			return fmt.Errorf("mode: archive-append can't be combined with %s in rsync_args", a)
+		}
+	}
+	return nil
+}
+
+// appendUnsafeArgs are the rsync options, besides the --delete family, that
+// would let an archive-append run remove or replace files.
+var appendUnsafeArgs = []string{"--remove-source-files", "--no-ignore-existing", "--force"}
+
+// ParseDrive splits a drive setting into UUID or LABEL and the value to
+// look for.
+func ParseDrive(spec string) (kind, value string, err error) {
+	kind, value, _ = strings.Cut(spec, "=")
+	if (kind != "UUID" && kind != "LABEL") || value == "" {
+		return "", "", fmt.Errorf("invalid drive %q (want UUID=... or LABEL=...)", spec)
+	}
+	return kind, value, nil
+}
+
+// sshOnlyOptions lists the settings of cat that need a remote reached over
+// ssh.
+func sshOnlyOptions(cat Category) []string {
+	var set []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"transport: agent", cat.Transport == "agent"},
+		{"backend", cat.Backend != ""},
+		{"from_host", cat.FromHost != ""},
+		{"encrypted", cat.Encrypted},
+		{"atomic_pull", cat.AtomicPull},
+		{"merge", cat.Merge != ""},
+		{"conflict", cat.Conflict != ""},
+		{"propagate_deletions", cat.PropagateDeletions},
+		{"detect_renames", GetBool(false, cat.DetectRenames, false)},
+		{"backup", GetBool(false, cat.Backup, false)},
+		{"anchor", cat.Anchor != ""},
+		{"icloud", cat.ICloud != ""},
+		{"check_space", GetBool(false, cat.CheckSpace, false)},
+	} {
+		if o.set {
+			set = append(set, o.name)
+		}
+	}
+	return set
+}
+
+// checkRsyncArgs accepts options only: anything else would be taken for an
+// extra source or destination.
+func checkRsyncArgs(field string, args []string) error {
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			return fmt.Errorf("%s: %q is not an option (write --opt=value as one item)", field, a)
+		}
+	}
+	return nil
+}
+
+// loadConfigTree reads path and merges the files named by its include:
+// directive over it, in order. Relative includes are resolved against the
+// including file's directory and may be globs.
+func loadConfigTree(path string, seen map[string]bool) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("%s is included more than once (include cycle?)", path)
+	}
+	seen[abs] = true
+
+	raw, err := readConfigMap(path)
+	if err != nil {
+		return nil, err
+	}
+	var includes []string
+	switch inc := raw["include"].(type) {
+	case nil:
+	case string:
+		includes = []string{inc}
+	case []any:
+		for _, v := range inc {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include entries must be strings", path)
+			}
+			includes = append(includes, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+	}
+	delete(raw, "include")
+
+	for _, pattern := range includes {
+		pattern, err := ExpandPath(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include: %w", path, err)
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %w", path, pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("%s: included file %s does not exist", path, pattern)
+		}
+		for _, m := range matches {
+			child, err := loadConfigTree(m, seen)
+			if err != nil {
+				return nil, err
+			}
+			mergeMaps(raw, child)
+		}
+	}
+	return raw, nil
+}
+
+func readConfigMap(path string) (map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if err == nil && IsEncrypted(path) {
+		b, err = decryptConfig(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	switch Format(path) {
+	case "toml":
+		m, err = decodeTOML(b)
+	case "json":
+		m, err = decodeJSON(b)
+	default:
+		err = yaml.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// formats are the extensions of the config file formats, by format. Files
+// with any other extension are read as YAML.
+var formats = map[string][]string{"yaml": {".yaml", ".yml"}, "toml": {".toml"}, "json": {".json"}}
+
+// Format returns the format of the config file at path, "yaml", "toml" or
+// "json", from its extension (the one before .age if it's encrypted).
+func Format(path string) string {
+	ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(path, EncryptedExt)))
+	for format, exts := range formats {
+		if slices.Contains(exts, ext) {
+			return format
+		}
+	}
+	return "yaml"
+}
+
+// decodeJSON decodes a JSON config into the tree yaml.Unmarshal makes,
+// with whole numbers as ints.
+func decodeJSON(b []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the top-level object")
+	}
+	return fromJSON(m).(map[string]any), nil
+}
+
+func fromJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	}
+	return v
+}
+
+// localOverridePath maps config.yaml to config.local.yaml. An encrypted
+// config.yaml.age gets a plaintext config.local.yaml: it stays on the machine
+// it is about.
+func localOverridePath(path string) string {
+	path = strings.TrimSuffix(path, EncryptedExt)
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".local" + ext
+}
+
+// mergeMaps merges src into dst: nested maps are merged key by key, anything
+// else (scalars, lists) in src replaces the value in dst.
+func mergeMaps(dst, src map[string]any) {
+	for k, sv := range src {
+		sm, srcIsMap := sv.(map[string]any)
+		dm, dstIsMap := dst[k].(map[string]any)
+		if srcIsMap && dstIsMap {
+			mergeMaps(dm, sm)
+			continue
+		}
+		dst[k] = sv
+	}
+}
+
+// applyExtends merges every category that has extends: over the template it
+// names, the way config.local.yaml is merged over config.yaml. Templates
+// may extend other templates. A list under a key ending in + (exclude+)
+// is added to the one the template has instead of replacing it.
+func applyExtends(raw map[string]any) error {
+	templates, _ := raw["templates"].(map[string]any)
+	var resolve func(m map[string]any, chain []string) (map[string]any, error)
+	resolve = func(m map[string]any, chain []string) (map[string]any, error) {
+		parent := map[string]any{}
+		if base, _ := m["extends"].(string); base != "" {
+			if slices.Contains(chain, base) {
+				return nil, fmt.Errorf("templates extend each other in a loop: %s", strings.Join(append(chain, base), " -> "))
+			}
+			t, ok := templates[base].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("extends %q: no such template in templates", base)
+			}
+			var err error
+			if parent, err = resolve(t, append(chain, base)); err != nil {
+				return nil, err
+			}
+		}
+		merged := cloneMap(parent)
+		delete(merged, "extends")
+		own := make(map[string]any, len(m))
+		for k, v := range m {
+			key, add := strings.CutSuffix(k, "+")
+			if !add {
+				own[k] = v
+				continue
+			}
+			if _, ok := m[key]; ok {
+				return nil, fmt.Errorf("%s and %s are both set; %s adds to the template's %s", key, k, k, key)
+			}
+			items, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: want a list", k)
+			}
+			list, ok := merged[key].([]any)
+			if !ok && merged[key] != nil {
+				return nil, fmt.Errorf("%s: the template's %s isn't a list", k, key)
+			}
+			merged[key] = append(slices.Clone(list), items...)
+		}
+		mergeMaps(merged, own)
+		return merged, nil
+	}
+	cats, _ := raw["categories"].(map[string]any)
+	for name, c := range cats {
+		m, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		merged, err := resolve(m, nil)
+		if err != nil {
+			return fmt.Errorf("category %q: %w", name, err)
+		}
+		cats[name] = merged
+	}
+	return nil
+}
+
+// cloneMap copies m and the maps nested in it, so merging into the copy
+// leaves m alone.
+func cloneMap(m map[string]any) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		if nested, ok := v.(map[string]any); ok {
+			v = cloneMap(nested)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// renderTemplates executes Go templates in every string value outside the
+// vars section, e.g. local: "{{ .vault_root }}/Notes".
+func renderTemplates(raw map[string]any, vars map[string]any) error {
+	funcs := template.FuncMap{"env": os.Getenv}
+	var render func(where string, v any) (any, error)
+	render = func(where string, v any) (any, error) {
+		switch v := v.(type) {
+		case string:
+			if !strings.Contains(v, "{{") {
+				return v, nil
+			}
+			tmpl, err := template.New(where).Funcs(funcs).Option("missingkey=error").Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			var b strings.Builder
+			if err := tmpl.Execute(&b, vars); err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			return b.String(), nil
+		case map[string]any:
+			for k, child := range v {
+				out, err := render(where+"."+k, child)
+				if err != nil {
+					return nil, err
+				}
+				v[k] = out
+			}
+		case []any:
+			for i, child := range v {
+				out, err := render(fmt.Sprintf("%s[%d]", where, i), child)
+				if err != nil {
+					return nil, err
+				}
+				v[i] = out
+			}
+		}
+		return v, nil
+	}
+	for k, v := range raw {
+		if k == "vars" {
+			continue
+		}
+		out, err := render(k, v)
+		if err != nil {
+			return err
+		}
+		raw[k] = out
+	}
+	return nil
+}
+
+// expandConfigPaths expands ~ and environment variables in every path-like
+// field so one config can be shared between machines with different homes.
+func expandConfigPaths(cfg *Config) error {
+	var errs []error
+	expand := func(field string, p *string) {
+		v, err := ExpandPath(*p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		*p = v
+	}
+	expand("ssh.key", &cfg.SSH.Key)
+	expand("ssh.control_path", &cfg.SSH.ControlPath)
+	expand("state_dir", &cfg.StateDir)
+	expand("log.dir", &cfg.Log.Dir)
+	expand("metrics.textfile", &cfg.Metrics.Textfile)
+	expand("last_run_dir", &cfg.LastRunDir)
+	expand("audit.path", &cfg.Audit.Path)
+	expand("ssh.known_hosts", &cfg.SSH.KnownHosts)
+	expand("daemon.socket", &cfg.Daemon.Socket)
+	expand("rsync.path", &cfg.Rsync.Path)
+	for name, cat := range cfg.Categories {
+		if cat.FromHost != "" {
+			// a path on from_host, where ~/ is the remote home
+			local, err := ExpandRemotePath(cat.Local)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("categories.%s.local: %w", name, err))
+			}
+			cat.Local = local
+		} else {
+			expand("categories."+name+".local", &cat.Local)
+		}
+		expand("categories."+name+".encryption_key", &cat.EncryptionKey)
+		expand("categories."+name+".password_file", &cat.PasswordFile)
+		if cat.Mount != "" || cat.Drive != "" {
+			// the drive's mountpoint is only known when it's plugged in:
+			// its remote stays relative until then
+			expand("categories."+name+".mount", &cat.Mount)
+			remote, err := ExpandEnv(cat.Remote)
+			if err == nil && remote != "" && !filepath.IsLocal(remote) {
+				err = errors.New("must be a path inside mount")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("categories.%s.remote: %w", name, err))
+			}
+			if cat.Mount != "" {
+				remote = filepath.Join(cat.Mount, remote)
+			}
+			cat.Remote = remote
+		} else {
+			remote, err := ExpandRemotePath(cat.Remote)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("categories.%s.remote: %w", name, err))
+			}
+			cat.Remote = remote
+		}
+		cfg.Categories[name] = cat
+	}
+	return errors.Join(errs...)
+}
+
+// ExpandPath expands a leading ~ to the local home directory and $VAR/${VAR}
+// references. Undefined variables are an error rather than silently empty, so
+// a missing variable can't turn into a sync to the wrong place.
+func ExpandPath(p string) (string, error) {
+	p, err := ExpandEnv(p)
+	if err != nil {
+		return "", err
+	}
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	return p, nil
+}
+
+// ExpandRemotePath expands variables from the local environment, but leaves ~
+// to mean the remote home: rsync and ssh resolve relative remote paths from the
+// login directory, so "~/Notes" becomes "Notes".
+func ExpandRemotePath(p string) (string, error) {
+	p, err := ExpandEnv(p)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case p == "~" || p == "~/":
+		return ".", nil
+	case strings.HasPrefix(p, "~/"):
+		return strings.TrimLeft(p[2:], "/"), nil
+	}
+	return p, nil
+}
+
+func ExpandEnv(s string) (string, error) {
+	var missing []string
+	out := os.Expand(s, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variable(s) %s in %q", strings.Join(missing, ", "), s)
+	}
+	return out, nil
+}
@@ -0,0 +1,982 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	t.Setenv("VAULT_ROOT", "/data/vault")
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "~/ObsidianVault/Notes", want: filepath.Join(home, "ObsidianVault/Notes")},
+		{in: "~", want: home},
+		{in: "$VAULT_ROOT/Notes", want: "/data/vault/Notes"},
+		{in: "${VAULT_ROOT}/Piano", want: "/data/vault/Piano"},
+		{in: "/plain/path", want: "/plain/path"},
+	}
+	for _, tt := range tests {
+		got, err := ExpandPath(tt.in)
+		if err != nil {
+			t.Fatalf("ExpandPath(%q) error: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ExpandPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ExpandPath("${BELTERLINK_SURELY_UNSET}/x"); err == nil {
+		t.Fatalf("expected error for undefined variable")
+	}
+}
+
+func TestExpandRemotePath(t *testing.T) {
+	t.Setenv("REMOTE_USER", "macuser")
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "~/Notes", want: "Notes"},
+		{in: "~", want: "."},
+		{in: "/Users/$REMOTE_USER/Notes", want: "/Users/macuser/Notes"},
+	}
+	for _, tt := range tests {
+		got, err := ExpandRemotePath(tt.in)
+		if err != nil {
+			t.Fatalf("ExpandRemotePath(%q) error: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ExpandRemotePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadExpandsPaths(t *testing.T) {
+	t.Setenv("VAULT_ROOT", "/data/vault")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh:\n  user: u\n  host: h\ncategories:\n  Notes:\n    local: $VAULT_ROOT/Notes\n    remote: ~/Vault/Notes\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	notes := cfg.Categories["Notes"]
+	if notes.Local != "/data/vault/Notes" || notes.Remote != "Vault/Notes" {
+		t.Fatalf("paths not expanded: %+v", notes)
+	}
+}
+
+func TestLoadTemplatesAndLocalOverride(t *testing.T) {
+	dir := t.TempDir()
+	base := `vars:
+  vault_root: /home/linux/Vault
+ssh:
+  user: u
+  host: h
+categories:
+  Notes:
+    local: "{{ .vault_root }}/Notes"
+    remote: /remote/Notes
+    exclude: ["*.tmp"]
+`
+	local := `vars:
+  vault_root: /Users/mac/Vault
+ssh:
+  host: other
+`
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(base), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Categories["Notes"].Local; got != "/home/linux/Vault/Notes" {
+		t.Fatalf("template not rendered: %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "config.local.yaml"), []byte(local), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Load with override: %v", err)
+	}
+	if got := cfg.Categories["Notes"].Local; got != "/Users/mac/Vault/Notes" {
+		t.Fatalf("override var not applied: %q", got)
+	}
+	if cfg.SSH.Host != "other" || cfg.SSH.User != "u" {
+		t.Fatalf("ssh should merge key by key: %+v", cfg.SSH)
+	}
+}
+
+func TestLoadUndefinedVar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh: {user: u, host: h}\ncategories:\n  Notes:\n    local: \"{{ .nope }}/Notes\"\n    remote: /r\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected error for undefined template var")
+	}
+}
+
+func TestLoadExtends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `vars:
+  root: /vaults
+ssh: {user: u, host: h}
+templates:
+  obsidian:
+    exclude: [".obsidian/workspace*", "*.tmp"]
+    compress: auto
+  vault:
+    extends: obsidian
+    resume: true
+    local: "{{ .root }}/unset"
+categories:
+  Notes:
+    extends: vault
+    local: "{{ .root }}/Notes"
+    remote: /r/Notes
+  Piano:
+    extends: vault
+    local: /vaults/Piano
+    remote: /r/Piano
+    exclude: ["*.wav"]
+  Scores:
+    extends: vault
+    local: /vaults/Scores
+    remote: /r/Scores
+    exclude+: ["*.mid"]
+    rsync_args+: ["--fuzzy"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	notes, piano := cfg.Categories["Notes"], cfg.Categories["Piano"]
+	if notes.Local != "/vaults/Notes" || notes.Compress != "auto" || !GetBool(false, notes.Resume, false) || len(notes.Exclude) != 2 {
+		t.Fatalf("Notes = %+v", notes)
+	}
+	if len(piano.Exclude) != 1 || piano.Exclude[0] != "*.wav" || piano.Compress != "auto" {
+		t.Fatalf("Piano should replace the template's excludes and keep the rest: %+v", piano)
+	}
+	scores := cfg.Categories["Scores"]
+	if !slices.Equal(scores.Exclude, []string{".obsidian/workspace*", "*.tmp", "*.mid"}) || !slices.Equal(scores.RsyncArgs, []string{"--fuzzy"}) {
+		t.Fatalf("Scores should add to the template's lists: exclude %q, rsync_args %q", scores.Exclude, scores.RsyncArgs)
+	}
+	if !slices.Equal(cfg.Categories["Notes"].Exclude, []string{".obsidian/workspace*", "*.tmp"}) {
+		t.Fatalf("exclude+ on Scores changed Notes' excludes: %q", cfg.Categories["Notes"].Exclude)
+	}
+
+	for _, bad := range []string{
+		"ssh: {user: u, host: h}\ncategories:\n  Notes: {extends: nope, local: /l, remote: /r}\n",
+		"ssh: {user: u, host: h}\ntemplates:\n  a: {extends: b}\n  b: {extends: a}\ncategories:\n  Notes: {extends: a, local: /l, remote: /r}\n",
+		"ssh: {user: u, host: h}\ntemplates:\n  a: {exclude: [x]}\ncategories:\n  Notes: {extends: a, local: /l, remote: /r, exclude: [y], exclude+: [z]}\n",
+		"ssh: {user: u, host: h}\ntemplates:\n  a: {exclude: [x]}\ncategories:\n  Notes: {extends: a, local: /l, remote: /r, exclude+: z}\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `ssh: {user: u, host: h}
+categories:
+  My Notes:
+    local: /l
+    remote: /r
+    exclude: ["*.tmp"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BELTERLINK_SSH_HOST", "ci.example.com")
+	t.Setenv("BELTERLINK_SSH_PORT", "2222")
+	t.Setenv("BELTERLINK_DEFAULTS_DELETE", "true")
+	t.Setenv("BELTERLINK_CATEGORIES_MY_NOTES_EXCLUDE", "[a, b]")
+	t.Setenv("BELTERLINK_CATEGORIES_MY_NOTES_CHMOD", "0755")
+	t.Setenv("BELTERLINK_CATEGORIES_OTHER_LOCAL", "/nope") // categories can't be added
+	t.Setenv("BELTERLINK_AGE_IDENTITY", "/not/a/setting")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SSH.Host != "ci.example.com" || cfg.SSH.Port != 2222 || !GetBool(false, cfg.Defaults.Delete, false) {
+		t.Fatalf("ssh = %+v, defaults.delete = %v", cfg.SSH, cfg.Defaults.Delete)
+	}
+	notes := cfg.Categories["My Notes"]
+	if !slices.Equal(notes.Exclude, []string{"a", "b"}) || notes.Chmod != "0755" {
+		t.Fatalf("My Notes = %+v", notes)
+	}
+	if len(cfg.Categories) != 1 {
+		t.Fatalf("categories = %v", cfg.Categories)
+	}
+
+	t.Setenv("BELTERLINK_SSH_PORT", "[")
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an unparsable value")
+	}
+}
+
+func TestLoadIncludesAndConfD(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml":             "include: [hosts.yaml, cats/*.yaml]\n",
+		"hosts.yaml":              "ssh: {user: u, host: h}\n",
+		"cats/notes.yaml":         "categories:\n  Notes: {local: /l/Notes, remote: /r/Notes}\n",
+		"conf.d/piano.yaml":       "categories:\n  Piano: {local: /l/Piano, remote: /r/Piano}\n",
+		"conf.d/ignored.yaml.bak": "categories:\n  Bogus: {local: /x, remote: /y}\n",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SSH.Host != "h" {
+		t.Fatalf("included ssh section missing: %+v", cfg.SSH)
+	}
+	for _, name := range []string{"Notes", "Piano"} {
+		if _, ok := cfg.Categories[name]; !ok {
+			t.Fatalf("category %s missing: %v", name, cfg.Categories)
+		}
+	}
+	if _, ok := cfg.Categories["Bogus"]; ok {
+		t.Fatalf("non-yaml drop-in should be ignored")
+	}
+}
+
+func TestLoadIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("include: other.yaml\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("include: config.yaml\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filepath.Join(dir, "config.yaml")); err == nil {
+		t.Fatalf("expected include cycle error")
+	}
+}
+
+func TestLoadRejectsEscapingAnchor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh: {user: u, host: h}\ncategories:\n  Notes:\n    local: /l\n    remote: /r\n    anchor: ../other/app.json\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected error for anchor outside the category")
+	}
+}
+
+func TestLoadRejectsInvalidSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh: {user: u, host: h}\ncategories:\n  Piano:\n    local: /l\n    remote: /r\n    max_size: 100 megs\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected error for invalid max_size")
+	}
+}
+
+func TestLoadRejectsInvalidBackend(t *testing.T) {
+	for _, cat := range []string{"backend: ../s3", "backend: s3\n    merge: markdown"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "categories:\n  Piano:\n    local: /l\n    remote: bucket/piano\n    " + cat + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Fatalf("expected error for %q", cat)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidSymlinks(t *testing.T) {
+	for _, cat := range []string{"symlinks: copy", "symlinks: follow\n    transport: agent"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "categories:\n  Notes:\n    local: /l\n    remote: /r\n    " + cat + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Fatalf("expected error for %q", cat)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidChmodChown(t *testing.T) {
+	for _, cat := range []string{"chmod: rwx", "chmod: u=rwx;g=r", "chown: a:b:c", "chmod: D755\n    transport: agent"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "categories:\n  Notes:\n    local: /l\n    remote: /r\n    " + cat + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Fatalf("expected error for %q", cat)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "categories:\n  Notes:\n    local: /l\n    remote: /r\n    chmod: Du=rwx,go=rx,Fu=rw,go=r\n    chown: :staff\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestLoadAddresses(t *testing.T) {
+	for _, tt := range []struct {
+		ssh, host, alias string
+		addrs            []string
+	}{
+		{"{addresses: [192.168.1.50, mymac.tailnet.ts.net]}", "192.168.1.50", "192.168.1.50", []string{"192.168.1.50", "mymac.tailnet.ts.net"}},
+		{"{host: mymac.local, addresses: [192.168.1.50, mymac.local]}", "mymac.local", "mymac.local", []string{"mymac.local", "192.168.1.50"}},
+		{"{addresses: [192.168.1.50], host_key_alias: mymac}", "192.168.1.50", "mymac", []string{"192.168.1.50"}},
+		{"{host: mymac.local}", "mymac.local", "", nil},
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "ssh: " + tt.ssh + "\ncategories:\n  Notes: {local: /l, remote: /r}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("Load(%s): %v", tt.ssh, err)
+		}
+		if s := cfg.SSH; s.Host != tt.host || s.HostKeyAlias != tt.alias || !slices.Equal(s.Addresses, tt.addrs) {
+			t.Errorf("%s: host %q, alias %q, addresses %q", tt.ssh, s.Host, s.HostKeyAlias, s.Addresses)
+		}
+	}
+}
+
+func TestLoadTimeouts(t *testing.T) {
+	for _, bad := range []string{
+		"ssh: {connect_timeout: 500ms}\n",
+		"ssh: {connect_timeout: ten}\n",
+		"defaults: {run_timeout: -1h}\n",
+		"categories:\n  Notes: {run_timeout: 2}\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := bad + "categories:\n  Notes: {local: /l, remote: /r}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh: {connect_timeout: 10s}\ndefaults: {run_timeout: 2h}\ncategories:\n  Notes: {local: /l, remote: /r, run_timeout: 30m}\n  Piano: {local: /p, remote: /q}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := RunTimeout(cfg, cfg.Categories["Notes"]); got != 30*time.Minute {
+		t.Errorf("Notes run timeout = %s, want 30m", got)
+	}
+	if got := RunTimeout(cfg, cfg.Categories["Piano"]); got != 2*time.Hour {
+		t.Errorf("Piano run timeout = %s, want the default 2h", got)
+	}
+}
+
+func TestLoadRejectsInplaceWithResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "defaults:\n  resume: true\ncategories:\n  VMs:\n    local: /l\n    remote: /r\n    inplace: true\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected inplace with resume to be rejected")
+	}
+}
+
+func TestLoadRejectsEncryptedCombinations(t *testing.T) {
+	for _, extra := range []string{"", "    encryption_key: /k\n    merge: markdown\n", "    encryption_key: /k\n    transport: agent\n", "    encryption_key: /k\n    backup: true\n"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "categories:\n  Journal:\n    local: /l\n    remote: /r\n    encrypted: true\n" + extra
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected encrypted with %q to be rejected", extra)
+		}
+	}
+}
+
+func TestLoadChecksSecrets(t *testing.T) {
+	base := "categories:\n  Notes:\n    local: /l\n    remote: /r\n"
+	for data, ok := range map[string]bool{
+		base + "notify:\n  email: {host: smtp.example.org, password: \"secret:smtp\", from: a@b, to: [c@d]}\nsecrets:\n  smtp: {command: pass show smtp}\n": true,
+		base + "notify:\n  email: {host: smtp.example.org, password: \"secret:smtp\", from: a@b, to: [c@d]}\n":                                              false,
+		base + "secrets:\n  smtp: {command: pass show smtp, env: SMTP}\n":                                                                                   false,
+		base + "secrets:\n  smtp: {env: SMTP, account: me}\n":                                                                                               false,
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); (err == nil) != ok {
+			t.Errorf("Load(%q) error = %v, want ok %v", data, err, ok)
+		}
+	}
+}
+
+func TestLoadRejectsPositionalRsyncArgs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "categories:\n  Notes:\n    local: /l\n    remote: /r\n    rsync_args: [--chmod, Du=rwx]\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "Du=rwx") {
+		t.Fatalf("Load = %v, want an error naming the non-option", err)
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	tests := []struct {
+		name     string
+		cli      bool
+		def      *bool
+		fallback bool
+		want     bool
+	}{
+		{name: "cli true wins", cli: true, def: boolPtr(false), fallback: false, want: true},
+		{name: "default used when cli false", cli: false, def: boolPtr(true), fallback: false, want: true},
+		{name: "fallback used when no default", cli: false, def: nil, fallback: true, want: true},
+		{name: "fallback false", cli: false, def: nil, fallback: false, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetBool(tt.cli, tt.def, tt.fallback); got != tt.want {
+				t.Fatalf("GetBool(%v, %v, %v) = %v, want %v", tt.cli, tt.def, tt.fallback, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCategoryExcludesSyncGit(t *testing.T) {
+	if !slices.Contains(CategoryExcludes(Category{}), ".git") {
+		t.Fatalf(".git should be excluded by default")
+	}
+	got := CategoryExcludes(Category{SyncGit: true, Exclude: []string{"*.wav"}})
+	if slices.Contains(got, ".git") || !slices.Contains(got, "*.wav") {
+		t.Fatalf("CategoryExcludes with sync_git = %v", got)
+	}
+}
+
+func TestNotifyWants(t *testing.T) {
+	if !(Notify{}).Wants("failure") || (Notify{}).Wants("success") {
+		t.Fatalf("default policy should notify on failure only")
+	}
+	n := Notify{On: []string{"success"}}
+	if !n.Wants("success") || n.Wants("failure") {
+		t.Fatalf("explicit policy not honored: %v", n.On)
+	}
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func TestParseWindow(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 5, 1, h, m, 0, 0, time.Local) }
+	w, err := ParseWindow("22:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		t    time.Time
+		want bool
+	}{{at(22, 0), true}, {at(3, 15), true}, {at(6, 59), true}, {at(7, 0), false}, {at(12, 0), false}} {
+		if got := w.Contains(tt.t); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+	if w, _ := ParseWindow("09:30-17:00"); !w.Contains(at(12, 0)) || w.Contains(at(18, 0)) {
+		t.Error("daytime window wrong")
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "08:00-08:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("ParseWindow(%q) accepted", bad)
+		}
+	}
+}
+
+func TestLoadEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	// a stand-in for age that "decrypts" by printing the file after the
+	// identity it was given
+	fake := "#!/bin/sh\n[ \"$1\" = --decrypt ] || exit 2\n[ \"$2\" = --identity ] || exit 3\ncat \"$4\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "age"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("BELTERLINK_AGE_IDENTITY", filepath.Join(dir, "identity.txt"))
+
+	path := filepath.Join(dir, "config.yaml.age")
+	data := "ssh: {user: me, host: nas}\ncategories:\n  Notes: {local: /l, remote: /r}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	local := "categories:\n  Notes: {remote: /elsewhere}\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.local.yaml"), []byte(local), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SSH.Host != "nas" || cfg.Categories["Notes"].Remote != "/elsewhere" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
+
+func TestLoadScrub(t *testing.T) {
+	for _, bad := range []string{"fortnightly", "30m", "-1h"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		data := "categories:\n  Notes: {local: /l, remote: /r, scrub: " + bad + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected error for scrub %q", bad)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "categories:\n  Notes: {local: /l, remote: /r, scrub: weekly}\n  Piano: {local: /p, remote: /q, scrub: 72h}\n  Misc: {local: /m, remote: /n}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for name, want := range map[string]time.Duration{"Notes": 7 * 24 * time.Hour, "Piano": 72 * time.Hour, "Misc": 0} {
+		if got := ScrubInterval(cfg.Categories[name]); got != want {
+			t.Errorf("%s scrub interval = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestLoadDefaultDirection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "categories:\n  Notes: {local: /l, remote: /r, default_direction: up}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected error for default_direction: up (an alias only the command line takes)")
+	}
+	data = "categories:\n  Notes: {local: /l, remote: /r, default_direction: backup}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := Load(path); err != nil || cfg.Categories["Notes"].DefaultDirection != "backup" {
+		t.Fatalf("Load = %v", err)
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.toml":       "include = \"hosts.json\"\n\n[categories.Notes]\nlocal = \"/l/Notes\"\nremote = \"/r/Notes\"\nresume = true\n",
+		"hosts.json":        `{"ssh": {"user": "u", "host": "h", "port": 2222}, "defaults": {"retries": 3}}`,
+		"conf.d/piano.toml": "[categories.Piano]\nlocal = \"/l/Piano\"\nremote = \"/r/Piano\"\n",
+		"config.local.toml": "[ssh]\nhost = \"h2\"\n",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := Load(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SSH.Host != "h2" || cfg.SSH.Port != 2222 || cfg.Defaults.Retries == nil || *cfg.Defaults.Retries != 3 {
+		t.Fatalf("ssh and defaults from the JSON include and the local TOML = %+v, %+v", cfg.SSH, cfg.Defaults)
+	}
+	if r := cfg.Categories["Notes"].Resume; r == nil || !*r {
+		t.Fatalf("Notes = %+v", cfg.Categories["Notes"])
+	}
+	if _, ok := cfg.Categories["Piano"]; !ok {
+		t.Fatalf("conf.d/piano.toml not merged: %v", cfg.Categories)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"ssh": {"port": 22,}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filepath.Join(dir, "bad.json")); err == nil || !strings.Contains(err.Error(), "bad.json") {
+		t.Fatalf("Load(bad.json) = %v, want a JSON syntax error", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for path, want := range map[string]string{
+		"config.yaml": "yaml", "config.yml": "yaml", "config.toml": "toml", "config.json": "json",
+		"config.TOML": "toml", "config.toml.age": "toml", "config": "yaml", "config.yaml.bak": "yaml",
+	} {
+		if got := Format(path); got != want {
+			t.Errorf("Format(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `ssh: {user: u, host: h}
+vars: {root: /l}
+templates:
+  vault: {exclude: [".trash/"]}
+categories:
+  Notes: {extends: vault, local: "{{ .root }}/Notes", remote: /r}
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { overrides = nil })
+	err := SetOverrides([]string{
+		"categories.Notes.exclude+=*.pdf",
+		"defaults.checksum=true",
+		"vars.root=/mnt",
+		"ssh.port=2222",
+		"categories.Notes.chmod=0755",
+	})
+	if err != nil {
+		t.Fatalf("SetOverrides: %v", err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	notes := cfg.Categories["Notes"]
+	if !slices.Equal(notes.Exclude, []string{".trash/", "*.pdf"}) || notes.Local != "/mnt/Notes" || notes.Chmod != "0755" {
+		t.Fatalf("Notes = %+v", notes)
+	}
+	if !GetBool(false, cfg.Defaults.Checksum, false) || cfg.SSH.Port != 2222 {
+		t.Fatalf("defaults.checksum = %v, ssh.port = %d", cfg.Defaults.Checksum, cfg.SSH.Port)
+	}
+
+	for set, want := range map[string]string{
+		"defaults.nope=1":             "defaults has no setting nope",
+		"categories.Other.delete=1":   `categories has no entry "Other"`,
+		"ssh.port+=1":                 "+= only adds to lists",
+		"ssh.port=[":                  "-set ssh.port=[",
+		"ssh.host.name=x":             "ssh.host is a value, not a section",
+		"categories.Notes.resume=yes": "", // YAML booleans
+	} {
+		if err := SetOverrides([]string{set}); err != nil {
+			t.Fatalf("SetOverrides(%s): %v", set, err)
+		}
+		_, err := Load(path)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("Load with -set %s = %v, want %q", set, err, want)
+		}
+	}
+	for _, set := range []string{"defaults.checksum", "defaults..checksum=true", "=true"} {
+		if err := SetOverrides([]string{set}); err == nil {
+			t.Errorf("SetOverrides(%s): expected an error", set)
+		}
+	}
+}
+
+func TestHostSSH(t *testing.T) {
+	base := SSH{User: "me", Host: "nas", Addresses: []string{"nas", "10.0.0.2"}, Port: 2222, Key: "/k", HostKeyAlias: "nas"}
+	for spec, want := range map[string]SSH{
+		"oldmac.local":         {User: "me", Host: "oldmac.local", Port: 22, Key: "/k"},
+		"ann@oldmac.local":     {User: "ann", Host: "oldmac.local", Port: 22, Key: "/k"},
+		"ann@oldmac.local:222": {User: "ann", Host: "oldmac.local", Port: 222, Key: "/k"},
+		"[fe80::1]:2200":       {User: "me", Host: "fe80::1", Port: 2200, Key: "/k"},
+	} {
+		got, err := HostSSH(base, spec)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("HostSSH(%q) = %+v, %v, want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "ann@", "oldmac:port", "oldmac:0", "a b"} {
+		if _, err := HostSSH(base, spec); err == nil {
+			t.Errorf("HostSSH(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestLoadRemoteToRemote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat string) (*Config, error) {
+		data := "ssh: {user: u, host: nas}\ncategories:\n  Vault: {remote: /r, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+	cfg, err := load("local: ~/Vault, from_host: ann@oldmac, relay: direct")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Categories["Vault"].Local; got != "Vault" {
+		t.Errorf("local on from_host = %q, want it relative to the remote home", got)
+	}
+	for _, cat := range []string{
+		"to_host: nas2",
+		"from_host: ann@oldmac, relay: sideways",
+		"from_host: 'oldmac:x'",
+		"from_host: oldmac, encrypted: true, encryption_key: /k",
+		"from_host: oldmac, default_direction: sync",
+		"from_host: oldmac, use_gitignore: true",
+	} {
+		if _, err := load(cat); err == nil {
+			t.Errorf("%s: expected an error", cat)
+		}
+	}
+}
+
+func TestLoadDaemonRemote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat string) (*Config, error) {
+		data := "categories:\n  Notes: {local: /l, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+	t.Setenv("SECRETS", "/etc/belterlink")
+	cfg, err := load("remote: 'rsync://me@nas:8730/vault/Notes', password_file: $SECRETS/rsyncd.secret")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Categories["Notes"].PasswordFile; got != "/etc/belterlink/rsyncd.secret" {
+		t.Errorf("password_file = %q", got)
+	}
+	for _, cat := range []string{
+		"remote: /r, password_file: /k",
+		"remote: 'rsync://nas'",
+		"remote: 'rsync://me:pw@nas/vault'",
+		"remote: 'rsync://nas/vault', create_remote: true",
+		"remote: 'rsync://nas/vault', default_direction: sync",
+	} {
+		if _, err := load(cat); err == nil {
+			t.Errorf("%s: expected an error", cat)
+		}
+	}
+}
+
+func TestLoadMount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat string) (*Config, error) {
+		data := "categories:\n  Archive: {local: /l, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+	cfg, err := load("mount: /mnt/nas, remote: vault/Notes, mount_command: mount /mnt/nas")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Categories["Archive"].Remote; got != "/mnt/nas/vault/Notes" {
+		t.Errorf("remote = %q, want it inside the mount", got)
+	}
+	for _, cat := range []string{
+		"remote: /r, mount_command: mount /mnt/nas",
+		"mount: /mnt/nas, remote: /mnt/nas/vault",
+		"mount: /mnt/nas, remote: ../vault",
+		"mount: /mnt/nas, remote: vault, backup: true",
+		"mount: /mnt/nas, remote: 'rsync://nas/vault'",
+	} {
+		if _, err := load(cat); err == nil {
+			t.Errorf("%s: expected an error", cat)
+		}
+	}
+}
+
+func TestLoadDrive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat string) (*Config, error) {
+		data := "categories:\n  Photos: {local: /l, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return Load(path)
+	}
+	cfg, err := load("drive: LABEL=Backup A, remote: photos")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.Categories["Photos"].Remote; got != "photos" {
+		t.Errorf("remote = %q, want it left relative until the drive is found", got)
+	}
+	for _, cat := range []string{
+		"drive: 1234-ABCD, remote: photos",
+		"drive: UUID=, remote: photos",
+		"drive: UUID=1234-ABCD, remote: /photos",
+		"drive: UUID=1234-ABCD, mount: /mnt/usb, remote: photos",
+		"drive: UUID=1234-ABCD, mount_command: mount /mnt/usb, remote: photos",
+		"drive: UUID=1234-ABCD, remote: photos, default_direction: sync",
+	} {
+		if _, err := load(cat); err == nil {
+			t.Errorf("%s: expected an error", cat)
+		}
+	}
+}
+
+func TestLoadTransforms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat string) error {
+		data := "ssh: {user: u, host: h}\ncategories:\n  Photos: {local: /l, remote: /r, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		return err
+	}
+	if err := load(`transforms: [{match: ["*.jpg"], command: 'exiftool -all= -o "$OUT" "$IN"'}, {match: ["*.excalidraw"], command: x, alongside: .svg}]`); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, cat := range []string{
+		"transforms: [{command: x}]",
+		"transforms: [{match: ['*.jpg']}]",
+		"transforms: [{match: ['*.jpg'], command: x, alongside: a/b}]",
+		"transforms: [{match: ['*.jpg'], command: x}], default_direction: sync",
+		"transforms: [{match: ['*.jpg'], command: x}], encrypted: true, encryption_key: /k",
+		"transforms: [{match: ['*.jpg'], command: x}], transport: agent",
+		"transforms: [{match: ['*.jpg'], command: x}], from_host: nas",
+	} {
+		if err := load(cat); err == nil {
+			t.Errorf("%s: expected an error", cat)
+		}
+	}
+}
+
+func TestLoadArchiveAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(defaults, cat string) error {
+		data := "ssh: {user: u, host: h}\ndefaults: {" + defaults + "}\ncategories:\n  Archive: {local: /l, remote: /r, " + cat + "}\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		return err
+	}
+	if err := load("delete: true", "mode: archive-append, rsync_args: [--chmod=F444]"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, tc := range []struct{ defaults, cat string }{
+		{"", "mode: append"},
+		{"", "mode: archive-append, default_direction: sync"},
+		{"", "mode: archive-append, detect_renames: true"},
+		{"", "mode: archive-append, rsync_args: [--delete-after]"},
+		{"", "mode: archive-append, rsync_args: [--remove-source-files]"},
+		{"rsync_args: [--del]", "mode: archive-append"},
+		{"", "mode: archive-append, transport: agent"},
+	} {
+		if err := load(tc.defaults, tc.cat); err == nil {
+			t.Errorf("%s / %s: expected an error", tc.defaults, tc.cat)
+		}
+	}
+}
+
+func TestLoadReadonly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(cat, daemon string) error {
+		data := "ssh: {user: u, host: h}\ncategories:\n  Reference: {local: /l, remote: /r, " + cat + "}\n" + daemon
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		return err
+	}
+	if err := load("readonly_local: true, default_direction: push", "daemon: {jobs: [{category: Reference, direction: push, every: 1h}]}\n"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, tc := range []struct{ cat, daemon string }{
+		{"readonly_remote: true, default_direction: backup", ""},
+		{"readonly_local: true, default_direction: sync", ""},
+		{"readonly_remote: true", "daemon: {jobs: [{category: Reference, direction: push, every: 1h}]}\n"},
+	} {
+		if err := load(tc.cat, tc.daemon); err == nil {
+			t.Errorf("%s %s: expected an error", tc.cat, tc.daemon)
+		}
+	}
+
+	remote, local := Category{ReadonlyRemote: true}, Category{ReadonlyLocal: true}
+	for _, tc := range []struct {
+		cat       Category
+		direction string
+		want      string
+	}{
+		{remote, "push", "readonly_remote"},
+		{remote, "backup", "readonly_remote"},
+		{remote, "pull", ""},
+		{local, "pull", "readonly_local"},
+		{local, "sync", "readonly_local"},
+		{local, "push", ""},
+	} {
+		if got := ReadonlySide(tc.cat, tc.direction); got != tc.want {
+			t.Errorf("ReadonlySide(%+v, %s) = %q, want %q", tc.cat, tc.direction, got, tc.want)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "ssh: {user: u0_a123, host: phone.local, profile: termux}\ncategories:\n  Notes: {local: /l, remote: /sdcard/Notes}\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.SSH.Port != 8022 {
+		t.Errorf("port = %d, want termux's 8022", cfg.SSH.Port)
+	}
+	data = strings.Replace(data, "profile: termux", "profile: ios", 1)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
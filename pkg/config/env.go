@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables that override config settings:
+// the setting's keys, upper-cased and joined by underscores, e.g.
+// BELTERLINK_SSH_HOST or BELTERLINK_CATEGORIES_NOTES_DELETE.
+const EnvPrefix = "BELTERLINK_"
+
+// applyEnv merges the overrides in environ (as from os.Environ) into the raw
+// config tree. Values are taken as YAML, so booleans, numbers and lists
+// like [a, b] work, except for string settings, which take the value as-is.
+// Categories, groups and other named entries can be changed but not added.
+// Variables under the prefix that name no setting are left alone; some,
+// like BELTERLINK_AGE_IDENTITY, mean something else.
+func applyEnv(raw map[string]any, environ []string) error {
+	targets := map[string][]envTarget{}
+	envTargets(reflect.TypeFor[Config](), raw, nil, strings.TrimSuffix(EnvPrefix, "_"), targets)
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		t, ok := targets[name]
+		if !ok {
+			continue
+		}
+		if len(t) > 1 {
+			var keys []string
+			for _, x := range t {
+				keys = append(keys, strings.Join(x.keys, "."))
+			}
+			return fmt.Errorf("%s is ambiguous: it could set any of %s", name, strings.Join(keys, ", "))
+		}
+		var v any = value
+		if t[0].kind != reflect.String {
+			if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		setPath(raw, t[0].keys, v)
+	}
+	return nil
+}
+
+// envTarget is the setting an environment variable overrides.
+type envTarget struct {
+	keys []string     // path through the config tree
+	kind reflect.Kind // of the setting, after pointers
+}
+
+// envTargets adds the variables for the settings of type t at keys, whose
+// part of the raw tree is node, under the variable name prefix.
+func envTargets(t reflect.Type, node any, keys []string, prefix string, targets map[string][]envTarget) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	m, _ := node.(map[string]any)
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := range t.NumField() {
+			f := t.Field(i)
+			key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if key == "" || key == "-" {
+				continue
+			}
+			envTargets(f.Type, m[key], append(slices.Clone(keys), key), prefix+"_"+envName(key), targets)
+		}
+	case reflect.Map:
+		// only the entries the config has: their names are free-form
+		for key, v := range m {
+			envTargets(t.Elem(), v, append(slices.Clone(keys), key), prefix+"_"+envName(key), targets)
+		}
+	default:
+		targets[prefix] = append(targets[prefix], envTarget{keys: keys, kind: t.Kind()})
+	}
+}
+
+// envName is key as it appears in a variable name.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// setPath sets the value at keys in raw, creating the maps on the way.
+func setPath(raw map[string]any, keys []string, v any) {
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := raw[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			raw[k] = next
+		}
+		raw = next
+	}
+	raw[keys[len(keys)-1]] = v
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// override is one -set: a setting, by its keys, and the value to set it to
+// or, with add, to append to it.
+type override struct {
+	text  string
+	keys  []string
+	value string
+	add   bool
+}
+
+// overrides are applied by every Load, over everything else.
+var overrides []override
+
+// SetOverrides makes every later Load apply sets, each key=value or
+// key+=value with the keys of the setting joined by dots, e.g.
+// defaults.checksum=true or categories.Notes.exclude+=*.pdf. They go over
+// the config files and the environment, in order. Values are taken as YAML
+// like those of the environment overrides; += adds to a list.
+func SetOverrides(sets []string) error {
+	parsed := make([]override, 0, len(sets))
+	for _, s := range sets {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("-set %s: want key=value or key+=value", s)
+		}
+		key, add := strings.CutSuffix(key, "+")
+		keys := strings.Split(key, ".")
+		if slices.Contains(keys, "") {
+			return fmt.Errorf("-set %s: want the keys of a setting joined by dots, e.g. defaults.checksum", s)
+		}
+		parsed = append(parsed, override{text: s, keys: keys, value: value, add: add})
+	}
+	overrides = parsed
+	return nil
+}
+
+// applyOverrides applies the overrides of vars (which the templates need
+// before they're rendered) or of the other settings (which go over the
+// categories as extended from their templates, so += adds to a list a
+// category has from its template) to the raw config tree.
+func applyOverrides(raw map[string]any, vars bool) error {
+	for _, o := range overrides {
+		if (o.keys[0] == "vars") != vars {
+			continue
+		}
+		if err := applyOverride(raw, o); err != nil {
+			return fmt.Errorf("-set %s: %w", o.text, err)
+		}
+	}
+	return nil
+}
+
+func applyOverride(raw map[string]any, o override) error {
+	t, err := overrideTarget(reflect.TypeFor[Config](), raw, o.keys)
+	if err != nil {
+		return err
+	}
+	var v any = o.value
+	switch {
+	case t.Kind() == reflect.String:
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String && !strings.HasPrefix(o.value, "["):
+		// a single pattern or path, which needn't be valid YAML (*.pdf)
+		v = []any{o.value}
+	default:
+		if err := yaml.Unmarshal([]byte(o.value), &v); err != nil {
+			return err
+		}
+	}
+	if o.add {
+		if t.Kind() != reflect.Slice {
+			return errors.New("+= only adds to lists")
+		}
+		items, ok := v.([]any)
+		if !ok {
+			items = []any{v}
+		}
+		old, _ := getPath(raw, o.keys).([]any)
+		v = append(slices.Clone(old), items...)
+	}
+	setPath(raw, o.keys, v)
+	return nil
+}
+
+// overrideTarget returns the type of the setting at keys under the part of
+// the config of type t whose raw tree is node. Entries of named sections,
+// such as categories, must exist; maps of plain values, such as vars, can
+// get new ones.
+func overrideTarget(t reflect.Type, node any, keys []string) (reflect.Type, error) {
+	for i, key := range keys {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		m, _ := node.(map[string]any)
+		at := strings.Join(keys[:i], ".")
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := yamlField(t, key)
+			if !ok {
+				if at == "" {
+					return nil, fmt.Errorf("no setting %s", key)
+				}
+				return nil, fmt.Errorf("%s has no setting %s", at, key)
+			}
+			t = f.Type
+		case reflect.Map:
+			elem := t.Elem()
+			for elem.Kind() == reflect.Pointer {
+				elem = elem.Elem()
+			}
+			if _, ok := m[key]; !ok && elem.Kind() == reflect.Struct {
+				return nil, fmt.Errorf("%s has no entry %q", at, key)
+			}
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("%s is a value, not a section", at)
+		}
+		node = m[key]
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t, nil
+}
+
+// yamlField finds the field of struct type t with the YAML key key.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if name, _, _ := strings.Cut(f.Tag.Get("yaml"), ","); name == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// getPath returns the value at keys in raw, or nil.
+func getPath(raw map[string]any, keys []string) any {
+	var v any = raw
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SecretPrefix marks a config value that names an entry of secrets: instead
+// of holding the value itself, e.g. password: secret:smtp.
+const SecretPrefix = "secret:"
+
+// Secret says where the value of a secret is looked up; exactly one of
+// Keychain, Command and Env is set. Secrets are looked up when they're used,
+// not when the config is loaded.
+type Secret struct {
+	Keychain string `yaml:"keychain,omitempty"` // service of a macOS Keychain (security) or libsecret (secret-tool) password
+	Account  string `yaml:"account,omitempty"`  // account of the keychain entry (optional)
+	Command  string `yaml:"command,omitempty"`  // shell command printing the secret on its first line, e.g. pass show smtp
+	Env      string `yaml:"env,omitempty"`      // environment variable holding the secret
+}
+
+// SecretRef returns the secret name if value is a secret:<name> reference.
+func SecretRef(value string) (string, bool) {
+	return strings.CutPrefix(value, SecretPrefix)
+}
+
+// secretFields lists the fields that may hold secret references, by their
+// config path.
+func secretFields(cfg *Config) map[string]string {
+	fields := map[string]string{"ssh.key_passphrase": cfg.SSH.KeyPassphrase}
+	if w := cfg.Notify.Webhook; w != nil {
+		fields["notify.webhook.url"] = w.URL
+		for k, v := range w.Headers {
+			fields["notify.webhook.headers."+k] = v
+		}
+	}
+	if e := cfg.Notify.Email; e != nil {
+		fields["notify.email.password"] = e.Password
+	}
+	for i, p := range cfg.Notify.Plugins {
+		for k, v := range p.Options {
+			fields[fmt.Sprintf("notify.plugins[%d].options.%s", i, k)] = v
+		}
+	}
+	for name, cat := range cfg.Categories {
+		fields["categories."+name+".encryption_key"] = cat.EncryptionKey
+		for k, v := range cat.BackendOptions {
+			fields["categories."+name+".backend_options."+k] = v
+		}
+	}
+	return fields
+}
+
+// RedactedValue replaces secrets in Redacted's copy of a config.
+const RedactedValue = "<redacted>"
+
+// secretVar matches the names of vars that look like they hold a secret.
+var secretVar = regexp.MustCompile(`(?i)pass|secret|token|api_?key|credential`)
+
+// Redacted returns a copy of cfg fit to show: the fields that may hold
+// secrets (see secretFields) have their values replaced by RedactedValue
+// unless they're secret:<name> references, and so do vars whose names look
+// like a password's. encryption_key is a file name and is kept.
+func Redacted(cfg *Config) *Config {
+	out := *cfg
+	redact := func(v string) string {
+		if _, ok := SecretRef(v); ok || v == "" {
+			return v
+		}
+		return RedactedValue
+	}
+	redactMap := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		r := make(map[string]string, len(m))
+		for k, v := range m {
+			r[k] = redact(v)
+		}
+		return r
+	}
+	out.SSH.KeyPassphrase = redact(cfg.SSH.KeyPassphrase)
+	if w := cfg.Notify.Webhook; w != nil {
+		out.Notify.Webhook = &Webhook{URL: redact(w.URL), Headers: redactMap(w.Headers)}
+	}
+	if e := cfg.Notify.Email; e != nil {
+		email := *e
+		email.Password = redact(e.Password)
+		out.Notify.Email = &email
+	}
+	out.Notify.Plugins = slices.Clone(cfg.Notify.Plugins)
+	for i, p := range out.Notify.Plugins {
+		out.Notify.Plugins[i].Options = redactMap(p.Options)
+	}
+	out.Categories = make(map[string]Category, len(cfg.Categories))
+	for name, cat := range cfg.Categories {
+		cat.BackendOptions = redactMap(cat.BackendOptions)
+		out.Categories[name] = cat
+	}
+	out.Vars = redactVars(cfg.Vars)
+	return &out
+}
+
+// redactVars returns a copy of vars with the values of secret-looking names
+// replaced, in nested maps too.
+func redactVars(vars map[string]any) map[string]any {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]any, len(vars))
+	for k, v := range vars {
+		if secretVar.MatchString(k) {
+			out[k] = RedactedValue
+			continue
+		}
+		if m, ok := v.(map[string]any); ok {
+			v = redactVars(m)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// checkSecrets validates secrets: and makes sure every reference names one
+// of them.
+func checkSecrets(cfg *Config) error {
+	for _, name := range slices.Sorted(maps.Keys(cfg.Secrets)) {
+		s := cfg.Secrets[name]
+		sources := 0
+		for _, v := range []string{s.Keychain, s.Command, s.Env} {
+			if v != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("secrets.%s: set exactly one of keychain, command and env", name)
+		}
+		if s.Account != "" && s.Keychain == "" {
+			return fmt.Errorf("secrets.%s: account needs keychain", name)
+		}
+	}
+	fields := secretFields(cfg)
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		name, ok := SecretRef(fields[field])
+		if !ok {
+			continue
+		}
+		if _, defined := cfg.Secrets[name]; !defined {
+			return fmt.Errorf("%s: secret %q is not defined in secrets", field, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ResolveCategory maps what the user typed to a configured category: exact
+// match first, then case-insensitive, then an unambiguous prefix. Otherwise
+// the error suggests close names.
+func ResolveCategory(cats map[string]Category, name string) (string, error) {
+	if _, ok := cats[name]; ok {
+		return name, nil
+	}
+	names := make([]string, 0, len(cats))
+	for n := range cats {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	lower := strings.ToLower(name)
+	var folded, prefixed []string
+	for _, n := range names {
+		ln := strings.ToLower(n)
+		if ln == lower {
+			folded = append(folded, n)
+		}
+		if strings.HasPrefix(ln, lower) {
+			prefixed = append(prefixed, n)
+		}
+	}
+	switch {
+	case len(folded) == 1:
+		return folded[0], nil
+	case len(folded) > 1:
+		return "", fmt.Errorf("category %q is ambiguous: %s", name, quoteList(folded))
+	case len(prefixed) == 1:
+		return prefixed[0], nil
+	case len(prefixed) > 1:
+		return "", fmt.Errorf("category %q is ambiguous: %s", name, quoteList(prefixed))
+	}
+
+	var suggestions []string
+	limit := max(2, len(name)/3)
+	for _, n := range names {
+		if levenshtein(lower, strings.ToLower(n)) <= limit {
+			suggestions = append(suggestions, n)
+		}
+	}
+	if len(suggestions) > 0 {
+		return "", fmt.Errorf("category %q not found in config; did you mean %s?", name, quoteList(suggestions))
+	}
+	return "", fmt.Errorf("category %q not found in config (available: %s)", name, quoteList(names))
+}
+
+func quoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = "'" + n + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// levenshtein returns the edit distance between a and b (in runes).
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// LookupGroup finds a group by exact or case-insensitive name.
+func LookupGroup(groups map[string][]string, name string) ([]string, bool) {
+	if members, ok := groups[name]; ok {
+		return members, true
+	}
+	for g, members := range groups {
+		if strings.EqualFold(g, name) {
+			return members, true
+		}
+	}
+	return nil, false
+}
+
+// SelectCategories expands group names, category names and glob patterns
+// (e.g. 'Obsidian*') into configured category names, in the order given and without duplicates.
+func SelectCategories(cfg *Config, patterns []string) ([]string, error) {
+	var names []string
+	add := func(n string) {
+		if !slices.Contains(names, n) {
+			names = append(names, n)
+		}
+	}
+	for _, p := range patterns {
+		if members, ok := LookupGroup(cfg.Groups, p); ok {
+			expanded, err := SelectCategories(&Config{Categories: cfg.Categories}, members)
+			if err != nil {
+				return nil, fmt.Errorf("group %q: %w", p, err)
+			}
+			for _, n := range expanded {
+				add(n)
+			}
+			continue
+		}
+		if !strings.ContainsAny(p, "*?[") {
+			name, err := ResolveCategory(cfg.Categories, p)
+			if err != nil {
+				return nil, err
+			}
+			add(name)
+			continue
+		}
+		var matched []string
+		for name := range cfg.Categories {
+			ok, err := path.Match(p, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			if ok {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("pattern %q matches no category", p)
+		}
+		slices.Sort(matched)
+		for _, n := range matched {
+			add(n)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveCategory(t *testing.T) {
+	cats := map[string]Category{"Notes": {}, "Piano": {}, "Projects": {}, "Journal": {}}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Notes", want: "Notes"},
+		{in: "notes", want: "Notes"},
+		{in: "No", want: "Notes"},
+		{in: "jour", want: "Journal"},
+	}
+	for _, tt := range tests {
+		got, err := ResolveCategory(cats, tt.in)
+		if err != nil {
+			t.Fatalf("ResolveCategory(%q) error: %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("ResolveCategory(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := ResolveCategory(cats, "P"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("expected ambiguity error, got %v", err)
+	}
+	if _, err := ResolveCategory(cats, "Ntoes"); err == nil || !strings.Contains(err.Error(), "did you mean 'Notes'") {
+		t.Fatalf("expected suggestion, got %v", err)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	if d := levenshtein("notes", "ntoes"); d != 2 {
+		t.Fatalf("levenshtein = %d, want 2", d)
+	}
+	if d := levenshtein("", "abc"); d != 3 {
+		t.Fatalf("levenshtein = %d, want 3", d)
+	}
+}
+
+func TestSelectCategories(t *testing.T) {
+	cfg := &Config{Categories: map[string]Category{
+		"ObsidianNotes": {}, "ObsidianPiano": {}, "Photos": {},
+	}}
+	got, err := SelectCategories(cfg, []string{"photos", "Obsidian*", "ObsidianNotes"})
+	if err != nil {
+		t.Fatalf("SelectCategories error: %v", err)
+	}
+	want := []string{"Photos", "ObsidianNotes", "ObsidianPiano"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("SelectCategories = %v, want %v", got, want)
+	}
+	if _, err := SelectCategories(cfg, []string{"Music*"}); err == nil {
+		t.Fatalf("expected error for pattern without matches")
+	}
+}
+
+func TestSelectCategoriesGroups(t *testing.T) {
+	cfg := &Config{
+		Categories: map[string]Category{"Notes": {}, "Piano": {}, "Journal": {}, "Photos": {}},
+		Groups:     map[string][]string{"vault": {"Notes", "Piano", "Jour*"}, "broken": {"Nope"}},
+	}
+	got, err := SelectCategories(cfg, []string{"Vault", "Photos"})
+	if err != nil {
+		t.Fatalf("SelectCategories error: %v", err)
+	}
+	want := []string{"Notes", "Piano", "Journal", "Photos"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("SelectCategories = %v, want %v", got, want)
+	}
+	if _, err := SelectCategories(cfg, []string{"broken"}); err == nil {
+		t.Fatalf("expected error for group with unknown member")
+	}
+}
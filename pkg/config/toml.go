@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// decodeTOML decodes a TOML document (https://toml.io, v1.0) into the tree
+// yaml.Unmarshal would make of the same settings: map[string]any, []any,
+// string, int, float64 and bool. Dates and times, which no setting takes,
+// are rejected.
+func decodeTOML(b []byte) (map[string]any, error) {
+	m := map[string]any{}
+	md, err := toml.Decode(string(b), &m)
+	if err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("line %d: %s", perr.Position.Line, perr.Message)
+		}
+		return nil, err
+	}
+	if err := checkDottedTables(md); err != nil {
+		return nil, err
+	}
+	v, err := yamlTree("", m)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]any), nil
+}
+
+// checkDottedTables rejects a [table] header for a table a dotted key
+// already made, as in
+//
+//	[t]
+//	a.b = 1
+//	[t.a]
+//
+// which TOML forbids but toml.Decode lets through. The keys come in the
+// order they're defined; a key's table is the longest table seen so far
+// that holds it, and any tables between the two were made by its dots.
+func checkDottedTables(md toml.MetaData) error {
+	tables, dotted := map[string]bool{"": true}, map[string]bool{}
+	for _, k := range md.Keys() {
+		if t := md.Type(k...); t == "Hash" || t == "ArrayHash" {
+			if dotted[k.String()] {
+				return fmt.Errorf("table [%s] is already defined by dotted keys", k)
+			}
+			tables[k.String()] = true
+			continue
+		}
+		i := len(k) - 1
+		for !tables[k[:i].String()] {
+			i--
+		}
+		for i++; i < len(k); i++ {
+			dotted[k[:i].String()] = true
+		}
+	}
+	return nil
+}
+
+// yamlTree converts a value toml.Decode made into its yaml.Unmarshal form.
+// key is the dotted key of v, for errors.
+func yamlTree(key string, v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			path := k
+			if key != "" {
+				path = key + "." + k
+			}
+			t, err := yamlTree(path, e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = t
+		}
+		return v, nil
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			t, err := yamlTree(fmt.Sprintf("%s[%d]", key, i), e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = t
+		}
+		return out, nil
+	case []any:
+		for i, e := range v {
+			t, err := yamlTree(fmt.Sprintf("%s[%d]", key, i), e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = t
+		}
+		return v, nil
+	case int64:
+		return int(v), nil
+	case time.Time:
+		return nil, fmt.Errorf("%s: dates and times aren't supported", key)
+	}
+	return v, nil
+}
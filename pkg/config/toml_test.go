@@ -0,0 +1,127 @@
+package config
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTOML(t *testing.T) {
+	doc := `# belterlink config
+vars.vault = "~/Obsidian" # dotted key
+
+[ssh]
+user = "me"
+host = 'nas.local'
+port = 2_222
+connect_timeout = "5s"
+
+[defaults]
+delete = true
+rsync_args = [
+  "--info=progress2", # trailing comma and comments
+  '--exclude=*.tmp',
+]
+
+[categories.Notes]
+local = "{{ .vault }}/Notes"
+remote = "/data/My Notes"
+exclude = [".trash/", "drafts/"]
+
+[categories."Piano Scores"]
+local = "~/Piano"
+remote = "/data/Piano"
+backend_options = { bucket = "scores", region = "eu" }
+
+[[daemon.jobs]]
+categories = ["Notes"]
+every = "15m"
+
+[[daemon.jobs]]
+categories = ["Piano Scores"]
+every = "1h"
+
+[misc]
+escaped = "tab\there \"quoted\" \u00e9"
+multi = """
+first
+second \
+  still second"""
+literal = '''C:\path\'''
+hex = 0xff
+float = 1.5e3
+neg = -inf
+`
+	got, err := decodeTOML([]byte(doc))
+	if err != nil {
+		t.Fatalf("decodeTOML: %v", err)
+	}
+	want := map[string]any{
+		"vars": map[string]any{"vault": "~/Obsidian"},
+		"ssh":  map[string]any{"user": "me", "host": "nas.local", "port": 2222, "connect_timeout": "5s"},
+		"defaults": map[string]any{
+			"delete":     true,
+			"rsync_args": []any{"--info=progress2", "--exclude=*.tmp"},
+		},
+		"categories": map[string]any{
+			"Notes": map[string]any{"local": "{{ .vault }}/Notes", "remote": "/data/My Notes", "exclude": []any{".trash/", "drafts/"}},
+			"Piano Scores": map[string]any{
+				"local": "~/Piano", "remote": "/data/Piano",
+				"backend_options": map[string]any{"bucket": "scores", "region": "eu"},
+			},
+		},
+		"daemon": map[string]any{"jobs": []any{
+			map[string]any{"categories": []any{"Notes"}, "every": "15m"},
+			map[string]any{"categories": []any{"Piano Scores"}, "every": "1h"},
+		}},
+		"misc": map[string]any{
+			"escaped": "tab\there \"quoted\" é",
+			"multi":   "first\nsecond still second",
+			"literal": `C:\path\`,
+			"hex":     255,
+			"float":   1500.0,
+			"neg":     math.Inf(-1),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeTOML =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDecodeTOMLErrors(t *testing.T) {
+	for doc, want := range map[string]string{
+		"a = 1\na = 2\n":                      "line 2: Key 'a' has already been defined",
+		"[ssh]\nuser = \"a\"\n[ssh]\n":        "line 3: Key 'ssh' has already been defined",
+		"a = 1\n[a]\n":                        "line 2: Key 'a' has already been defined",
+		"[t]\na.b = 1\n[t.a]\n":               "table [t.a] is already defined by dotted keys",
+		"[t]\na.b.c = 1\n[t.a.b]\n":           "table [t.a.b] is already defined by dotted keys",
+		"k = 007\n":                           "line 1: Invalid integer \"007\": cannot have leading zeroes",
+		"host = nas.local\n":                  "line 1: expected value",
+		"when = 2024-06-01\n":                 "when: dates and times aren't supported",
+		"a = \"open\n":                        "line 1: strings cannot contain newlines",
+		"a = [1, 2\n":                         "expected a comma (',') or array terminator (']')",
+		"a = 1 b = 2\n":                       "line 1: expected a top-level item to end with a newline",
+		"[categories.Notes\nlocal = \"/l\"\n": "to end table name",
+		"= 1\n":                               "key name appears blank",
+		"a = \"\\q\"\n":                       `invalid escape in string '\q'`,
+	} {
+		_, err := decodeTOML([]byte(doc))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("decodeTOML(%q) = %v, want an error containing %q", doc, err, want)
+		}
+	}
+}
+
+func TestDecodeTOMLTables(t *testing.T) {
+	for _, doc := range []string{
+		"[t.a.b]\nx = 1\n[t.a]\ny = 1\n",
+		"[t]\na.b = 1\na.c = 2\n",
+		"[t]\nx = {p.q = 1}\n[t.y]\n",
+		"a.b = 1\n[c]\n[c.a]\n",
+	} {
+		if _, err := decodeTOML([]byte(doc)); err != nil {
+			t.Errorf("decodeTOML(%q): %v", doc, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time range such as 22:00-07:00, in minutes after
+// midnight. It may wrap past midnight.
+type Window struct {
+	Start, End int
+}
+
+// ParseWindow reads "HH:MM-HH:MM".
+func ParseWindow(s string) (Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %q (want HH:MM-HH:MM, e.g. 22:00-07:00)", s)
+	}
+	var w Window
+	for _, p := range []struct {
+		s   string
+		dst *int
+	}{{from, &w.Start}, {to, &w.End}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid window %q (want HH:MM-HH:MM, e.g. 22:00-07:00)", s)
+		}
+		*p.dst = t.Hour()*60 + t.Minute()
+	}
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("invalid window %q: start and end are the same", s)
+	}
+	return w, nil
+}
+
+// Contains reports whether t's local time of day falls inside the window;
+// the start is included, the end isn't.
+func (w Window) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
@@ -0,0 +1,280 @@
+// Package crypt encrypts file contents and names for categories synced to a
+// remote that shouldn't see them.
+//
+// Contents are split into 64 KiB chunks sealed with AES-256-GCM under a key
+// derived from a random per-file salt; the chunk counter and a last-chunk flag
+// form the nonce, so chunks can't be reordered or the file truncated unnoticed
+// (the STREAM construction age uses). Each path component is sealed with
+// AES-256-GCM under a nonce derived from the component and its parent path
+// (SIV-style), so the same name always encrypts to the same string, which
+// rsync needs to match files between runs, without equal names in different
+// directories looking equal. Encrypted names are lowercase base32, for remotes
+// with case-insensitive file systems.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	magic     = "belenc01"
+	saltSize  = 32
+	chunkSize = 64 << 10
+	tagSize   = 16
+	nonceSize = 12
+
+	headerSize = len(magic) + saltSize
+
+	// MaxNameLength is the longest file name, in bytes, that still fits in
+	// the 255 bytes file systems allow once encrypted.
+	MaxNameLength = 255*5/8 - nonceSize - tagSize
+
+	// passphrase stretching; the salt is fixed so every machine derives the
+	// same keys from the same key file
+	kdfSalt       = "belterlink encryption v1"
+	kdfIterations = 600000
+)
+
+// ErrAuth is returned for data that wasn't encrypted with the key, or was
+// modified since.
+var ErrAuth = errors.New("decryption failed: wrong key or corrupted data")
+
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Key holds the keys for one category's names and contents.
+type Key struct {
+	names   cipher.AEAD
+	nameMAC []byte
+	content []byte
+}
+
+// LoadKey reads a key file: a passphrase or random key on its first line.
+func LoadKey(file string) (*Key, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret, _, _ := strings.Cut(string(b), "\n")
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, fmt.Errorf("%s: empty key file", file)
+	}
+	return PassphraseKey(secret)
+}
+
+// PassphraseKey derives the keys from a passphrase or random key, as kept
+// in a key file.
+func PassphraseKey(secret string) (*Key, error) {
+	master, err := pbkdf2.Key(sha256.New, secret, []byte(kdfSalt), kdfIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(master)
+}
+
+// NewKey derives the name and content keys from a 32-byte master key.
+func NewKey(master []byte) (*Key, error) {
+	derive := func(info string) ([]byte, error) {
+		return hkdf.Key(sha256.New, master, nil, info, 32)
+	}
+	nameKey, err := derive("belterlink names")
+	if err != nil {
+		return nil, err
+	}
+	nameMAC, err := derive("belterlink name nonces")
+	if err != nil {
+		return nil, err
+	}
+	content, err := derive("belterlink contents")
+	if err != nil {
+		return nil, err
+	}
+	names, err := newGCM(nameKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{names: names, nameMAC: nameMAC, content: content}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptPath encrypts each component of the slash-separated relative path.
+func (k *Key) EncryptPath(rel string) (string, error) {
+	var out []string
+	parent := ""
+	for _, name := range strings.Split(rel, "/") {
+		if len(name) > MaxNameLength {
+			return "", fmt.Errorf("%s: name longer than %d bytes can't be encrypted", rel, MaxNameLength)
+		}
+		mac := hmac.New(sha256.New, k.nameMAC)
+		mac.Write([]byte(parent + "\x00" + name))
+		nonce := mac.Sum(nil)[:nonceSize]
+		sealed := k.names.Seal(nonce, nonce, []byte(name), []byte(parent))
+		out = append(out, strings.ToLower(nameEncoding.EncodeToString(sealed)))
+		parent = path.Join(parent, name)
+	}
+	return strings.Join(out, "/"), nil
+}
+
+// DecryptPath reverses EncryptPath.
+func (k *Key) DecryptPath(rel string) (string, error) {
+	var out []string
+	parent := ""
+	for _, enc := range strings.Split(rel, "/") {
+		sealed, err := nameEncoding.DecodeString(strings.ToUpper(enc))
+		if err != nil || len(sealed) < nonceSize+tagSize {
+			return "", fmt.Errorf("%s: not an encrypted name", rel)
+		}
+		name, err := k.names.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(parent))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", rel, ErrAuth)
+		}
+		out = append(out, string(name))
+		parent = path.Join(parent, string(name))
+	}
+	return strings.Join(out, "/"), nil
+}
+
+// EncryptedSize is the size of the encryption of n bytes.
+func EncryptedSize(n int64) int64 {
+	chunks := max(1, (n+chunkSize-1)/chunkSize) // an empty file is one empty chunk
+	return int64(headerSize) + n + chunks*tagSize
+}
+
+// DecryptedSize reverses EncryptedSize; it returns -1 for sizes no
+// encryption has.
+func DecryptedSize(n int64) int64 {
+	n -= int64(headerSize)
+	full := n / (chunkSize + tagSize)
+	rest := n % (chunkSize + tagSize)
+	switch {
+	case n < tagSize || rest > 0 && rest < tagSize:
+		return -1
+	case rest == 0:
+		return full * chunkSize // the last chunk is full
+	}
+	return full*chunkSize + rest - tagSize
+}
+
+// Encrypt writes the encryption of src to dst.
+func (k *Key) Encrypt(dst io.Writer, src io.Reader) error {
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	aead, err := k.fileAEAD(salt)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dst, magic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, chunkSize)
+	buf := make([]byte, chunkSize, chunkSize+tagSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < chunkSize
+		if !last {
+			if _, perr := r.Peek(1); perr == io.EOF {
+				last = true
+			} else if perr != nil {
+				return perr
+			}
+		}
+		if _, err := dst.Write(aead.Seal(buf[:0], chunkNonce(counter, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt writes the decryption of src to dst. It fails with ErrAuth if src
+// was modified, truncated or encrypted with another key; dst may have
+// received part of the file by then.
+func (k *Key) Decrypt(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReaderSize(src, chunkSize+tagSize)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(magic)) {
+		return errors.New("not an encrypted file")
+	}
+	aead, err := k.fileAEAD(header[len(magic):])
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize+tagSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			if _, perr := r.Peek(1); perr == io.EOF {
+				last = true
+			} else if perr != nil {
+				return perr
+			}
+		}
+		plain, err := aead.Open(buf[:0], chunkNonce(counter, last), buf[:n], nil)
+		if err != nil {
+			return ErrAuth
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (k *Key) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, k.content, salt, "belterlink file", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// chunkNonce is the big-endian chunk counter followed by 1 for the last
+// chunk and 0 otherwise.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	for i := 10; i >= 3; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,129 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, seed byte) *Key {
+	t.Helper()
+	k, err := NewKey(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatalf("NewKey error: %v", err)
+	}
+	return k
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k := testKey(t, 1)
+	for _, n := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := bytes.Repeat([]byte("belterlink"), n/10+1)[:n]
+		var enc bytes.Buffer
+		if err := k.Encrypt(&enc, bytes.NewReader(plain)); err != nil {
+			t.Fatalf("Encrypt(%d bytes) error: %v", n, err)
+		}
+		if got := int64(enc.Len()); got != EncryptedSize(int64(n)) {
+			t.Errorf("EncryptedSize(%d) = %d, encryption has %d bytes", n, EncryptedSize(int64(n)), got)
+		}
+		if got := DecryptedSize(int64(enc.Len())); got != int64(n) {
+			t.Errorf("DecryptedSize(%d) = %d, want %d", enc.Len(), got, n)
+		}
+		var dec bytes.Buffer
+		if err := k.Decrypt(&dec, bytes.NewReader(enc.Bytes())); err != nil {
+			t.Fatalf("Decrypt(%d bytes) error: %v", n, err)
+		}
+		if !bytes.Equal(dec.Bytes(), plain) {
+			t.Errorf("round trip of %d bytes changed the data", n)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	k := testKey(t, 1)
+	plain := bytes.Repeat([]byte{'x'}, 2*chunkSize+5)
+	var enc bytes.Buffer
+	if err := k.Encrypt(&enc, bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	b := enc.Bytes()
+
+	flipped := bytes.Clone(b)
+	flipped[headerSize+10] ^= 1
+	truncated := b[:headerSize+chunkSize+tagSize] // drops the last chunks
+	for name, data := range map[string][]byte{"flipped": flipped, "truncated": truncated} {
+		if err := k.Decrypt(&bytes.Buffer{}, bytes.NewReader(data)); !errors.Is(err, ErrAuth) {
+			t.Errorf("%s: Decrypt error = %v, want ErrAuth", name, err)
+		}
+	}
+	if err := testKey(t, 2).Decrypt(&bytes.Buffer{}, bytes.NewReader(b)); !errors.Is(err, ErrAuth) {
+		t.Errorf("other key: Decrypt error = %v, want ErrAuth", err)
+	}
+}
+
+func TestEncryptPath(t *testing.T) {
+	k := testKey(t, 1)
+	a, err := k.EncryptPath("Projects/ideas.md")
+	if err != nil {
+		t.Fatalf("EncryptPath error: %v", err)
+	}
+	again, _ := k.EncryptPath("Projects/ideas.md")
+	if a != again {
+		t.Errorf("EncryptPath isn't deterministic: %q, %q", a, again)
+	}
+	if a != strings.ToLower(a) || strings.Contains(a, "ideas") {
+		t.Errorf("EncryptPath = %q", a)
+	}
+	other, _ := k.EncryptPath("Archive/ideas.md")
+	if path.Base(a) == path.Base(other) {
+		t.Errorf("ideas.md encrypts the same in two directories: %q", path.Base(a))
+	}
+	dec, err := k.DecryptPath(a)
+	if err != nil || dec != "Projects/ideas.md" {
+		t.Errorf("DecryptPath = %q, %v", dec, err)
+	}
+	if _, err := testKey(t, 2).DecryptPath(a); !errors.Is(err, ErrAuth) {
+		t.Errorf("DecryptPath with another key: %v, want ErrAuth", err)
+	}
+	if _, err := k.DecryptPath("ideas.md"); err == nil {
+		t.Errorf("DecryptPath accepted a plain name")
+	}
+
+	long := strings.Repeat("é", MaxNameLength/2)
+	enc, err := k.EncryptPath(long)
+	if err != nil || len(enc) > 255 {
+		t.Errorf("EncryptPath(%d bytes) = %d bytes, %v", len(long), len(enc), err)
+	}
+	if _, err := k.EncryptPath(strings.Repeat("a", MaxNameLength+1)); err == nil {
+		t.Errorf("EncryptPath accepted a name longer than MaxNameLength")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(content), 0o600)
+		return p
+	}
+	a, err := LoadKey(write("a", "correct horse battery staple\n"))
+	if err != nil {
+		t.Fatalf("LoadKey error: %v", err)
+	}
+	b, err := LoadKey(write("b", "  correct horse battery staple  "))
+	if err != nil {
+		t.Fatalf("LoadKey error: %v", err)
+	}
+	ea, _ := a.EncryptPath("Notes")
+	eb, _ := b.EncryptPath("Notes")
+	if ea != eb {
+		t.Errorf("the same passphrase gave different keys")
+	}
+	if _, err := LoadKey(write("empty", "\n")); err == nil {
+		t.Errorf("LoadKey accepted an empty key file")
+	}
+}
@@ -0,0 +1,240 @@
+// Package mdns finds services on the local network with multicast DNS
+// service discovery (Bonjour), e.g. the Macs that have Remote Login on.
+//
+// Only what browsing needs is implemented: a one-shot query (RFC 6762 §5.1)
+// for a service type's PTR records, and the SRV, A and AAAA records the
+// responders send along with them.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SSH is the service type of SSH servers; macOS advertises it when Remote
+// Login is on.
+const SSH = "_ssh._tcp.local"
+
+// Service is an instance of a service type that answered.
+type Service struct {
+	Instance string   // e.g. "Anna's MacBook Pro"
+	Host     string   // e.g. "annas-mbp.local"
+	Port     int      // e.g. 22
+	Addrs    []net.IP // the host's addresses, if the responder sent them
+}
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS record types and the class, with the bit asking for a unicast answer.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeAAAA = 28
+	typeSRV  = 33
+
+	classIN        = 1
+	classUnicastQU = 0x8000
+)
+
+// Browse asks the local network for instances of service (e.g. SSH) and
+// collects the answers until ctx is done, sorted by host. The query is sent
+// again after a second, for responders that missed it.
+func Browse(ctx context.Context, service string) ([]Service, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := Query(service)
+	// a first send that fails (no multicast route) fails the browse
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, fmt.Errorf("mdns query: %w", err)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+				conn.WriteToUDP(query, group)
+			}
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var answers answers
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		answers.add(buf[:n]) // malformed packets from other software are ignored
+	}
+	return answers.services(service), nil
+}
+
+// Query builds the one-shot query for service's PTR records.
+func Query(service string) []byte {
+	msg := make([]byte, 12) // id 0, no flags, one question
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = appendName(msg, service)
+	msg = binary.BigEndian.AppendUint16(msg, typePTR)
+	return binary.BigEndian.AppendUint16(msg, classIN|classUnicastQU)
+}
+
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// answers collects the records of interest from any number of responses,
+// keyed by lower-cased owner name.
+type answers struct {
+	ptr   map[string][]string
+	srv   map[string]srv
+	addrs map[string][]net.IP
+}
+
+type srv struct {
+	target string
+	port   int
+}
+
+// add parses a response and keeps its PTR, SRV, A and AAAA records.
+func (a *answers) add(msg []byte) error {
+	if a.ptr == nil {
+		a.ptr, a.srv, a.addrs = map[string][]string{}, map[string]srv{}, map[string][]net.IP{}
+	}
+	if len(msg) < 12 {
+		return errors.New("short message")
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for range qd {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4
+	}
+	for range rr {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(msg) {
+			return errors.New("truncated record")
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		size := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+size > len(msg) {
+			return errors.New("truncated record")
+		}
+		key := strings.ToLower(name)
+		switch typ {
+		case typePTR:
+			target, _, err := readName(msg, data)
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(a.ptr[key], target) {
+				a.ptr[key] = append(a.ptr[key], target)
+			}
+		case typeSRV:
+			if size < 7 {
+				return errors.New("short SRV record")
+			}
+			target, _, err := readName(msg, data+6)
+			if err != nil {
+				return err
+			}
+			a.srv[key] = srv{target: target, port: int(binary.BigEndian.Uint16(msg[data+4:]))}
+		case typeA, typeAAAA:
+			ip := net.IP(slices.Clone(msg[data : data+size]))
+			if len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+				if !slices.ContainsFunc(a.addrs[key], ip.Equal) {
+					a.addrs[key] = append(a.addrs[key], ip)
+				}
+			}
+		}
+		off = data + size
+	}
+	return nil
+}
+
+// services lists the instances of service the answers name, with the host,
+// port and addresses their SRV, A and AAAA records give.
+func (a *answers) services(service string) []Service {
+	service = strings.TrimSuffix(service, ".")
+	var out []Service
+	for _, inst := range a.ptr[strings.ToLower(service)] {
+		s := Service{Instance: inst}
+		if len(inst) > len(service)+1 && strings.EqualFold(inst[len(inst)-len(service)-1:], "."+service) {
+			s.Instance = inst[:len(inst)-len(service)-1]
+		}
+		if r, ok := a.srv[strings.ToLower(inst)]; ok {
+			s.Host, s.Port = r.target, r.port
+			s.Addrs = a.addrs[strings.ToLower(r.target)]
+		}
+		out = append(out, s)
+	}
+	slices.SortFunc(out, func(x, y Service) int {
+		return strings.Compare(x.Host+"\x00"+x.Instance, y.Host+"\x00"+y.Instance)
+	})
+	return out
+}
+
+// readName decodes the possibly compressed name at off and returns it
+// without the trailing dot, with the offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("truncated name")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("name compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, errors.New("bad label")
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("truncated name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
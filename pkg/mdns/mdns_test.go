@@ -0,0 +1,81 @@
+package mdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	want := []byte{
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		4, '_', 's', 's', 'h', 4, '_', 't', 'c', 'p', 5, 'l', 'o', 'c', 'a', 'l', 0,
+		0, 12, 0x80, 1,
+	}
+	if got := Query(SSH); !bytes.Equal(got, want) {
+		t.Fatalf("Query = %v\nwant    %v", got, want)
+	}
+}
+
+// response builds an answer the way macOS sends it: the PTR record, with
+// the SRV and address records as additionals, names compressed.
+func response() []byte {
+	msg := []byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 3}
+	record := func(name []byte, typ uint16, data []byte) {
+		msg = append(msg, name...)
+		msg = binary.BigEndian.AppendUint16(msg, typ)
+		msg = binary.BigEndian.AppendUint16(msg, 0x8001)
+		msg = binary.BigEndian.AppendUint32(msg, 120)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+	}
+	service := appendName(nil, SSH) // at offset 12
+	instance := append([]byte{18}, "Anna's MacBook Pro"...)
+	instance = append(instance, 0xc0, 12)
+	record(service, typePTR, instance)
+	instanceOff := len(msg) - len(instance)
+	host := appendName(nil, "annas-mbp.local")
+	record([]byte{0xc0, byte(instanceOff)}, typeSRV, append([]byte{0, 0, 0, 0, 0, 22}, host...))
+	hostOff := len(msg) - len(host)
+	record([]byte{0xc0, byte(hostOff)}, typeA, []byte{192, 168, 1, 50})
+	record([]byte{0xc0, byte(hostOff)}, typeAAAA, net.ParseIP("fd00::50"))
+	return msg
+}
+
+func TestAnswers(t *testing.T) {
+	var a answers
+	for range 2 { // repeated answers aren't listed twice
+		if err := a.add(response()); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	want := []Service{{
+		Instance: "Anna's MacBook Pro",
+		Host:     "annas-mbp.local",
+		Port:     22,
+		Addrs:    []net.IP{net.IPv4(192, 168, 1, 50).To4(), net.ParseIP("fd00::50")},
+	}}
+	if got := a.services(SSH); !reflect.DeepEqual(got, want) {
+		t.Fatalf("services = %+v\nwant       %+v", got, want)
+	}
+	if got := a.services("_sftp-ssh._tcp.local"); len(got) != 0 {
+		t.Fatalf("other service type: %+v", got)
+	}
+}
+
+func TestAddRejectsMalformed(t *testing.T) {
+	msg := response()
+	for _, bad := range [][]byte{
+		msg[:8],
+		msg[:len(msg)-3],
+		// a name pointing at itself
+		{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0xc0, 12, 0, 12, 0, 1, 0, 0, 0, 0, 0, 0},
+	} {
+		var a answers
+		if err := a.add(bad); err == nil {
+			t.Errorf("add(%v): no error", bad)
+		}
+	}
+}
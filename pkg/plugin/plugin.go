@@ -0,0 +1,131 @@
+// Package plugin implements belterlink's exec-based extension protocol.
+//
+// A plugin is an executable named belterlink-<kind>-<name> found on PATH, e.g.
+// belterlink-backend-s3 or belterlink-notify-matrix. belterlink runs it with
+// the request as a single JSON object on stdin and reads one JSON object from
+// its stdout. Whatever the plugin writes to stderr is passed through to the
+// user. A non-zero exit status or a non-empty "error" field fails the call.
+//
+// Plugins written in Go can import this package for the request and response
+// types; any other language only needs to follow the JSON shapes below.
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ProtocolVersion is sent with every request so plugins can refuse versions
+// they don't understand. It changes only when a field changes meaning.
+const ProtocolVersion = 1
+
+// Plugin kinds, the middle part of the executable name.
+const (
+	KindBackend = "backend" // transfers a category instead of rsync
+	KindNotify  = "notify"  // receives run summaries
+)
+
+// BackendRequest asks a backend plugin to transfer one category.
+type BackendRequest struct {
+	Protocol  int               `json:"protocol"`
+	Category  string            `json:"category"`
+	Direction string            `json:"direction"` // push (local → remote) or pull
+	Local     string            `json:"local"`     // local directory, ~ and $VARS already expanded
+	Remote    string            `json:"remote"`    // the category's remote, passed through as written
+	Exclude   []string          `json:"exclude,omitempty"`
+	Paths     []string          `json:"paths,omitempty"` // only these paths relative to local (-path, -files-from)
+	DryRun    bool              `json:"dry_run"`
+	Delete    bool              `json:"delete"`
+	Checksum  bool              `json:"checksum"`
+	Options   map[string]string `json:"options,omitempty"` // the category's backend_options
+}
+
+// BackendResponse reports what a backend plugin transferred.
+type BackendResponse struct {
+	FilesTransferred int64  `json:"files_transferred"`
+	FilesDeleted     int64  `json:"files_deleted"`
+	BytesTransferred int64  `json:"bytes_transferred"`
+	Error            string `json:"error,omitempty"`
+}
+
+// NotifyRequest hands a run summary to a notification plugin. Notification
+// plugins may print nothing; an empty response means success.
+type NotifyRequest struct {
+	Protocol int               `json:"protocol"`
+	Summary  json.RawMessage   `json:"summary"` // the same JSON body webhooks receive
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidName reports whether name can be used as a plugin name: lower-case
+// letters, digits, '-' and '_', so it can never point outside PATH.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Executable returns the file name of the plugin of the given kind and name.
+func Executable(kind, name string) string {
+	return "belterlink-" + kind + "-" + name
+}
+
+// Find looks the plugin up on PATH.
+func Find(kind, name string) (string, error) {
+	if !ValidName(name) {
+		return "", fmt.Errorf("invalid %s plugin name %q", kind, name)
+	}
+	path, err := exec.LookPath(Executable(kind, name))
+	if err != nil {
+		return "", fmt.Errorf("%s plugin %q: %s not found on PATH", kind, name, Executable(kind, name))
+	}
+	return path, nil
+}
+
+// Call runs the plugin with req on stdin and decodes its stdout into resp,
+// which may be nil when the response carries nothing but an error.
+func Call(kind, name string, req, resp any) error {
+	path, err := Find(kind, name)
+	if err != nil {
+		return err
+	}
+	in, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	body := bytes.TrimSpace(out.Bytes())
+	var status struct {
+		Error string `json:"error"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &status); err != nil {
+			if runErr != nil {
+				return fmt.Errorf("%s: %w", Executable(kind, name), runErr)
+			}
+			return fmt.Errorf("%s: invalid response: %w", Executable(kind, name), err)
+		}
+		if resp != nil {
+			if err := json.Unmarshal(body, resp); err != nil {
+				return fmt.Errorf("%s: invalid response: %w", Executable(kind, name), err)
+			}
+		}
+	}
+	switch {
+	case status.Error != "":
+		return fmt.Errorf("%s: %s", Executable(kind, name), strings.TrimSpace(status.Error))
+	case runErr != nil:
+		return fmt.Errorf("%s: %w", Executable(kind, name), runErr)
+	}
+	return nil
+}
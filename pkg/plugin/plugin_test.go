@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// installPlugin writes a shell script plugin into a fresh PATH directory.
+func installPlugin(t *testing.T, kind, name, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, Executable(kind, name)), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+func TestCallBackend(t *testing.T) {
+	dir := installPlugin(t, KindBackend, "test", `cat > "$(dirname "$0")/request.json"
+echo '{"files_transferred": 3, "bytes_transferred": 42}'
+`)
+	var resp BackendResponse
+	req := BackendRequest{Protocol: ProtocolVersion, Category: "Notes", Direction: "push", Local: "/l", Remote: "bucket/notes"}
+	if err := Call(KindBackend, "test", req, &resp); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if resp.FilesTransferred != 3 || resp.BytesTransferred != 42 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil || !strings.Contains(string(got), `"direction":"push"`) || !strings.Contains(string(got), `"protocol":1`) {
+		t.Fatalf("plugin received %s (%v)", got, err)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	installPlugin(t, KindNotify, "fails", `echo '{"error": "quota exceeded"}'; exit 1`)
+	if err := Call(KindNotify, "fails", NotifyRequest{}, nil); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("expected the plugin's error, got %v", err)
+	}
+	installPlugin(t, KindNotify, "crashes", `echo oops; exit 2`)
+	if err := Call(KindNotify, "crashes", NotifyRequest{}, nil); err == nil || !strings.Contains(err.Error(), "exit status 2") {
+		t.Fatalf("expected the exit status, got %v", err)
+	}
+	if err := Call(KindNotify, "missing", NotifyRequest{}, nil); err == nil || !strings.Contains(err.Error(), "not found on PATH") {
+		t.Fatalf("expected a lookup error, got %v", err)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for name, want := range map[string]bool{"s3": true, "b2-cloud": true, "my_sink": true, "": false, "../x": false, "S3": false, "-x": false} {
+		if got := ValidName(name); got != want {
+			t.Fatalf("ValidName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rsync
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// ResolveCompression decides whether to pass -z and, when both rsyncs list
+// zstd in their compress list, prefers it over the zlib default.
+func ResolveCompression(cfg *config.Config, cat config.Category, local, remote Version) (bool, string, error) {
+	mode := cat.Compress
+	if mode == "" {
+		mode = cfg.Defaults.Compress
+	}
+	switch strings.ToLower(mode) {
+	case "", "false", "no", "off":
+		return false, "", nil
+	case "true", "yes", "on":
+	case "auto":
+		if isLANHost(cfg.SSH.Host) {
+			return false, "", nil
+		}
+	default:
+		return false, "", fmt.Errorf("invalid compress value %q (want true, false or auto)", mode)
+	}
+
+	if !slices.Contains(local.Compress, "zstd") || !slices.Contains(remote.Compress, "zstd") {
+		return true, "", nil
+	}
+	return true, "zstd", nil
+}
+
+// ResolveWholeFile decides between sending whole files and rsync's delta
+// transfer. With auto, whole files go to LAN hosts, where the network is
+// faster than reading both copies to find the changed blocks. nil leaves the
+// choice to rsync (delta transfer over ssh).
+func ResolveWholeFile(cfg *config.Config, cat config.Category) (*bool, error) {
+	mode := cat.WholeFile
+	if mode == "" {
+		mode = cfg.Defaults.WholeFile
+	}
+	whole := true
+	switch strings.ToLower(mode) {
+	case "":
+		return nil, nil
+	case "true", "yes", "on":
+	case "false", "no", "off":
+		whole = false
+	case "auto":
+		whole = isLANHost(cfg.SSH.Host)
+	default:
+		return nil, fmt.Errorf("invalid whole_file value %q (want true, false or auto)", mode)
+	}
+	return &whole, nil
+}
+
+// compressChoices extracts the "Compress list:" section of rsync --version
+// output (rsync >= 3.2); older versions yield nothing.
+func compressChoices(versionOutput string) []string {
+	var choices []string
+	inList := false
+	for _, line := range strings.Split(versionOutput, "\n") {
+		if strings.HasPrefix(line, "Compress list:") {
+			inList = true
+			continue
+		}
+		if !inList {
+			continue
+		}
+		if line == "" || !strings.HasPrefix(line, " ") {
+			break
+		}
+		choices = append(choices, strings.Fields(line)...)
+	}
+	return choices
+}
+
+// isLANHost reports whether host is on the local network: mDNS names and
+// addresses that are private (RFC 1918 / ULA), loopback or link-local.
+func isLANHost(host string) bool {
+	if strings.HasSuffix(strings.ToLower(host), ".local") {
+		return true
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		ips = resolved
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package rsync
+
+import (
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestCompressChoices(t *testing.T) {
+	out := "rsync  version 3.2.7  protocol version 31\nCapabilities:\n    64-bit files\nCompress list:\n    zstd lz4 zlibx zlib none\nDaemon auth list:\n    sha512\n"
+	got := compressChoices(out)
+	if !containsArg(got, "zstd") || containsArg(got, "sha512") {
+		t.Fatalf("unexpected compress choices: %v", got)
+	}
+	if got := compressChoices("rsync  version 2.6.9  protocol version 29\n"); len(got) != 0 {
+		t.Fatalf("expected no choices for old rsync, got %v", got)
+	}
+}
+
+func TestResolveWholeFile(t *testing.T) {
+	tests := []struct {
+		host, mode string
+		want       *bool
+	}{
+		{host: "nas.local", mode: "", want: nil},
+		{host: "nas.local", mode: "auto", want: boolPtr(true)},
+		{host: "8.8.8.8", mode: "auto", want: boolPtr(false)},
+		{host: "8.8.8.8", mode: "true", want: boolPtr(true)},
+		{host: "nas.local", mode: "false", want: boolPtr(false)},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{SSH: config.SSH{Host: tt.host}}
+		got, err := ResolveWholeFile(cfg, config.Category{WholeFile: tt.mode})
+		if err != nil {
+			t.Fatalf("ResolveWholeFile(%s, %q): %v", tt.host, tt.mode, err)
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Fatalf("ResolveWholeFile(%s, %q) = %v, want %v", tt.host, tt.mode, got, tt.want)
+		}
+	}
+	if _, err := ResolveWholeFile(&config.Config{}, config.Category{WholeFile: "sometimes"}); err == nil {
+		t.Fatal("expected an error for an invalid whole_file")
+	}
+}
+
+func TestIsLANHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "mymac.local", want: true},
+		{host: "192.168.1.50", want: true},
+		{host: "10.0.0.2", want: true},
+		{host: "127.0.0.1", want: true},
+		{host: "8.8.8.8", want: false},
+	}
+	for _, tt := range tests {
+		if got := isLANHost(tt.host); got != tt.want {
+			t.Fatalf("isLANHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
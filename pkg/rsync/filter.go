@@ -0,0 +1,158 @@
+package rsync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// Matcher applies rsync-style exclude patterns to paths relative to a
+// category root, for the features that walk the local tree themselves.
+type Matcher struct {
+	rules []excludeRule
+	only  []string // lowercase extensions files must have (only_extensions); empty allows all
+}
+
+type excludeRule struct {
+	pattern string // as written in the config
+	re      *regexp.Regexp
+	dirOnly bool
+	include bool // an ignore file's ! rule: matching paths are kept
+}
+
+// NewMatcher compiles patterns with rsync's rules: a pattern without a
+// slash matches a name at any depth, a leading slash anchors it at the root,
+// a trailing slash matches only directories, "*" and "?" stop at slashes and
+// "**" doesn't.
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, p := range patterns {
+		if err := m.add(excludeRule{pattern: p}, p); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// add compiles p into rule and appends it.
+func (m *Matcher) add(rule excludeRule, p string) error {
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	anchored := strings.HasPrefix(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil
+	}
+	expr := "(^|/)" + globToRegexp(p) + "$"
+	if anchored {
+		expr = "^" + globToRegexp(p) + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern %q: %w", p, err)
+	}
+	rule.re = re
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+// Match reports whether the slash-separated relative path is excluded.
+func (m *Matcher) Match(rel string, isDir bool) bool {
+	_, ok := m.MatchPattern(rel, isDir)
+	return ok
+}
+
+// MatchPattern is Match that also returns the first pattern that matched.
+// As in rsync, the first matching rule decides, so an include rule keeps
+// what later rules would exclude.
+func (m *Matcher) MatchPattern(rel string, isDir bool) (string, bool) {
+	if r, ok := m.rule(rel, isDir); ok {
+		if r.include {
+			return "", false
+		}
+		return r.pattern, true
+	}
+	if len(m.only) > 0 && !isDir && !slices.Contains(m.only, strings.ToLower(strings.TrimPrefix(path.Ext(rel), "."))) {
+		return "only_extensions", true
+	}
+	return "", false
+}
+
+// rule returns the first rule matching rel.
+func (m *Matcher) rule(rel string, isDir bool) (excludeRule, bool) {
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			return r, true
+		}
+	}
+	return excludeRule{}, false
+}
+
+// CategoryMatcher applies everything a sync of cat filters by path: the
+// built-in and category excludes, the ignore file and only_extensions.
+func CategoryMatcher(cat config.Category) (*Matcher, error) {
+	m, err := NewMatcher(config.CategoryExcludes(cat))
+	if err != nil {
+		return nil, err
+	}
+	ignore, err := IgnoreRules(cat)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ignore {
+		if err := m.add(excludeRule{pattern: r.Source, include: r.Include}, r.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, ext := range cat.OnlyExtensions {
+		m.only = append(m.only, strings.ToLower(config.NormalizeExtension(ext)))
+	}
+	return m, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
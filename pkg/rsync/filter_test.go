@@ -0,0 +1,58 @@
+package rsync
+
+import (
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestMatcher(t *testing.T) {
+	m, err := NewMatcher([]string{".DS_Store", "._*", ".obsidian/cache", "/Archive", "build/", "**/tmp/*.log", "draft[0-9].md"})
+	if err != nil {
+		t.Fatalf("NewMatcher: %v", err)
+	}
+	for _, tc := range []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{".DS_Store", false, true},
+		{"Daily/.DS_Store", false, true},
+		{"Daily/._note.md", false, true},
+		{".obsidian/cache", true, true},
+		{"Sub/.obsidian/cache", true, true},
+		{".obsidian/app.json", false, false},
+		{"Archive", true, true},
+		{"Daily/Archive", true, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"a/b/tmp/x.log", false, true},
+		{"a/b/tmp/y/x.log", false, false},
+		{"draft1.md", false, true},
+		{"draft10.md", false, false},
+		{"note.md", false, false},
+	} {
+		if got := m.Match(tc.path, tc.isDir); got != tc.want {
+			t.Fatalf("Match(%q, %v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+func TestCategoryMatcherOnlyExtensions(t *testing.T) {
+	m, err := CategoryMatcher(config.Category{OnlyExtensions: []string{"md", "*.PNG"}})
+	if err != nil {
+		t.Fatalf("CategoryMatcher: %v", err)
+	}
+	if _, excluded := m.MatchPattern("Daily/note.md", false); excluded {
+		t.Fatalf("note.md should be included")
+	}
+	if _, excluded := m.MatchPattern("img/photo.png", false); excluded {
+		t.Fatalf("photo.png should be included")
+	}
+	if pattern, excluded := m.MatchPattern("audio/take.wav", false); !excluded || pattern != "only_extensions" {
+		t.Fatalf("take.wav: got %q, %v", pattern, excluded)
+	}
+	if _, excluded := m.MatchPattern("audio", true); excluded {
+		t.Fatalf("directories must not be filtered by extension")
+	}
+}
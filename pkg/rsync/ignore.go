@@ -0,0 +1,179 @@
+package rsync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// IgnoreFile, at the root of a category's local path, holds excludes in
+// .gitignore syntax that travel with the data.
+const IgnoreFile = ".belterlinkignore"
+
+// FilterRule is an rsync include or exclude rule.
+type FilterRule struct {
+	Include bool
+	Pattern string // rsync syntax, relative to the category root
+	Source  string // the line it was translated from, prefixed with its file
+}
+
+// String is the rule as rsync's --filter takes it.
+func (r FilterRule) String() string {
+	if r.Include {
+		return "+ " + r.Pattern
+	}
+	return "- " + r.Pattern
+}
+
+// ParseIgnore translates a file in .gitignore syntax into rsync filter
+// rules. dir is the file's directory relative to the category root ("" for
+// the root), which its patterns are relative to; file names the file in
+// the rules' Source. Git lets the last matching line win and rsync the
+// first, so the rules come out in reverse order.
+func ParseIgnore(data, dir, file string) []FilterRule {
+	var rules []FilterRule
+	for _, line := range strings.Split(data, "\n") {
+		line = trimIgnoreLine(strings.TrimSuffix(line, "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := path.Join(dir, file) + ": " + line
+		include := strings.HasPrefix(line, "!")
+		p := strings.TrimPrefix(line, "!")
+		if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+			p = p[1:]
+		}
+		dirOnly := strings.HasSuffix(p, "/")
+		p = strings.TrimRight(p, "/")
+		// a slash before the end anchors the pattern to the file's
+		// directory, except for a leading **/, which matches at any depth
+		anchored := strings.Contains(p, "/")
+		if strings.HasPrefix(p, "**/") {
+			p, anchored = strings.TrimPrefix(p, "**/"), false
+		}
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			continue
+		}
+		var patterns []string
+		switch {
+		case anchored:
+			patterns = []string{"/" + path.Join(dir, p)}
+		case dir == "":
+			patterns = []string{p}
+		default:
+			patterns = []string{"/" + dir + "/" + p, "/" + dir + "/**/" + p}
+		}
+		for _, rp := range patterns {
+			if dirOnly {
+				rp += "/"
+			}
+			rules = append(rules, FilterRule{Include: include, Pattern: rp, Source: source})
+		}
+	}
+	slices.Reverse(rules)
+	return rules
+}
+
+// trimIgnoreLine drops trailing spaces unless they are escaped.
+func trimIgnoreLine(line string) string {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+// IgnoreRules reads the ignore file at the root of cat's local path, if it
+// has one, and with use_gitignore the tree's .gitignore files after it.
+func IgnoreRules(cat config.Category) ([]FilterRule, error) {
+	var rules []FilterRule
+	data, err := os.ReadFile(filepath.Join(cat.Local, IgnoreFile))
+	if err == nil {
+		rules = ParseIgnore(string(data), "", IgnoreFile)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if cat.UseGitignore {
+		git, err := gitignoreRules(cat.Local)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, git...)
+	}
+	return rules, nil
+}
+
+// gitignoreRules translates the .gitignore files under root. Deeper files
+// come first, so their rules win over their parents' as in git. Directories
+// the rules found so far ignore aren't searched, nor are .git directories.
+func gitignoreRules(root string) ([]FilterRule, error) {
+	type ignoreFile struct {
+		depth int
+		rules []FilterRule
+	}
+	var files []ignoreFile
+	var stack []*Matcher // the .gitignore rules of the directories being walked, outermost first
+	ignored := func(rel string) bool {
+		for _, m := range slices.Backward(stack) {
+			if r, ok := m.rule(rel, true); ok {
+				return !r.include
+			}
+		}
+		return false
+	}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(dir), ".gitignore"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		pushed := err == nil
+		if pushed {
+			rules := ParseIgnore(string(data), dir, ".gitignore")
+			depth := 0
+			if dir != "" {
+				depth = strings.Count(dir, "/") + 1
+			}
+			files = append(files, ignoreFile{depth, rules})
+			m := &Matcher{}
+			for _, r := range rules {
+				if err := m.add(excludeRule{pattern: r.Source, include: r.Include}, r.Pattern); err != nil {
+					return err
+				}
+			}
+			stack = append(stack, m)
+		}
+		entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, e := range entries {
+			rel := path.Join(dir, e.Name())
+			if !e.IsDir() || e.Name() == ".git" || ignored(rel) {
+				continue
+			}
+			if err := walk(rel); err != nil {
+				return err
+			}
+		}
+		if pushed {
+			stack = stack[:len(stack)-1]
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(files, func(a, b ignoreFile) int { return b.depth - a.depth })
+	var rules []FilterRule
+	for _, f := range files {
+		rules = append(rules, f.rules...)
+	}
+	return rules, nil
+}
@@ -0,0 +1,112 @@
+package rsync
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestParseIgnore(t *testing.T) {
+	data := "# build output\nbuild/\n*.log\n!keep.log\n/TODO.md\ndocs/drafts\n**/cache\n\\#hash.md\ntrailing.md  \r\n"
+	var got []string
+	for _, r := range ParseIgnore(data, "", IgnoreFile) {
+		got = append(got, r.String())
+	}
+	want := []string{"- trailing.md", "- #hash.md", "- cache", "- /docs/drafts", "- /TODO.md", "+ keep.log", "- *.log", "- build/"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("rules = %q, want %q", got, want)
+	}
+
+	got = nil
+	for _, r := range ParseIgnore("*.o\n/bin/\n", "src/c", ".gitignore") {
+		got = append(got, r.String())
+	}
+	want = []string{"- /src/c/bin/", "- /src/c/**/*.o", "- /src/c/*.o"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("nested rules = %q, want %q", got, want)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, IgnoreFile), []byte("*.log\n!keep.log\nbuild/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cat := config.Category{Local: root, Remote: "/r"}
+	m, err := CategoryMatcher(cat)
+	if err != nil {
+		t.Fatalf("CategoryMatcher error: %v", err)
+	}
+	for rel, want := range map[string]bool{"debug.log": true, "a/keep.log": false, "notes.md": false, ".DS_Store": true} {
+		if got := m.Match(rel, false); got != want {
+			t.Errorf("Match(%q) = %v, want %v", rel, got, want)
+		}
+	}
+	if pattern, ok := m.MatchPattern("build", true); !ok || pattern != ".belterlinkignore: build/" {
+		t.Errorf("MatchPattern(build/) = %q, %v", pattern, ok)
+	}
+
+	args, err := BuildArgs(&config.Config{SSH: config.SSH{User: "u", Host: "h"}}, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "+ keep.log") || !containsArg(args, "- *.log") {
+		t.Fatalf("expected the ignore file's rules, got: %v", args)
+	}
+}
+
+func TestGitignoreRules(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		".gitignore":                  "node_modules/\n*.log\n/dist\n",
+		"web/.gitignore":              "!debug.log\n",
+		"node_modules/pkg/.gitignore": "*.md\n",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat := config.Category{Local: root, Remote: "/r", UseGitignore: true}
+	rules, err := IgnoreRules(cat)
+	if err != nil {
+		t.Fatalf("IgnoreRules error: %v", err)
+	}
+	for _, r := range rules {
+		if r.Pattern == "*.md" || r.Pattern == "/node_modules/pkg/*.md" {
+			t.Fatalf("read a .gitignore inside an ignored directory: %+v", r)
+		}
+	}
+	m, err := CategoryMatcher(cat)
+	if err != nil {
+		t.Fatalf("CategoryMatcher error: %v", err)
+	}
+	for _, c := range []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"server.log", false, true},
+		{"web/debug.log", false, false}, // re-included by the deeper file
+		{"web/access.log", false, true},
+		{"dist", true, true},
+		{"web/dist", true, false}, // anchored to the root
+		{"web/index.html", false, false},
+	} {
+		if got := m.Match(c.rel, c.isDir); got != c.want {
+			t.Errorf("Match(%q) = %v, want %v", c.rel, got, c.want)
+		}
+	}
+
+	cat.UseGitignore = false
+	if rules, err := IgnoreRules(cat); err != nil || len(rules) != 0 {
+		t.Fatalf("without use_gitignore: %v, %v", rules, err)
+	}
+}
@@ -0,0 +1,124 @@
+package rsync
+
+import "strings"
+
+// Difference is one entry of a verify report.
+type Difference struct {
+	Kind string // differs, local-only, remote-only or metadata
+	Path string
+}
+
+// ParseItemized classifies rsync --itemize-changes lines; direction tells
+// which side is the receiver.
+func ParseItemized(out, direction string) []Difference {
+	senderOnly, receiverOnly := "local-only", "remote-only"
+	if direction == "pull" {
+		senderOnly, receiverOnly = receiverOnly, senderOnly
+	}
+	var diffs []Difference
+	for _, line := range strings.Split(out, "\n") {
+		flags, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name = strings.TrimLeft(name, " ")
+		if flags == "*deleting" {
+			diffs = append(diffs, Difference{receiverOnly, name})
+			continue
+		}
+		if len(flags) != 11 || !strings.ContainsRune("<>ch.", rune(flags[0])) {
+			continue // not an itemized line
+		}
+		attrs := flags[2:]
+		switch {
+		case strings.Trim(attrs, "+") == "":
+			diffs = append(diffs, Difference{senderOnly, name})
+		case flags[0] == '.' || (attrs[0] != 'c' && attrs[1] != 's'):
+			diffs = append(diffs, Difference{"metadata", name})
+		default:
+			diffs = append(diffs, Difference{"differs", name})
+		}
+	}
+	return diffs
+}
+
+// ParseInPlace returns the files in itemized output that rsync updates
+// without replacing them: only their permissions, owner or times change.
+func ParseInPlace(itemized string) []string {
+	var paths []string
+	for _, line := range strings.Split(itemized, "\n") {
+		flags, name, ok := strings.Cut(line, " ")
+		if !ok || len(flags) != 11 || flags[0] != '.' || flags[1] != 'f' {
+			continue
+		}
+		paths = append(paths, strings.TrimLeft(name, " "))
+	}
+	return paths
+}
+
+// CountDeletions counts "*deleting" lines in rsync --itemize-changes output.
+func CountDeletions(itemized string) int {
+	n := 0
+	for _, line := range strings.Split(itemized, "\n") {
+		if strings.HasPrefix(line, "*deleting") {
+			n++
+		}
+	}
+	return n
+}
+
+// Change is a destructive change in rsync --itemize-changes output: a file
+// or directory deleted on the receiver, or a receiver's file replaced.
+type Change struct {
+	Kind string // delete or overwrite
+	Path string // directories end in /
+}
+
+// ParseChanges returns the deletions and overwrites in itemized output;
+// files new to the receiver and metadata-only updates aren't destructive.
+func ParseChanges(itemized string) []Change {
+	var changes []Change
+	for _, line := range strings.Split(itemized, "\n") {
+		flags, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name = strings.TrimLeft(name, " ")
+		if flags == "*deleting" {
+			changes = append(changes, Change{"delete", name})
+			continue
+		}
+		if len(flags) != 11 || (flags[0] != '<' && flags[0] != '>') || flags[1] != 'f' {
+			continue
+		}
+		if strings.Trim(flags[2:], "+") != "" { // not a new file
+			changes = append(changes, Change{"overwrite", name})
+		}
+	}
+	return changes
+}
+
+// ParseTransferred returns the paths rsync -v lists as it goes: the files
+// and directories it sends or creates, without the trailing / of
+// directories or the target of symlinks. rsync's own lines (the file list
+// header, deletions, -vv chatter) and everything from the closing summary on
+// are skipped.
+func ParseTransferred(out string) []string {
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Number of files:") || strings.HasPrefix(line, "sent ") {
+			break // the --stats block and the summary
+		}
+		switch {
+		case line == "", line == "./",
+			strings.HasSuffix(line, " file list"), strings.HasSuffix(line, " file list ... done"),
+			strings.HasPrefix(line, "deleting "), strings.HasPrefix(line, "*deleting "),
+			strings.HasPrefix(line, "created directory "), strings.HasPrefix(line, "["),
+			strings.HasPrefix(line, "delta-transmission "), strings.HasSuffix(line, " is uptodate"):
+			continue
+		}
+		name, _, _ := strings.Cut(line, " -> ")
+		paths = append(paths, strings.TrimSuffix(name, "/"))
+	}
+	return paths
+}
@@ -0,0 +1,99 @@
+package rsync
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseItemized(t *testing.T) {
+	out := `*deleting   old.md
+>f+++++++++ new.md
+>fcs....... changed.md
+.f..t...... touched.md
+.d..t...... attachments/
+cL+++++++++ link -> target
+`
+	want := []Difference{
+		{"remote-only", "old.md"},
+		{"local-only", "new.md"},
+		{"differs", "changed.md"},
+		{"metadata", "touched.md"},
+		{"metadata", "attachments/"},
+		{"local-only", "link -> target"},
+	}
+	if got := ParseItemized(out, "push"); !slices.Equal(got, want) {
+		t.Fatalf("ParseItemized =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseItemizedPull(t *testing.T) {
+	got := ParseItemized("*deleting   stale.md\n>f+++++++++ fresh.md\n", "pull")
+	want := []Difference{{"local-only", "stale.md"}, {"remote-only", "fresh.md"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ParseItemized = %v, want %v", got, want)
+	}
+}
+
+func TestCountDeletions(t *testing.T) {
+	out := "*deleting   old/note.md\n>f+++++++++ new.md\n*deleting   old/\n.d..t...... ./\n"
+	if got := CountDeletions(out); got != 2 {
+		t.Fatalf("CountDeletions = %d, want 2", got)
+	}
+}
+
+func TestParseChanges(t *testing.T) {
+	out := `*deleting   old.md
+*deleting   old/
+>f+++++++++ new.md
+>fcs....... changed.md
+<f..t...... touched-content.md
+.f...p..... chmod.md
+cL+++++++++ link -> target
+`
+	want := []Change{
+		{"delete", "old.md"},
+		{"delete", "old/"},
+		{"overwrite", "changed.md"},
+		{"overwrite", "touched-content.md"},
+	}
+	if got := ParseChanges(out); !slices.Equal(got, want) {
+		t.Fatalf("ParseChanges =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseInPlace(t *testing.T) {
+	out := `>f..t...... content.md
+.f...p..... chmod.md
+.f..t...... touched.md
+.d..t...... attachments/
+.L..t...... link -> target
+`
+	want := []string{"chmod.md", "touched.md"}
+	if got := ParseInPlace(out); !slices.Equal(got, want) {
+		t.Fatalf("ParseInPlace = %q, want %q", got, want)
+	}
+}
+
+func TestParseTransferred(t *testing.T) {
+	out := `receiving incremental file list
+created directory /home/me/Notes
+./
+Projects/
+Projects/ideas.md
+deleting old.md
+link.md -> ideas.md
+notes.md is uptodate
+[receiver] expand file_list pointer array to 65536 bytes, did move
+a:b.md
+
+Number of files: 4 (reg: 2, dir: 1, link: 1)
+Total file size: 1,824 bytes
+
+sent 58 bytes  received 1,966 bytes  4,048.00 bytes/sec
+total size is 1,824  speedup is 0.90 (DRY RUN)
+`
+	want := []string{"Projects", "Projects/ideas.md", "link.md", "a:b.md"}
+	if got := ParseTransferred(out); !slices.Equal(got, want) {
+		t.Fatalf("ParseTransferred =\n%v\nwant\n%v", got, want)
+	}
+}
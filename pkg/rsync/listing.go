@@ -0,0 +1,46 @@
+package rsync
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is one line of rsync --list-only output.
+type Entry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time // whole seconds, in the local time zone as rsync prints it
+	Dir     bool
+}
+
+// ParseListing reads rsync --list-only output: permissions, size (with
+// digit grouping since 3.1), date, time and name. Other lines are skipped.
+func ParseListing(out string) []Entry {
+	var entries []Entry
+	for _, line := range strings.Split(out, "\n") {
+		var f [4]string
+		rest := line
+		for i := range f {
+			f[i], rest, _ = strings.Cut(strings.TrimLeft(rest, " "), " ")
+		}
+		if rest == "" || len(f[0]) != 10 {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, f[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		mtime, err := time.ParseInLocation("2006/01/02 15:04:05", f[2]+" "+f[3], time.Local)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{Path: rest, Size: size, ModTime: mtime, Dir: f[0][0] == 'd'})
+	}
+	return entries
+}
@@ -0,0 +1,25 @@
+package rsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseListing(t *testing.T) {
+	out := "drwxr-xr-x          4,096 2024/05/01 09:00:00 scores\n" +
+		"-rw-r--r--      1,234,567 2024/05/01 10:30:15 scores/Nocturne op. 9.pdf\n" +
+		"-rw-r--r--             12 2023/12/24 18:00:00 todo.md\n" +
+		"\n" +
+		"sent 20 bytes  received 120 bytes\n"
+	got := ParseListing(out)
+	if len(got) != 3 {
+		t.Fatalf("entries = %+v", got)
+	}
+	want := Entry{Path: "scores/Nocturne op. 9.pdf", Size: 1234567, ModTime: time.Date(2024, 5, 1, 10, 30, 15, 0, time.Local)}
+	if got[1] != want {
+		t.Fatalf("entry = %+v, want %+v", got[1], want)
+	}
+	if !got[0].Dir || got[2].Dir || got[2].Size != 12 {
+		t.Fatalf("entries = %+v", got)
+	}
+}
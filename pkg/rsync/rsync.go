@@ -0,0 +1,448 @@
+// Package rsync builds and runs belterlink's rsync invocations.
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+	"githu.com/arcapol/belterlink/pkg/ssh"
+)
+
+// Options are the per-run settings that shape the rsync command line.
+type Options struct {
+	DryRun    bool
+	Delete    bool
+	Checksum  bool
+	Verbosity Verbosity
+	Direction string
+
+	Compress       bool   // rsync -z
+	CompressChoice string // --compress-choice, empty lets rsync negotiate
+
+	NoDelete  bool   // never delete, whatever the config says (the passes of a sync)
+	FilesFrom string // file listing the paths to transfer (rsync --files-from)
+
+	CreationTimes bool   // with preserve_xattrs: both rsyncs can keep creation times (--crtimes)
+	Iconv         string // local,remote charsets for file names (--iconv), e.g. utf-8-mac,utf-8
+	WholeFile     *bool  // --whole-file or --no-whole-file; nil leaves it to rsync
+	TempDir       string // --temp-dir on the receiving side
+	BackupDir     string // with backup: where the receiving side keeps what this run replaces or deletes
+	LinkDest      string // hard-link files unchanged since this earlier copy, relative to the destination (--link-dest)
+
+	LowPriority bool // run at low CPU and disk priority (LowPriorityCommand) and with --bwlimit
+}
+
+// Verbosity is how much a run prints, from -q to -vv.
+type Verbosity int
+
+const (
+	Quiet       Verbosity = -1 // errors and warnings only
+	Normal      Verbosity = 0  // progress, and rsync -v unless defaults.verbose is false
+	Verbose     Verbosity = 1  // rsync -v --stats, and belterlink's own details
+	VeryVerbose Verbosity = 2  // rsync -vv, with --debug output on filter rules and deletions
+)
+
+// PartialDir holds interrupted transfers when resume is enabled; it lives next
+// to the files being transferred on the receiving side.
+const PartialDir = ".belterlink-partial"
+
+// BackupDir holds, with backup enabled, the files the last run replaced or
+// deleted, under the run's ID; it lives in the destination directory.
+const BackupDir = ".belterlink-backup"
+
+// LowPriorityBwLimit caps the bandwidth of a low-priority run, in KiB/s
+// (rsync 2.6's unit too, which takes no suffix).
+const LowPriorityBwLimit = 10240
+
+// BuildArgs returns the rsync arguments that transfer cat in opts.Direction.
+func BuildArgs(cfg *config.Config, cat config.Category, opts Options) ([]string, error) {
+	if cfg == nil {
+		return nil, errors.New("config is nil")
+	}
+	switch opts.Direction {
+	case "push", "pull":
+	default:
+		return nil, fmt.Errorf("invalid direction %q", opts.Direction)
+	}
+
+	// Resolve defaults
+	useDelete := ResolveDelete(cfg, opts) && !AppendOnly(cat)
+	useChecksum := config.GetBool(opts.Checksum, cfg.Defaults.Checksum, false)
+	detectRenames := DetectRenames(cfg, cat)
+
+	profile := config.RemoteProfile(cfg)
+
+	// Base rsync args
+	rsArgs := []string{"-aH", "--protect-args", "--update"} // archive + hardlinks + don't clobber newer
+	if profile.NoHardLinks {
+		rsArgs[0] = "-a"
+	}
+	switch {
+	case opts.Verbosity >= VeryVerbose:
+		rsArgs = append(rsArgs, "-vv", "--stats", "--debug=FILTER,DEL")
+	case opts.Verbosity == Verbose:
+		rsArgs = append(rsArgs, "-v", "--stats")
+	case opts.Verbosity == Normal && config.GetBool(false, cfg.Defaults.Verbose, true):
+		rsArgs = append(rsArgs, "-v")
+	}
+	if opts.DryRun {
+		rsArgs = append(rsArgs, "--dry-run")
+	}
+	if AppendOnly(cat) {
+		rsArgs = append(rsArgs, "--ignore-existing") // never replace a file the receiver has
+	}
+	if useChecksum {
+		rsArgs = append(rsArgs, "--checksum")
+	}
+	if t := config.RunTimeout(cfg, cat); t > 0 {
+		// both rsyncs give up when no data moves for that long, so the
+		// remote one doesn't linger after a timed-out run
+		rsArgs = append(rsArgs, fmt.Sprintf("--timeout=%d", int(math.Ceil(t.Seconds()))))
+	}
+	if useDelete {
+		rsArgs = append(rsArgs, "--delete", "--delete-excluded")
+		if detectRenames {
+			rsArgs = append(rsArgs, "--delete-delay") // keep the old names around as --fuzzy bases
+		}
+	}
+	if detectRenames {
+		rsArgs = append(rsArgs, "--fuzzy") // base a new file on a similar one in its directory
+	}
+	if opts.Compress {
+		rsArgs = append(rsArgs, "-z")
+		if opts.CompressChoice != "" {
+			rsArgs = append(rsArgs, "--compress-choice="+opts.CompressChoice)
+		}
+	}
+
+	if config.GetBool(false, cat.PreserveXattrs, config.GetBool(false, cfg.Defaults.PreserveXattrs, false)) {
+		rsArgs = append(rsArgs, "--xattrs", "--acls") // -X -A: Finder tags, resource forks, ACLs
+		if opts.CreationTimes {
+			rsArgs = append(rsArgs, "--crtimes")
+		}
+	}
+
+	switch firstNonEmpty(cat.Symlinks, profile.Symlinks) {
+	case "follow":
+		rsArgs = append(rsArgs, "--copy-links") // -L: transfer what the link points to
+	case "skip":
+		rsArgs = append(rsArgs, "--no-links")
+	case "safe":
+		rsArgs = append(rsArgs, "--safe-links") // only links that stay inside the tree
+	}
+
+	if chmod := firstNonEmpty(cat.Chmod, cfg.Defaults.Chmod); chmod != "" {
+		rsArgs = append(rsArgs, "--chmod="+chmod)
+	}
+	if chown := firstNonEmpty(cat.Chown, cfg.Defaults.Chown); chown != "" {
+		rsArgs = append(rsArgs, "--chown="+chown)
+	}
+	if config.GetBool(false, cat.NumericIDs, config.GetBool(false, cfg.Defaults.NumericIDs, false)) {
+		rsArgs = append(rsArgs, "--numeric-ids")
+	}
+	if !config.GetBool(false, cat.Perms, config.GetBool(false, cfg.Defaults.Perms, !profile.NoOwnership)) {
+		rsArgs = append(rsArgs, "--no-perms")
+	}
+	if !config.GetBool(false, cat.Owner, config.GetBool(false, cfg.Defaults.Owner, !profile.NoOwnership)) {
+		rsArgs = append(rsArgs, "--no-owner", "--no-group")
+	}
+	if w := ModifyWindow(cfg, cat); w > 0 {
+		rsArgs = append(rsArgs, fmt.Sprintf("--modify-window=%d", w))
+	}
+	if opts.LowPriority {
+		rsArgs = append(rsArgs, fmt.Sprintf("--bwlimit=%d", LowPriorityBwLimit))
+	}
+
+	if config.GetBool(false, cat.Sparse, config.GetBool(false, cfg.Defaults.Sparse, false)) {
+		rsArgs = append(rsArgs, "--sparse")
+	}
+	if opts.WholeFile != nil {
+		if *opts.WholeFile {
+			rsArgs = append(rsArgs, "--whole-file")
+		} else {
+			rsArgs = append(rsArgs, "--no-whole-file")
+		}
+	}
+	if cat.Inplace {
+		rsArgs = append(rsArgs, "--inplace")
+	} else if opts.TempDir != "" {
+		rsArgs = append(rsArgs, "--temp-dir="+opts.TempDir)
+	}
+
+	if opts.Iconv != "" {
+		rsArgs = append(rsArgs, "--iconv="+opts.Iconv)
+	}
+
+	if config.GetBool(false, cat.Resume, config.GetBool(false, cfg.Defaults.Resume, false)) {
+		rsArgs = append(rsArgs, "--partial", "--partial-dir="+PartialDir)
+		// never send partial dirs, and keep --delete-excluded from removing them
+		rsArgs = append(rsArgs, "--filter", "H "+PartialDir+"/", "--filter", "P "+PartialDir+"/")
+	}
+
+	if Backup(cfg, cat) {
+		if opts.BackupDir != "" {
+			rsArgs = append(rsArgs, "--backup", "--backup-dir="+opts.BackupDir)
+		}
+		// like partial dirs: never sent, never deleted
+		rsArgs = append(rsArgs, "--filter", "H "+BackupDir+"/", "--filter", "P "+BackupDir+"/")
+	}
+
+	if opts.LinkDest != "" {
+		rsArgs = append(rsArgs, "--link-dest="+opts.LinkDest)
+	}
+
+	if opts.FilesFrom != "" {
+		// --files-from turns off the recursion -a implies
+		rsArgs = append(rsArgs, "--files-from="+opts.FilesFrom, "-r")
+	}
+
+	if cat.MaxSize != "" {
+		rsArgs = append(rsArgs, "--max-size="+cat.MaxSize)
+	}
+	if cat.MinSize != "" {
+		rsArgs = append(rsArgs, "--min-size="+cat.MinSize)
+	}
+	for _, e := range config.CategoryExcludes(cat) {
+		rsArgs = append(rsArgs, "--exclude", e)
+	}
+	ignore, err := IgnoreRules(cat)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ignore {
+		rsArgs = append(rsArgs, "--filter", r.String())
+	}
+	if len(cat.OnlyExtensions) > 0 {
+		// descend into every directory and keep the listed extensions; the rest
+		// is hidden from the sender and protected on the receiver, so -delete
+		// never removes files this category doesn't manage
+		rsArgs = append(rsArgs, "--prune-empty-dirs", "--include", "*/")
+		for _, ext := range cat.OnlyExtensions {
+			rsArgs = append(rsArgs, "--include", "*."+config.NormalizeExtension(ext))
+		}
+		rsArgs = append(rsArgs, "--filter", "H *", "--filter", "P *")
+	}
+
+	switch {
+	case cat.Mount != "":
+		// a copy between two local paths
+	case config.IsDaemonURL(cat.Remote):
+		// the daemon runs its own rsync and takes no ssh
+		if cat.PasswordFile != "" {
+			rsArgs = append(rsArgs, "--password-file="+cat.PasswordFile)
+		}
+	default:
+		// ssh transport
+		rsArgs = append(rsArgs, "-e", Shell(cfg.SSH))
+		if cfg.Rsync.RemotePath != "" {
+			rsArgs = append(rsArgs, "--rsync-path="+cfg.Rsync.RemotePath)
+		}
+	}
+
+	// user-supplied options go last so they can refine or override ours
+	rsArgs = append(rsArgs, cfg.Defaults.RsyncArgs...)
+	rsArgs = append(rsArgs, cat.RsyncArgs...)
+
+	// Source/Destination
+	local := ensureTrailingSlash(cat.Local)
+	remote := RemoteSpec(cfg.SSH, cat)
+
+	switch opts.Direction {
+	case "push": // local → remote
+		rsArgs = append(rsArgs, local, remote)
+	case "pull": // remote → local
+		rsArgs = append(rsArgs, remote, local)
+	}
+
+	return rsArgs, nil
+}
+
+// Shell is the -e value that makes rsync use our ssh options.
+func Shell(s config.SSH) string {
+	sshCmd := ssh.Args(s)
+	for i, a := range sshCmd {
+		sshCmd[i] = ssh.Escape(a)
+	}
+	return strings.Join(sshCmd, " ")
+}
+
+// RemoteSpec is the category's remote directory in rsync's user@host:path/
+// form, its rsync:// URL, or with mount its path on this machine.
+func RemoteSpec(s config.SSH, cat config.Category) string {
+	if config.IsDaemonURL(cat.Remote) || cat.Mount != "" {
+		return ensureTrailingSlash(cat.Remote)
+	}
+	return fmt.Sprintf("%s@%s:%s/", s.User, s.Host, strings.TrimRight(cat.Remote, "/"))
+}
+
+// InsertBeforePaths adds rsync options in front of the trailing source and
+// destination arguments produced by BuildArgs.
+func InsertBeforePaths(rsArgs []string, extra ...string) []string {
+	return slices.Insert(slices.Clone(rsArgs), len(rsArgs)-2, extra...)
+}
+
+// DetectRenames reports whether detect_renames is on for cat.
+func DetectRenames(cfg *config.Config, cat config.Category) bool {
+	if cat.Encrypted {
+		return false // renames in the local tree are new files in the encrypted mirror
+	}
+	if AppendOnly(cat) {
+		return false // moving files on the receiving side isn't adding them
+	}
+	return config.GetBool(false, cat.DetectRenames, config.GetBool(false, cfg.Defaults.DetectRenames, false))
+}
+
+// AppendOnly reports whether cat has mode: archive-append, whose runs only
+// ever add files the receiving side doesn't have yet.
+func AppendOnly(cat config.Category) bool {
+	return cat.Mode == "archive-append"
+}
+
+// ModifyWindow is the number of seconds two modification times of a file in
+// cat may differ by and still count as the same: modify_window, else
+// defaults', else the remote profile's.
+func ModifyWindow(cfg *config.Config, cat config.Category) int {
+	switch {
+	case cat.ModifyWindow != nil:
+		return *cat.ModifyWindow
+	case cfg.Defaults.ModifyWindow != nil:
+		return *cfg.Defaults.ModifyWindow
+	}
+	return config.RemoteProfile(cfg).ModifyWindow
+}
+
+// LowPriority reports whether low_priority is on for cat.
+func LowPriority(cfg *config.Config, cat config.Category) bool {
+	return config.GetBool(false, cat.LowPriority, config.GetBool(false, cfg.Defaults.LowPriority, false))
+}
+
+// Backup reports whether backup is on for cat.
+func Backup(cfg *config.Config, cat config.Category) bool {
+	if cat.Encrypted {
+		return false // the encrypted mirror only keeps what the local tree has
+	}
+	if AppendOnly(cat) {
+		return false // nothing is replaced, and pruning old backups would delete
+	}
+	return config.GetBool(false, cat.Backup, config.GetBool(false, cfg.Defaults.Backup, false))
+}
+
+// ResolveDelete reports whether the run should pass --delete.
+func ResolveDelete(cfg *config.Config, opts Options) bool {
+	if opts.NoDelete {
+		return false
+	}
+	return config.GetBool(opts.Delete, cfg.Defaults.Delete, false)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func ensureTrailingSlash(p string) string {
+	p = strings.TrimRight(p, "/")
+	return p + "/"
+}
+
+// Binary is the local rsync to run: rsync.path, or rsync from PATH.
+func Binary(cfg *config.Config) string {
+	if cfg.Rsync.Path != "" {
+		return cfg.Rsync.Path
+	}
+	return "rsync"
+}
+
+// RemoteBinary is the rsync the remote runs: rsync.remote_path, or rsync
+// from the remote PATH.
+func RemoteBinary(cfg *config.Config) string {
+	if cfg.Rsync.RemotePath != "" {
+		return cfg.Rsync.RemotePath
+	}
+	return "rsync"
+}
+
+// Command prepares the local rsync with args. When ctx is done, rsync gets
+// a SIGTERM, on which it removes its temporary files (keeping partial ones
+// with resume) and exits; Wait waits for that.
+func Command(ctx context.Context, cfg *config.Config, args ...string) *exec.Cmd {
+	return commandContext(ctx, Binary(cfg), args...)
+}
+
+// LowPriorityCommand is Command at the lowest CPU priority and the idle I/O
+// class: nice -n 19 ionice -c 3 rsync on Linux (without ionice where it
+// isn't installed), and taskpolicy -b rsync on macOS, whose background
+// policy throttles disk and network access too. Each wrapper execs rsync,
+// which keeps its pid, signals and exit code.
+func LowPriorityCommand(ctx context.Context, cfg *config.Config, args ...string) *exec.Cmd {
+	argv := append([]string{Binary(cfg)}, args...)
+	if runtime.GOOS == "darwin" {
+		argv = append([]string{"taskpolicy", "-b"}, argv...)
+	} else {
+		if _, err := exec.LookPath("ionice"); err == nil {
+			argv = append([]string{"ionice", "-c", "3"}, argv...)
+		}
+		argv = append([]string{"nice", "-n", "19"}, argv...)
+	}
+	return commandContext(ctx, argv[0], argv[1:]...)
+}
+
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	return cmd
+}
+
+// Run runs rsync with args, sending its output to stdout and os.Stderr,
+// until it exits or ctx is done.
+func Run(ctx context.Context, cfg *config.Config, args []string, stdout io.Writer) error {
+	return run(Command(ctx, cfg, args...), stdout)
+}
+
+// RunLowPriority is Run with LowPriorityCommand.
+func RunLowPriority(ctx context.Context, cfg *config.Config, args []string, stdout io.Writer) error {
+	return run(LowPriorityCommand(ctx, cfg, args...), stdout)
+}
+
+func run(cmd *exec.Cmd, stdout io.Writer) error {
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ExitCode returns the process exit code carried by err, or -1.
+func ExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// IsRetryable reports whether an rsync exit code points at a transient
+// network/transport problem rather than a permanent one (e.g. 23: permissions).
+func IsRetryable(code int) bool {
+	switch code {
+	case 10, // error in socket I/O
+		12,  // error in rsync protocol data stream
+		30,  // timeout in data send/receive
+		35,  // timeout waiting for daemon connection
+		255: // ssh could not connect
+		return true
+	}
+	return false
+}
@@ -0,0 +1,634 @@
+package rsync
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestEnsureTrailingSlash(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/tmp/notes", want: "/tmp/notes/"},
+		{in: "/tmp/notes/", want: "/tmp/notes/"},
+		{in: "/tmp/notes////", want: "/tmp/notes/"},
+	}
+	for _, tt := range tests {
+		if got := ensureTrailingSlash(tt.in); got != tt.want {
+			t.Fatalf("ensureTrailingSlash(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBuildArgsDeleteFlag(t *testing.T) {
+	cfg := &config.Config{
+		SSH: config.SSH{User: "alice", Host: "example.com", Port: 22},
+	}
+	cat := config.Category{
+		Local:  "/local/path",
+		Remote: "/remote/path",
+		Exclude: []string{
+			"*.tmp",
+		},
+	}
+	opts := Options{
+		Delete:    true,
+		Direction: "push",
+	}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--delete") || !containsArg(args, "--delete-excluded") {
+		t.Fatalf("expected delete flags in args, got: %v", args)
+	}
+	expectSrc := "/local/path/"
+	expectDst := "alice@example.com:/remote/path/"
+	if len(args) < 2 || args[len(args)-2] != expectSrc || args[len(args)-1] != expectDst {
+		t.Fatalf("unexpected src/dst: got %v, want %q %q", args[len(args)-2:], expectSrc, expectDst)
+	}
+}
+
+func TestBuildArgsDeleteDefaultFromConfig(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "bob", Host: "host", Port: 22},
+		Defaults: config.Defaults{Delete: boolPtr(true)},
+	}
+	cat := config.Category{Local: "/l", Remote: "/r"}
+	opts := Options{Delete: false, Direction: "push"}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--delete") {
+		t.Fatalf("expected delete flag from defaults, got: %v", args)
+	}
+}
+
+func TestBuildArgsNoDeleteWhenDisabled(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "bob", Host: "host", Port: 22},
+		Defaults: config.Defaults{Delete: boolPtr(false)},
+	}
+	cat := config.Category{Local: "/l", Remote: "/r"}
+	opts := Options{Delete: false, Direction: "push"}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if containsArg(args, "--delete") || containsArg(args, "--delete-excluded") {
+		t.Fatalf("did not expect delete flags, got: %v", args)
+	}
+}
+
+func TestBuildArgsPullDirection(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	opts := Options{Direction: "pull"}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	expectSrc := "u@h:/remote/"
+	expectDst := "/local/"
+	if len(args) < 2 || args[len(args)-2] != expectSrc || args[len(args)-1] != expectDst {
+		t.Fatalf("unexpected src/dst: got %v, want %q %q", args[len(args)-2:], expectSrc, expectDst)
+	}
+}
+
+func TestBuildArgsInvalidDirection(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	opts := Options{Direction: "sideways"}
+
+	if _, err := BuildArgs(cfg, cat, opts); err == nil {
+		t.Fatalf("expected error for invalid direction")
+	}
+}
+
+func TestBuildArgsMultiplex(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 2222, Multiplex: true, ControlPath: "/tmp/cm-%C"}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	opts := Options{Direction: "push"}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	want := "ssh -p 2222 -o ControlMaster=auto -o ControlPath=/tmp/cm-%C -o ControlPersist=60s"
+	if !containsArg(args, want) {
+		t.Fatalf("expected ssh command %q in args, got: %v", want, args)
+	}
+}
+
+func TestBuildArgsRemoteRsyncPath(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Rsync: config.Rsync{Path: "/opt/homebrew/bin/rsync", RemotePath: "/opt/homebrew/bin/rsync"}}
+	args, err := BuildArgs(cfg, config.Category{Local: "/local", Remote: "/remote"}, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--rsync-path=/opt/homebrew/bin/rsync") {
+		t.Fatalf("expected --rsync-path, got: %v", args)
+	}
+	if got := Command(context.Background(), cfg, "--version").Path; got != "/opt/homebrew/bin/rsync" {
+		t.Fatalf("Command runs %q, want the configured rsync", got)
+	}
+
+	args, _ = BuildArgs(&config.Config{SSH: cfg.SSH}, config.Category{Local: "/local", Remote: "/remote"}, Options{Direction: "push"})
+	for _, a := range args {
+		if strings.HasPrefix(a, "--rsync-path") {
+			t.Fatalf("unexpected %q without rsync.remote_path", a)
+		}
+	}
+}
+
+func TestBuildArgsPreserveXattrs(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Defaults: config.Defaults{PreserveXattrs: boolPtr(true)}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--xattrs") || !containsArg(args, "--acls") || containsArg(args, "--crtimes") {
+		t.Fatalf("expected --xattrs --acls without --crtimes, got: %v", args)
+	}
+	args, _ = BuildArgs(cfg, cat, Options{Direction: "push", CreationTimes: true})
+	if !containsArg(args, "--crtimes") {
+		t.Fatalf("expected --crtimes when both ends support it, got: %v", args)
+	}
+	cat.PreserveXattrs = boolPtr(false)
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push"}); containsArg(args, "--xattrs") {
+		t.Fatalf("category preserve_xattrs: false should override defaults, got: %v", args)
+	}
+}
+
+func TestBuildArgsSymlinks(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	for policy, want := range map[string]string{"follow": "--copy-links", "skip": "--no-links", "safe": "--safe-links"} {
+		args, err := BuildArgs(cfg, config.Category{Local: "/local", Remote: "/remote", Symlinks: policy}, Options{Direction: "push"})
+		if err != nil {
+			t.Fatalf("BuildArgs error: %v", err)
+		}
+		if !containsArg(args, want) {
+			t.Fatalf("symlinks: %s should pass %s, got: %v", policy, want, args)
+		}
+	}
+	args, _ := BuildArgs(cfg, config.Category{Local: "/local", Remote: "/remote", Symlinks: "preserve"}, Options{Direction: "push"})
+	for _, a := range []string{"--copy-links", "--no-links", "--safe-links"} {
+		if containsArg(args, a) {
+			t.Fatalf("symlinks: preserve should leave -a's -l alone, got: %v", args)
+		}
+	}
+}
+
+func TestBuildArgsOwnershipAndPermissions(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "u", Host: "h", Port: 22},
+		Defaults: config.Defaults{Chmod: "D755,F644", NumericIDs: boolPtr(true), Owner: boolPtr(false)},
+	}
+	cat := config.Category{Local: "/local", Remote: "/remote", Chmod: "Du=rwx,go=rx,Fu=rw,go=r", Chown: "me:staff", Perms: boolPtr(false)}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	for _, want := range []string{"--chmod=Du=rwx,go=rx,Fu=rw,go=r", "--chown=me:staff", "--numeric-ids", "--no-perms", "--no-owner", "--no-group"} {
+		if !containsArg(args, want) {
+			t.Fatalf("expected %q in args, got: %v", want, args)
+		}
+	}
+	if containsArg(args, "--chmod=D755,F644") {
+		t.Fatalf("category chmod should override defaults, got: %v", args)
+	}
+
+	args, _ = BuildArgs(&config.Config{SSH: cfg.SSH}, config.Category{Local: "/local", Remote: "/remote"}, Options{Direction: "push"})
+	for _, a := range []string{"--numeric-ids", "--no-perms", "--no-owner"} {
+		if containsArg(args, a) {
+			t.Fatalf("unexpected %s by default, got: %v", a, args)
+		}
+	}
+}
+
+func TestBuildArgsLargeFiles(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Defaults: config.Defaults{Sparse: boolPtr(true)}}
+	cat := config.Category{Local: "/vm", Remote: "/vm", Inplace: true}
+	whole := false
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push", WholeFile: &whole})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	for _, want := range []string{"--sparse", "--inplace", "--no-whole-file"} {
+		if !containsArg(args, want) {
+			t.Fatalf("expected %q in args, got: %v", want, args)
+		}
+	}
+	whole = true
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push", WholeFile: &whole}); !containsArg(args, "--whole-file") {
+		t.Fatalf("expected --whole-file, got: %v", args)
+	}
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push"}); containsArg(args, "--whole-file") || containsArg(args, "--no-whole-file") {
+		t.Fatalf("unset whole_file should leave the choice to rsync, got: %v", args)
+	}
+}
+
+func TestBuildArgsTempDir(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "pull", TempDir: "/local/.tmp"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--temp-dir=/local/.tmp") {
+		t.Fatalf("expected --temp-dir, got: %v", args)
+	}
+	cat.Inplace = true
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "pull", TempDir: "/local/.tmp"}); containsArg(args, "--temp-dir=/local/.tmp") {
+		t.Fatalf("inplace writes no temp files, got: %v", args)
+	}
+}
+
+func TestBuildArgsDetectRenames(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Defaults: config.Defaults{DetectRenames: boolPtr(true)}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--fuzzy") || containsArg(args, "--delete-delay") {
+		t.Fatalf("expected --fuzzy without --delete-delay, got: %v", args)
+	}
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push", Delete: true}); !containsArg(args, "--delete-delay") {
+		t.Fatalf("expected --delete-delay with delete, got: %v", args)
+	}
+	cat.DetectRenames = boolPtr(false)
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push"}); containsArg(args, "--fuzzy") {
+		t.Fatalf("category should override the default, got: %v", args)
+	}
+}
+
+func TestBuildArgsCompress(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/local", Remote: "/remote"}
+	opts := Options{Direction: "push", Compress: true, CompressChoice: "zstd"}
+
+	args, err := BuildArgs(cfg, cat, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "-z") || !containsArg(args, "--compress-choice=zstd") {
+		t.Fatalf("expected compression flags, got: %v", args)
+	}
+}
+
+func TestBuildArgsResume(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "u", Host: "h", Port: 22},
+		Defaults: config.Defaults{Resume: boolPtr(true)},
+	}
+	opts := Options{Direction: "push"}
+
+	args, err := BuildArgs(cfg, config.Category{Local: "/l", Remote: "/r"}, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--partial-dir=.belterlink-partial") || !containsArg(args, "H .belterlink-partial/") {
+		t.Fatalf("expected resume flags from defaults, got: %v", args)
+	}
+
+	args, err = BuildArgs(cfg, config.Category{Local: "/l", Remote: "/r", Resume: boolPtr(false)}, opts)
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if containsArg(args, "--partial") {
+		t.Fatalf("category resume: false should override defaults, got: %v", args)
+	}
+}
+
+func TestBuildArgsBackup(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "u", Host: "h", Port: 22},
+		Defaults: config.Defaults{Backup: boolPtr(true)},
+	}
+	cat := config.Category{Local: "/l", Remote: "/r"}
+
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push", BackupDir: ".belterlink-backup/abcd1234"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--backup") || !containsArg(args, "--backup-dir=.belterlink-backup/abcd1234") || !containsArg(args, "P .belterlink-backup/") {
+		t.Fatalf("expected backup flags, got: %v", args)
+	}
+
+	// dry runs get no backup dir but must still leave the backups alone
+	args, err = BuildArgs(cfg, cat, Options{Direction: "push", DryRun: true})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if containsArg(args, "--backup") || !containsArg(args, "H .belterlink-backup/") {
+		t.Fatalf("dry run: expected only the backup filters, got: %v", args)
+	}
+
+	cat.Encrypted = true
+	if Backup(cfg, cat) {
+		t.Fatal("encrypted categories should never keep backups")
+	}
+}
+
+func TestBuildArgsVerbosity(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/l", Remote: "/r"}
+	cases := []struct {
+		verbosity  Verbosity
+		quietRsync bool // defaults.verbose: false
+		want, not  []string
+	}{
+		{Quiet, false, nil, []string{"-v", "-vv", "--stats"}},
+		{Normal, false, []string{"-v"}, []string{"--stats"}},
+		{Normal, true, nil, []string{"-v"}},
+		{Verbose, true, []string{"-v", "--stats"}, []string{"-vv"}},
+		{VeryVerbose, false, []string{"-vv", "--stats", "--debug=FILTER,DEL"}, []string{"-v"}},
+	}
+	for _, c := range cases {
+		cfg.Defaults.Verbose = boolPtr(!c.quietRsync)
+		args, err := BuildArgs(cfg, cat, Options{Direction: "push", Verbosity: c.verbosity})
+		if err != nil {
+			t.Fatalf("BuildArgs error: %v", err)
+		}
+		for _, a := range c.want {
+			if !containsArg(args, a) {
+				t.Errorf("verbosity %d: expected %s in %v", c.verbosity, a, args)
+			}
+		}
+		for _, a := range c.not {
+			if containsArg(args, a) {
+				t.Errorf("verbosity %d: unexpected %s in %v", c.verbosity, a, args)
+			}
+		}
+	}
+}
+
+func TestBuildArgsSizeAndExtensionFilters(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "bob", Host: "host", Port: 22}}
+	cat := config.Category{Local: "/l", Remote: "/r", MaxSize: "100M", MinSize: "1", OnlyExtensions: []string{"md", ".png"}}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	for _, want := range []string{"--max-size=100M", "--min-size=1", "*.md", "*.png", "H *", "P *"} {
+		if !containsArg(args, want) {
+			t.Fatalf("expected %q in args, got: %v", want, args)
+		}
+	}
+	// the catch-all rules must come after the built-in excludes and includes
+	if slices.Index(args, "H *") < slices.Index(args, "*.png") || slices.Index(args, "H *") < slices.Index(args, ".git") {
+		t.Fatalf("filter rules out of order: %v", args)
+	}
+}
+
+func TestBuildArgsExtraRsyncArgs(t *testing.T) {
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "bob", Host: "host", Port: 22},
+		Defaults: config.Defaults{RsyncArgs: []string{"--iconv=utf-8-mac,utf-8"}},
+	}
+	cat := config.Category{Local: "/l", Remote: "/r", RsyncArgs: []string{"--chmod=Du=rwx"}}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	n := len(args)
+	if args[n-4] != "--iconv=utf-8-mac,utf-8" || args[n-3] != "--chmod=Du=rwx" || args[n-2] != "/l/" {
+		t.Fatalf("extra args should follow belterlink's own and precede the paths, got: %v", args)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, code := range []int{10, 12, 30, 255} {
+		if !IsRetryable(code) {
+			t.Fatalf("expected exit code %d to be retryable", code)
+		}
+	}
+	for _, code := range []int{0, 1, 23, 24, -1} {
+		if IsRetryable(code) {
+			t.Fatalf("expected exit code %d to be permanent", code)
+		}
+	}
+}
+
+func TestInsertBeforePaths(t *testing.T) {
+	args := []string{"-aH", "/src/", "host:/dst/"}
+	got := InsertBeforePaths(args, "--max-delete=5")
+	if len(got) != 4 || got[1] != "--max-delete=5" || got[3] != "host:/dst/" {
+		t.Fatalf("InsertBeforePaths = %v", got)
+	}
+	if len(args) != 3 {
+		t.Fatalf("InsertBeforePaths must not modify its input: %v", args)
+	}
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func containsArg(args []string, want string) bool {
+	for _, a := range args {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildArgsRunTimeout(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Defaults: config.Defaults{RunTimeout: "2h"}}
+	args, err := BuildArgs(cfg, config.Category{Local: "/l", Remote: "/r", RunTimeout: "90s"}, Options{Direction: "pull"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--timeout=90") {
+		t.Fatalf("expected --timeout=90, got: %v", args)
+	}
+}
+
+func TestRunStopsRsyncOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	// stands in for rsync, which cleans up and exits 20 on SIGTERM
+	script := filepath.Join(dir, "rsync")
+	marker := filepath.Join(dir, "cleaned-up")
+	body := "#!/bin/sh\ntrap 'touch " + marker + "; exit 20' TERM\nwhile :; do sleep 0.05; done\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Rsync: config.Rsync{Path: script}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := Run(ctx, cfg, nil, io.Discard)
+	if ExitCode(err) != 20 {
+		t.Fatalf("Run = %v, want rsync's exit code 20", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatal("Run returned before rsync cleaned up")
+	}
+}
+
+func TestBuildArgsLinkDest(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/l", Remote: "backups/Notes/2024-05-10T120000Z.partial"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push", LinkDest: "../2024-05-09T120000Z"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--link-dest=../2024-05-09T120000Z") {
+		t.Fatalf("expected --link-dest, got: %v", args)
+	}
+	if got := args[len(args)-1]; got != "u@h:backups/Notes/2024-05-10T120000Z.partial/" {
+		t.Fatalf("destination = %q", got)
+	}
+}
+
+func TestBuildArgsDaemonURL(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Rsync: config.Rsync{RemotePath: "/opt/bin/rsync"}}
+	cat := config.Category{Local: "/l", Remote: "rsync://me@nas/vault/Notes", PasswordFile: "/k/rsyncd.secret"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if containsArg(args, "-e") || containsArg(args, "--rsync-path=/opt/bin/rsync") {
+		t.Fatalf("ssh options for an rsync daemon: %v", args)
+	}
+	if !containsArg(args, "--password-file=/k/rsyncd.secret") {
+		t.Fatalf("expected --password-file, got: %v", args)
+	}
+	if got := args[len(args)-2:]; got[0] != "/l/" || got[1] != "rsync://me@nas/vault/Notes/" {
+		t.Fatalf("paths = %v", got)
+	}
+}
+
+func TestBuildArgsMount(t *testing.T) {
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	cat := config.Category{Local: "/l", Remote: "/mnt/nas/vault", Mount: "/mnt/nas"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "pull"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if containsArg(args, "-e") {
+		t.Fatalf("ssh for a mounted share: %v", args)
+	}
+	if got := args[len(args)-2:]; got[0] != "/mnt/nas/vault/" || got[1] != "/l/" {
+		t.Fatalf("paths = %v", got)
+	}
+}
+
+func TestBuildArgsTermuxProfile(t *testing.T) {
+	yes := true
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "phone", Port: 8022, Profile: "termux"}}
+	args, err := BuildArgs(cfg, config.Category{Local: "/l", Remote: "/sdcard/Notes", Owner: &yes}, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if args[0] != "-a" || !containsArg(args, "--no-perms") || !containsArg(args, "--modify-window=2") || !containsArg(args, "--no-links") {
+		t.Fatalf("expected -a, --no-perms, --modify-window=2 and --no-links, got: %v", args)
+	}
+	if containsArg(args, "--no-owner") {
+		t.Fatalf("owner: true on the category should win over the profile: %v", args)
+	}
+	args, _ = BuildArgs(cfg, config.Category{Local: "/l", Remote: "/sdcard/Notes", Symlinks: "follow"}, Options{Direction: "push"})
+	if containsArg(args, "--no-links") || !containsArg(args, "--copy-links") {
+		t.Fatalf("symlinks: follow on the category should win over the profile: %v", args)
+	}
+}
+
+func TestModifyWindow(t *testing.T) {
+	zero, two, three := 0, 2, 3
+	termux := config.SSH{Profile: "termux"}
+	for _, tc := range []struct {
+		cfg  *config.Config
+		cat  config.Category
+		want int
+	}{
+		{&config.Config{}, config.Category{}, 0},
+		{&config.Config{SSH: termux}, config.Category{}, 2},
+		{&config.Config{SSH: termux}, config.Category{ModifyWindow: &zero}, 0},
+		{&config.Config{Defaults: config.Defaults{ModifyWindow: &three}}, config.Category{}, 3},
+		{&config.Config{Defaults: config.Defaults{ModifyWindow: &three}}, config.Category{ModifyWindow: &two}, 2},
+	} {
+		if got := ModifyWindow(tc.cfg, tc.cat); got != tc.want {
+			t.Errorf("ModifyWindow(%+v, %+v) = %d, want %d", tc.cfg.Defaults, tc.cat, got, tc.want)
+		}
+	}
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}}
+	args, err := BuildArgs(cfg, config.Category{Local: "/l", Remote: "/r", ModifyWindow: &two}, Options{Direction: "push"})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--modify-window=2") {
+		t.Fatalf("expected --modify-window=2, got: %v", args)
+	}
+}
+
+func TestLowPriority(t *testing.T) {
+	yes, no := true, false
+	cfg := &config.Config{SSH: config.SSH{User: "u", Host: "h", Port: 22}, Defaults: config.Defaults{LowPriority: &yes}}
+	if !LowPriority(cfg, config.Category{}) || LowPriority(cfg, config.Category{LowPriority: &no}) {
+		t.Fatal("category low_priority should override defaults")
+	}
+	cat := config.Category{Local: "/l", Remote: "/r"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push", LowPriority: true})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--bwlimit=10240") {
+		t.Fatalf("expected --bwlimit, got: %v", args)
+	}
+	if args, _ = BuildArgs(cfg, cat, Options{Direction: "push"}); slices.ContainsFunc(args, func(a string) bool { return strings.HasPrefix(a, "--bwlimit") }) {
+		t.Fatalf("unexpected --bwlimit without LowPriority: %v", args)
+	}
+
+	cmd := LowPriorityCommand(context.Background(), cfg, "--version")
+	if cmd.Args[len(cmd.Args)-2] != "rsync" {
+		t.Fatalf("LowPriorityCommand should end with the rsync command, got %v", cmd.Args)
+	}
+	want := "nice"
+	if runtime.GOOS == "darwin" {
+		want = "taskpolicy"
+	}
+	if cmd.Args[0] != want {
+		t.Fatalf("LowPriorityCommand = %v, want it to start with %s", cmd.Args, want)
+	}
+}
+
+func TestBuildArgsArchiveAppend(t *testing.T) {
+	yes := true
+	cfg := &config.Config{
+		SSH:      config.SSH{User: "u", Host: "h", Port: 22},
+		Defaults: config.Defaults{Delete: &yes, DetectRenames: &yes, Backup: &yes},
+	}
+	cat := config.Category{Local: "/l", Remote: "/r", Mode: "archive-append"}
+	args, err := BuildArgs(cfg, cat, Options{Direction: "push", Delete: true})
+	if err != nil {
+		t.Fatalf("BuildArgs error: %v", err)
+	}
+	if !containsArg(args, "--ignore-existing") {
+		t.Fatalf("expected --ignore-existing, got: %v", args)
+	}
+	for _, a := range args {
+		if strings.HasPrefix(a, "--del") || a == "--fuzzy" {
+			t.Fatalf("archive-append run has %s: %v", a, args)
+		}
+	}
+	if DetectRenames(cfg, cat) || Backup(cfg, cat) {
+		t.Fatal("detect_renames and backup should be off for archive-append")
+	}
+}
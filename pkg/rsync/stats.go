@@ -0,0 +1,87 @@
+package rsync
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// Stats is what we can learn about a transfer from rsync --stats.
+type Stats struct {
+	FilesScanned     int64   `json:"files_scanned,omitempty"` // "Number of files", directories included
+	FilesCreated     int64   `json:"files_created,omitempty"` // rsync 3.1 and newer
+	FilesTransferred int64   `json:"files_transferred"`
+	FilesDeleted     int64   `json:"files_deleted"`
+	BytesTransferred int64   `json:"bytes_transferred"`        // "Total transferred file size"
+	TotalSize        int64   `json:"total_size,omitempty"`     // of the files scanned
+	BytesSent        int64   `json:"bytes_sent,omitempty"`     // over the wire, after compression and delta encoding
+	BytesReceived    int64   `json:"bytes_received,omitempty"` // likewise
+	Speedup          float64 `json:"speedup,omitempty"`        // TotalSize over the bytes sent and received, as rsync reports it
+}
+
+// Add adds o's counters to s, e.g. for the pull and push of a sync.
+func (s *Stats) Add(o Stats) {
+	s.FilesScanned += o.FilesScanned
+	s.FilesCreated += o.FilesCreated
+	s.FilesTransferred += o.FilesTransferred
+	s.FilesDeleted += o.FilesDeleted
+	s.BytesTransferred += o.BytesTransferred
+	s.TotalSize += o.TotalSize
+	s.BytesSent += o.BytesSent
+	s.BytesReceived += o.BytesReceived
+	s.Speedup = speedup(s.TotalSize, s.BytesSent+s.BytesReceived)
+}
+
+func speedup(total, traffic int64) float64 {
+	if traffic == 0 {
+		return 0
+	}
+	return float64(total) / float64(traffic)
+}
+
+// ParseStats picks the counters we care about out of rsync --stats output.
+// Both the 3.x ("regular files") and 2.6.9 wording are understood.
+func ParseStats(out string) Stats {
+	var st Stats
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		key, val, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, ok := statNumber(val)
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Number of files":
+			st.FilesScanned = n
+		case "Number of created files":
+			st.FilesCreated = n
+		case "Total file size":
+			st.TotalSize = n
+		case "Total bytes sent":
+			st.BytesSent = n
+		case "Total bytes received":
+			st.BytesReceived = n
+		case "Number of regular files transferred", "Number of files transferred":
+			st.FilesTransferred = n
+		case "Number of deleted files":
+			st.FilesDeleted = n
+		case "Total transferred file size":
+			st.BytesTransferred = n
+		}
+	}
+	st.Speedup = speedup(st.TotalSize, st.BytesSent+st.BytesReceived)
+	return st
+}
+
+// statNumber parses the leading number of a stats value like " 1,234 bytes".
+func statNumber(val string) (int64, bool) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64)
+	return n, err == nil
+}
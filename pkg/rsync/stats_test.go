@@ -0,0 +1,42 @@
+package rsync
+
+import "testing"
+
+const statsOutput = `
+Number of files: 1,204 (reg: 1,100, dir: 104)
+Number of created files: 2 (reg: 2)
+Number of deleted files: 1 (reg: 1)
+Number of regular files transferred: 5
+Total file size: 98,765,432 bytes
+Total transferred file size: 12,345 bytes
+Literal data: 12,345 bytes
+Total bytes sent: 13,001
+Total bytes received: 140
+`
+
+func TestParseStats(t *testing.T) {
+	got := ParseStats(statsOutput)
+	want := Stats{
+		FilesScanned: 1204, FilesCreated: 2, FilesTransferred: 5, FilesDeleted: 1, BytesTransferred: 12345,
+		TotalSize: 98765432, BytesSent: 13001, BytesReceived: 140, Speedup: 98765432.0 / 13141,
+	}
+	if got != want {
+		t.Fatalf("ParseStats = %+v, want %+v", got, want)
+	}
+
+	old := ParseStats("Number of files transferred: 7\nTotal transferred file size: 10 bytes\n")
+	if old.FilesTransferred != 7 || old.BytesTransferred != 10 {
+		t.Fatalf("rsync 2.x stats not parsed: %+v", old)
+	}
+}
+
+func TestStatsAdd(t *testing.T) {
+	pull := Stats{FilesScanned: 10, FilesTransferred: 2, TotalSize: 1000, BytesSent: 20, BytesReceived: 80, Speedup: 10}
+	push := Stats{FilesScanned: 10, FilesTransferred: 1, FilesDeleted: 1, TotalSize: 1000, BytesSent: 100}
+	var total Stats
+	total.Add(pull)
+	total.Add(push)
+	if total.FilesScanned != 20 || total.FilesTransferred != 3 || total.FilesDeleted != 1 || total.Speedup != 10 {
+		t.Fatalf("Add = %+v", total)
+	}
+}
@@ -0,0 +1,158 @@
+package rsync
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// Version is an rsync release as reported by rsync --version. The zero
+// Version stands for one that couldn't be determined, which is assumed to
+// support everything.
+type Version struct {
+	Major, Minor, Patch int
+	Compress            []string // the "Compress list:" section (rsync >= 3.2)
+	Capabilities        []string // e.g. "xattrs", "no crtimes"
+}
+
+var versionLine = regexp.MustCompile(`rsync\s+version\s+v?(\d+)\.(\d+)\.(\d+)`)
+
+// ParseVersion reads the output of rsync --version.
+func ParseVersion(out string) Version {
+	m := versionLine.FindStringSubmatch(out)
+	if m == nil {
+		return Version{}
+	}
+	v := Version{Compress: compressChoices(out), Capabilities: capabilities(out)}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v
+}
+
+// capabilities lists the comma-separated entries of the "Capabilities:"
+// section, which may start on the same line.
+func capabilities(out string) []string {
+	var caps []string
+	inList := false
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, "Capabilities:"); ok {
+			inList = true
+			line = rest
+		} else if !inList {
+			continue
+		} else if !strings.HasPrefix(line, " ") {
+			break
+		}
+		for _, c := range strings.Split(line, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				caps = append(caps, c)
+			}
+		}
+	}
+	return caps
+}
+
+// Has reports whether the rsync is known to support capability c, e.g.
+// "crtimes"; rsync lists missing ones as "no crtimes".
+func (v Version) Has(c string) bool {
+	return slices.ContainsFunc(v.Capabilities, func(s string) bool { return strings.EqualFold(s, c) })
+}
+
+// Known reports whether the version was determined.
+func (v Version) Known() bool {
+	return v.Major > 0
+}
+
+// AtLeast reports whether v is the given release or newer. An unknown
+// version is.
+func (v Version) AtLeast(major, minor, patch int) bool {
+	if !v.Known() {
+		return true
+	}
+	return slices.Compare([]int{v.Major, v.Minor, v.Patch}, []int{major, minor, patch}) >= 0
+}
+
+func (v Version) String() string {
+	if !v.Known() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// LocalVersion runs the local rsync --version; the zero Version means it
+// couldn't.
+func LocalVersion(ctx context.Context, cfg *config.Config) Version {
+	out, err := Command(ctx, cfg, "--version").Output()
+	if err != nil {
+		return Version{}
+	}
+	return ParseVersion(string(out))
+}
+
+// optionSince lists options newer than the oldest rsync still around (2.6.9,
+// shipped with macOS) and the release that introduced them. Options the
+// remote must understand too are marked as such; the rest only affect the
+// local side, e.g. its output. Some also need a capability rsync may be
+// built without.
+var optionSince = []struct {
+	name                string
+	major, minor, patch int
+	remote              bool
+	capability          string
+}{
+	{"--iconv", 3, 0, 0, true, "iconv"},
+	{"--xattrs", 3, 0, 0, true, "xattrs"},
+	{"--acls", 3, 0, 0, true, "ACLs"},
+	{"--delete-delay", 3, 0, 0, true, ""},
+	{"--info", 3, 1, 0, false, ""},
+	{"--chown", 3, 1, 0, false, ""},
+	{"--debug", 3, 1, 0, false, ""},
+	{"--compress-choice", 3, 2, 0, true, ""},
+	{"--crtimes", 3, 2, 0, true, "crtimes"},
+	{"--mkpath", 3, 2, 3, true, ""},
+	{"--old-args", 3, 2, 4, false, ""},
+}
+
+// Adapt fits args to the rsyncs on both ends. --protect-args goes when both
+// are 3.2.4 or newer, which protect arguments by default; options one of
+// them doesn't know yet are dropped and returned, so the caller can warn
+// instead of rsync failing with "unknown option".
+func Adapt(args []string, local, remote Version) (adapted, dropped []string) {
+	modern := local.Known() && remote.Known() && local.AtLeast(3, 2, 4) && remote.AtLeast(3, 2, 4)
+	for _, a := range args {
+		if a == "--protect-args" && modern {
+			continue
+		}
+		if !supported(a, local, remote) {
+			dropped = append(dropped, a)
+			continue
+		}
+		adapted = append(adapted, a)
+	}
+	return adapted, dropped
+}
+
+func supported(arg string, local, remote Version) bool {
+	for _, o := range optionSince {
+		if arg != o.name && !strings.HasPrefix(arg, o.name+"=") {
+			continue
+		}
+		sides := []Version{local}
+		if o.remote {
+			sides = append(sides, remote)
+		}
+		for _, v := range sides {
+			if !v.AtLeast(o.major, o.minor, o.patch) || o.capability != "" && v.Has("no "+o.capability) {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package rsync
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	v := ParseVersion("rsync  version 3.2.7  protocol version 31\nCompress list:\n    zstd lz4 zlib none\n\n")
+	if v.String() != "3.2.7" || !slices.Contains(v.Compress, "zstd") {
+		t.Fatalf("ParseVersion = %+v", v)
+	}
+	if v := ParseVersion("rsync  version 2.6.9  protocol version 29\n"); v.String() != "2.6.9" || v.AtLeast(3, 0, 0) {
+		t.Fatalf("ParseVersion(2.6.9) = %+v", v)
+	}
+	if v := ParseVersion("openrsync: protocol version 29\n"); v.Known() || !v.AtLeast(9, 9, 9) {
+		t.Fatalf("unparseable output should give an unknown version, got %+v", v)
+	}
+}
+
+func TestVersionCapabilities(t *testing.T) {
+	out := "rsync  version 3.2.7  protocol version 31\nCapabilities:\n    64-bit files, socketpairs, symlinks,\n    ACLs, xattrs, iconv, no crtimes\nOptimizations:\n    SIMD-roll\n"
+	v := ParseVersion(out)
+	if !v.Has("xattrs") || !v.Has("acls") || v.Has("crtimes") || !v.Has("no crtimes") || v.Has("SIMD-roll") {
+		t.Fatalf("capabilities = %q", v.Capabilities)
+	}
+	noXattrs := Version{Major: 3, Minor: 2, Patch: 7, Capabilities: []string{"no xattrs"}}
+	modern := Version{Major: 3, Minor: 2, Patch: 7}
+	if _, dropped := Adapt([]string{"--xattrs", "--acls"}, modern, noXattrs); !slices.Equal(dropped, []string{"--xattrs"}) {
+		t.Fatalf("dropped = %v, want --xattrs only", dropped)
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	args := []string{"-aH", "--protect-args", "--update", "--iconv=utf-8-mac,utf-8", "--info=progress2", "/l/", "h:/r/"}
+	old := Version{Major: 2, Minor: 6, Patch: 9}
+	v324 := Version{Major: 3, Minor: 2, Patch: 4}
+	v31 := Version{Major: 3, Minor: 1, Patch: 3}
+
+	tests := []struct {
+		name          string
+		local, remote Version
+		want, dropped []string
+	}{
+		{"unknown", Version{}, Version{}, args, nil},
+		{"modern", v324, v324, []string{"-aH", "--update", "--iconv=utf-8-mac,utf-8", "--info=progress2", "/l/", "h:/r/"}, nil},
+		{"old local", old, v324, []string{"-aH", "--protect-args", "--update", "/l/", "h:/r/"}, []string{"--iconv=utf-8-mac,utf-8", "--info=progress2"}},
+		{"old remote", v31, old, []string{"-aH", "--protect-args", "--update", "--info=progress2", "/l/", "h:/r/"}, []string{"--iconv=utf-8-mac,utf-8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := Adapt(args, tt.local, tt.remote)
+			if !slices.Equal(got, tt.want) || !slices.Equal(dropped, tt.dropped) {
+				t.Fatalf("Adapt = %v, dropped %v; want %v, dropped %v", got, dropped, tt.want, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Package ssh runs commands on the remote host with the configured ssh options.
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+// ControlPath returns the ControlPath socket template for multiplexed connections.
+func ControlPath(s config.SSH) string {
+	if s.ControlPath != "" {
+		return s.ControlPath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "belterlink-cm-%C")
+	}
+	// %C is a hash of local host, remote host, port and user; keeps the path short
+	return filepath.Join(home, ".belterlink", "cm-%C")
+}
+
+// Args returns the ssh command line (without destination) used as rsync's
+// remote shell.
+func Args(s config.SSH) []string {
+	args := []string{"ssh"}
+	if s.Key != "" {
+		args = append(args, "-i", s.Key)
+	}
+	if s.Port != 0 && s.Port != 22 {
+		args = append(args, "-p", strconv.Itoa(s.Port))
+	}
+	if s.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.KnownHosts)
+	}
+	if s.HostKeyAlias != "" {
+		args = append(args, "-o", "HostKeyAlias="+s.HostKeyAlias)
+	}
+	if d, err := time.ParseDuration(s.ConnectTimeout); err == nil {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", int(math.Ceil(d.Seconds()))))
+	}
+	if s.HostKeyCheck != "" {
+		// with tofu, belterlink has added the key before ssh gets to see it
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	}
+	if s.Multiplex {
+		persist := s.ControlPersist
+		if persist == "" {
+			persist = "60s"
+		}
+		args = append(args,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+ControlPath(s),
+			"-o", "ControlPersist="+persist,
+		)
+	}
+	return args
+}
+
+// Target is the user@host destination passed to ssh.
+func Target(s config.SSH) string {
+	return s.User + "@" + s.Host
+}
+
+// KnownHostsName is how the host is written in known_hosts: host_key_alias
+// if set, else the bare name for port 22, [host]:port otherwise.
+func KnownHostsName(s config.SSH) string {
+	if s.HostKeyAlias != "" {
+		return s.HostKeyAlias // ssh doesn't add the port to an alias
+	}
+	if s.Port != 0 && s.Port != 22 {
+		return "[" + s.Host + "]:" + strconv.Itoa(s.Port)
+	}
+	return s.Host
+}
+
+// PickAddress returns the first of addrs that accepts a TCP connection on
+// the ssh port within timeout each, trying them in order.
+func PickAddress(addrs []string, port int, timeout time.Duration) (string, error) {
+	if port == 0 {
+		port = 22
+	}
+	var errs []error
+	for _, a := range addrs {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(a, strconv.Itoa(port)), timeout)
+		if err == nil {
+			conn.Close()
+			return a, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", fmt.Errorf("none of %s answers on port %d: %w", strings.Join(addrs, ", "), port, errors.Join(errs...))
+}
+
+// Run runs a shell command on the remote host and returns its stdout.
+func Run(s config.SSH, command string) ([]byte, error) {
+	return RunContext(context.Background(), s, command)
+}
+
+// RunContext is Run that kills ssh, and with it the remote command, when ctx
+// is done.
+func RunContext(ctx context.Context, s config.SSH, command string) ([]byte, error) {
+	args := append(Args(s)[1:], Target(s), command)
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("ssh %s: %w", Target(s), err)
+	}
+	return out, nil
+}
+
+// EnsureControlDir creates the directory for the multiplex socket; ssh won't
+// create it itself.
+func EnsureControlDir(s config.SSH) error {
+	if !s.Multiplex {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(ControlPath(s)), 0o700); err != nil {
+		return fmt.Errorf("create control socket dir: %w", err)
+	}
+	return nil
+}
+
+// ClockSkew returns how far the remote clock is ahead of the local one.
+func ClockSkew(ctx context.Context, s config.SSH) (time.Duration, error) {
+	before := time.Now()
+	out, err := RunContext(ctx, s, "date +%s")
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected remote date output %q", strings.TrimSpace(string(out)))
+	}
+	// compare against the midpoint of the round trip
+	local := before.Add(after.Sub(before) / 2)
+	return time.Unix(secs, 0).Sub(local), nil
+}
+
+// Escape is a very light "escape" for showing in the printed command (rsync gets --protect-args)
+func Escape(s string) string {
+	if strings.ContainsAny(s, " \t") && !strings.HasPrefix(s, "'") && !strings.HasSuffix(s, "'") {
+		return "'" + s + "'"
+	}
+	return s
+}
+
+// Quote quotes s for a POSIX shell (used for commands run over ssh).
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"githu.com/arcapol/belterlink/pkg/config"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/remote/path", want: "/remote/path"},
+		{in: "", want: "''"},
+		{in: "Mobile Documents", want: "'Mobile Documents'"},
+		{in: "it's", want: `'it'\''s'`},
+		{in: "com~apple", want: "'com~apple'"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Fatalf("Quote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestArgsHostKeys(t *testing.T) {
+	s := config.SSH{Host: "nas", Port: 2222, KnownHosts: "/k/known hosts", HostKeyCheck: "tofu"}
+	got := strings.Join(Args(s), " ")
+	want := "ssh -p 2222 -o UserKnownHostsFile=/k/known hosts -o StrictHostKeyChecking=yes"
+	if got != want {
+		t.Errorf("Args = %q, want %q", got, want)
+	}
+	if got := KnownHostsName(s); got != "[nas]:2222" {
+		t.Errorf("KnownHostsName = %q, want [nas]:2222", got)
+	}
+	if got := KnownHostsName(config.SSH{Host: "nas", Port: 22}); got != "nas" {
+		t.Errorf("KnownHostsName = %q, want nas", got)
+	}
+}
+
+func TestArgsConnectTimeout(t *testing.T) {
+	got := strings.Join(Args(config.SSH{Host: "nas", ConnectTimeout: "1500ms"}), " ")
+	if got != "ssh -o ConnectTimeout=2" {
+		t.Errorf("Args = %q, want ssh -o ConnectTimeout=2", got)
+	}
+}
+
+func TestArgsHostKeyAlias(t *testing.T) {
+	s := config.SSH{Host: "100.64.0.7", Port: 2222, HostKeyAlias: "mymac.local"}
+	if got := strings.Join(Args(s), " "); got != "ssh -p 2222 -o HostKeyAlias=mymac.local" {
+		t.Errorf("Args = %q", got)
+	}
+	if got := KnownHostsName(s); got != "mymac.local" {
+		t.Errorf("KnownHostsName = %q, want mymac.local", got)
+	}
+}
+
+func TestPickAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	got, err := PickAddress([]string{"127.0.0.2", "127.0.0.1", "localhost"}, port, time.Second)
+	if err != nil || got != "127.0.0.1" { // nothing listens on 127.0.0.2
+		t.Fatalf("PickAddress = %q, %v", got, err)
+	}
+	if _, err := PickAddress([]string{"127.0.0.1"}, closedPort, time.Second); err == nil {
+		t.Fatal("PickAddress found a closed port")
+	}
+}